@@ -19,6 +19,7 @@ import (
 	core "github.com/caicloud/loadbalancer-provider/core/provider"
 	"github.com/caicloud/loadbalancer-provider/pkg/version"
 	"github.com/caicloud/loadbalancer-provider/providers/azure"
+	"github.com/caicloud/loadbalancer-provider/providers/azure/client"
 )
 
 // Run ...
@@ -33,6 +34,8 @@ func Run(opts *Options) error {
 		"lb.name":   opts.LoadBalancerName,
 		"pod.name":  opts.PodName,
 		"pod.ns":    opts.PodNamespace,
+		"cloud":     opts.Cloud,
+		"secret":    opts.CredentialSecret,
 	})
 
 	if opts.Debug {
@@ -62,6 +65,17 @@ func Run(opts *Options) error {
 		return err
 	}
 
+	env, err := opts.Environment()
+	if err != nil {
+		log.Fatal("Invalid azure cloud environment", log.Fields{"cloud": opts.Cloud, "err": err})
+		return err
+	}
+	log.Info("Use azure cloud environment", log.Fields{"name": env.Name, "resourceManager": env.ResourceManagerEndpoint})
+	client.SetDefaultEnvironment(env)
+	if opts.CredentialSecret != "" {
+		client.SetCredentialSecret(opts.CredentialSecretRef())
+	}
+
 	azure, err := azure.New(clientset, opts.LoadBalancerName, opts.LoadBalancerNamespace)
 	if err != nil {
 		return err
@@ -17,13 +17,21 @@ limitations under the License.
 package main
 
 import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/caicloud/loadbalancer-provider/core/options"
+	"github.com/caicloud/loadbalancer-provider/providers/azure/client"
 	cli "gopkg.in/urfave/cli.v1"
 )
 
 // Options contains controller options
 type Options struct {
 	*options.Options
+	Cloud            string
+	EnvironmentFile  string
+	CredentialSecret string
 }
 
 // NewOptions reutrns a new Options
@@ -35,5 +43,52 @@ func NewOptions() *Options {
 
 // AddFlags add flags to app
 func (opts *Options) AddFlags(app *cli.App) {
+
 	opts.Options.AddFlags(app)
+
+	flags := []cli.Flag{
+		cli.StringFlag{
+			Name:        "azure-cloud",
+			EnvVar:      "AZURE_CLOUD",
+			Value:       client.CloudChina,
+			Usage:       "default azure cloud if the credential secret does not specify one, public, china, usgovernment, german or custom",
+			Destination: &opts.Cloud,
+		},
+		cli.StringFlag{
+			Name:        "azure-environment-file",
+			EnvVar:      azure.EnvironmentFilepathName,
+			Usage:       "path to the custom environment json of azure cloud, e.g. Azure Stack, used with --azure-cloud=custom",
+			Destination: &opts.EnvironmentFile,
+		},
+		cli.StringFlag{
+			Name:        "azure-credential-secret",
+			EnvVar:      "AZURE_CREDENTIAL_SECRET",
+			Usage:       "secret of azure credentials in the form of [namespace/]name, defaults to the first secret of azure type in kube-system",
+			Destination: &opts.CredentialSecret,
+		},
+	}
+
+	app.Flags = append(app.Flags, flags...)
+}
+
+// CredentialSecretRef returns the namespace and name of the credential secret
+func (opts *Options) CredentialSecretRef() (string, string) {
+	parts := strings.SplitN(opts.CredentialSecret, "/", 2)
+	if len(parts) == 1 {
+		return "", parts[0]
+	}
+	return parts[0], parts[1]
+}
+
+// Environment returns the default azure environment from flags
+func (opts *Options) Environment() (azure.Environment, error) {
+	var custom []byte
+	if opts.EnvironmentFile != "" {
+		data, err := ioutil.ReadFile(opts.EnvironmentFile)
+		if err != nil {
+			return azure.Environment{}, err
+		}
+		custom = data
+	}
+	return client.LoadEnvironment(opts.Cloud, custom)
 }
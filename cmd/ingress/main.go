@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"sort"
@@ -26,6 +27,7 @@ import (
 	"time"
 
 	"github.com/caicloud/clientset/kubernetes"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/journal"
 	corenode "github.com/caicloud/loadbalancer-provider/core/pkg/node"
 	core "github.com/caicloud/loadbalancer-provider/core/provider"
 	"github.com/caicloud/loadbalancer-provider/pkg/version"
@@ -50,6 +52,7 @@ func Run(opts *Options) error {
 		"lb.name":   opts.LoadBalancerName,
 		"pod.name":  opts.PodName,
 		"pod.ns":    opts.PodNamespace,
+		"state.dir": opts.StateDir,
 	})
 
 	if opts.Debug {
@@ -89,11 +92,29 @@ func Run(opts *Options) error {
 		return err
 	}
 
-	sidecar, err := ingress.NewIngressSidecar(nodeIP, lb)
+	nodeName, err := corenode.GetNodeNameForPod(clientset, opts.PodNamespace, opts.PodName)
 	if err != nil {
+		log.Fatal("Can not get node name", log.Fields{"err": err})
 		return err
 	}
 
+	sidecar, err := ingress.NewIngressSidecar(nodeIP, lb, opts.StateDir, opts.SysctlConfigMap, clientset, nodeName)
+	if err != nil {
+		return err
+	}
+
+	if opts.HealthAddr != "" {
+		go func() {
+			err := http.ListenAndServe(opts.HealthAddr, sidecar.Handler())
+			log.Error("health server exited", log.Fields{"addr": opts.HealthAddr, "err": err})
+		}()
+	}
+
+	var extraConfigMaps []string
+	if opts.SysctlConfigMap != "" {
+		extraConfigMaps = append(extraConfigMaps, opts.SysctlConfigMap)
+	}
+
 	lp := core.NewLoadBalancerProvider(&core.Configuration{
 		KubeClient:            clientset,
 		Backend:               sidecar,
@@ -101,6 +122,7 @@ func Run(opts *Options) error {
 		LoadBalancerNamespace: opts.LoadBalancerNamespace,
 		TCPConfigMap:          lb.Status.ProxyStatus.TCPConfigMap,
 		UDPConfigMap:          lb.Status.ProxyStatus.UDPConfigMap,
+		ExtraConfigMaps:       extraConfigMaps,
 	})
 
 	// handle shutdown
@@ -134,6 +156,20 @@ func main() {
 		return nil
 	}
 
+	app.Commands = []cli.Command{
+		{
+			Name:  "cleanup",
+			Usage: "revert all the host changes recorded in the journal of state dir and exit",
+			Action: func(c *cli.Context) error {
+				if err := journal.Cleanup(opts.StateDir); err != nil {
+					msg := fmt.Sprintf("cleanup failed, with err: %v\n", err)
+					return cli.NewExitError(msg, 1)
+				}
+				return nil
+			},
+		},
+	}
+
 	sort.Sort(cli.FlagsByName(app.Flags))
 
 	app.Run(os.Args)
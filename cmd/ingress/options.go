@@ -24,6 +24,9 @@ import (
 // Options contains controller options
 type Options struct {
 	*options.Options
+	StateDir        string
+	SysctlConfigMap string
+	HealthAddr      string
 }
 
 // NewOptions reutrns a new Options
@@ -36,4 +39,29 @@ func NewOptions() *Options {
 // AddFlags add flags to app
 func (opts *Options) AddFlags(app *cli.App) {
 	opts.Options.AddFlags(app)
+
+	flags := []cli.Flag{
+		cli.StringFlag{
+			Name:        "state-dir",
+			EnvVar:      "STATE_DIR",
+			Value:       "/var/lib/loadbalancer-provider/ingress",
+			Usage:       "directory to persist provider state across restarts, it should be a hostPath",
+			Destination: &opts.StateDir,
+		},
+		cli.StringFlag{
+			Name:        "sysctl-configmap",
+			EnvVar:      "SYSCTL_CONFIGMAP",
+			Usage:       "name of configmap in loadbalancer namespace which holds the sysctl profile of node, it overrides the proxy config",
+			Destination: &opts.SysctlConfigMap,
+		},
+		cli.StringFlag{
+			Name:        "health-addr",
+			EnvVar:      "HEALTH_ADDR",
+			Value:       ":18081",
+			Usage:       "address to serve /healthz and the readiness of exported ports on /ports, empty to disable",
+			Destination: &opts.HealthAddr,
+		},
+	}
+
+	app.Flags = append(app.Flags, flags...)
 }
@@ -26,6 +26,7 @@ import (
 	"time"
 
 	"github.com/caicloud/clientset/kubernetes"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/journal"
 	corenode "github.com/caicloud/loadbalancer-provider/core/pkg/node"
 	core "github.com/caicloud/loadbalancer-provider/core/provider"
 	"github.com/caicloud/loadbalancer-provider/pkg/version"
@@ -50,6 +51,7 @@ func Run(opts *Options) error {
 		"lb.name":   opts.LoadBalancerName,
 		"pod.name":  opts.PodName,
 		"pod.ns":    opts.PodNamespace,
+		"announce":  opts.AnnounceMode,
 	})
 
 	if opts.Debug {
@@ -92,6 +94,20 @@ func Run(opts *Options) error {
 		return err
 	}
 
+	announce, err := opts.AnnounceConfig()
+	if err != nil {
+		log.Error("invalid announce config", log.Fields{"err": err})
+		return err
+	}
+	if announce.Mode == ipvsdr.AnnounceModeL2 {
+		announce.L2.Client = clientset
+		announce.L2.NodeName, err = corenode.GetNodeNameForPod(clientset, opts.PodNamespace, opts.PodName)
+		if err != nil {
+			log.Fatal("Can not get node name", log.Fields{"err": err})
+			return err
+		}
+	}
+
 	err = loadIPVSModule()
 	if err != nil {
 		log.Error("load ipvs module error", log.Fields{"err": err})
@@ -104,7 +120,7 @@ func Run(opts *Options) error {
 		return err
 	}
 
-	ipvsdr, err := ipvsdr.NewIpvsdrProvider(nodeIP, lb, opts.Unicast, labels, annotations)
+	ipvsdr, err := ipvsdr.NewIpvsdrProvider(nodeIP, lb, opts.Unicast, labels, annotations, opts.StateDir, announce)
 	if err != nil {
 		log.Error("Create ipvsdr provider error", log.Fields{"err": err})
 		return err
@@ -151,6 +167,20 @@ func main() {
 		return nil
 	}
 
+	app.Commands = []cli.Command{
+		{
+			Name:  "cleanup",
+			Usage: "revert all the host changes recorded in the journal of state dir and exit",
+			Action: func(c *cli.Context) error {
+				if err := journal.Cleanup(opts.StateDir); err != nil {
+					msg := fmt.Sprintf("cleanup failed, with err: %v\n", err)
+					return cli.NewExitError(msg, 1)
+				}
+				return nil
+			},
+		},
+	}
+
 	sort.Sort(cli.FlagsByName(app.Flags))
 
 	app.Run(os.Args)
@@ -17,14 +17,27 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
 	"github.com/caicloud/loadbalancer-provider/core/options"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/bgp"
+	"github.com/caicloud/loadbalancer-provider/providers/ipvsdr"
 	cli "gopkg.in/urfave/cli.v1"
 )
 
 // Options contains controller options
 type Options struct {
 	*options.Options
-	Unicast bool
+	Unicast         bool
+	StateDir        string
+	AnnounceMode    string
+	BGPLocalASN     uint
+	BGPPeers        string
+	BGPRouterID     string
+	L2LeaseDuration time.Duration
 }
 
 // NewOptions reutrns a new Options
@@ -45,7 +58,78 @@ func (opts *Options) AddFlags(app *cli.App) {
 			Usage:       "use unicast instead of multicast for communication with other keepalived instances",
 			Destination: &opts.Unicast,
 		},
+		cli.StringFlag{
+			Name:        "state-dir",
+			EnvVar:      "STATE_DIR",
+			Value:       "/var/lib/loadbalancer-provider/ipvsdr",
+			Usage:       "directory to persist provider state across restarts, it should be a hostPath",
+			Destination: &opts.StateDir,
+		},
+		cli.StringFlag{
+			Name:        "announce-mode",
+			EnvVar:      "ANNOUNCE_MODE",
+			Value:       ipvsdr.AnnounceModeVRRP,
+			Usage:       "how to announce the VIP, vrrp, bgp or l2",
+			Destination: &opts.AnnounceMode,
+		},
+		cli.UintFlag{
+			Name:        "bgp-local-as",
+			EnvVar:      "BGP_LOCAL_AS",
+			Usage:       "local AS number of the BGP speaker in bgp announce mode",
+			Destination: &opts.BGPLocalASN,
+		},
+		cli.StringFlag{
+			Name:        "bgp-peers",
+			EnvVar:      "BGP_PEERS",
+			Usage:       "comma separated BGP peers in the form of asn@ip[:port] in bgp announce mode",
+			Destination: &opts.BGPPeers,
+		},
+		cli.StringFlag{
+			Name:        "bgp-router-id",
+			EnvVar:      "BGP_ROUTER_ID",
+			Usage:       "BGP router id in bgp announce mode, defaults to the node ip",
+			Destination: &opts.BGPRouterID,
+		},
+		cli.DurationFlag{
+			Name:        "l2-lease-duration",
+			EnvVar:      "L2_LEASE_DURATION",
+			Value:       15 * time.Second,
+			Usage:       "duration of the leader lease in l2 announce mode",
+			Destination: &opts.L2LeaseDuration,
+		},
 	}
 
 	app.Flags = append(app.Flags, flags...)
 }
+
+// AnnounceConfig returns the announce config of ipvsdr provider
+func (opts *Options) AnnounceConfig() (ipvsdr.AnnounceConfig, error) {
+	config := ipvsdr.AnnounceConfig{Mode: opts.AnnounceMode}
+	if opts.AnnounceMode == ipvsdr.AnnounceModeL2 {
+		config.L2.LeaseDuration = opts.L2LeaseDuration
+		return config, nil
+	}
+	if opts.AnnounceMode != ipvsdr.AnnounceModeBGP {
+		return config, nil
+	}
+
+	config.BGP.LocalASN = uint32(opts.BGPLocalASN)
+	if opts.BGPRouterID != "" {
+		config.BGP.RouterID = net.ParseIP(opts.BGPRouterID)
+		if config.BGP.RouterID == nil {
+			return config, fmt.Errorf("invalid bgp router id %q", opts.BGPRouterID)
+		}
+	}
+	for _, s := range strings.Split(opts.BGPPeers, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		peer, err := bgp.ParsePeer(s)
+		if err != nil {
+			return config, err
+		}
+		config.BGP.Peers = append(config.BGP.Peers, peer)
+	}
+	return config, nil
+}
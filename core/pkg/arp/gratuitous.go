@@ -0,0 +1,60 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arp
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	arpClient "github.com/mdlayher/arp"
+	"github.com/mdlayher/ethernet"
+)
+
+// Gratuitous broadcasts gratuitous ARP request and reply of the given ip
+// through the net interface, so that the neighbors update their ARP
+// caches to the hardware address of the interface.
+func Gratuitous(iface string, ip net.IP) error {
+	if ip.To4() == nil {
+		return fmt.Errorf("gratuitous arp only supports ipv4 address: %v", ip)
+	}
+
+	dev, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+
+	client, err := arpClient.Dial(dev)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	client.SetWriteDeadline(time.Now().Add(2 * time.Second))
+
+	// some devices only update the cache by request, others by reply
+	for _, op := range []arpClient.Operation{arpClient.OperationRequest, arpClient.OperationReply} {
+		packet, err := arpClient.NewPacket(op, dev.HardwareAddr, ip, ethernet.Broadcast, ip)
+		if err != nil {
+			return err
+		}
+		if err := client.WriteTo(packet, ethernet.Broadcast); err != nil {
+			return err
+		}
+	}
+	return nil
+}
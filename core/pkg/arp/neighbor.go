@@ -0,0 +1,75 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arp
+
+import (
+	"net"
+)
+
+// NeighborState is the state of an entry in the kernel neighbor table
+type NeighborState int
+
+// the neighbor states, see NUD_* in linux/neighbour.h
+const (
+	NeighborUnknown NeighborState = iota
+	NeighborIncomplete
+	NeighborReachable
+	NeighborStale
+	NeighborDelay
+	NeighborProbe
+	NeighborFailed
+	NeighborNoARP
+	NeighborPermanent
+)
+
+var neighborStateNames = map[NeighborState]string{
+	NeighborUnknown:    "unknown",
+	NeighborIncomplete: "incomplete",
+	NeighborReachable:  "reachable",
+	NeighborStale:      "stale",
+	NeighborDelay:      "delay",
+	NeighborProbe:      "probe",
+	NeighborFailed:     "failed",
+	NeighborNoARP:      "noarp",
+	NeighborPermanent:  "permanent",
+}
+
+func (s NeighborState) String() string {
+	if name, ok := neighborStateNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Valid returns true if the hardware address of the entry can be used.
+// A stale entry still has the last known address, the kernel just has
+// not confirmed it recently.
+func (s NeighborState) Valid() bool {
+	switch s {
+	case NeighborReachable, NeighborStale, NeighborDelay, NeighborProbe, NeighborNoARP, NeighborPermanent:
+		return true
+	}
+	return false
+}
+
+// Neighbor represents an entry in the kernel neighbor table
+type Neighbor struct {
+	IP           net.IP
+	HardwareAddr net.HardwareAddr
+	Interface    string
+	State        NeighborState
+}
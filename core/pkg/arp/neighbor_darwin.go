@@ -26,6 +26,7 @@ import (
 	k8sexec "k8s.io/kubernetes/pkg/util/exec"
 )
 
+// fields of the output of arp -anl
 const (
 	fIPAddr int = iota
 	fHWAddr
@@ -36,55 +37,46 @@ const (
 	fPrbs
 )
 
-func loadCache() (Caches, error) {
+// readNeighbors reads the arp cache, darwin does not report the states
+// of entries, so all of them are treated as reachable
+func readNeighbors() ([]Neighbor, error) {
 	output, err := k8sexec.New().Command("arp", "-anl").CombinedOutput()
 	if err != nil {
 		return nil, err
 	}
-	ifaces, err := net.Interfaces()
-	if err != nil {
-		return nil, err
-	}
 	scanner := bufio.NewScanner(bytes.NewReader(output))
 	// skip first line, it is descriptions
 	scanner.Scan()
 
-	var caches = make(Caches, 0)
-
+	neighbors := make([]Neighbor, 0)
 	for scanner.Scan() {
-		c, err := parse(scanner.Text(), ifaces)
+		n, err := parseNeighbor(scanner.Text())
 		if err != nil {
 			continue
 		}
-		caches = append(caches, c)
+		neighbors = append(neighbors, n)
 	}
-	return caches, nil
-
+	return neighbors, nil
 }
 
-func parse(line string, ifaces []net.Interface) (*Cache, error) {
+func parseNeighbor(line string) (Neighbor, error) {
 	fields := strings.Fields(line)
+	if len(fields) <= fNetif {
+		return Neighbor{}, fmt.Errorf("invalid arp entry: %v", line)
+	}
 
 	ip := net.ParseIP(fields[fIPAddr])
 	if ip == nil {
-		return nil, fmt.Errorf("failed to parse IP addr: %v", fields[fIPAddr])
+		return Neighbor{}, fmt.Errorf("failed to parse IP addr: %v", fields[fIPAddr])
 	}
 	hwAddr, err := net.ParseMAC(fields[fHWAddr])
 	if err != nil {
-		return nil, err
+		return Neighbor{}, err
 	}
-	d := fields[fNetif]
-	var dev *net.Interface
-	for _, iface := range ifaces {
-		if iface.Name == d {
-			dev = &iface
-			break
-		}
-	}
-
-	return &Cache{
+	return Neighbor{
 		IP:           ip,
 		HardwareAddr: hwAddr,
-		Interface:    dev,
+		Interface:    fields[fNetif],
+		State:        NeighborReachable,
 	}, nil
 }
@@ -0,0 +1,144 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// netlink neighbor attributes and states, linux/neighbour.h
+const (
+	sizeofNdMsg = 12
+
+	ndaDst    = 1
+	ndaLLAddr = 2
+
+	nudIncomplete = 0x01
+	nudReachable  = 0x02
+	nudStale      = 0x04
+	nudDelay      = 0x08
+	nudProbe      = 0x10
+	nudFailed     = 0x20
+	nudNoARP      = 0x40
+	nudPermanent  = 0x80
+)
+
+var nativeEndian = func() binary.ByteOrder {
+	var x uint16 = 1
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// readNeighbors dumps the ipv4 neighbor table by netlink, the entries of
+// all states are returned
+func readNeighbors() ([]Neighbor, error) {
+	tab, err := syscall.NetlinkRIB(syscall.RTM_GETNEIGH, syscall.AF_INET)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(tab)
+	if err != nil {
+		return nil, err
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[int]string, len(ifaces))
+	for _, iface := range ifaces {
+		names[iface.Index] = iface.Name
+	}
+	return parseNeighMessages(msgs, names)
+}
+
+func parseNeighMessages(msgs []syscall.NetlinkMessage, names map[int]string) ([]Neighbor, error) {
+	neighbors := make([]Neighbor, 0, len(msgs))
+	for _, m := range msgs {
+		if m.Header.Type == syscall.NLMSG_DONE {
+			break
+		}
+		if m.Header.Type != syscall.RTM_NEWNEIGH {
+			continue
+		}
+		if len(m.Data) < sizeofNdMsg {
+			return nil, fmt.Errorf("invalid neighbor message length %d", len(m.Data))
+		}
+		if m.Data[0] != syscall.AF_INET {
+			continue
+		}
+		ifindex := int(int32(nativeEndian.Uint32(m.Data[4:8])))
+		n := Neighbor{
+			Interface: names[ifindex],
+			State:     neighborState(nativeEndian.Uint16(m.Data[8:10])),
+		}
+
+		attrs := m.Data[sizeofNdMsg:]
+		for len(attrs) >= syscall.SizeofRtAttr {
+			l := int(nativeEndian.Uint16(attrs[0:2]))
+			typ := nativeEndian.Uint16(attrs[2:4])
+			if l < syscall.SizeofRtAttr || l > len(attrs) {
+				return nil, fmt.Errorf("invalid neighbor attribute length %d", l)
+			}
+			value := attrs[syscall.SizeofRtAttr:l]
+			switch typ {
+			case ndaDst:
+				n.IP = net.IP(append([]byte(nil), value...))
+			case ndaLLAddr:
+				n.HardwareAddr = net.HardwareAddr(append([]byte(nil), value...))
+			}
+			// attributes are aligned to 4 bytes
+			l = (l + syscall.NLMSG_ALIGNTO - 1) &^ (syscall.NLMSG_ALIGNTO - 1)
+			if l > len(attrs) {
+				break
+			}
+			attrs = attrs[l:]
+		}
+		if n.IP == nil {
+			continue
+		}
+		neighbors = append(neighbors, n)
+	}
+	return neighbors, nil
+}
+
+func neighborState(nud uint16) NeighborState {
+	switch {
+	case nud&nudPermanent != 0:
+		return NeighborPermanent
+	case nud&nudNoARP != 0:
+		return NeighborNoARP
+	case nud&nudReachable != 0:
+		return NeighborReachable
+	case nud&nudStale != 0:
+		return NeighborStale
+	case nud&nudDelay != 0:
+		return NeighborDelay
+	case nud&nudProbe != 0:
+		return NeighborProbe
+	case nud&nudFailed != 0:
+		return NeighborFailed
+	case nud&nudIncomplete != 0:
+		return NeighborIncomplete
+	}
+	return NeighborUnknown
+}
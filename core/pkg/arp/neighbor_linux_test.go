@@ -0,0 +1,76 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arp
+
+import (
+	"syscall"
+	"testing"
+)
+
+func rtattr(typ uint16, value []byte) []byte {
+	l := syscall.SizeofRtAttr + len(value)
+	b := make([]byte, 4, (l+3)&^3)
+	nativeEndian.PutUint16(b[0:2], uint16(l))
+	nativeEndian.PutUint16(b[2:4], typ)
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func ndmsg(ifindex int32, state uint16) []byte {
+	b := make([]byte, sizeofNdMsg)
+	b[0] = syscall.AF_INET
+	nativeEndian.PutUint32(b[4:8], uint32(ifindex))
+	nativeEndian.PutUint16(b[8:10], state)
+	return b
+}
+
+func TestParseNeighMessages(t *testing.T) {
+	data := append(ndmsg(2, nudStale), rtattr(ndaDst, []byte{10, 0, 0, 2})...)
+	data = append(data, rtattr(ndaLLAddr, []byte{0, 1, 2, 3, 4, 5})...)
+	failed := append(ndmsg(2, nudFailed), rtattr(ndaDst, []byte{10, 0, 0, 3})...)
+
+	msgs := []syscall.NetlinkMessage{
+		{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWNEIGH}, Data: data},
+		{Header: syscall.NlMsghdr{Type: syscall.RTM_NEWNEIGH}, Data: failed},
+		{Header: syscall.NlMsghdr{Type: syscall.NLMSG_DONE}},
+	}
+	neighbors, err := parseNeighMessages(msgs, map[int]string{2: "eth0"})
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if len(neighbors) != 2 {
+		t.Fatalf("expect 2 neighbors, got %v", neighbors)
+	}
+	n := neighbors[0]
+	if n.IP.String() != "10.0.0.2" || n.HardwareAddr.String() != "00:01:02:03:04:05" || n.Interface != "eth0" || n.State != NeighborStale {
+		t.Errorf("unexpected neighbor %+v", n)
+	}
+	if !n.State.Valid() {
+		t.Errorf("stale neighbor should be valid")
+	}
+	n = neighbors[1]
+	if n.State != NeighborFailed || n.State.Valid() || n.HardwareAddr != nil {
+		t.Errorf("unexpected neighbor %+v", n)
+	}
+
+	if _, err := readNeighbors(); err != nil {
+		t.Errorf("read neighbors error: %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	arpClient "github.com/mdlayher/arp"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	defaultTTL         = 5 * time.Minute
+	defaultTimeout     = 1 * time.Second
+	defaultRetries     = 2
+	defaultBackoff     = 200 * time.Millisecond
+	defaultConcurrency = 16
+)
+
+var defaultResolver = NewResolver(ResolverOptions{})
+
+// Resolve resolves the hardware address of the given ip on the net interface
+// by a shared Resolver, the address is cached for a while.
+// 1. it try to get hardware address from the kernel neighbor table
+// 2. If the hardware address is not in the table, then It performs ARP requests,
+// attempting to retrieve the hardware address of  the machine using its IPv4 address
+// through the given net interface
+func Resolve(iface, ip string) (net.HardwareAddr, error) {
+	return defaultResolver.Resolve(iface, ip)
+}
+
+// ResolverOptions contains the settings of Resolver, zero values are
+// replaced by the defaults
+type ResolverOptions struct {
+	// TTL is how long a resolved address is used without resolving
+	// again, 5m by default. If resolving fails, the last known address
+	// is still used until it is older than twice of TTL.
+	TTL time.Duration
+	// Timeout of each ARP request, 1s by default
+	Timeout time.Duration
+	// Retries is the number of ARP requests sent after the first one
+	// fails, 2 by default
+	Retries int
+	// Backoff is the wait before the first retry, it doubles for each
+	// retry, 200ms by default
+	Backoff time.Duration
+	// Concurrency is the max number of parallel resolutions of ResolveAll,
+	// 16 by default
+	Concurrency int
+	// OnChange is called when the hardware address of a resolved
+	// neighbor changes
+	OnChange func(iface, ip string, old, cur net.HardwareAddr)
+}
+
+type entry struct {
+	hwAddr  net.HardwareAddr
+	updated time.Time
+}
+
+// Resolver resolves hardware addresses of neighbors. It looks up the
+// kernel neighbor table at first, and sends ARP requests if the neighbor
+// is not in the table or the entry is invalid, such as failed.
+type Resolver struct {
+	opts ResolverOptions
+
+	mu    sync.Mutex
+	cache map[string]*entry
+
+	// they are replaced in testing
+	readNeighbors func() ([]Neighbor, error)
+	probe         func(iface string, ip net.IP, timeout time.Duration) (net.HardwareAddr, error)
+	now           func() time.Time
+}
+
+// NewResolver returns a new Resolver
+func NewResolver(opts ResolverOptions) *Resolver {
+	if opts.TTL <= 0 {
+		opts.TTL = defaultTTL
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	} else if opts.Retries == 0 {
+		opts.Retries = defaultRetries
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultBackoff
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultConcurrency
+	}
+	return &Resolver{
+		opts:          opts,
+		cache:         make(map[string]*entry),
+		readNeighbors: readNeighbors,
+		probe:         probe,
+		now:           time.Now,
+	}
+}
+
+// Resolve returns the hardware address of ip on the net interface
+func (r *Resolver) Resolve(iface, ip string) (net.HardwareAddr, error) {
+	if hwAddr, ok := r.lookup(iface, ip); ok {
+		return hwAddr, nil
+	}
+	neighbors, _ := r.readNeighbors()
+	return r.resolve(iface, ip, neighbors)
+}
+
+// ResolveAll resolves the ips on the net interface in parallel, it returns
+// the resolved hardware addresses and the errors of unresolved ips
+func (r *Resolver) ResolveAll(iface string, ips []string) (map[string]net.HardwareAddr, map[string]error) {
+	resolved := make(map[string]net.HardwareAddr, len(ips))
+	errs := make(map[string]error)
+
+	pending := make([]string, 0)
+	for _, ip := range ips {
+		if hwAddr, ok := r.lookup(iface, ip); ok {
+			resolved[ip] = hwAddr
+			continue
+		}
+		pending = append(pending, ip)
+	}
+	if len(pending) == 0 {
+		return resolved, errs
+	}
+
+	// read the neighbor table once for all
+	neighbors, _ := r.readNeighbors()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, r.opts.Concurrency)
+	for _, ip := range pending {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(ip string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			hwAddr, err := r.resolve(iface, ip, neighbors)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[ip] = err
+				return
+			}
+			resolved[ip] = hwAddr
+		}(ip)
+	}
+	wg.Wait()
+	return resolved, errs
+}
+
+// Refresh resolves all the known neighbors again regardless of TTL, so
+// that the changes of hardware addresses are noticed
+func (r *Resolver) Refresh() {
+	r.mu.Lock()
+	keys := make([][2]string, 0, len(r.cache))
+	for key := range r.cache {
+		iface, ip := splitKey(key)
+		keys = append(keys, [2]string{iface, ip})
+	}
+	r.mu.Unlock()
+
+	if len(keys) == 0 {
+		return
+	}
+	neighbors, _ := r.readNeighbors()
+	for _, key := range keys {
+		r.resolve(key[0], key[1], neighbors)
+	}
+}
+
+// Run refreshes the known neighbors every period until stopCh is closed
+func (r *Resolver) Run(period time.Duration, stopCh <-chan struct{}) {
+	wait.Until(r.Refresh, period, stopCh)
+}
+
+// lookup returns the cached hardware address which is not expired
+func (r *Resolver) lookup(iface, ip string) (net.HardwareAddr, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.cache[cacheKey(iface, ip)]
+	if !ok || r.now().Sub(e.updated) > r.opts.TTL {
+		return nil, false
+	}
+	return e.hwAddr, true
+}
+
+func (r *Resolver) resolve(iface, ip string, neighbors []Neighbor) (net.HardwareAddr, error) {
+	ipAddr := net.ParseIP(ip)
+	if ipAddr == nil || ipAddr.To4() == nil {
+		return nil, fmt.Errorf("failed to parse ipv4 addr: %v", ip)
+	}
+
+	hwAddr, err := r.resolveUncached(iface, ipAddr, neighbors)
+	if err == nil {
+		r.store(iface, ip, hwAddr)
+		return hwAddr, nil
+	}
+
+	// tolerate transient failures by the last known address
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.cache[cacheKey(iface, ip)]; ok && r.now().Sub(e.updated) <= 2*r.opts.TTL {
+		return e.hwAddr, nil
+	}
+	return nil, err
+}
+
+func (r *Resolver) resolveUncached(iface string, ip net.IP, neighbors []Neighbor) (net.HardwareAddr, error) {
+	for _, n := range neighbors {
+		if n.Interface == iface && n.IP.Equal(ip) && n.State.Valid() && len(n.HardwareAddr) > 0 {
+			return n.HardwareAddr, nil
+		}
+	}
+
+	var hwAddr net.HardwareAddr
+	var err error
+	backoff := r.opts.Backoff
+	for i := 0; i <= r.opts.Retries; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		hwAddr, err = r.probe(iface, ip, r.opts.Timeout)
+		if err == nil {
+			return hwAddr, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to resolve %v on %v after %d attempts: %v", ip, iface, r.opts.Retries+1, err)
+}
+
+func (r *Resolver) store(iface, ip string, hwAddr net.HardwareAddr) {
+	r.mu.Lock()
+	key := cacheKey(iface, ip)
+	var old net.HardwareAddr
+	if e, ok := r.cache[key]; ok {
+		old = e.hwAddr
+	}
+	r.cache[key] = &entry{hwAddr: hwAddr, updated: r.now()}
+	r.mu.Unlock()
+
+	if old != nil && old.String() != hwAddr.String() && r.opts.OnChange != nil {
+		r.opts.OnChange(iface, ip, old, hwAddr)
+	}
+}
+
+func cacheKey(iface, ip string) string {
+	return iface + "/" + ip
+}
+
+func splitKey(key string) (string, string) {
+	parts := strings.SplitN(key, "/", 2)
+	return parts[0], parts[1]
+}
+
+// probe sends an ARP request through the net interface
+func probe(iface string, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	dev, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := arpClient.Dial(dev)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	// add timeout to avoid infinite waiting
+	client.SetDeadline(time.Now().Add(timeout))
+
+	return client.Resolve(ip)
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package arp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeNetwork struct {
+	mu        sync.Mutex
+	neighbors []Neighbor
+	macs      map[string]net.HardwareAddr
+	failures  map[string]int
+	probes    map[string]int
+	delay     time.Duration
+}
+
+func (f *fakeNetwork) readNeighbors() ([]Neighbor, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.neighbors, nil
+}
+
+func (f *fakeNetwork) probe(iface string, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	time.Sleep(f.delay)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.probes[ip.String()]++
+	if f.failures[ip.String()] > 0 {
+		f.failures[ip.String()]--
+		return nil, fmt.Errorf("timeout")
+	}
+	mac, ok := f.macs[ip.String()]
+	if !ok {
+		return nil, fmt.Errorf("timeout")
+	}
+	return mac, nil
+}
+
+func newTestResolver(f *fakeNetwork, opts ResolverOptions) *Resolver {
+	opts.Backoff = time.Millisecond
+	r := NewResolver(opts)
+	r.readNeighbors = f.readNeighbors
+	r.probe = f.probe
+	return r
+}
+
+func newFakeNetwork() *fakeNetwork {
+	return &fakeNetwork{
+		macs:     make(map[string]net.HardwareAddr),
+		failures: make(map[string]int),
+		probes:   make(map[string]int),
+	}
+}
+
+func mustMAC(s string) net.HardwareAddr {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		panic(err)
+	}
+	return mac
+}
+
+func TestResolverNeighborTable(t *testing.T) {
+	f := newFakeNetwork()
+	f.neighbors = []Neighbor{
+		{IP: net.ParseIP("10.0.0.2"), HardwareAddr: mustMAC("00:00:00:00:00:02"), Interface: "eth0", State: NeighborStale},
+		{IP: net.ParseIP("10.0.0.3"), HardwareAddr: mustMAC("00:00:00:00:00:03"), Interface: "eth0", State: NeighborFailed},
+	}
+	f.macs["10.0.0.3"] = mustMAC("00:00:00:00:00:33")
+	r := newTestResolver(f, ResolverOptions{})
+
+	mac, err := r.Resolve("eth0", "10.0.0.2")
+	if err != nil || mac.String() != "00:00:00:00:00:02" {
+		t.Errorf("expect mac from stale entry, got %v, %v", mac, err)
+	}
+	if f.probes["10.0.0.2"] != 0 {
+		t.Errorf("expect no arp request for a valid entry")
+	}
+
+	// failed entries are probed again
+	mac, err = r.Resolve("eth0", "10.0.0.3")
+	if err != nil || mac.String() != "00:00:00:00:00:33" {
+		t.Errorf("expect mac from arp request, got %v, %v", mac, err)
+	}
+}
+
+func TestResolverRetryAndCache(t *testing.T) {
+	f := newFakeNetwork()
+	f.macs["10.0.0.2"] = mustMAC("00:00:00:00:00:02")
+	f.failures["10.0.0.2"] = 2
+	now := time.Now()
+	r := newTestResolver(f, ResolverOptions{TTL: time.Minute, Retries: 2})
+	r.now = func() time.Time { return now }
+
+	mac, err := r.Resolve("eth0", "10.0.0.2")
+	if err != nil || mac.String() != "00:00:00:00:00:02" {
+		t.Fatalf("expect resolved after retries, got %v, %v", mac, err)
+	}
+	if f.probes["10.0.0.2"] != 3 {
+		t.Errorf("expect 3 attempts, got %d", f.probes["10.0.0.2"])
+	}
+
+	// cached
+	r.Resolve("eth0", "10.0.0.2")
+	if f.probes["10.0.0.2"] != 3 {
+		t.Errorf("expect cached result, got %d attempts", f.probes["10.0.0.2"])
+	}
+
+	// expired and failing, the last known address is used
+	now = now.Add(90 * time.Second)
+	f.failures["10.0.0.2"] = 10
+	mac, err = r.Resolve("eth0", "10.0.0.2")
+	if err != nil || mac.String() != "00:00:00:00:00:02" {
+		t.Errorf("expect the last known address, got %v, %v", mac, err)
+	}
+
+	// too old
+	now = now.Add(time.Minute)
+	if _, err = r.Resolve("eth0", "10.0.0.2"); err == nil {
+		t.Errorf("expect error after the address is too old")
+	}
+}
+
+func TestResolverResolveAll(t *testing.T) {
+	f := newFakeNetwork()
+	f.delay = 100 * time.Millisecond
+	ips := make([]string, 0)
+	for i := 1; i <= 20; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		ips = append(ips, ip)
+		if i%2 == 0 {
+			f.macs[ip] = mustMAC(fmt.Sprintf("00:00:00:00:00:%02x", i))
+		}
+	}
+	r := newTestResolver(f, ResolverOptions{Retries: -1, Concurrency: 20})
+
+	start := time.Now()
+	resolved, errs := r.ResolveAll("eth0", ips)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expect resolving in parallel, took %v", elapsed)
+	}
+	if len(resolved) != 10 || len(errs) != 10 {
+		t.Errorf("expect 10 resolved and 10 errors, got %d and %d", len(resolved), len(errs))
+	}
+}
+
+func TestResolverOnChange(t *testing.T) {
+	f := newFakeNetwork()
+	f.macs["10.0.0.2"] = mustMAC("00:00:00:00:00:02")
+
+	changed := make([]string, 0)
+	r := newTestResolver(f, ResolverOptions{
+		OnChange: func(iface, ip string, old, cur net.HardwareAddr) {
+			changed = append(changed, fmt.Sprintf("%s %s %v->%v", iface, ip, old, cur))
+		},
+	})
+
+	r.Resolve("eth0", "10.0.0.2")
+	r.Refresh()
+	if len(changed) != 0 {
+		t.Errorf("expect no change, got %v", changed)
+	}
+
+	f.macs["10.0.0.2"] = mustMAC("00:00:00:00:00:22")
+	r.Refresh()
+	want := "eth0 10.0.0.2 00:00:00:00:00:02->00:00:00:00:00:22"
+	if len(changed) != 1 || changed[0] != want {
+		t.Errorf("expect %q, got %v", want, changed)
+	}
+}
@@ -0,0 +1,418 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bgp implements a minimal BGP-4 speaker which only announces
+// IPv4 unicast prefixes to its peers and ignores the routes it receives.
+package bgp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/zoumo/logdog"
+)
+
+const (
+	defaultPort     = "179"
+	defaultHoldTime = 90 * time.Second
+	dialTimeout     = 5 * time.Second
+	minBackoff      = 2 * time.Second
+	maxBackoff      = 60 * time.Second
+)
+
+// Peer is a BGP neighbor the speaker connects to
+type Peer struct {
+	// Address is the ip of the neighbor, a port can be specified as
+	// ip:port, 179 is used by default
+	Address string
+	// ASN is the AS number of the neighbor
+	ASN uint32
+}
+
+// Config contains the settings of a speaker
+type Config struct {
+	// LocalASN is the AS number of the speaker
+	LocalASN uint32
+	// RouterID is the BGP identifier of the speaker, it is usually the node ip
+	RouterID net.IP
+	// NextHop is the next hop of the announced prefixes
+	NextHop net.IP
+	// HoldTime is the proposed hold time, 90s by default
+	HoldTime time.Duration
+	// Peers are the neighbors to announce prefixes to
+	Peers []Peer
+}
+
+// ParsePeer parses a peer in the form of asn@ip[:port]
+func ParsePeer(s string) (Peer, error) {
+	parts := strings.SplitN(s, "@", 2)
+	if len(parts) != 2 {
+		return Peer{}, fmt.Errorf("bgp: invalid peer %q, should be asn@ip[:port]", s)
+	}
+	asn, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return Peer{}, fmt.Errorf("bgp: invalid peer asn %q: %v", parts[0], err)
+	}
+	host := parts[1]
+	if h, _, err := net.SplitHostPort(parts[1]); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.To4() == nil {
+		return Peer{}, fmt.Errorf("bgp: invalid peer address %q", parts[1])
+	}
+	return Peer{Address: parts[1], ASN: uint32(asn)}, nil
+}
+
+// Speaker announces prefixes to all the configured peers
+type Speaker struct {
+	cfg Config
+
+	mu       sync.Mutex
+	prefixes map[string]*net.IPNet
+	sessions []*session
+
+	wg     sync.WaitGroup
+	stopCh chan struct{}
+}
+
+// NewSpeaker returns a new Speaker
+func NewSpeaker(cfg Config) (*Speaker, error) {
+	if cfg.LocalASN == 0 {
+		return nil, fmt.Errorf("bgp: local asn is required")
+	}
+	if cfg.RouterID.To4() == nil {
+		return nil, fmt.Errorf("bgp: router id must be an ipv4 address")
+	}
+	if cfg.NextHop == nil {
+		cfg.NextHop = cfg.RouterID
+	}
+	if cfg.NextHop.To4() == nil {
+		return nil, fmt.Errorf("bgp: next hop must be an ipv4 address")
+	}
+	if cfg.HoldTime == 0 {
+		cfg.HoldTime = defaultHoldTime
+	}
+	if cfg.HoldTime < 3*time.Second {
+		return nil, fmt.Errorf("bgp: hold time must be at least 3s")
+	}
+	if len(cfg.Peers) == 0 {
+		return nil, fmt.Errorf("bgp: no peers specified")
+	}
+
+	s := &Speaker{
+		cfg:      cfg,
+		prefixes: make(map[string]*net.IPNet),
+		stopCh:   make(chan struct{}),
+	}
+	for _, peer := range cfg.Peers {
+		addr := peer.Address
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, defaultPort)
+		}
+		s.sessions = append(s.sessions, &session{
+			speaker:  s,
+			peer:     peer,
+			addr:     addr,
+			updateCh: make(chan struct{}, 1),
+		})
+	}
+	return s, nil
+}
+
+// Start connects to all the peers in background
+func (s *Speaker) Start() {
+	for _, ss := range s.sessions {
+		s.wg.Add(1)
+		go func(ss *session) {
+			defer s.wg.Done()
+			ss.run(s.stopCh)
+		}(ss)
+	}
+}
+
+// Stop closes all the sessions, peers will remove the routes learned
+// from the speaker
+func (s *Speaker) Stop() {
+	close(s.stopCh)
+	s.wg.Wait()
+}
+
+// Announce advertises the prefix to all peers
+func (s *Speaker) Announce(prefix *net.IPNet) error {
+	if prefix.IP.To4() == nil {
+		return fmt.Errorf("bgp: only ipv4 prefix is supported: %v", prefix)
+	}
+	s.mu.Lock()
+	_, ok := s.prefixes[prefix.String()]
+	s.prefixes[prefix.String()] = prefix
+	s.mu.Unlock()
+
+	if !ok {
+		log.Info("bgp: announce prefix", log.Fields{"prefix": prefix})
+		s.notify()
+	}
+	return nil
+}
+
+// Withdraw withdraws the prefix from all peers
+func (s *Speaker) Withdraw(prefix *net.IPNet) {
+	s.mu.Lock()
+	_, ok := s.prefixes[prefix.String()]
+	delete(s.prefixes, prefix.String())
+	s.mu.Unlock()
+
+	if ok {
+		log.Info("bgp: withdraw prefix", log.Fields{"prefix": prefix})
+		s.notify()
+	}
+}
+
+// Established returns the address of peers whose session is established
+func (s *Speaker) Established() []string {
+	peers := make([]string, 0)
+	for _, ss := range s.sessions {
+		if ss.isEstablished() {
+			peers = append(peers, ss.peer.Address)
+		}
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+func (s *Speaker) notify() {
+	for _, ss := range s.sessions {
+		select {
+		case ss.updateCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *Speaker) snapshot() map[string]*net.IPNet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefixes := make(map[string]*net.IPNet, len(s.prefixes))
+	for k, v := range s.prefixes {
+		prefixes[k] = v
+	}
+	return prefixes
+}
+
+type session struct {
+	speaker  *Speaker
+	peer     Peer
+	addr     string
+	updateCh chan struct{}
+
+	mu          sync.Mutex
+	established bool
+}
+
+func (ss *session) isEstablished() bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.established
+}
+
+func (ss *session) setEstablished(established bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.established = established
+}
+
+// run keeps the session connected until stopCh is closed
+func (ss *session) run(stopCh <-chan struct{}) {
+	backoff := minBackoff
+	for {
+		established, err := ss.connect(stopCh)
+		ss.setEstablished(false)
+		if err == nil {
+			// stopped
+			return
+		}
+		log.Warn("bgp: session closed", log.Fields{"peer": ss.addr, "err": err})
+		if established {
+			backoff = minBackoff
+		}
+
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// connect opens the session and serves it, it returns nil error only
+// when stopCh is closed
+func (ss *session) connect(stopCh <-chan struct{}) (bool, error) {
+	cfg := ss.speaker.cfg
+	conn, err := net.DialTimeout("tcp", ss.addr, dialTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	err = writeMessage(conn, msgOpen, encodeOpen(&openMessage{
+		ASN:      cfg.LocalASN,
+		HoldTime: uint16(cfg.HoldTime / time.Second),
+		RouterID: cfg.RouterID,
+	}))
+	if err != nil {
+		return false, err
+	}
+
+	// OpenSent -> OpenConfirm
+	conn.SetReadDeadline(time.Now().Add(cfg.HoldTime))
+	msg, err := readMessage(conn)
+	if err != nil {
+		return false, err
+	}
+	if msg.Type != msgOpen {
+		return false, fmt.Errorf("bgp: expect OPEN but got message type %d", msg.Type)
+	}
+	open, err := decodeOpen(msg.Body)
+	if err != nil {
+		return false, err
+	}
+	if ss.peer.ASN != 0 && open.ASN != ss.peer.ASN {
+		return false, fmt.Errorf("bgp: peer asn %d mismatches the configured asn %d", open.ASN, ss.peer.ASN)
+	}
+	holdTime := cfg.HoldTime
+	if peerHold := time.Duration(open.HoldTime) * time.Second; peerHold < holdTime {
+		holdTime = peerHold
+	}
+	if holdTime != 0 && holdTime < 3*time.Second {
+		return false, fmt.Errorf("bgp: unacceptable hold time %v", holdTime)
+	}
+	if err := writeMessage(conn, msgKeepalive, nil); err != nil {
+		return false, err
+	}
+
+	// OpenConfirm -> Established
+	msg, err = readMessage(conn)
+	if err != nil {
+		return false, err
+	}
+	if msg.Type != msgKeepalive {
+		return false, fmt.Errorf("bgp: expect KEEPALIVE but got message type %d", msg.Type)
+	}
+	ss.setEstablished(true)
+	log.Info("bgp: session established", log.Fields{"peer": ss.addr, "asn": open.ASN, "holdTime": holdTime})
+
+	errCh := make(chan error, 1)
+	go func() {
+		for {
+			if holdTime > 0 {
+				conn.SetReadDeadline(time.Now().Add(holdTime))
+			} else {
+				conn.SetReadDeadline(time.Time{})
+			}
+			msg, err := readMessage(conn)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if msg.Type == msgNotification {
+				errCh <- fmt.Errorf("bgp: received notification %v", msg.Body)
+				return
+			}
+			// routes from peers are ignored
+		}
+	}()
+
+	keepalive := make(<-chan time.Time)
+	if holdTime > 0 {
+		ticker := time.NewTicker(holdTime / 3)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	ibgp := open.ASN == cfg.LocalASN
+	fourOctetASN := open.FourOctetASN
+	advertised := make(map[string]*net.IPNet)
+	if err := ss.sync(conn, advertised, ibgp, fourOctetASN); err != nil {
+		return true, err
+	}
+
+	for {
+		select {
+		case <-stopCh:
+			// Cease/Administrative Shutdown
+			writeMessage(conn, msgNotification, []byte{errCodeCease, errSubCodeShutdown})
+			return true, nil
+		case err := <-errCh:
+			return true, err
+		case <-keepalive:
+			if err := writeMessage(conn, msgKeepalive, nil); err != nil {
+				return true, err
+			}
+		case <-ss.updateCh:
+			if err := ss.sync(conn, advertised, ibgp, fourOctetASN); err != nil {
+				return true, err
+			}
+		}
+	}
+}
+
+// sync sends an UPDATE containing the difference between the prefixes
+// of speaker and the prefixes advertised in this session
+func (ss *session) sync(conn net.Conn, advertised map[string]*net.IPNet, ibgp, fourOctetASN bool) error {
+	cfg := ss.speaker.cfg
+	desired := ss.speaker.snapshot()
+
+	update := &updateMessage{NextHop: cfg.NextHop}
+	for key, prefix := range advertised {
+		if _, ok := desired[key]; !ok {
+			update.Withdrawn = append(update.Withdrawn, prefix)
+		}
+	}
+	for key, prefix := range desired {
+		if _, ok := advertised[key]; !ok {
+			update.NLRI = append(update.NLRI, prefix)
+		}
+	}
+	if len(update.Withdrawn) == 0 && len(update.NLRI) == 0 {
+		return nil
+	}
+	if !ibgp {
+		asn := cfg.LocalASN
+		if !fourOctetASN && asn > 0xffff {
+			asn = asTrans
+		}
+		update.ASPath = []uint32{asn}
+	}
+
+	if err := writeMessage(conn, msgUpdate, encodeUpdate(update, ibgp, fourOctetASN)); err != nil {
+		return err
+	}
+	for _, prefix := range update.Withdrawn {
+		delete(advertised, prefix.String())
+	}
+	for _, prefix := range update.NLRI {
+		advertised[prefix.String()] = prefix
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// fakePeer is a stand-in of a BGP router, it accepts one session and
+// reports the received UPDATE messages
+type fakePeer struct {
+	t        *testing.T
+	asn      uint32
+	listener net.Listener
+	opens    chan *openMessage
+	updates  chan *updateMessage
+	closed   chan struct{}
+}
+
+func newFakePeer(t *testing.T, asn uint32) *fakePeer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	p := &fakePeer{
+		t:        t,
+		asn:      asn,
+		listener: l,
+		opens:    make(chan *openMessage, 1),
+		updates:  make(chan *updateMessage, 10),
+		closed:   make(chan struct{}),
+	}
+	go p.serve()
+	return p
+}
+
+func (p *fakePeer) serve() {
+	conn, err := p.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	defer close(p.closed)
+
+	for {
+		msg, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		switch msg.Type {
+		case msgOpen:
+			open, err := decodeOpen(msg.Body)
+			if err != nil {
+				p.t.Errorf("decode open error: %v", err)
+				return
+			}
+			p.opens <- open
+			writeMessage(conn, msgOpen, encodeOpen(&openMessage{
+				ASN:      p.asn,
+				HoldTime: 9,
+				RouterID: net.ParseIP("10.0.0.254"),
+			}))
+			writeMessage(conn, msgKeepalive, nil)
+		case msgUpdate:
+			update, err := decodeUpdate(msg.Body)
+			if err != nil {
+				p.t.Errorf("decode update error: %v", err)
+				return
+			}
+			p.updates <- update
+		case msgNotification:
+			return
+		}
+	}
+}
+
+func (p *fakePeer) waitUpdate() *updateMessage {
+	select {
+	case u := <-p.updates:
+		return u
+	case <-time.After(5 * time.Second):
+		p.t.Fatal("timeout waiting for update")
+	}
+	return nil
+}
+
+func TestSpeaker(t *testing.T) {
+	peer := newFakePeer(t, 65001)
+	defer peer.listener.Close()
+
+	speaker, err := NewSpeaker(Config{
+		LocalASN: 4200000001,
+		RouterID: net.ParseIP("10.0.0.1"),
+		Peers:    []Peer{{Address: peer.listener.Addr().String(), ASN: 65001}},
+	})
+	if err != nil {
+		t.Fatalf("new speaker error: %v", err)
+	}
+
+	_, vip, _ := net.ParseCIDR("192.168.99.200/32")
+	if err := speaker.Announce(vip); err != nil {
+		t.Fatalf("announce error: %v", err)
+	}
+	speaker.Start()
+
+	open := <-peer.opens
+	if open.ASN != 4200000001 || !open.FourOctetASN {
+		t.Errorf("unexpected open message %+v", open)
+	}
+
+	update := peer.waitUpdate()
+	if len(update.NLRI) != 1 || update.NLRI[0].String() != vip.String() {
+		t.Errorf("unexpected nlri %v", update.NLRI)
+	}
+	if !update.NextHop.Equal(net.ParseIP("10.0.0.1").To4()) {
+		t.Errorf("unexpected next hop %v", update.NextHop)
+	}
+	if len(update.ASPath) != 1 || update.ASPath[0] != 4200000001 {
+		t.Errorf("unexpected as path %v", update.ASPath)
+	}
+	if established := speaker.Established(); len(established) != 1 {
+		t.Errorf("expect the session established, got %v", established)
+	}
+
+	speaker.Withdraw(vip)
+	update = peer.waitUpdate()
+	if len(update.Withdrawn) != 1 || update.Withdrawn[0].String() != vip.String() || len(update.NLRI) != 0 {
+		t.Errorf("unexpected withdraw update %+v", update)
+	}
+
+	speaker.Stop()
+	select {
+	case <-peer.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("session is not closed after stopping")
+	}
+}
+
+func TestParsePeer(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Peer
+		wantErr bool
+	}{
+		{"65000@10.0.0.254", Peer{Address: "10.0.0.254", ASN: 65000}, false},
+		{"65000@10.0.0.254:1179", Peer{Address: "10.0.0.254:1179", ASN: 65000}, false},
+		{"10.0.0.254", Peer{}, true},
+		{"abc@10.0.0.254", Peer{}, true},
+		{"65000@fe80::1", Peer{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePeer(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePeer(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParsePeer(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
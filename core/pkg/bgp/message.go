@@ -0,0 +1,307 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// message types, RFC 4271 4.1
+const (
+	msgOpen         uint8 = 1
+	msgUpdate       uint8 = 2
+	msgNotification uint8 = 3
+	msgKeepalive    uint8 = 4
+)
+
+const (
+	headerLen     = 19
+	maxMessageLen = 4096
+
+	bgpVersion = 4
+	// asTrans is used in the my AS field of OPEN when the real ASN
+	// can not be represented in two octets, RFC 6793
+	asTrans = 23456
+
+	optParamCapabilities uint8 = 2
+	capMultiprotocol     uint8 = 1
+	capFourOctetAS       uint8 = 65
+
+	afiIPv4     uint16 = 1
+	safiUnicast uint8  = 1
+
+	// path attributes
+	attrFlagTransitive uint8 = 0x40
+	attrOrigin         uint8 = 1
+	attrASPath         uint8 = 2
+	attrNextHop        uint8 = 3
+	attrLocalPref      uint8 = 5
+
+	originIGP        uint8 = 0
+	asPathSegSeq     uint8 = 2
+	defaultLocalPref       = 100
+
+	// notification error codes
+	errCodeCease       uint8 = 6
+	errSubCodeShutdown uint8 = 2
+)
+
+var marker = bytes.Repeat([]byte{0xff}, 16)
+
+type message struct {
+	Type uint8
+	Body []byte
+}
+
+type openMessage struct {
+	ASN          uint32
+	HoldTime     uint16
+	RouterID     net.IP
+	FourOctetASN bool
+}
+
+type updateMessage struct {
+	Withdrawn []*net.IPNet
+	NLRI      []*net.IPNet
+	NextHop   net.IP
+	ASPath    []uint32
+}
+
+func writeMessage(w io.Writer, typ uint8, body []byte) error {
+	length := headerLen + len(body)
+	if length > maxMessageLen {
+		return fmt.Errorf("bgp: message too long: %d", length)
+	}
+	buf := make([]byte, 0, length)
+	buf = append(buf, marker...)
+	buf = append(buf, byte(length>>8), byte(length))
+	buf = append(buf, typ)
+	buf = append(buf, body...)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readMessage(r io.Reader) (*message, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:16], marker) {
+		return nil, fmt.Errorf("bgp: invalid message marker")
+	}
+	length := int(binary.BigEndian.Uint16(header[16:18]))
+	if length < headerLen || length > maxMessageLen {
+		return nil, fmt.Errorf("bgp: invalid message length %d", length)
+	}
+	body := make([]byte, length-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &message{Type: header[18], Body: body}, nil
+}
+
+func encodeOpen(o *openMessage) []byte {
+	myAS := uint16(asTrans)
+	if o.ASN <= 0xffff {
+		myAS = uint16(o.ASN)
+	}
+
+	// capabilities: ipv4 unicast and four-octet AS number
+	caps := []byte{
+		capMultiprotocol, 4, byte(afiIPv4 >> 8), byte(afiIPv4), 0, safiUnicast,
+		capFourOctetAS, 4, 0, 0, 0, 0,
+	}
+	binary.BigEndian.PutUint32(caps[8:], o.ASN)
+	params := append([]byte{optParamCapabilities, byte(len(caps))}, caps...)
+
+	body := make([]byte, 10, 10+len(params))
+	body[0] = bgpVersion
+	binary.BigEndian.PutUint16(body[1:3], myAS)
+	binary.BigEndian.PutUint16(body[3:5], o.HoldTime)
+	copy(body[5:9], o.RouterID.To4())
+	body[9] = byte(len(params))
+	return append(body, params...)
+}
+
+func decodeOpen(body []byte) (*openMessage, error) {
+	if len(body) < 10 {
+		return nil, fmt.Errorf("bgp: open message too short")
+	}
+	if body[0] != bgpVersion {
+		return nil, fmt.Errorf("bgp: unsupported version %d", body[0])
+	}
+	o := &openMessage{
+		ASN:      uint32(binary.BigEndian.Uint16(body[1:3])),
+		HoldTime: binary.BigEndian.Uint16(body[3:5]),
+		RouterID: net.IP(append([]byte(nil), body[5:9]...)),
+	}
+	params := body[10:]
+	if int(body[9]) != len(params) {
+		return nil, fmt.Errorf("bgp: invalid optional parameters length")
+	}
+	for len(params) >= 2 {
+		typ, l := params[0], int(params[1])
+		if len(params) < 2+l {
+			return nil, fmt.Errorf("bgp: invalid optional parameter")
+		}
+		value := params[2 : 2+l]
+		params = params[2+l:]
+		if typ != optParamCapabilities {
+			continue
+		}
+		for len(value) >= 2 {
+			code, cl := value[0], int(value[1])
+			if len(value) < 2+cl {
+				return nil, fmt.Errorf("bgp: invalid capability")
+			}
+			if code == capFourOctetAS && cl == 4 {
+				o.FourOctetASN = true
+				o.ASN = binary.BigEndian.Uint32(value[2:6])
+			}
+			value = value[2+cl:]
+		}
+	}
+	return o, nil
+}
+
+func encodePrefix(buf []byte, prefix *net.IPNet) []byte {
+	ones, _ := prefix.Mask.Size()
+	buf = append(buf, byte(ones))
+	return append(buf, prefix.IP.To4()[:(ones+7)/8]...)
+}
+
+func decodePrefixes(b []byte) ([]*net.IPNet, error) {
+	prefixes := make([]*net.IPNet, 0)
+	for len(b) > 0 {
+		ones := int(b[0])
+		n := (ones + 7) / 8
+		if ones > 32 || len(b) < 1+n {
+			return nil, fmt.Errorf("bgp: invalid prefix")
+		}
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, b[1:1+n])
+		prefixes = append(prefixes, &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)})
+		b = b[1+n:]
+	}
+	return prefixes, nil
+}
+
+func encodeAttr(buf []byte, typ uint8, value []byte) []byte {
+	return append(append(buf, attrFlagTransitive, typ, byte(len(value))), value...)
+}
+
+// encodeUpdate encodes an UPDATE message, path attributes are only
+// added when there are NLRI to be announced
+func encodeUpdate(u *updateMessage, ibgp, fourOctetASN bool) []byte {
+	withdrawn := make([]byte, 0)
+	for _, prefix := range u.Withdrawn {
+		withdrawn = encodePrefix(withdrawn, prefix)
+	}
+
+	attrs := make([]byte, 0)
+	nlri := make([]byte, 0)
+	if len(u.NLRI) > 0 {
+		attrs = encodeAttr(attrs, attrOrigin, []byte{originIGP})
+
+		asPath := make([]byte, 0)
+		if len(u.ASPath) > 0 {
+			asPath = append(asPath, asPathSegSeq, byte(len(u.ASPath)))
+			for _, asn := range u.ASPath {
+				if fourOctetASN {
+					asPath = append(asPath, byte(asn>>24), byte(asn>>16), byte(asn>>8), byte(asn))
+				} else {
+					asPath = append(asPath, byte(asn>>8), byte(asn))
+				}
+			}
+		}
+		attrs = encodeAttr(attrs, attrASPath, asPath)
+		attrs = encodeAttr(attrs, attrNextHop, u.NextHop.To4())
+		if ibgp {
+			attrs = encodeAttr(attrs, attrLocalPref, []byte{0, 0, 0, defaultLocalPref})
+		}
+		for _, prefix := range u.NLRI {
+			nlri = encodePrefix(nlri, prefix)
+		}
+	}
+
+	body := make([]byte, 0, 4+len(withdrawn)+len(attrs)+len(nlri))
+	body = append(body, byte(len(withdrawn)>>8), byte(len(withdrawn)))
+	body = append(body, withdrawn...)
+	body = append(body, byte(len(attrs)>>8), byte(len(attrs)))
+	body = append(body, attrs...)
+	return append(body, nlri...)
+}
+
+// decodeUpdate decodes the withdrawn routes, NLRI and next hop of an
+// UPDATE message, AS_PATH is decoded with four-octet ASN
+func decodeUpdate(body []byte) (*updateMessage, error) {
+	if len(body) < 4 {
+		return nil, fmt.Errorf("bgp: update message too short")
+	}
+	u := &updateMessage{}
+	wl := int(binary.BigEndian.Uint16(body[:2]))
+	if len(body) < 4+wl {
+		return nil, fmt.Errorf("bgp: invalid withdrawn routes length")
+	}
+	var err error
+	if u.Withdrawn, err = decodePrefixes(body[2 : 2+wl]); err != nil {
+		return nil, err
+	}
+	body = body[2+wl:]
+	al := int(binary.BigEndian.Uint16(body[:2]))
+	if len(body) < 2+al {
+		return nil, fmt.Errorf("bgp: invalid path attributes length")
+	}
+	attrs := body[2 : 2+al]
+	for len(attrs) >= 3 {
+		flags, typ := attrs[0], attrs[1]
+		l, off := int(attrs[2]), 3
+		if flags&0x10 != 0 {
+			// extended length
+			if len(attrs) < 4 {
+				return nil, fmt.Errorf("bgp: invalid path attribute")
+			}
+			l, off = int(binary.BigEndian.Uint16(attrs[2:4])), 4
+		}
+		if len(attrs) < off+l {
+			return nil, fmt.Errorf("bgp: invalid path attribute")
+		}
+		value := attrs[off : off+l]
+		switch typ {
+		case attrNextHop:
+			u.NextHop = net.IP(append([]byte(nil), value...))
+		case attrASPath:
+			for len(value) >= 2 {
+				n := int(value[1])
+				value = value[2:]
+				for i := 0; i < n && len(value) >= 4; i++ {
+					u.ASPath = append(u.ASPath, binary.BigEndian.Uint32(value[:4]))
+					value = value[4:]
+				}
+			}
+		}
+		attrs = attrs[off+l:]
+	}
+	if u.NLRI, err = decodePrefixes(body[2+al:]); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
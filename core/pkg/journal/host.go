@@ -0,0 +1,100 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package journal
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/sysctl"
+	utildbus "k8s.io/kubernetes/pkg/util/dbus"
+	k8sexec "k8s.io/kubernetes/pkg/util/exec"
+	"k8s.io/kubernetes/pkg/util/iptables"
+)
+
+var _ Undoer = &hostUndoer{}
+
+// hostUndoer reverts the mutations on the local host
+type hostUndoer struct {
+	sysctl sysctl.Interface
+	ipt    iptables.Interface
+	exec   k8sexec.Interface
+}
+
+// NewHostUndoer returns an Undoer which reverts the mutations on the
+// local host
+func NewHostUndoer() Undoer {
+	execer := k8sexec.New()
+	return &hostUndoer{
+		sysctl: sysctl.New(),
+		ipt:    iptables.New(execer, utildbus.New(), iptables.ProtocolIpv4),
+		exec:   execer,
+	}
+}
+
+func (h *hostUndoer) SetSysctl(key, value string) error {
+	return h.sysctl.SetSysctl(key, value)
+}
+
+// DeleteChain deletes the jump rule and the chain, it is ok if the chain
+// does not exist
+func (h *hostUndoer) DeleteChain(c Chain) error {
+	table := iptables.Table(c.Table)
+	chain := iptables.Chain(c.Chain)
+	if c.JumpFrom != "" {
+		if err := h.ipt.DeleteRule(table, iptables.Chain(c.JumpFrom), "-j", c.Chain); err != nil && !iptables.IsNotFoundError(err) {
+			return err
+		}
+	}
+	if err := h.ipt.FlushChain(table, chain); err != nil {
+		if iptables.IsNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+	if err := h.ipt.DeleteChain(table, chain); err != nil && !iptables.IsNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+func (h *hostUndoer) RemoveAddress(iface string, addr *net.IPNet) error {
+	if _, err := net.InterfaceByName(iface); err != nil {
+		// the interface is gone, so is the address
+		return nil
+	}
+	return corenet.RemoveAddress(iface, addr)
+}
+
+// DeleteService deletes the fwmark virtual service, it is ok if the
+// service or ipvs does not exist
+func (h *hostUndoer) DeleteService(mark int) error {
+	out, err := h.exec.Command("ipvsadm", "-D", "-f", strconv.Itoa(mark)).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(string(out), "No such service") {
+		return nil
+	}
+	if _, lookErr := h.exec.LookPath("ipvsadm"); lookErr != nil {
+		return nil
+	}
+	return fmt.Errorf("delete ipvs service %d error: %v, %s", mark, err, out)
+}
@@ -0,0 +1,372 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package journal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/sysctl"
+	log "github.com/zoumo/logdog"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+const (
+	// FileName is the name of the journal file in the state dir
+	FileName = "journal.json"
+)
+
+// Chain is an iptables chain created by the provider, JumpFrom is the
+// builtin chain which has a rule jumping to it
+type Chain struct {
+	Table    string `json:"table"`
+	Chain    string `json:"chain"`
+	JumpFrom string `json:"jumpFrom,omitempty"`
+}
+
+// Address is an address bound to an interface by the provider
+type Address struct {
+	Iface string `json:"iface"`
+	CIDR  string `json:"cidr"`
+}
+
+// State is the content of journal
+type State struct {
+	// Sysctls holds the original values of the changed settings
+	Sysctls   map[string]string `json:"sysctls,omitempty"`
+	Chains    []Chain           `json:"chains,omitempty"`
+	Addresses []Address         `json:"addresses,omitempty"`
+	// Services holds the fwmarks of ipvs virtual services
+	Services []int `json:"services,omitempty"`
+}
+
+// Empty returns true if nothing is recorded
+func (s State) Empty() bool {
+	return len(s.Sysctls) == 0 && len(s.Chains) == 0 && len(s.Addresses) == 0 && len(s.Services) == 0
+}
+
+// Undoer reverts the host mutations
+type Undoer interface {
+	SetSysctl(key, value string) error
+	DeleteChain(chain Chain) error
+	RemoveAddress(iface string, addr *net.IPNet) error
+	DeleteService(mark int) error
+}
+
+// Journal records every host mutation of provider in a file, which
+// should be on a hostPath, so that the mutations can be reverted after
+// the provider crashed or the node rebooted. Every mutation must be
+// recorded before it is applied.
+type Journal struct {
+	path   string
+	sysctl sysctl.Interface
+
+	mu    sync.Mutex
+	state State
+}
+
+// Open loads the journal in dir, the journal is kept in memory only if
+// dir is empty
+func Open(dir string) (*Journal, error) {
+	j := &Journal{
+		sysctl: sysctl.New(),
+	}
+	if dir == "" {
+		return j, nil
+	}
+
+	j.path = filepath.Join(dir, FileName)
+	data, err := ioutil.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &j.state); err != nil {
+		// a corrupted journal can not be replayed, start over
+		log.Error("Error decode journal, discard it", log.Fields{"file": j.path, "err": err})
+		j.state = State{}
+	}
+	return j, nil
+}
+
+// Cleanup reverts all the mutations recorded in the journal in dir on
+// the local host
+func Cleanup(dir string) error {
+	j, err := Open(dir)
+	if err != nil {
+		return err
+	}
+	return j.Undo(NewHostUndoer())
+}
+
+// State returns a copy of recorded state
+func (j *Journal) State() State {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.copyState()
+}
+
+// ModifySysctl records the original values of settings and then changes
+// them transactionally. The first recorded original value is kept, so the
+// values changed by the previous run are never taken as original.
+func (j *Journal) ModifySysctl(settings []sysctl.Setting) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	changes, err := sysctl.Diff(j.sysctl, settings)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	recorded := false
+	for _, c := range changes {
+		if _, ok := j.state.Sysctls[c.Key]; ok {
+			continue
+		}
+		if j.state.Sysctls == nil {
+			j.state.Sysctls = make(map[string]string)
+		}
+		j.state.Sysctls[c.Key] = c.Old
+		recorded = true
+	}
+	if recorded {
+		if err := j.save(); err != nil {
+			return err
+		}
+	}
+
+	return sysctl.Commit(j.sysctl, changes)
+}
+
+// ResetSysctl restores the original values of the given settings and
+// forgets them, the ones which no longer exist are just forgotten
+func (j *Journal) ResetSysctl(settings []sysctl.Setting) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	restore := make([]sysctl.Setting, 0, len(settings))
+	for _, s := range settings {
+		if v, ok := j.state.Sysctls[s.Key]; ok {
+			restore = append(restore, sysctl.Setting{Key: s.Key, Value: v, Optional: true})
+		}
+	}
+	if len(restore) == 0 {
+		return nil
+	}
+	if _, err := sysctl.Apply(j.sysctl, restore); err != nil {
+		return err
+	}
+	for _, s := range restore {
+		delete(j.state.Sysctls, s.Key)
+	}
+	return j.save()
+}
+
+// RecordChain records an iptables chain
+func (j *Journal) RecordChain(chain Chain) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range j.state.Chains {
+		if c == chain {
+			return nil
+		}
+	}
+	j.state.Chains = append(j.state.Chains, chain)
+	return j.save()
+}
+
+// ForgetChain forgets an iptables chain after it is deleted
+func (j *Journal) ForgetChain(chain Chain) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	chains := j.state.Chains[:0]
+	for _, c := range j.state.Chains {
+		if c != chain {
+			chains = append(chains, c)
+		}
+	}
+	j.state.Chains = chains
+	return j.save()
+}
+
+// RecordAddress records an address bound to iface
+func (j *Journal) RecordAddress(iface string, addr *net.IPNet) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	a := Address{Iface: iface, CIDR: addr.String()}
+	for _, c := range j.state.Addresses {
+		if c == a {
+			return nil
+		}
+	}
+	j.state.Addresses = append(j.state.Addresses, a)
+	return j.save()
+}
+
+// ForgetAddress forgets an address after it is removed
+func (j *Journal) ForgetAddress(iface string, addr *net.IPNet) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	a := Address{Iface: iface, CIDR: addr.String()}
+	addrs := j.state.Addresses[:0]
+	for _, c := range j.state.Addresses {
+		if c != a {
+			addrs = append(addrs, c)
+		}
+	}
+	j.state.Addresses = addrs
+	return j.save()
+}
+
+// RecordService records an ipvs fwmark virtual service
+func (j *Journal) RecordService(mark int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, m := range j.state.Services {
+		if m == mark {
+			return nil
+		}
+	}
+	j.state.Services = append(j.state.Services, mark)
+	return j.save()
+}
+
+// ForgetService forgets an ipvs fwmark virtual service
+func (j *Journal) ForgetService(mark int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	marks := j.state.Services[:0]
+	for _, m := range j.state.Services {
+		if m != mark {
+			marks = append(marks, m)
+		}
+	}
+	j.state.Services = marks
+	return j.save()
+}
+
+// Undo reverts all the recorded mutations in the reverse order of
+// applying: ipvs services, addresses, iptables chains and then sysctls.
+// The journal is cleared even if some of them fail, because the leftovers
+// are usually gone, e.g. the chains are flushed by a reboot.
+func (j *Journal) Undo(u Undoer) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.state.Empty() {
+		return nil
+	}
+	log.Info("Undo host mutations in journal", log.Fields{"file": j.path, "state": j.state})
+
+	var errs []error
+	for _, mark := range j.state.Services {
+		if err := u.DeleteService(mark); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, a := range j.state.Addresses {
+		ip, ipnet, err := net.ParseCIDR(a.CIDR)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		ipnet.IP = ip
+		if err := u.RemoveAddress(a.Iface, ipnet); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, c := range j.state.Chains {
+		if err := u.DeleteChain(c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for k, v := range j.state.Sysctls {
+		if err := u.SetSysctl(k, v); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	j.state = State{}
+	if err := j.save(); err != nil {
+		errs = append(errs, err)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func (j *Journal) copyState() State {
+	s := State{
+		Chains:    append([]Chain(nil), j.state.Chains...),
+		Addresses: append([]Address(nil), j.state.Addresses...),
+		Services:  append([]int(nil), j.state.Services...),
+	}
+	if j.state.Sysctls != nil {
+		s.Sysctls = make(map[string]string, len(j.state.Sysctls))
+		for k, v := range j.state.Sysctls {
+			s.Sysctls[k] = v
+		}
+	}
+	return s
+}
+
+// save writes the journal atomically, the journal file is removed when
+// nothing is recorded
+func (j *Journal) save() error {
+	if j.path == "" {
+		return nil
+	}
+	if j.state.Empty() {
+		if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(j.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	// the journal must survive a power failure
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package journal
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/sysctl"
+	sysctltesting "github.com/caicloud/loadbalancer-provider/core/pkg/sysctl/testing"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeUndoer struct {
+	sysctl    *sysctltesting.Fake
+	chains    []Chain
+	addresses []string
+	services  []int
+}
+
+func (f *fakeUndoer) SetSysctl(key, value string) error {
+	return f.sysctl.SetSysctl(key, value)
+}
+
+func (f *fakeUndoer) DeleteChain(chain Chain) error {
+	f.chains = append(f.chains, chain)
+	return nil
+}
+
+func (f *fakeUndoer) RemoveAddress(iface string, addr *net.IPNet) error {
+	f.addresses = append(f.addresses, iface+"/"+addr.String())
+	return nil
+}
+
+func (f *fakeUndoer) DeleteService(mark int) error {
+	f.services = append(f.services, mark)
+	return nil
+}
+
+func open(t *testing.T, dir string, sys *sysctltesting.Fake) *Journal {
+	j, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.sysctl = sys
+	return j
+}
+
+func TestJournalReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sys := sysctltesting.NewFake(map[string]string{"net.core.somaxconn": "128"})
+	adjustments := sysctl.Settings(map[string]string{"net.core.somaxconn": "2048"})
+
+	j := open(t, dir, sys)
+	assert.NoError(t, j.ModifySysctl(adjustments))
+	assert.Equal(t, "2048", sys.Values()["net.core.somaxconn"])
+
+	chain := Chain{Table: "raw", Chain: "TEST", JumpFrom: "PREROUTING"}
+	assert.NoError(t, j.RecordChain(chain))
+	assert.NoError(t, j.RecordChain(chain))
+	_, vip, _ := net.ParseCIDR("10.0.0.1/32")
+	assert.NoError(t, j.RecordAddress("lo", vip))
+	assert.NoError(t, j.RecordService(1))
+
+	// the provider crashed, the modified value must not be taken as original
+	j = open(t, dir, sys)
+	assert.NoError(t, j.ModifySysctl(adjustments))
+	state := j.State()
+	assert.Equal(t, map[string]string{"net.core.somaxconn": "128"}, state.Sysctls)
+	assert.Equal(t, []Chain{chain}, state.Chains)
+	assert.Equal(t, []Address{{Iface: "lo", CIDR: "10.0.0.1/32"}}, state.Addresses)
+	assert.Equal(t, []int{1}, state.Services)
+
+	u := &fakeUndoer{sysctl: sys}
+	assert.NoError(t, j.Undo(u))
+	assert.Equal(t, "128", sys.Values()["net.core.somaxconn"])
+	assert.Equal(t, []Chain{chain}, u.chains)
+	assert.Equal(t, []string{"lo/10.0.0.1/32"}, u.addresses)
+	assert.Equal(t, []int{1}, u.services)
+
+	_, err = os.Stat(filepath.Join(dir, FileName))
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, open(t, dir, sys).State().Empty())
+}
+
+func TestJournalForget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sys := sysctltesting.NewFake(map[string]string{"a": "0", "b": "0"})
+	j := open(t, dir, sys)
+	assert.NoError(t, j.ModifySysctl(sysctl.Settings(map[string]string{"a": "1", "b": "1", "c": "1"}, "c")))
+	assert.NoError(t, j.ResetSysctl(sysctl.Settings(map[string]string{"a": "1"})))
+	assert.Equal(t, map[string]string{"a": "0", "b": "1"}, sys.Values())
+
+	_, vip, _ := net.ParseCIDR("10.0.0.1/32")
+	assert.NoError(t, j.RecordAddress("lo", vip))
+	assert.NoError(t, j.ForgetAddress("lo", vip))
+	chain := Chain{Table: "raw", Chain: "TEST"}
+	assert.NoError(t, j.RecordChain(chain))
+	assert.NoError(t, j.ForgetChain(chain))
+	assert.NoError(t, j.RecordService(1))
+	assert.NoError(t, j.ForgetService(1))
+
+	state := open(t, dir, sys).State()
+	assert.Equal(t, map[string]string{"b": "0"}, state.Sysctls)
+	assert.Empty(t, state.Chains)
+	assert.Empty(t, state.Addresses)
+	assert.Empty(t, state.Services)
+}
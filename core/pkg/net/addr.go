@@ -14,27 +14,22 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package arp
+package net
 
-import "testing"
+import (
+	"fmt"
+	"net"
+)
 
-func Test_loadCache(t *testing.T) {
-	tests := []struct {
-		name    string
-		want    Caches
-		wantErr bool
-	}{
-		{
-			"loadcache", nil, false,
-		},
+// HostNet returns the single host network of the ip, /32 for ipv4 and
+// /128 for ipv6
+func HostNet(ip string) (*net.IPNet, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid ip address %q", ip)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			_, err := loadCache()
-			if (err != nil) != tt.wantErr {
-				t.Errorf("loadCache() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-		})
+	if v4 := addr.To4(); v4 != nil {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
 	}
+	return &net.IPNet{IP: addr, Mask: net.CIDRMask(128, 128)}, nil
 }
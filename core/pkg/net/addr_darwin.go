@@ -14,27 +14,22 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-package arp
+package net
 
-import "testing"
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
 
-func Test_loadCache(t *testing.T) {
-	tests := []struct {
-		name    string
-		want    Caches
-		wantErr bool
-	}{
-		{
-			"loadcache", nil, false,
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			_, err := loadCache()
-			if (err != nil) != tt.wantErr {
-				t.Errorf("loadCache() error = %v, wantErr %v", err, tt.wantErr)
-				return
-			}
-		})
-	}
+// EnsureAddress adds the address to the net interface, it is only
+// supported on linux
+func EnsureAddress(iface string, addr *net.IPNet) error {
+	return fmt.Errorf("not support on os: %s", runtime.GOOS)
+}
+
+// RemoveAddress removes the address from the net interface, it is only
+// supported on linux
+func RemoveAddress(iface string, addr *net.IPNet) error {
+	return fmt.Errorf("not support on os: %s", runtime.GOOS)
 }
@@ -0,0 +1,165 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var nativeEndian = func() binary.ByteOrder {
+	var x uint16 = 1
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// EnsureAddress adds the address to the net interface, it is a no-op if
+// the address already exists. The ipv6 address is added with nodad flag,
+// the VIP is shared by nodes and must not fail duplicate address detection.
+func EnsureAddress(iface string, addr *net.IPNet) error {
+	dev, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	req, err := addrRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, dev, addr)
+	if err != nil {
+		return err
+	}
+	err = netlinkExec(req)
+	if err == syscall.EEXIST {
+		return nil
+	}
+	if err != nil {
+		return os.NewSyscallError(fmt.Sprintf("add address %v to %v", addr, iface), err)
+	}
+	return nil
+}
+
+// RemoveAddress removes the address from the net interface, it is a
+// no-op if the address does not exist
+func RemoveAddress(iface string, addr *net.IPNet) error {
+	dev, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	req, err := addrRequest(syscall.RTM_DELADDR, 0, dev, addr)
+	if err != nil {
+		return err
+	}
+	err = netlinkExec(req)
+	if err == syscall.EADDRNOTAVAIL || err == syscall.ENOENT {
+		return nil
+	}
+	if err != nil {
+		return os.NewSyscallError(fmt.Sprintf("remove address %v from %v", addr, iface), err)
+	}
+	return nil
+}
+
+// addrRequest builds the netlink message to add or delete the address
+func addrRequest(typ uint16, flags uint16, dev *net.Interface, addr *net.IPNet) ([]byte, error) {
+	family := syscall.AF_INET
+	ip := addr.IP.To4()
+	if ip == nil {
+		family = syscall.AF_INET6
+		ip = addr.IP.To16()
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip address %v", addr.IP)
+	}
+	prefixlen, _ := addr.Mask.Size()
+
+	body := make([]byte, syscall.SizeofIfAddrmsg)
+	body[0] = byte(family)
+	body[1] = byte(prefixlen)
+	if family == syscall.AF_INET6 {
+		body[2] = syscall.IFA_F_NODAD
+	}
+	nativeEndian.PutUint32(body[4:8], uint32(dev.Index))
+	body = appendAttr(body, syscall.IFA_LOCAL, ip)
+	body = appendAttr(body, syscall.IFA_ADDRESS, ip)
+
+	msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(body))
+	nativeEndian.PutUint32(msg[0:4], uint32(syscall.NLMSG_HDRLEN+len(body)))
+	nativeEndian.PutUint16(msg[4:6], typ)
+	nativeEndian.PutUint16(msg[6:8], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags)
+	nativeEndian.PutUint32(msg[8:12], 1)
+	return append(msg, body...), nil
+}
+
+func appendAttr(b []byte, typ uint16, value []byte) []byte {
+	l := syscall.SizeofRtAttr + len(value)
+	attr := make([]byte, syscall.SizeofRtAttr, rtaAlign(l))
+	nativeEndian.PutUint16(attr[0:2], uint16(l))
+	nativeEndian.PutUint16(attr[2:4], typ)
+	attr = append(attr, value...)
+	for len(attr) < rtaAlign(l) {
+		attr = append(attr, 0)
+	}
+	return append(b, attr...)
+}
+
+func rtaAlign(l int) int {
+	return (l + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+}
+
+// netlinkExec sends the request and waits for the ack, the errno in the
+// ack is returned
+func netlinkExec(req []byte) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	if err := syscall.Sendto(fd, req, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return fmt.Errorf("invalid netlink ack")
+			}
+			if errno := int32(nativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package net
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestAddrRequest(t *testing.T) {
+	dev := &net.Interface{Index: 2, Name: "eth0"}
+	for _, ip := range []string{"192.168.99.200", "fd00::1"} {
+		addr, _ := HostNet(ip)
+		req, err := addrRequest(syscall.RTM_NEWADDR, 0, dev, addr)
+		if err != nil {
+			t.Fatalf("build request error: %v", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(req)
+		if err != nil {
+			t.Fatalf("parse request error: %v", err)
+		}
+		ifa := (*syscall.IfAddrmsg)(unsafe.Pointer(&msgs[0].Data[0]))
+		if int(ifa.Index) != dev.Index {
+			t.Errorf("unexpected index %d", ifa.Index)
+		}
+		// the VIP is shared by nodes, duplicate address detection is skipped
+		if nodad := ifa.Flags&syscall.IFA_F_NODAD != 0; nodad != (addr.IP.To4() == nil) {
+			t.Errorf("unexpected flags %x of %v", ifa.Flags, ip)
+		}
+		msgs[0].Header.Type = syscall.RTM_NEWADDR
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msgs[0])
+		if err != nil {
+			t.Fatalf("parse attributes error: %v", err)
+		}
+		// no label is set, the addresses are tracked by journal
+		if len(attrs) != 2 {
+			t.Errorf("unexpected attributes %v of %v", attrs, ip)
+		}
+		for _, attr := range attrs {
+			if !net.IP(attr.Value).Equal(addr.IP) {
+				t.Errorf("unexpected address %v of %v", net.IP(attr.Value), ip)
+			}
+		}
+	}
+}
+
+// TestAddressLifecycle changes the addresses of lo, it is skipped if
+// the privilege is not enough
+func TestAddressLifecycle(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	lo, err := InterfaceByLoopback()
+	if err != nil {
+		t.Skip("no loopback interface")
+	}
+	addr, _ := HostNet("127.100.100.100")
+
+	if err := EnsureAddress(lo.Name, addr); err != nil {
+		if err.(*os.SyscallError).Err == syscall.EPERM {
+			t.Skip("not permitted")
+		}
+		t.Fatalf("ensure address error: %v", err)
+	}
+	defer RemoveAddress(lo.Name, addr)
+
+	// idempotent
+	if err := EnsureAddress(lo.Name, addr); err != nil {
+		t.Errorf("ensure address again error: %v", err)
+	}
+	if !hasAddress(lo.Name, addr) {
+		t.Errorf("address %v is not added", addr)
+	}
+
+	if err := RemoveAddress(lo.Name, addr); err != nil {
+		t.Errorf("remove address error: %v", err)
+	}
+	if err := RemoveAddress(lo.Name, addr); err != nil {
+		t.Errorf("remove address again error: %v", err)
+	}
+	if hasAddress(lo.Name, addr) {
+		t.Errorf("address %v is not removed", addr)
+	}
+}
+
+func hasAddress(iface string, addr *net.IPNet) bool {
+	dev, err := net.InterfaceByName(iface)
+	if err != nil {
+		return false
+	}
+	addrs, _ := dev.Addrs()
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.String() == addr.String() {
+			return true
+		}
+	}
+	return false
+}
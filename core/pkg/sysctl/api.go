@@ -16,21 +16,156 @@ limitations under the License.
 
 package sysctl
 
-// BulkModify changes the settings according to the given sysctlAdjustments,
-// returns the original value and error
-func BulkModify(sysctlAdjustments map[string]string) (originalSysctl map[string]string, err error) {
-	originalSysctl = make(map[string]string)
-	sys := New()
-	for k, v := range sysctlAdjustments {
-		defVar, err := sys.GetSysctl(k)
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/zoumo/logdog"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+// Setting is the desired value of a sysctl
+type Setting struct {
+	Key   string
+	Value string
+	// Optional settings are skipped with a warning if the key does not
+	// exist on the kernel, e.g. net.ipv4.vs.* before ip_vs is loaded
+	Optional bool
+}
+
+// Change is a sysctl whose value differs from the desired one
+type Change struct {
+	Key string
+	Old string
+	New string
+}
+
+// Settings converts the adjustments to settings sorted by key, the keys
+// in optional are marked optional
+func Settings(adjustments map[string]string, optional ...string) []Setting {
+	opt := make(map[string]bool, len(optional))
+	for _, k := range optional {
+		opt[k] = true
+	}
+	settings := make([]Setting, 0, len(adjustments))
+	for k, v := range adjustments {
+		settings = append(settings, Setting{Key: k, Value: v, Optional: opt[k]})
+	}
+	sort.Slice(settings, func(i, j int) bool {
+		return settings[i].Key < settings[j].Key
+	})
+	return settings
+}
+
+// Diff validates all the settings and returns the changes needed to
+// apply them in order, nothing is modified.
+func Diff(sys Interface, settings []Setting) ([]Change, error) {
+	var errs []error
+	seen := make(map[string]bool, len(settings))
+	changes := make([]Change, 0, len(settings))
+
+	for _, s := range settings {
+		if err := validate(s); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if seen[s.Key] {
+			errs = append(errs, fmt.Errorf("duplicate sysctl %v", s.Key))
+			continue
+		}
+		seen[s.Key] = true
+
+		cur, err := sys.GetSysctl(s.Key)
+		if os.IsNotExist(err) && s.Optional {
+			log.Warn("skip optional sysctl which does not exist", log.Fields{"key": s.Key})
+			continue
+		}
 		if err != nil {
-			return originalSysctl, err
+			errs = append(errs, fmt.Errorf("read sysctl %v error: %v", s.Key, err))
+			continue
 		}
-		originalSysctl[k] = defVar
+		if normalize(cur) == normalize(s.Value) {
+			continue
+		}
+		changes = append(changes, Change{Key: s.Key, Old: cur, New: s.Value})
+	}
+
+	if len(errs) > 0 {
+		return nil, utilerrors.NewAggregate(errs)
+	}
+	return changes, nil
+}
 
-		if err := sys.SetSysctl(k, v); err != nil {
-			return originalSysctl, err
+// Commit applies the changes in order, if any of them fails, the applied
+// ones are rolled back in reverse order.
+func Commit(sys Interface, changes []Change) error {
+	for i, c := range changes {
+		err := sys.SetSysctl(c.Key, c.New)
+		if err == nil {
+			continue
 		}
+		err = fmt.Errorf("write sysctl %v=%q error: %v", c.Key, c.New, err)
+		if rerr := Rollback(sys, changes[:i]); rerr != nil {
+			return utilerrors.NewAggregate([]error{err, rerr})
+		}
+		return err
+	}
+	return nil
+}
+
+// Apply validates all the settings firstly and then applies the changes
+// transactionally, it returns the applied changes.
+func Apply(sys Interface, settings []Setting) ([]Change, error) {
+	changes, err := Diff(sys, settings)
+	if err != nil {
+		return nil, err
+	}
+	if err := Commit(sys, changes); err != nil {
+		return nil, err
 	}
-	return originalSysctl, nil
+	return changes, nil
+}
+
+// Rollback reverts the changes in reverse order
+func Rollback(sys Interface, changes []Change) error {
+	var errs []error
+	for i := len(changes) - 1; i >= 0; i-- {
+		c := changes[i]
+		if err := sys.SetSysctl(c.Key, c.Old); err != nil {
+			errs = append(errs, fmt.Errorf("rollback sysctl %v=%q error: %v", c.Key, c.Old, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// BulkModify changes the settings according to the given sysctlAdjustments
+// transactionally, returns the original values of the changed settings and error
+func BulkModify(sysctlAdjustments map[string]string) (originalSysctl map[string]string, err error) {
+	originalSysctl = make(map[string]string)
+	changes, err := Apply(New(), Settings(sysctlAdjustments))
+	for _, c := range changes {
+		originalSysctl[c.Key] = c.Old
+	}
+	return originalSysctl, err
+}
+
+func validate(s Setting) error {
+	if s.Key == "" {
+		return fmt.Errorf("empty sysctl key")
+	}
+	if strings.HasPrefix(s.Key, "/") || strings.Contains(s.Key, "..") {
+		return fmt.Errorf("invalid sysctl key %q", s.Key)
+	}
+	if strings.TrimSpace(s.Value) == "" || strings.ContainsAny(s.Value, "\n\r") {
+		return fmt.Errorf("invalid value %q of sysctl %v", s.Value, s.Key)
+	}
+	return nil
+}
+
+// normalize collapses the whitespaces, e.g. ip_local_port_range is
+// printed as "10240\t65000" by kernel
+func normalize(v string) string {
+	return strings.Join(strings.Fields(v), " ")
 }
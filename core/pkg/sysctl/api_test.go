@@ -0,0 +1,129 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sysctl
+
+import (
+	"errors"
+	"testing"
+
+	sysctltesting "github.com/caicloud/loadbalancer-provider/core/pkg/sysctl/testing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApply(t *testing.T) {
+	initial := map[string]string{
+		"net.core.somaxconn":           "128",
+		"net.ipv4.ip_local_port_range": "32768\t60999",
+		"net.ipv4.tcp_fin_timeout":     "60",
+	}
+	tests := []struct {
+		name     string
+		settings []Setting
+		errors   map[string]error
+		want     map[string]string
+		writes   []string
+		wantErr  bool
+	}{
+		{
+			name: "ordered apply and skip unchanged",
+			settings: Settings(map[string]string{
+				"net.ipv4.tcp_fin_timeout":     "30",
+				"net.core.somaxconn":           "2048",
+				"net.ipv4.ip_local_port_range": "32768 60999",
+			}),
+			want: map[string]string{
+				"net.core.somaxconn":           "2048",
+				"net.ipv4.ip_local_port_range": "32768\t60999",
+				"net.ipv4.tcp_fin_timeout":     "30",
+			},
+			writes: []string{"net.core.somaxconn", "net.ipv4.tcp_fin_timeout"},
+		},
+		{
+			name: "skip missing optional key",
+			settings: Settings(map[string]string{
+				"net.core.somaxconn":    "2048",
+				"net.ipv4.vs.conntrack": "1",
+			}, "net.ipv4.vs.conntrack"),
+			want: map[string]string{
+				"net.core.somaxconn":           "2048",
+				"net.ipv4.ip_local_port_range": "32768\t60999",
+				"net.ipv4.tcp_fin_timeout":     "60",
+			},
+			writes: []string{"net.core.somaxconn"},
+		},
+		{
+			name: "missing required key fails before writing",
+			settings: Settings(map[string]string{
+				"net.core.somaxconn":    "2048",
+				"net.ipv4.vs.conntrack": "1",
+			}),
+			want:    initial,
+			wantErr: true,
+		},
+		{
+			name: "invalid settings",
+			settings: []Setting{
+				{Key: "net.core.somaxconn", Value: "2048"},
+				{Key: "net.core.somaxconn", Value: "4096"},
+				{Key: "../../etc/passwd", Value: "1"},
+				{Key: "net.ipv4.tcp_fin_timeout", Value: " "},
+			},
+			want:    initial,
+			wantErr: true,
+		},
+		{
+			name: "rollback on partial failure",
+			settings: Settings(map[string]string{
+				"net.core.somaxconn":       "2048",
+				"net.ipv4.tcp_fin_timeout": "30",
+			}),
+			errors:  map[string]error{"net.ipv4.tcp_fin_timeout": errors.New("permission denied")},
+			want:    initial,
+			writes:  []string{"net.core.somaxconn", "net.core.somaxconn"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		fake := sysctltesting.NewFake(initial)
+		for k, err := range tt.errors {
+			fake.Errors[k] = err
+		}
+		_, err := Apply(fake, tt.settings)
+		if tt.wantErr {
+			assert.NotNil(t, err, tt.name)
+		} else {
+			assert.Nil(t, err, tt.name)
+		}
+		assert.Equal(t, tt.want, fake.Values(), tt.name)
+		assert.Equal(t, tt.writes, fake.Writes, tt.name)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	fake := sysctltesting.NewFake(map[string]string{
+		"net.core.somaxconn":       "128",
+		"net.ipv4.tcp_fin_timeout": "30",
+	})
+	changes, err := Diff(fake, Settings(map[string]string{
+		"net.core.somaxconn":       "2048",
+		"net.ipv4.tcp_fin_timeout": "30",
+	}))
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{{Key: "net.core.somaxconn", Old: "128", New: "2048"}}, changes)
+	assert.Empty(t, fake.Writes)
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"os"
+	"sync"
+)
+
+// Fake is an in-memory sysctl.Interface for unit tests. Like the kernel,
+// it fails to read or write the keys which do not exist.
+type Fake struct {
+	mu     sync.Mutex
+	values map[string]string
+	// Errors makes SetSysctl of the keys fail
+	Errors map[string]error
+	// Writes records the keys written in order
+	Writes []string
+}
+
+// NewFake returns a Fake with the given existing values
+func NewFake(values map[string]string) *Fake {
+	f := &Fake{
+		values: make(map[string]string, len(values)),
+		Errors: make(map[string]error),
+	}
+	for k, v := range values {
+		f.values[k] = v
+	}
+	return f
+}
+
+// GetSysctl returns the value for the specified sysctl setting
+func (f *Fake) GetSysctl(sysctl string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.values[sysctl]
+	if !ok {
+		return "", &os.PathError{Op: "open", Path: sysctl, Err: os.ErrNotExist}
+	}
+	return v, nil
+}
+
+// SetSysctl modifies the specified sysctl flag to the new value
+func (f *Fake) SetSysctl(sysctl string, newVal string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.Errors[sysctl]; err != nil {
+		return err
+	}
+	if _, ok := f.values[sysctl]; !ok {
+		return &os.PathError{Op: "open", Path: sysctl, Err: os.ErrNotExist}
+	}
+	f.values[sysctl] = newVal
+	f.Writes = append(f.Writes, sysctl)
+	return nil
+}
+
+// Values returns a copy of all the values
+func (f *Fake) Values() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	values := make(map[string]string, len(f.values))
+	for k, v := range f.values {
+		values[k] = v
+	}
+	return values
+}
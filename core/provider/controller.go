@@ -19,6 +19,7 @@ package provider
 import (
 	"fmt"
 	"reflect"
+	"strings"
 	"sync"
 
 	"github.com/caicloud/clientset/informers"
@@ -66,7 +67,9 @@ func NewLoadBalancerProvider(cfg *Configuration) *GenericProvider {
 		DeleteFunc: gp.deleteLoadBalancer,
 	})
 	cminformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    gp.addConfigMap,
 		UpdateFunc: gp.updateConfigMap,
+		DeleteFunc: gp.deleteConfigMap,
 	})
 
 	// sync nodes
@@ -87,6 +90,13 @@ func NewLoadBalancerProvider(cfg *Configuration) *GenericProvider {
 	gp.queue = syncqueue.NewSyncQueue(&lbapi.LoadBalancer{}, gp.syncLoadBalancer)
 	gp.lbLister = lbinformer.Lister()
 
+	if resyncer, ok := gp.cfg.Backend.(Resyncer); ok {
+		resyncer.SetResyncFunc(gp.resync)
+	}
+	if setter, ok := gp.cfg.Backend.(EventRecorderSetter); ok {
+		setter.SetEventRecorder(NewEventRecorder(cfg.KubeClient, cfg.Backend.Info().Name))
+	}
+
 	return gp
 }
 
@@ -167,8 +177,10 @@ func (p *GenericProvider) updateLoadBalancer(oldObj, curObj interface{}) {
 		return
 	}
 
-	// ignore change of status
+	// ignore change of status, annotations are checked because some
+	// providers read their extra options from them
 	if reflect.DeepEqual(old.Spec, cur.Spec) &&
+		reflect.DeepEqual(specAnnotations(old.Annotations), specAnnotations(cur.Annotations)) &&
 		reflect.DeepEqual(old.Finalizers, cur.Finalizers) &&
 		reflect.DeepEqual(old.DeletionTimestamp, cur.DeletionTimestamp) {
 		return
@@ -180,6 +192,17 @@ func (p *GenericProvider) updateLoadBalancer(oldObj, curObj interface{}) {
 
 }
 
+// specAnnotations returns the annotations except the status ones
+func specAnnotations(annotations map[string]string) map[string]string {
+	spec := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		if !strings.HasPrefix(k, StatusAnnotationPrefix) {
+			spec[k] = v
+		}
+	}
+	return spec
+}
+
 func (p *GenericProvider) deleteLoadBalancer(obj interface{}) {
 	lb, ok := obj.(*lbapi.LoadBalancer)
 
@@ -205,6 +228,36 @@ func (p *GenericProvider) deleteLoadBalancer(obj interface{}) {
 	p.queue.Enqueue(lb)
 }
 
+// addConfigMap resyncs the loadbalancer when an extra configmap is
+// created, the tcp and udp configmaps are created with the loadbalancer
+func (p *GenericProvider) addConfigMap(obj interface{}) {
+	cm := obj.(*v1.ConfigMap)
+	if !p.isExtraConfigMap(cm) {
+		return
+	}
+	p.resync()
+}
+
+func (p *GenericProvider) deleteConfigMap(obj interface{}) {
+	cm, ok := obj.(*v1.ConfigMap)
+	if !ok {
+		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("Couldn't get object from tombstone %#v", obj))
+			return
+		}
+		cm, ok = tombstone.Obj.(*v1.ConfigMap)
+		if !ok {
+			utilruntime.HandleError(fmt.Errorf("Tombstone contained object that is not a ConfigMap %#v", obj))
+			return
+		}
+	}
+	if !p.isExtraConfigMap(cm) {
+		return
+	}
+	p.resync()
+}
+
 func (p *GenericProvider) updateConfigMap(oldObj, curObj interface{}) {
 	old := oldObj.(*v1.ConfigMap)
 	cur := curObj.(*v1.ConfigMap)
@@ -225,8 +278,12 @@ func (p *GenericProvider) updateConfigMap(oldObj, curObj interface{}) {
 		return
 	}
 
-	p.queue.Enqueue(cache.ExplicitKey(p.cfg.LoadBalancerNamespace + "/" + p.cfg.LoadBalancerName))
+	p.resync()
+}
 
+// resync enqueues the loadbalancer
+func (p *GenericProvider) resync() {
+	p.queue.Enqueue(cache.ExplicitKey(p.cfg.LoadBalancerNamespace + "/" + p.cfg.LoadBalancerName))
 }
 
 func (p *GenericProvider) filterLoadBalancer(lb *lbapi.LoadBalancer) bool {
@@ -238,10 +295,25 @@ func (p *GenericProvider) filterLoadBalancer(lb *lbapi.LoadBalancer) bool {
 }
 
 func (p *GenericProvider) filterConfigMap(cm *v1.ConfigMap) bool {
-	if cm.Namespace == p.cfg.LoadBalancerNamespace && (cm.Name == p.cfg.TCPConfigMap || cm.Name == p.cfg.UDPConfigMap) {
+	if cm.Namespace != p.cfg.LoadBalancerNamespace {
+		return true
+	}
+	if cm.Name == p.cfg.TCPConfigMap || cm.Name == p.cfg.UDPConfigMap {
 		return false
 	}
-	return true
+	return !p.isExtraConfigMap(cm)
+}
+
+func (p *GenericProvider) isExtraConfigMap(cm *v1.ConfigMap) bool {
+	if cm.Namespace != p.cfg.LoadBalancerNamespace {
+		return false
+	}
+	for _, name := range p.cfg.ExtraConfigMaps {
+		if cm.Name == name {
+			return true
+		}
+	}
+	return false
 }
 
 func (p *GenericProvider) syncLoadBalancer(obj interface{}) error {
@@ -0,0 +1,110 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/caicloud/clientset/kubernetes"
+	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+	log "github.com/zoumo/logdog"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// the same event is recorded at most once in eventDedupInterval
+	eventDedupInterval = 10 * time.Minute
+)
+
+// EventRecorder records events of loadbalancer
+type EventRecorder interface {
+	// Event records an event of lb, eventType is v1.EventTypeNormal or
+	// v1.EventTypeWarning
+	Event(lb *lbapi.LoadBalancer, eventType, reason, message string)
+}
+
+// EventRecorderSetter is an optional interface of Provider, the provider
+// reports the problems of loadbalancer by the given recorder
+type EventRecorderSetter interface {
+	SetEventRecorder(EventRecorder)
+}
+
+type eventRecorder struct {
+	client kubernetes.Interface
+	source v1.EventSource
+
+	mu       sync.Mutex
+	recorded map[string]time.Time
+}
+
+// NewEventRecorder returns an EventRecorder which creates events by client
+func NewEventRecorder(client kubernetes.Interface, component string) EventRecorder {
+	host, _ := os.Hostname()
+	return &eventRecorder{
+		client:   client,
+		source:   v1.EventSource{Component: component, Host: host},
+		recorded: make(map[string]time.Time),
+	}
+}
+
+func (r *eventRecorder) Event(lb *lbapi.LoadBalancer, eventType, reason, message string) {
+	key := fmt.Sprintf("%s/%s/%s/%s/%s", lb.Namespace, lb.Name, eventType, reason, message)
+	now := time.Now()
+
+	r.mu.Lock()
+	for k, t := range r.recorded {
+		if now.Sub(t) > eventDedupInterval {
+			delete(r.recorded, k)
+		}
+	}
+	if _, ok := r.recorded[key]; ok {
+		r.mu.Unlock()
+		return
+	}
+	r.recorded[key] = now
+	r.mu.Unlock()
+
+	timestamp := metav1.NewTime(now)
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", lb.Name, now.UnixNano()),
+			Namespace: lb.Namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:            "LoadBalancer",
+			APIVersion:      lbapi.SchemeGroupVersion.String(),
+			Namespace:       lb.Namespace,
+			Name:            lb.Name,
+			UID:             lb.UID,
+			ResourceVersion: lb.ResourceVersion,
+		},
+		Reason:         reason,
+		Message:        message,
+		Source:         r.source,
+		FirstTimestamp: timestamp,
+		LastTimestamp:  timestamp,
+		Count:          1,
+		Type:           eventType,
+	}
+	if _, err := r.client.CoreV1().Events(lb.Namespace).Create(event); err != nil {
+		log.Error("record event error", log.Fields{"reason": reason, "message": message, "err": err})
+	}
+}
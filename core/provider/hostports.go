@@ -0,0 +1,205 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/zoumo/logdog"
+)
+
+const (
+	// socket states in /proc/net/{tcp,udp}
+	tcpListen  = "0A"
+	udpUnconnd = "07"
+)
+
+// HostPortChecker detects the exported ports which are bound on the node
+// by unexpected processes. The owner of a socket is found in /proc/[pid]/fd,
+// so the processes are only visible if the provider runs in host pid
+// namespace, the sockets whose owner is unknown are ignored.
+type HostPortChecker struct {
+	// AllowedProcesses are the names of processes which are expected to
+	// bind the exported ports, e.g. the proxy
+	AllowedProcesses []string
+
+	procRoot string
+}
+
+// NewHostPortChecker returns a HostPortChecker
+func NewHostPortChecker(allowed ...string) *HostPortChecker {
+	return &HostPortChecker{
+		AllowedProcesses: allowed,
+		procRoot:         "/proc",
+	}
+}
+
+// Check returns the conflicts of tcp and udp ports with the sockets on
+// the node
+func (c *HostPortChecker) Check(tcpPorts, udpPorts []string) ([]PortConflict, error) {
+	tcp, err := c.boundPorts(tcpListen, "tcp", "tcp6")
+	if err != nil {
+		return nil, err
+	}
+	udp, err := c.boundPorts(udpUnconnd, "udp", "udp6")
+	if err != nil {
+		return nil, err
+	}
+
+	var owners map[string]string
+	var conflicts []PortConflict
+	check := func(protocol string, ports []string, bound map[int][]string) {
+		for _, port := range ports {
+			p, err := strconv.Atoi(port)
+			if err != nil {
+				continue
+			}
+			inodes := bound[p]
+			if len(inodes) == 0 {
+				continue
+			}
+			if owners == nil {
+				owners = c.socketOwners()
+			}
+			for _, inode := range inodes {
+				owner, ok := owners[inode]
+				if !ok {
+					log.Debug("unknown owner of socket", log.Fields{"protocol": protocol, "port": port, "inode": inode})
+					continue
+				}
+				if c.allowed(owner) {
+					continue
+				}
+				conflicts = append(conflicts, PortConflict{
+					Protocol: protocol,
+					Port:     port,
+					Reason:   fmt.Sprintf("bound by process %v on node", owner),
+				})
+				break
+			}
+		}
+	}
+	check("tcp", tcpPorts, tcp)
+	check("udp", udpPorts, udp)
+	return conflicts, nil
+}
+
+func (c *HostPortChecker) allowed(owner string) bool {
+	// owner is in the form of name(pid)
+	name := owner
+	if i := strings.LastIndex(owner, "("); i >= 0 {
+		name = owner[:i]
+	}
+	for _, p := range c.AllowedProcesses {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// boundPorts returns the inodes of sockets in state by local port
+func (c *HostPortChecker) boundPorts(state string, files ...string) (map[int][]string, error) {
+	ports := make(map[int][]string)
+	for _, file := range files {
+		f, err := os.Open(filepath.Join(c.procRoot, "net", file))
+		if os.IsNotExist(err) {
+			// ipv6 is disabled or not linux
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = parseProcNetSockets(f, state, ports)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ports, nil
+}
+
+// parseProcNetSockets parses /proc/net/{tcp,tcp6,udp,udp6}, e.g.
+//
+//	sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+//	 0: 00000000:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 12345 ...
+func parseProcNetSockets(r io.Reader, state string, ports map[int][]string) error {
+	scanner := bufio.NewScanner(r)
+	// skip header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != state {
+			continue
+		}
+		i := strings.LastIndex(fields[1], ":")
+		if i < 0 {
+			continue
+		}
+		port, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+		if err != nil {
+			continue
+		}
+		ports[int(port)] = append(ports[int(port)], fields[9])
+	}
+	return scanner.Err()
+}
+
+// socketOwners returns the owners of sockets by inode, the owner is in
+// the form of name(pid)
+func (c *HostPortChecker) socketOwners() map[string]string {
+	owners := make(map[string]string)
+	pids, err := ioutil.ReadDir(c.procRoot)
+	if err != nil {
+		return owners
+	}
+	for _, pid := range pids {
+		if _, err := strconv.Atoi(pid.Name()); err != nil {
+			continue
+		}
+		fdDir := filepath.Join(c.procRoot, pid.Name(), "fd")
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			// the process exited or permission denied
+			continue
+		}
+		var name string
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			if name == "" {
+				comm, err := ioutil.ReadFile(filepath.Join(c.procRoot, pid.Name(), "comm"))
+				if err != nil {
+					break
+				}
+				name = strings.TrimSpace(string(comm))
+			}
+			inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+			owners[inode] = fmt.Sprintf("%s(%s)", name, pid.Name())
+		}
+	}
+	return owners
+}
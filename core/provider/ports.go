@@ -16,16 +16,29 @@ limitations under the License.
 
 package provider
 
-import "k8s.io/api/core/v1"
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+	log "github.com/zoumo/logdog"
+	"k8s.io/api/core/v1"
+)
 
 var (
 	// ReservedTCPPorts represents the reserved tcp ports
 	ReservedTCPPorts = []string{"80", "443", "450", "451"}
 	// ReservedUDPPorts represents the reserved udp ports
 	ReservedUDPPorts = []string{}
+	// ProxyProcesses are the names of proxy processes which bind the
+	// exported ports, the names are truncated to 15 characters by kernel
+	ProxyProcesses = []string{"nginx", "nginx-ingress-c", "haproxy", "traefik"}
 )
 
-// GetExportedPorts get exported ports from tcp and udp ConfigMap
+// GetExportedPorts get exported ports from tcp and udp ConfigMap, the ports
+// are sorted by SortPorts
 func GetExportedPorts(tcpcm, udpcm *v1.ConfigMap) ([]string, []string) {
 	tcpPorts := make([]string, 0)
 	udpPorts := make([]string, 0)
@@ -38,6 +51,130 @@ func GetExportedPorts(tcpcm, udpcm *v1.ConfigMap) ([]string, []string) {
 	for port := range udpcm.Data {
 		udpPorts = append(udpPorts, port)
 	}
-	return tcpPorts, udpPorts
+	return SortPorts(tcpPorts), SortPorts(udpPorts)
+}
+
+// SortPorts returns the ports sorted numerically without duplicates, the
+// ports which are not numbers are sorted lexically after the numbers
+func SortPorts(ports []string) []string {
+	seen := make(map[string]bool, len(ports))
+	sorted := make([]string, 0, len(ports))
+	for _, port := range ports {
+		if seen[port] {
+			continue
+		}
+		seen[port] = true
+		sorted = append(sorted, port)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, erra := strconv.Atoi(sorted[i])
+		b, errb := strconv.Atoi(sorted[j])
+		switch {
+		case erra == nil && errb == nil:
+			return a < b
+		case erra == nil || errb == nil:
+			return erra == nil
+		}
+		return sorted[i] < sorted[j]
+	})
+	return sorted
+}
+
+// PortConflict describes an exported port which can not be used as is
+type PortConflict struct {
+	Protocol string
+	Port     string
+	Reason   string
+}
+
+func (c PortConflict) String() string {
+	return fmt.Sprintf("%s port %s: %s", c.Protocol, c.Port, c.Reason)
+}
+
+// ValidateExportedPorts parses and range checks the keys of tcp and udp
+// ConfigMap, and detects the duplicates and the collisions with reserved
+// ports. It returns the sorted valid ports, a duplicate is kept once, the
+// invalid ports are dropped and reported in conflicts.
+func ValidateExportedPorts(tcpcm, udpcm *v1.ConfigMap) ([]string, []string, []PortConflict) {
+	var conflicts []PortConflict
+	tcpPorts := validatePorts("tcp", ReservedTCPPorts, tcpcm, &conflicts)
+	udpPorts := validatePorts("udp", ReservedUDPPorts, udpcm, &conflicts)
+	return tcpPorts, udpPorts, conflicts
+}
+
+func validatePorts(protocol string, reserved []string, cm *v1.ConfigMap, conflicts *[]PortConflict) []string {
+	seen := make(map[int]string)
+	for _, port := range reserved {
+		p, _ := strconv.Atoi(port)
+		seen[p] = "reserved"
+	}
 
+	var keys []string
+	if cm != nil {
+		for key := range cm.Data {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		port, err := parsePort(key)
+		if err != nil {
+			*conflicts = append(*conflicts, PortConflict{Protocol: protocol, Port: key, Reason: err.Error()})
+			continue
+		}
+		if owner, ok := seen[port]; ok {
+			reason := fmt.Sprintf("duplicate of %v port", owner)
+			if owner == "reserved" {
+				reason = "conflicts with reserved port"
+			}
+			*conflicts = append(*conflicts, PortConflict{Protocol: protocol, Port: key, Reason: reason})
+			continue
+		}
+		seen[port] = "configmap " + cm.Name
+	}
+
+	ports := make([]string, 0, len(seen))
+	for port := range seen {
+		ports = append(ports, strconv.Itoa(port))
+	}
+	return SortPorts(ports)
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid port number")
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port out of range 1-65535")
+	}
+	return port, nil
+}
+
+// CheckExportedPorts validates the exported ports in tcp and udp ConfigMap
+// and checks them against the sockets on the node by checker if it is not
+// nil. The conflicts are logged and recorded as an event of lb if recorder
+// is not nil. It returns the valid ports.
+func CheckExportedPorts(recorder EventRecorder, checker *HostPortChecker, lb *lbapi.LoadBalancer, tcpcm, udpcm *v1.ConfigMap) ([]string, []string) {
+	tcpPorts, udpPorts, conflicts := ValidateExportedPorts(tcpcm, udpcm)
+	if checker != nil {
+		hostConflicts, err := checker.Check(tcpPorts, udpPorts)
+		if err != nil {
+			log.Error("check host ports error", log.Fields{"err": err})
+		}
+		conflicts = append(conflicts, hostConflicts...)
+	}
+	if len(conflicts) == 0 {
+		return tcpPorts, udpPorts
+	}
+
+	msgs := make([]string, 0, len(conflicts))
+	for _, c := range conflicts {
+		log.Warn("exported port conflict", log.Fields{"protocol": c.Protocol, "port": c.Port, "reason": c.Reason})
+		msgs = append(msgs, c.String())
+	}
+	if recorder != nil {
+		recorder.Event(lb, v1.EventTypeWarning, "PortConflict", strings.Join(msgs, "; "))
+	}
+	return tcpPorts, udpPorts
 }
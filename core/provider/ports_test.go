@@ -0,0 +1,123 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+)
+
+func TestSortPorts(t *testing.T) {
+	assert.Equal(t, []string{"80", "443", "8080", "http"}, SortPorts([]string{"8080", "http", "443", "80", "443"}))
+	assert.Equal(t, []string{}, SortPorts(nil))
+}
+
+func TestGetExportedPorts(t *testing.T) {
+	tcpcm := &v1.ConfigMap{Data: map[string]string{"8080": "default/a:80", "443": "default/c:443", "53": "default/dns:53"}}
+	udpcm := &v1.ConfigMap{Data: map[string]string{"53": "default/dns:53"}}
+
+	tcpPorts, udpPorts := GetExportedPorts(tcpcm, udpcm)
+	assert.Equal(t, []string{"53", "80", "443", "450", "451", "8080"}, tcpPorts)
+	assert.Equal(t, []string{"53"}, udpPorts)
+}
+
+func TestValidateExportedPorts(t *testing.T) {
+	tcpcm := &v1.ConfigMap{Data: map[string]string{
+		"8080":  "default/a:80",
+		"08080": "default/b:80",
+		"443":   "default/c:443",
+		"70000": "default/d:80",
+		"ssh":   "default/e:22",
+		"53":    "default/dns:53",
+	}}
+	tcpcm.Name = "tcp"
+	udpcm := &v1.ConfigMap{Data: map[string]string{
+		"53": "default/dns:53",
+	}}
+	udpcm.Name = "udp"
+
+	tcpPorts, udpPorts, conflicts := ValidateExportedPorts(tcpcm, udpcm)
+	assert.Equal(t, []string{"53", "80", "443", "450", "451", "8080"}, tcpPorts)
+	assert.Equal(t, []string{"53"}, udpPorts)
+
+	reasons := make(map[string]string)
+	for _, c := range conflicts {
+		assert.Equal(t, "tcp", c.Protocol)
+		reasons[c.Port] = c.Reason
+	}
+	assert.Len(t, reasons, 4)
+	assert.Contains(t, reasons["8080"], "duplicate")
+	assert.Contains(t, reasons["443"], "reserved")
+	assert.Contains(t, reasons["70000"], "range")
+	assert.Contains(t, reasons["ssh"], "invalid")
+}
+
+const procNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1001 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1002 1 0000000000000000 100 0 0 10 0
+   2: 0100007F:1F91 0100007F:C350 01 00000000:00000000 00:00000000 00000000     0        0 1003 1 0000000000000000 100 0 0 10 0
+`
+
+func TestHostPortChecker(t *testing.T) {
+	root, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	write := func(path, content string) {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	link := func(pid, fd, inode string) {
+		dir := filepath.Join(root, pid, "fd")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("socket:["+inode+"]", filepath.Join(dir, fd)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("net/tcp", procNetTCP)
+	write("1/comm", "nginx\n")
+	link("1", "3", "1001")
+	write("2/comm", "redis-server\n")
+	link("2", "4", "1002")
+
+	checker := NewHostPortChecker(ProxyProcesses...)
+	checker.procRoot = root
+
+	// 80 is bound by nginx, 8080 by redis, 8081 is not listening
+	conflicts, err := checker.Check([]string{"80", "8080", "8081"}, []string{"53"})
+	assert.Nil(t, err)
+	if assert.Len(t, conflicts, 1) {
+		assert.Equal(t, "8080", conflicts[0].Port)
+		assert.True(t, strings.Contains(conflicts[0].Reason, "redis-server(2)"))
+	}
+}
@@ -24,6 +24,13 @@ import (
 	v1listers "k8s.io/client-go/listers/core/v1"
 )
 
+const (
+	// StatusAnnotationPrefix is the prefix of the annotations which hold
+	// the status reported by providers, the loadbalancer is not resynced
+	// when they change
+	StatusAnnotationPrefix = "status.loadbalance.caicloud.io/"
+)
+
 // Provider holds the methods to handle an Provider backend
 type Provider interface {
 	// Info returns information about the loadbalancer provider
@@ -41,6 +48,14 @@ type Provider interface {
 	Stop() error
 }
 
+// Resyncer is an optional interface of Provider, the provider can
+// trigger a resync of the loadbalancer by the given function when its
+// environment changes, e.g. the hardware address of a neighbor changes
+type Resyncer interface {
+	// SetResyncFunc sets the function which enqueues the loadbalancer
+	SetResyncFunc(func())
+}
+
 // Info returns information about the provider.
 // This fields contains information that helps to track issues or to
 // map the running loadbalancer provider to source code
@@ -72,4 +87,8 @@ type Configuration struct {
 	LoadBalancerNamespace string
 	TCPConfigMap          string
 	UDPConfigMap          string
+	// ExtraConfigMaps are the names of other configmaps in the namespace
+	// of loadbalancer which the backend depends on, the loadbalancer is
+	// resynced when any of them changes
+	ExtraConfigMaps []string
 }
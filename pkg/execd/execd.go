@@ -1,20 +1,26 @@
 package execd
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
-	ps "github.com/keybase/go-ps"
+	log "github.com/zoumo/logdog"
 )
 
 const (
+	// the daemon gives up restarting after crashBackoff consecutive start errors
 	crashBackoff = 3
+
+	defaultMinBackoff    = 1 * time.Second
+	defaultMaxBackoff    = 1 * time.Minute
+	defaultStableRuntime = 10 * time.Second
 )
 
 var (
@@ -89,14 +95,55 @@ type D struct {
 	// Run passes it to os.StartProcess as the os.ProcAttr's Sys field.
 	SysProcAttr *syscall.SysProcAttr
 
-	cmd *exec.Cmd
+	// OnStart is called with the pid after the process is started,
+	// including every restart.
+	OnStart func(pid int)
+
+	// OnExit is called after the process exits, including the exit
+	// caused by Stop.
+	OnExit func(status ExitStatus)
+
+	// MinBackoff and MaxBackoff bound the delay before restarting the
+	// exited process, the delay doubles on every restart and is reset to
+	// MinBackoff if the process has run longer than StableRuntime.
+	// They are 1s, 1m and 10s by default.
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+	StableRuntime time.Duration
+
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	startedAt time.Time
+	restarts  int
+	lastExit  *ExitStatus
+	logs      *logRing
+	// exited is closed when the current process exits
+	exited chan struct{}
 
 	gracePeriod      time.Duration
 	gracefulShutDown func(*exec.Cmd) error
 
 	lookPathErr error
+	cancel      context.CancelFunc
+	stopOnce    sync.Once
 	stopCh      chan struct{}
 	errCh       chan error
+	doneOnce    sync.Once
+	doneCh      chan struct{}
+}
+
+// ExitStatus describes an exit of the daemon process
+type ExitStatus struct {
+	Pid int
+	// Err is the result of exec.Cmd.Wait
+	Err error
+	// Code is the exit code, it is 128 + signal number if the process
+	// is killed by a signal
+	Code int
+	// Time is when the exit is noticed
+	Time time.Time
+	// Runtime is how long the process has run
+	Runtime time.Duration
 }
 
 // Daemon returns the D struct to execute the named program with
@@ -136,6 +183,8 @@ func DaemonFrom(c *exec.Cmd) *D {
 
 // Command returns the running exec.Cmd struct in D
 func (c *D) Command() *exec.Cmd {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.cmd
 }
 
@@ -145,7 +194,7 @@ func (c *D) Pid() (int, error) {
 	if !c.IsRunning() {
 		return 0, ErrNotRunning
 	}
-	return c.cmd.Process.Pid, nil
+	return c.Command().Process.Pid, nil
 }
 
 // Signal sends a signal to the daemon pocess.
@@ -154,7 +203,55 @@ func (c *D) Signal(signal os.Signal) error {
 	if !c.IsRunning() {
 		return ErrNotRunning
 	}
-	return c.cmd.Process.Signal(signal)
+	return c.Command().Process.Signal(signal)
+}
+
+// Restarts returns how many times the daemon process has been restarted
+func (c *D) Restarts() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.restarts
+}
+
+// LastExit returns the last exit status of the daemon process, false if
+// it has never exited
+func (c *D) LastExit() (ExitStatus, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastExit == nil {
+		return ExitStatus{}, false
+	}
+	return *c.lastExit, true
+}
+
+// ExitCode returns the exit code of the last exited process, -1 if the
+// process is running or has never exited
+func (c *D) ExitCode() int {
+	if c.IsRunning() {
+		return -1
+	}
+	status, ok := c.LastExit()
+	if !ok {
+		return -1
+	}
+	return status.Code
+}
+
+// Done returns a channel which is closed when the daemon is stopped and
+// its process has exited, the daemon is stopped by Stop, the cancellation
+// of the context or too many restart errors
+func (c *D) Done() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.doneCh == nil {
+		c.doneCh = make(chan struct{})
+	}
+	return c.doneCh
+}
+
+func (c *D) closeDone() {
+	c.Done()
+	c.doneOnce.Do(func() { close(c.doneCh) })
 }
 
 // Name returns the name of daemon
@@ -185,81 +282,119 @@ func (c *D) SetGracefulShutDown(f func(*exec.Cmd) error) {
 // RunForever starts the specified command and waits for it to complete in another goroutine.
 // If there is no error, the daemon will run forever.
 //
-// In the meantime, It starts a goroutine to keep the backgroud process alive.
+// In the meantime, It starts a goroutine to keep the backgroud process alive,
+// the exited process is restarted with exponential backoff.
 // But if the error occurs more than `crashBackOff` times when command is starting,
 // it will stop tracking anymore.
 func (c *D) RunForever() error {
+	return c.RunForeverContext(context.Background())
+}
+
+// RunForeverContext is like RunForever, the daemon is stopped when ctx is done
+func (c *D) RunForeverContext(ctx context.Context) error {
 	if c.lookPathErr != nil {
 		return c.lookPathErr
 	}
+	c.mu.Lock()
 	if c.cmd == nil {
 		c.cmd = c.delegate()
 	}
+	c.mu.Unlock()
 	if c.stopCh == nil {
 		c.stopCh = make(chan struct{})
 	}
 	if c.errCh == nil {
-		c.errCh = make(chan error)
+		// buffered, so that the waiting goroutine never blocks after the
+		// supervisor exits
+		c.errCh = make(chan error, 1)
+	}
+	ctx, c.cancel = context.WithCancel(ctx)
+	if os.Getpid() == 1 {
+		// the orphaned processes are re-parented to us
+		startReaper()
 	}
 
 	err := c.run()
 	if err != nil {
-		close(c.stopCh)
-		close(c.errCh)
+		c.markStopped()
+		c.closeDone()
 		return err
 	}
-	c.keepalive()
-	c.reportError()
+	go c.supervise(ctx)
 
 	return nil
 }
 
-// IsRunning returns true if the daemon is still running background
+// IsRunning returns true if the daemon is still running background,
+// the process is considered running until exec.Cmd.Wait returns
 func (c *D) IsRunning() bool {
-	if c.cmd == nil {
-		return false
-	}
-	if c.cmd.Process == nil {
-		return false
-	}
-	process, err := ps.FindProcess(c.cmd.Process.Pid)
-	if err != nil {
-		fmt.Printf("execd(%v): error find process: %v\n", c.Name(), err)
+	c.mu.Lock()
+	exited := c.exited
+	c.mu.Unlock()
+	if exited == nil {
 		return false
 	}
-	if process == nil && err == nil {
-		// not found
+	select {
+	case <-exited:
 		return false
+	default:
+		return true
 	}
-	return true
 }
 
-// Stop stops the daemon process
+// Stop stops the daemon process, it is safe to call Stop more than once
 func (c *D) Stop() error {
 	if c.stopCh == nil {
 		return errors.New("execd: stop must be called after run")
 	}
 
-	close(c.stopCh)
+	if !c.markStopped() {
+		return nil
+	}
+	return c.terminate()
+}
+
+// markStopped closes stopCh and cancels the supervisor, it returns false
+// if the daemon has already been stopped
+func (c *D) markStopped() bool {
+	stopped := false
+	c.stopOnce.Do(func() {
+		stopped = true
+		close(c.stopCh)
+		if c.cancel != nil {
+			c.cancel()
+		}
+	})
+	return stopped
+}
 
+func (c *D) terminate() error {
 	if c.gracefulShutDown != nil && c.IsRunning() {
-		return c.gracefulShutDown(c.cmd)
+		return c.gracefulShutDown(c.Command())
 	}
-
 	return c.shutdown()
-
 }
 
 func (c *D) shutdown() error {
-	if c.gracePeriod > 0 {
-		err := c.cmd.Process.Signal(syscall.SIGTERM)
+	cmd := c.Command()
+	if cmd == nil || cmd.Process == nil {
+		return nil
+	}
+	if c.gracePeriod > 0 && c.IsRunning() {
+		err := cmd.Process.Signal(syscall.SIGTERM)
 		if err != nil {
 			return err
 		}
-		<-time.After(c.gracePeriod)
+		c.mu.Lock()
+		exited := c.exited
+		c.mu.Unlock()
+		select {
+		case <-exited:
+		case <-time.After(c.gracePeriod):
+		}
 	}
 	if c.IsRunning() {
-		err := c.cmd.Process.Kill()
+		err := cmd.Process.Kill()
 		if err != nil {
 			return err
 		}
@@ -268,64 +403,188 @@ func (c *D) shutdown() error {
 }
 
 func (c *D) run() error {
-	if c.cmd == nil {
+	c.mu.Lock()
+	cmd := c.cmd
+	c.mu.Unlock()
+	if cmd == nil {
 		return errors.New("execd: no command")
 	}
 
-	if err := c.cmd.Start(); err != nil {
+	flush := c.captureOutput(cmd)
+	// the reaper must not reap the process before it is managed
+	managed.Lock()
+	err := cmd.Start()
+	if err == nil {
+		managed.pids[cmd.Process.Pid] = true
+	}
+	managed.Unlock()
+	if err != nil {
 		return err
 	}
 
+	exited := make(chan struct{})
+	c.mu.Lock()
+	c.startedAt = time.Now()
+	c.exited = exited
+	c.mu.Unlock()
+	log.Info("execd: process started", log.Fields{"name": c.Name(), "pid": cmd.Process.Pid})
+	if c.OnStart != nil {
+		c.OnStart(cmd.Process.Pid)
+	}
+
 	go func() {
 		// maybe killed
-		c.errCh <- c.cmd.Wait()
+		err := cmd.Wait()
+		managed.Lock()
+		delete(managed.pids, cmd.Process.Pid)
+		managed.Unlock()
+		flush()
+		close(exited)
+		c.errCh <- err
 	}()
 
 	return nil
 }
 
-func (c *D) keepalive() {
-	go func() {
-		tick := time.NewTicker(1 * time.Second)
-		defer tick.Stop()
-		restartErrTimes := 0
-		for {
-			select {
-			case <-tick.C:
-				if !c.IsRunning() {
-					c.cmd = c.delegate()
-					err := c.run()
-					if err != nil {
-						if restartErrTimes >= crashBackoff {
-							fmt.Printf("execd(%v): too many errors occur when restarting the process, stop the daemon\n", c.Name())
-							c.Stop()
-							return
-						}
-						fmt.Printf("execd(%v): error restart command: %v\n", c.Name(), err)
-						restartErrTimes++
-					}
-				}
-			case <-c.stopCh:
+// supervise waits for the process to exit and restarts it with backoff
+// until ctx is done
+func (c *D) supervise(ctx context.Context) {
+	defer c.closeDone()
+	backoff := c.minBackoff()
+	for {
+		select {
+		case err := <-c.errCh:
+			status := c.recordExit(err)
+			if ctx.Err() != nil {
 				return
 			}
-		}
-
-	}()
-}
-
-func (c *D) reportError() {
-	go func() {
-		for {
+			if status.Runtime >= c.stableRuntime() {
+				backoff = c.minBackoff()
+			}
+			log.Warn("execd: process exited, restart it later", log.Fields{
+				"name": c.Name(), "pid": status.Pid, "err": err, "runtime": status.Runtime, "backoff": backoff,
+			})
+			if !c.restart(ctx, &backoff) {
+				return
+			}
+		case <-ctx.Done():
+			// Stop may terminate the old process while a new one is being
+			// started, so the current process is always terminated here,
+			// then wait for it to record the exit
+			c.markStopped()
+			if err := c.terminate(); err != nil {
+				log.Error("execd: error terminate process", log.Fields{"name": c.Name(), "err": err})
+			}
 			select {
 			case err := <-c.errCh:
-				if err != nil {
-					fmt.Printf("execd(%v): receive an error, %v\n", c.Name(), err)
-				}
-			case <-c.stopCh:
-				return
+				c.recordExit(err)
+			case <-time.After(c.gracePeriod + time.Second):
 			}
+			return
 		}
-	}()
+	}
+}
+
+// restart starts the process after backoff, it returns false if ctx is
+// done or too many errors occur
+func (c *D) restart(ctx context.Context, backoff *time.Duration) bool {
+	failures := 0
+	for {
+		select {
+		case <-time.After(*backoff):
+		case <-ctx.Done():
+			return false
+		}
+		*backoff *= 2
+		if max := c.maxBackoff(); *backoff > max {
+			*backoff = max
+		}
+
+		// the daemon may be stopped while waiting, never start a process
+		// after it
+		c.mu.Lock()
+		if ctx.Err() != nil {
+			c.mu.Unlock()
+			return false
+		}
+		c.cmd = c.delegate()
+		c.mu.Unlock()
+		err := c.run()
+		if err == nil {
+			c.mu.Lock()
+			c.restarts++
+			c.mu.Unlock()
+			return true
+		}
+
+		failures++
+		if failures >= crashBackoff {
+			log.Error("execd: too many errors occur when restarting the process, stop the daemon", log.Fields{"name": c.Name(), "err": err})
+			c.markStopped()
+			return false
+		}
+		log.Error("execd: error restart command", log.Fields{"name": c.Name(), "err": err})
+	}
+}
+
+func (c *D) recordExit(err error) ExitStatus {
+	c.mu.Lock()
+	status := ExitStatus{
+		Err:     err,
+		Code:    exitCode(err),
+		Time:    time.Now(),
+		Runtime: time.Since(c.startedAt),
+	}
+	if c.cmd != nil && c.cmd.Process != nil {
+		status.Pid = c.cmd.Process.Pid
+	}
+	c.lastExit = &status
+	c.mu.Unlock()
+
+	if c.OnExit != nil {
+		c.OnExit(status)
+	}
+	return status
+}
+
+// exitCode returns the exit code from the result of exec.Cmd.Wait
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return -1
+	}
+	ws, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return -1
+	}
+	if ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return ws.ExitStatus()
+}
+
+func (c *D) minBackoff() time.Duration {
+	if c.MinBackoff > 0 {
+		return c.MinBackoff
+	}
+	return defaultMinBackoff
+}
+
+func (c *D) maxBackoff() time.Duration {
+	if c.MaxBackoff > 0 {
+		return c.MaxBackoff
+	}
+	return defaultMaxBackoff
+}
+
+func (c *D) stableRuntime() time.Duration {
+	if c.StableRuntime > 0 {
+		return c.StableRuntime
+	}
+	return defaultStableRuntime
 }
 
 func (c *D) delegate() *exec.Cmd {
@@ -341,11 +600,26 @@ func convertToExec(c *D) *exec.Cmd {
 		Stdin:       c.Stdin,
 		Stderr:      c.Stderr,
 		Stdout:      c.Stdout,
-		SysProcAttr: c.SysProcAttr,
+		SysProcAttr: processGroupAttr(c.SysProcAttr),
 	}
 	return cmd
 }
 
+// processGroupAttr returns a copy of attr which starts the process in a
+// new process group, so that its orphaned descendants are told from the
+// children started by os/exec and reaped
+func processGroupAttr(attr *syscall.SysProcAttr) *syscall.SysProcAttr {
+	group := &syscall.SysProcAttr{}
+	if attr != nil {
+		*group = *attr
+	}
+	// a session leader leads its own process group already
+	if !group.Setsid {
+		group.Setpgid = true
+	}
+	return group
+}
+
 func convertFromExec(c *exec.Cmd) *D {
 	cmd := &D{
 		Path:        c.Path,
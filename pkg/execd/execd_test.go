@@ -2,12 +2,15 @@ package execd
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
 	ps "github.com/keybase/go-ps"
 	"github.com/moby/moby/pkg/reexec"
+	"github.com/stretchr/testify/assert"
 )
 
 func init() {
@@ -29,6 +32,9 @@ func init() {
 		}
 	})
 
+	reexec.Register("execd-test-exit", func() {
+		os.Exit(1)
+	})
 }
 
 func TestRun(t *testing.T) {
@@ -85,18 +91,163 @@ func TestStop(t *testing.T) {
 	}
 }
 
-func TestCrasLoopBackoff(t *testing.T) {
+func TestRestartBackoff(t *testing.T) {
+	if reexec.Init() {
+		os.Exit(0)
+	}
+
+	var mu sync.Mutex
+	starts, exits := 0, 0
+	cmd := DaemonFrom(reexec.Command("execd-test-exit"))
+	cmd.MinBackoff = 100 * time.Millisecond
+	cmd.MaxBackoff = 200 * time.Millisecond
+	cmd.OnStart = func(pid int) {
+		mu.Lock()
+		starts++
+		mu.Unlock()
+	}
+	cmd.OnExit = func(status ExitStatus) {
+		mu.Lock()
+		exits++
+		mu.Unlock()
+	}
+
+	if err := cmd.RunForever(); err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(1500 * time.Millisecond)
+	cmd.Stop()
+
+	restarts := cmd.Restarts()
+	// 100ms, 200ms, 200ms ... between restarts
+	assert.True(t, restarts >= 3 && restarts <= 8, "unexpected restarts %d", restarts)
+	mu.Lock()
+	assert.Equal(t, restarts+1, starts)
+	assert.True(t, exits >= restarts)
+	mu.Unlock()
+
+	status, ok := cmd.LastExit()
+	assert.True(t, ok)
+	assert.NotNil(t, status.Err)
+	assert.NotZero(t, status.Pid)
+}
+
+func TestCrashLoopBackoff(t *testing.T) {
 	cmd := &D{
 		Path: "/not-found-path",
 		Args: []string{"execd-test-crash"},
 	}
+	assert.NotNil(t, cmd.RunForever())
+	assert.False(t, cmd.IsRunning())
+	assert.Nil(t, cmd.Stop())
 
-	cmd.keepalive()
-	cmd.reportError()
-	<-time.After(5 * time.Second)
+	// the working directory disappears, restarting fails
+	dir, err := ioutil.TempDir("", "execd-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd = DaemonFrom(reexec.Command("execd-test-exit"))
+	cmd.Dir = dir
+	cmd.MinBackoff = 50 * time.Millisecond
+	cmd.MaxBackoff = 50 * time.Millisecond
+	if err := cmd.RunForever(); err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dir)
 
-	if cmd.IsRunning() {
-		t.Error("still running")
+	select {
+	case <-cmd.stopCh:
+	case <-time.After(5 * time.Second):
+		t.Error("daemon is not stopped")
+	}
+	assert.False(t, cmd.IsRunning())
+	assert.Equal(t, 0, cmd.Restarts())
+	// Stop is safe after the daemon gives up
+	assert.Nil(t, cmd.Stop())
+}
+
+func TestDoneAndExitCode(t *testing.T) {
+	if reexec.Init() {
+		os.Exit(0)
+	}
+
+	exited := make(chan struct{}, 10)
+	cmd := DaemonFrom(reexec.Command("execd-test-exit"))
+	cmd.MinBackoff = time.Minute
+	cmd.OnExit = func(status ExitStatus) {
+		exited <- struct{}{}
+	}
+	assert.Equal(t, -1, cmd.ExitCode())
+	if err := cmd.RunForever(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("process does not exit")
+	}
+	assert.False(t, cmd.IsRunning())
+	assert.Equal(t, 1, cmd.ExitCode())
+	_, err := cmd.Pid()
+	assert.Equal(t, ErrNotRunning, err)
+
+	select {
+	case <-cmd.Done():
+		t.Fatal("daemon is done before stopping")
+	default:
 	}
 	cmd.Stop()
+	select {
+	case <-cmd.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon is not done after stopping")
+	}
+}
+
+func TestDoneAfterStop(t *testing.T) {
+	if reexec.Init() {
+		os.Exit(0)
+	}
+
+	cmd := DaemonFrom(reexec.Command("execd-test-stop"))
+	if err := cmd.RunForever(); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, cmd.IsRunning())
+	assert.Equal(t, -1, cmd.ExitCode())
+
+	cmd.Stop()
+	select {
+	case <-cmd.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon is not done after stopping")
+	}
+	assert.False(t, cmd.IsRunning())
+	// killed by SIGKILL
+	assert.Equal(t, 128+9, cmd.ExitCode())
+	assert.Equal(t, 0, cmd.Restarts())
+}
+
+func TestTerminateProcessStartedWhileStopping(t *testing.T) {
+	if reexec.Init() {
+		os.Exit(0)
+	}
+
+	cmd := DaemonFrom(reexec.Command("execd-test-stop"))
+	cmd.SetGracePeriod(100 * time.Millisecond)
+	if err := cmd.RunForever(); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, cmd.IsRunning())
+
+	// the daemon is marked stopped as if Stop terminated the previous
+	// process, the current one must still be terminated by the supervisor
+	cmd.markStopped()
+	select {
+	case <-cmd.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon is not done after stopping")
+	}
+	assert.False(t, cmd.IsRunning())
 }
@@ -0,0 +1,209 @@
+package execd
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/zoumo/logdog"
+)
+
+const (
+	// StreamStdout is the stream of lines written to stdout
+	StreamStdout = "stdout"
+	// StreamStderr is the stream of lines written to stderr
+	StreamStderr = "stderr"
+
+	// lines longer than maxLineSize are split
+	maxLineSize = 4096
+)
+
+// LogLine is a line written by the daemon process
+type LogLine struct {
+	Time   time.Time
+	Pid    int
+	Stream string
+	Text   string
+}
+
+// logRing keeps the most recent lines
+type logRing struct {
+	mu    sync.Mutex
+	lines []LogLine
+	next  int
+	full  bool
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([]LogLine, size)}
+}
+
+func (r *logRing) add(line LogLine) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.lines) == 0 {
+		return
+	}
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// tail returns the most recent n lines in order, all lines if n <= 0
+func (r *logRing) tail(n int) []LogLine {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ret []LogLine
+	if r.full {
+		ret = append(ret, r.lines[r.next:]...)
+	}
+	ret = append(ret, r.lines[:r.next]...)
+	if n > 0 && len(ret) > n {
+		ret = ret[len(ret)-n:]
+	}
+	return ret
+}
+
+// lineWriter splits the output of the process into lines, each line is
+// logged and saved in the ring
+type lineWriter struct {
+	name   string
+	stream string
+	pid    func() int
+	ring   *logRing
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			if w.buf.Len() >= maxLineSize {
+				w.emit(string(w.buf.Next(maxLineSize)))
+				continue
+			}
+			break
+		}
+		line := w.buf.Next(i + 1)
+		w.emit(string(line[:i]))
+	}
+	return len(p), nil
+}
+
+// flush emits the last line without newline
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() > 0 {
+		w.emit(w.buf.String())
+		w.buf.Reset()
+	}
+}
+
+func (w *lineWriter) emit(text string) {
+	text = strings.TrimRight(text, "\r")
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	line := LogLine{
+		Time:   time.Now(),
+		Pid:    w.pid(),
+		Stream: w.stream,
+		Text:   text,
+	}
+	w.ring.add(line)
+
+	fields := log.Fields{"name": w.name, "pid": line.Pid, "stream": line.Stream}
+	switch logLevel(text) {
+	case log.ErrorLevel:
+		log.Error(text, fields)
+	case log.WarnLevel:
+		log.Warn(text, fields)
+	case log.DebugLevel:
+		log.Debug(text, fields)
+	default:
+		log.Info(text, fields)
+	}
+}
+
+// logLevel guesses the level of a line by its content
+func logLevel(text string) log.Level {
+	lower := strings.ToLower(text)
+	switch {
+	case containsAny(lower, "error", "fatal", "panic", "fail", "can't", "cannot"):
+		return log.ErrorLevel
+	case containsAny(lower, "warn"):
+		return log.WarnLevel
+	case containsAny(lower, "debug"):
+		return log.DebugLevel
+	default:
+		return log.InfoLevel
+	}
+}
+
+func containsAny(s string, subs ...string) bool {
+	for _, sub := range subs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// CaptureLogs captures the stdout and stderr of the daemon process line by
+// line instead of writing to Stdout and Stderr. Each line is forwarded to
+// logdog with the name and pid of the process, the recent size lines are
+// kept and returned by RecentLogs.
+// It must be called before RunForever.
+func (c *D) CaptureLogs(size int) {
+	c.logs = newLogRing(size)
+}
+
+// RecentLogs returns the most recent n captured lines, all lines if n <= 0
+func (c *D) RecentLogs(n int) []LogLine {
+	if c.logs == nil {
+		return nil
+	}
+	return c.logs.tail(n)
+}
+
+// captureOutput replaces the stdout and stderr of cmd with line writers,
+// the returned function flushes the incomplete lines
+func (c *D) captureOutput(cmd *exec.Cmd) func() {
+	if c.logs == nil {
+		return func() {}
+	}
+	pid := func() int {
+		if cmd.Process == nil {
+			return 0
+		}
+		return cmd.Process.Pid
+	}
+	stdout := &lineWriter{name: c.Name(), stream: StreamStdout, pid: pid, ring: c.logs}
+	stderr := &lineWriter{name: c.Name(), stream: StreamStderr, pid: pid, ring: c.logs}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return func() {
+		stdout.flush()
+		stderr.flush()
+	}
+}
+
+// FormatLogs formats lines as text, one line per log
+func FormatLogs(lines []LogLine) string {
+	var buf bytes.Buffer
+	for _, l := range lines {
+		buf.WriteString(l.Text)
+		buf.WriteByte('\n')
+	}
+	return strings.TrimRight(buf.String(), "\n")
+}
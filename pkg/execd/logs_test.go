@@ -0,0 +1,113 @@
+package execd
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/moby/moby/pkg/reexec"
+	"github.com/stretchr/testify/assert"
+	log "github.com/zoumo/logdog"
+)
+
+func init() {
+	reexec.Register("execd-test-logs", func() {
+		fmt.Println("starting")
+		fmt.Fprintln(os.Stderr, "error: something wrong")
+		fmt.Print("no newline")
+		os.Exit(2)
+	})
+}
+
+func TestLogRing(t *testing.T) {
+	r := newLogRing(3)
+	assert.Len(t, r.tail(0), 0)
+
+	for i := 0; i < 5; i++ {
+		r.add(LogLine{Text: fmt.Sprint(i)})
+	}
+	assert.Equal(t, "2\n3\n4", FormatLogs(r.tail(0)))
+	assert.Equal(t, "3\n4", FormatLogs(r.tail(2)))
+	assert.Equal(t, "2\n3\n4", FormatLogs(r.tail(10)))
+}
+
+func TestLineWriter(t *testing.T) {
+	r := newLogRing(10)
+	w := &lineWriter{name: "test", stream: StreamStdout, pid: func() int { return 1 }, ring: r}
+
+	w.Write([]byte("a\nb"))
+	w.Write([]byte("c\r\n\n  \nd"))
+	assert.Equal(t, "a\nbc", FormatLogs(r.tail(0)))
+	w.flush()
+	assert.Equal(t, "a\nbc\nd", FormatLogs(r.tail(0)))
+
+	r = newLogRing(10)
+	w = &lineWriter{name: "test", stream: StreamStdout, pid: func() int { return 1 }, ring: r}
+	long := make([]byte, maxLineSize+10)
+	for i := range long {
+		long[i] = 'x'
+	}
+	w.Write(long)
+	w.flush()
+	lines := r.tail(0)
+	assert.Len(t, lines, 2)
+	assert.Len(t, lines[0].Text, maxLineSize)
+	assert.Equal(t, 1, lines[0].Pid)
+}
+
+func TestLogLevel(t *testing.T) {
+	cases := []struct {
+		text string
+		want log.Level
+	}{
+		{"Starting Keepalived v1.3.5", log.InfoLevel},
+		{"VRRP_Instance(VI_1) Entering BACKUP STATE", log.InfoLevel},
+		{"Keepalived_vrrp exited with permanent error CONFIG", log.ErrorLevel},
+		{"Unable to load ipset library - libipset.so.3: cannot open shared object file", log.ErrorLevel},
+		{"WARNING - default user 'keepalived_script' for script execution does not exist", log.WarnLevel},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, logLevel(c.text), c.text)
+	}
+}
+
+func TestCaptureLogs(t *testing.T) {
+	if reexec.Init() {
+		os.Exit(0)
+	}
+
+	exited := make(chan ExitStatus, 10)
+	cmd := DaemonFrom(reexec.Command("execd-test-logs"))
+	cmd.MinBackoff = time.Minute
+	cmd.CaptureLogs(10)
+	cmd.OnExit = func(status ExitStatus) {
+		exited <- status
+	}
+	if err := cmd.RunForever(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Stop()
+
+	var status ExitStatus
+	select {
+	case status = <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("process does not exit")
+	}
+
+	lines := cmd.RecentLogs(0)
+	if assert.Len(t, lines, 3) {
+		for _, l := range lines {
+			assert.Equal(t, status.Pid, l.Pid)
+		}
+		assert.Equal(t, "no newline", lines[2].Text)
+	}
+	streams := map[string]string{}
+	for _, l := range lines {
+		streams[l.Text] = l.Stream
+	}
+	assert.Equal(t, StreamStdout, streams["starting"])
+	assert.Equal(t, StreamStderr, streams["error: something wrong"])
+	assert.Len(t, cmd.RecentLogs(1), 1)
+}
@@ -0,0 +1,115 @@
+package execd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/zoumo/logdog"
+)
+
+// managed is the set of pids started by execd, they are waited by
+// exec.Cmd.Wait and must not be reaped by the reaper
+var managed = struct {
+	sync.Mutex
+	pids map[int]bool
+}{pids: make(map[int]bool)}
+
+var reaperOnce sync.Once
+
+// startReaper reaps the orphaned zombie processes.
+//
+// When running as PID 1 in a container, the orphaned processes, e.g.
+// the children of keepalived, are re-parented to us and become zombies
+// after exiting if nobody waits for them. wait4(-1) would steal the
+// exit status of the processes started by os/exec, e.g. ipvsadm and
+// iptables, from exec.Cmd.Wait. They stay in our process group while
+// the processes managed by execd lead their own groups, so only the
+// zombie children in other process groups are reaped one by one.
+func startReaper() {
+	reaperOnce.Do(func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGCHLD)
+		go func() {
+			for range sigCh {
+				reapZombies("/proc", os.Getpid(), syscall.Getpgrp())
+			}
+		}()
+	})
+}
+
+func reapZombies(procRoot string, ppid, pgid int) {
+	managed.Lock()
+	defer managed.Unlock()
+
+	for _, pid := range zombieChildren(procRoot, ppid, pgid) {
+		if managed.pids[pid] {
+			continue
+		}
+		var ws syscall.WaitStatus
+		_, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil)
+		if err != nil && err != syscall.ECHILD {
+			log.Warn("execd: error reap zombie process", log.Fields{"pid": pid, "err": err})
+			continue
+		}
+		log.Debug("execd: reaped zombie process", log.Fields{"pid": pid, "status": ws.ExitStatus()})
+	}
+}
+
+// zombieChildren returns the pids of zombie processes whose parent is ppid
+// and which are not in the process group pgid
+func zombieChildren(procRoot string, ppid, pgid int) []int {
+	dirs, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		log.Warn("execd: error read proc", log.Fields{"err": err})
+		return nil
+	}
+	var pids []int
+	for _, d := range dirs {
+		pid, err := strconv.Atoi(d.Name())
+		if err != nil || !d.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(procRoot, d.Name(), "stat"))
+		if err != nil {
+			// the process has gone
+			continue
+		}
+		state, parent, group, err := parseProcStat(string(data))
+		if err != nil {
+			continue
+		}
+		if state == "Z" && parent == ppid && group != pgid {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// parseProcStat returns the state, ppid and pgrp in /proc/<pid>/stat, e.g.
+// "1234 (keepalived) Z 1 1234 ...", the comm may contain spaces and parentheses
+func parseProcStat(stat string) (string, int, int, error) {
+	i := strings.LastIndex(stat, ")")
+	if i < 0 {
+		return "", 0, 0, fmt.Errorf("invalid stat %q", stat)
+	}
+	fields := strings.Fields(stat[i+1:])
+	if len(fields) < 3 {
+		return "", 0, 0, fmt.Errorf("invalid stat %q", stat)
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("invalid ppid in stat %q", stat)
+	}
+	pgrp, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("invalid pgrp in stat %q", stat)
+	}
+	return fields[0], ppid, pgrp, nil
+}
@@ -0,0 +1,150 @@
+package execd
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestParseProcStat(t *testing.T) {
+	cases := []struct {
+		stat  string
+		state string
+		ppid  int
+		pgrp  int
+		err   bool
+	}{
+		{"1234 (keepalived) Z 1 1234 1234 0 -1", "Z", 1, 1234, false},
+		{"1234 (a (b) c) S 42 1 1", "S", 42, 1, false},
+		{"1234 (keepalived", "", 0, 0, true},
+		{"1234 (keepalived) Z", "", 0, 0, true},
+		{"1234 (keepalived) Z x 1", "", 0, 0, true},
+		{"1234 (keepalived) Z 1", "", 0, 0, true},
+		{"1234 (keepalived) Z 1 x", "", 0, 0, true},
+	}
+	for _, c := range cases {
+		state, ppid, pgrp, err := parseProcStat(c.stat)
+		if c.err {
+			assert.NotNil(t, err, c.stat)
+			continue
+		}
+		assert.Nil(t, err, c.stat)
+		assert.Equal(t, c.state, state, c.stat)
+		assert.Equal(t, c.ppid, ppid, c.stat)
+		assert.Equal(t, c.pgrp, pgrp, c.stat)
+	}
+}
+
+func TestZombieChildren(t *testing.T) {
+	root, err := ioutil.TempDir("", "execd-proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	stats := map[string]string{
+		"10":   "10 (keepalived) Z 1 10",
+		"11":   "11 (keepalived) S 1 11",
+		"12":   "12 (sh) Z 5 12",
+		"13":   "13 (a b) Z 1 13",
+		"14":   "14 (ipvsadm) Z 1 1",
+		"self": "1 (provider) S 0 1",
+	}
+	for pid, stat := range stats {
+		if err := os.MkdirAll(filepath.Join(root, pid), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, pid, "stat"), []byte(stat), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the children in our process group are waited by exec.Cmd.Wait
+	assert.Equal(t, []int{10, 13}, zombieChildren(root, 1, 1))
+	assert.Equal(t, []int{10, 13, 14}, zombieChildren(root, 1, 0))
+	assert.Equal(t, []int{12}, zombieChildren(root, 5, 1))
+}
+
+func TestReapZombiesKeepsExecStatus(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("no procfs")
+	}
+	reap := func() {
+		reapZombies("/proc", os.Getpid(), syscall.Getpgrp())
+	}
+	exitStatus := func(err error) int {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+		}
+		return -1
+	}
+
+	stopCh := make(chan struct{})
+	reaped := make(chan struct{})
+	go func() {
+		defer close(reaped)
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+				reap()
+			}
+		}
+	}()
+	// the children started by os/exec are not reaped
+	for i := 0; i < 20; i++ {
+		err := exec.Command("sh", "-c", "exit 3").Run()
+		assert.Equal(t, 3, exitStatus(err), "%v", err)
+	}
+	close(stopCh)
+	<-reaped
+
+	// the zombie child is reaped before Wait if it is in another process group
+	for _, setpgid := range []bool{false, true} {
+		cmd := exec.Command("sh", "-c", "exit 3")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: setpgid}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		stat := filepath.Join("/proc", strconv.Itoa(cmd.Process.Pid), "stat")
+		err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			data, err := ioutil.ReadFile(stat)
+			if err != nil {
+				return false, nil
+			}
+			state, _, _, err := parseProcStat(string(data))
+			return err == nil && state == "Z", nil
+		})
+		if !assert.Nil(t, err) {
+			continue
+		}
+		reap()
+		err = cmd.Wait()
+		if setpgid {
+			assert.Equal(t, -1, exitStatus(err), "%v", err)
+		} else {
+			assert.Equal(t, 3, exitStatus(err), "%v", err)
+		}
+	}
+}
+
+func TestProcessGroupAttr(t *testing.T) {
+	assert.Equal(t, &syscall.SysProcAttr{Setpgid: true}, processGroupAttr(nil))
+
+	attr := &syscall.SysProcAttr{Setsid: true}
+	assert.Equal(t, &syscall.SysProcAttr{Setsid: true}, processGroupAttr(attr))
+
+	attr = &syscall.SysProcAttr{Chroot: "/"}
+	assert.Equal(t, &syscall.SysProcAttr{Chroot: "/", Setpgid: true}, processGroupAttr(attr))
+	// the attr of the daemon is not changed
+	assert.False(t, attr.Setpgid)
+}
@@ -2,12 +2,13 @@ package azure
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"strings"
 	"time"
 
-	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-01-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-07-01/network"
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/to"
 	log "github.com/zoumo/logdog"
@@ -22,16 +23,38 @@ import (
 	"github.com/caicloud/loadbalancer-provider/providers/azure/client"
 )
 
+var (
+	// the reserved azure lb is recovered with retries when cleaning up
+	recoverPollInterval = 5 * time.Second
+	recoverPollTimeout  = 60 * time.Second
+)
+
+// loadBalancerPatcher patches the loadbalancer resource
+type loadBalancerPatcher interface {
+	Patch(namespace, name string, data []byte) (*lbapi.LoadBalancer, error)
+}
+
+type clientsetPatcher struct {
+	clientset *kubernetes.Clientset
+}
+
+func (p *clientsetPatcher) Patch(namespace, name string, data []byte) (*lbapi.LoadBalancer, error) {
+	return p.clientset.LoadbalanceV1alpha2().LoadBalancers(namespace).Patch(name, types.MergePatchType, data)
+}
+
 // AzureProvider azure lb provider
 type AzureProvider struct {
 	storeLister           core.StoreLister
-	clientset             *kubernetes.Clientset
+	patcher               loadBalancerPatcher
+	newClient             func(*core.StoreLister) (*client.Client, error)
 	loadBalancerNamespace string
 	loadBalancerName      string
 
 	// old azure lb azure spec
 	oldAzureProvider *lbapi.AzureProvider
 	nodes            []string
+	// raw config annotation
+	config string
 
 	// load balancer rules cache
 	tcpRuleMap map[string]string
@@ -39,12 +62,17 @@ type AzureProvider struct {
 
 	// cleanAzure
 	cleanAzure bool
+
+	// progress of the last failed sync
+	progress *syncProgress
 }
 
 // New creates a new azure LoadBalancer Provider.
+// The azure client is reused until the credential secret changes.
 func New(clientset *kubernetes.Clientset, name, namespace string) (*AzureProvider, error) {
 	azure := &AzureProvider{
-		clientset:             clientset,
+		patcher:               &clientsetPatcher{clientset: clientset},
+		newClient:             client.NewCache().Get,
 		loadBalancerName:      name,
 		loadBalancerNamespace: namespace,
 	}
@@ -105,6 +133,7 @@ func (l *AzureProvider) OnUpdate(lb *lbapi.LoadBalancer) error {
 	// ignore change of other providers
 	if reflect.DeepEqual(lb.Spec.Providers.Azure, l.oldAzureProvider) &&
 		reflect.DeepEqual(l.nodes, lb.Spec.Nodes.Names) &&
+		l.config == configAnnotation(lb) &&
 		!ruleChange {
 		return nil
 	}
@@ -122,6 +151,7 @@ func (l *AzureProvider) OnUpdate(lb *lbapi.LoadBalancer) error {
 	nlb := lb.DeepCopy()
 
 	azlb, ip, err := l.ensureSync(nlb, tcp, udp)
+	logRequestMetrics()
 
 	l.updateLoadBalancerAzureStatus(azlb, lb, ip, err)
 	if err == nil {
@@ -134,6 +164,7 @@ func (l *AzureProvider) OnUpdate(lb *lbapi.LoadBalancer) error {
 func (l *AzureProvider) updateCacheData(lb *lbapi.LoadBalancer, tcp, udp map[string]string) {
 	l.oldAzureProvider = lb.Spec.Providers.Azure
 	l.nodes = lb.Spec.Nodes.Names
+	l.config = configAnnotation(lb)
 	l.tcpRuleMap = tcp
 	l.udpRuleMap = udp
 }
@@ -202,39 +233,86 @@ func (l *AzureProvider) ensureSync(lb *lbapi.LoadBalancer, tcp, udp map[string]s
 		return nil, "", err
 	}
 
-	c, err := client.NewClient(&l.storeLister)
+	config, err := parseConfig(lb)
 	if err != nil {
-		log.Errorf("init client error %v", err)
+		log.Errorf("parse config error %v", err)
 		return nil, "", err
 	}
 
-	// get a valid azure load balancer
-	azlb, err := l.ensureAzureLoadbalancer(c, lb)
+	c, err := l.newClient(&l.storeLister)
 	if err != nil {
+		log.Errorf("init client error %v", err)
 		return nil, "", err
 	}
 
-	// make sure default config is correct
-	azlb, err = ensureSyncDefaultAzureLBConfig(c, azlb, lb)
+	// resume the failed sync if nothing changes
+	key := syncProgressKey(lb, tcp, udp)
+	if l.progress == nil || l.progress.key != key {
+		l.progress = newSyncProgress(key)
+	} else {
+		log.Info("resume the failed sync", log.Fields{"done": l.progress.done})
+	}
+	progress := l.progress
 
+	// the public ip is needed by the frontend of a new azure lb
+	err = ensureManagedPublicIPAddress(c, lb, config)
 	if err != nil {
 		return nil, "", err
 	}
 
-	ip, err := getPublicIPAddress(c, lb)
+	azlb, err := l.ensureAzureLoadbalancerWithProgress(c, lb, config, desiredProbes(config, tcp, udp), progress)
 	if err != nil {
 		return nil, "", err
 	}
 
-	err = ensureSyncRulesAndBackendPools(c, &l.storeLister, azlb, lb, tcp, udp)
+	ip, err := getPublicIPAddress(c, lb, config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = ensureSyncRulesAndBackendPools(c, &l.storeLister, azlb, lb, tcp, udp, config, progress)
+	if err == nil {
+		l.progress = nil
+	}
 
 	return azlb, ip, err
 }
 
-func getPublicIPAddress(c *client.Client, lb *lbapi.LoadBalancer) (string, error) {
+// ensureAzureLoadbalancerWithProgress gets a valid azure load balancer with
+// the default config and probes, it is only read if it is done in the failed sync
+func (l *AzureProvider) ensureAzureLoadbalancerWithProgress(c *client.Client, lb *lbapi.LoadBalancer, config *Config, probes []network.Probe, progress *syncProgress) (*network.LoadBalancer, error) {
+	if progress.finished(stepLoadBalancer) {
+		azureSpec := lb.Spec.Providers.Azure
+		azlb, err := getAzureLoadbalancer(c, azureSpec.ResourceGroupName, azureSpec.Name)
+		if err != nil {
+			return nil, err
+		}
+		if azlb != nil {
+			return azlb, nil
+		}
+		// deleted by others, start over
+		*progress = *newSyncProgress(progress.key)
+	}
+
+	// get a valid azure load balancer
+	azlb, err := l.ensureAzureLoadbalancer(c, lb, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// make sure default config is correct
+	azlb, err = ensureSyncDefaultAzureLBConfig(c, azlb, lb, config, probes)
+	if err != nil {
+		return nil, err
+	}
+	progress.finish(stepLoadBalancer)
+	return azlb, nil
+}
+
+func getPublicIPAddress(c *client.Client, lb *lbapi.LoadBalancer, config *Config) (string, error) {
 	if lb != nil && lb.Spec.Providers.Azure != nil &&
-		lb.Spec.Providers.Azure != nil && lb.Spec.Providers.Azure.IPAddressProperties.Public != nil {
-		public := lb.Spec.Providers.Azure.IPAddressProperties.Public
+		lb.Spec.Providers.Azure.IPAddressProperties.Public != nil {
+		public := config.ipAddressProperties(lb.Spec.Providers.Azure.IPAddressProperties).Public
 		group, name, err := getGroupAndResourceNameFromID(to.String(public.PublicIPAddressID), azurePublicIPAddresses)
 		if err != nil {
 			return "", err
@@ -285,14 +363,14 @@ func (l *AzureProvider) getProxyConfigMapAndCompare(lb *lbapi.LoadBalancer) (map
 }
 
 // get a valid azure load balancer
-func (l *AzureProvider) ensureAzureLoadbalancer(c *client.Client, lb *lbapi.LoadBalancer) (*network.LoadBalancer, error) {
+func (l *AzureProvider) ensureAzureLoadbalancer(c *client.Client, lb *lbapi.LoadBalancer, config *Config) (*network.LoadBalancer, error) {
 	azureSpec := lb.Spec.Providers.Azure
 	azlb, err := getAzureLoadbalancer(c, azureSpec.ResourceGroupName, azureSpec.Name)
 	if err != nil {
 		return nil, err
 	}
 	if azlb == nil {
-		azlb, err = createAzureLoadBalancer(c, lb)
+		azlb, err = createAzureLoadBalancer(c, lb, config)
 		if err != nil {
 			return nil, err
 		}
@@ -311,7 +389,7 @@ func (l *AzureProvider) pathLoadBalancerName(lb *lbapi.LoadBalancer, name string
 	lb.Spec.Providers.Azure.Name = name
 	l.setCacheAzureLoadbalancer(lb.Spec.Providers.Azure)
 	patch := fmt.Sprintf(`{"spec":{"providers":{"azure":{"name":"%s"}}}}`, name)
-	_, err := l.clientset.LoadbalanceV1alpha2().LoadBalancers(lb.Namespace).Patch(lb.Name, types.MergePatchType, []byte(patch))
+	_, err := l.patcher.Patch(lb.Namespace, lb.Name, []byte(patch))
 	if err != nil {
 		log.Errorf("patch lb %s failed %v", lb.Name, err)
 		return err
@@ -360,7 +438,7 @@ func (l *AzureProvider) patachFinalizersAndStatus(lb *lbapi.LoadBalancer, delete
 
 	patchJSON := strings.Join(patchs, ",")
 	patchJSON = fmt.Sprintf("{%s}", patchJSON)
-	_, err := l.clientset.LoadbalanceV1alpha2().LoadBalancers(namespace).Patch(name, types.MergePatchType, []byte(patchJSON))
+	_, err := l.patcher.Patch(namespace, name, []byte(patchJSON))
 	if err != nil {
 		log.Errorf("patch lb finalizers %s failed %v patch info %s", name, err, patchJSON)
 		return err
@@ -395,6 +473,8 @@ func (l *AzureProvider) patchLoadBalancerAzureStatus(lb *lbapi.LoadBalancer, pha
 		provisioningState = lb.Status.ProvidersStatuses.Azure.ProvisioningState
 		publicIPAddress = to.String(lb.Status.ProvidersStatuses.Azure.PublicIPAddress)
 	}
+	// the messages of errors may contain quotes
+	reason, message = escapeJSONString(reason), escapeJSONString(message)
 	var patch string
 	if result == nil {
 		patch = fmt.Sprintf(azureProviderStatusAndPublicIPAddressFormat, phase, reason, message, provisioningState, publicIPAddress)
@@ -406,7 +486,7 @@ func (l *AzureProvider) patchLoadBalancerAzureStatus(lb *lbapi.LoadBalancer, pha
 	if lb != nil {
 		namespace, name = lb.Namespace, lb.Name
 	}
-	lb, err := l.clientset.LoadbalanceV1alpha2().LoadBalancers(namespace).Patch(name, types.MergePatchType, []byte(patch))
+	lb, err := l.patcher.Patch(namespace, name, []byte(patch))
 	if err != nil {
 		log.Errorf("patch lb %s failed %v", name, err)
 		return nil, err
@@ -414,6 +494,43 @@ func (l *AzureProvider) patchLoadBalancerAzureStatus(lb *lbapi.LoadBalancer, pha
 	return lb, nil
 }
 
+// logRequestMetrics logs the requests to azure resource manager so far
+func logRequestMetrics() {
+	metrics := client.DefaultMetrics.Snapshot()
+	for _, op := range client.DefaultMetrics.Operations() {
+		m := metrics[op]
+		log.Debug("Azure requests", log.Fields{
+			"op":         op,
+			"requests":   m.Requests,
+			"errors":     m.Errors,
+			"throttled":  m.Throttled,
+			"retries":    m.Retries,
+			"avgLatency": m.AverageLatency(),
+			"maxLatency": m.MaxLatency,
+		})
+	}
+}
+
+// escapeJSONString escapes s to be put in a json string
+// managedPublicIPAddressProvider returns the azure provider whose public ip
+// is deleted, only the name and group of the azure lb are cached before the
+// first successful sync, so the ip properties of the spec are used if the
+// cached ones do not have a managed public ip
+func managedPublicIPAddressProvider(old *lbapi.AzureProvider, lb *lbapi.LoadBalancer) *lbapi.AzureProvider {
+	if managedPublicIPAddress(old.IPAddressProperties) || lb == nil || lb.Spec.Providers.Azure == nil {
+		return old
+	}
+	azure := *old
+	azure.IPAddressProperties = lb.Spec.Providers.Azure.IPAddressProperties
+	azure.ClusterID = lb.Spec.Providers.Azure.ClusterID
+	return &azure
+}
+
+func escapeJSONString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data[1 : len(data)-1])
+}
+
 // clean up azure lb info and make oldAzureProvider nil
 func (l *AzureProvider) cleanupAzureLB(lb *lbapi.LoadBalancer, deleteLB bool) error {
 	log.Info("start clean up ")
@@ -430,7 +547,7 @@ func (l *AzureProvider) cleanupAzureLB(lb *lbapi.LoadBalancer, deleteLB bool) er
 		}
 		return err
 	}
-	c, err := client.NewClient(&l.storeLister)
+	c, err := l.newClient(&l.storeLister)
 	if err != nil {
 		log.Errorf("init client error %v", err)
 		return err
@@ -453,7 +570,7 @@ func (l *AzureProvider) cleanupAzureLB(lb *lbapi.LoadBalancer, deleteLB bool) er
 	}
 
 	if reserve {
-		err = wait.Poll(5*time.Second, 60*time.Second, func() (bool, error) {
+		err = wait.Poll(recoverPollInterval, recoverPollTimeout, func() (bool, error) {
 			err = recoverDefaultAzureLoadBalancer(c, l.oldAzureProvider.ResourceGroupName, l.oldAzureProvider.Name)
 			if err == nil {
 				return true, nil
@@ -476,6 +593,20 @@ func (l *AzureProvider) cleanupAzureLB(lb *lbapi.LoadBalancer, deleteLB bool) er
 	if err != nil {
 		return err
 	}
+	// the public ip is in use until the azure lb is deleted
+	owner := getPublicIPAddressOwner(l.loadBalancerNamespace, l.loadBalancerName)
+	azure := managedPublicIPAddressProvider(l.oldAzureProvider, lb)
+	err = wait.Poll(recoverPollInterval, recoverPollTimeout, func() (bool, error) {
+		err = deleteManagedPublicIPAddress(c, azure, owner)
+		if err == nil {
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		l.patchLoadBalancerAzureStatus(lb, lbapi.AzureErrorPhase, err)
+		return err
+	}
 	err = l.patachFinalizersAndStatus(lb, deleteLB)
 	if err == nil {
 		l.cleanAzure = true
@@ -4,249 +4,1454 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-07-01/network"
 	"github.com/Azure/go-autorest/autorest/to"
-	"github.com/caicloud/clientset/kubernetes"
+	lblisters "github.com/caicloud/clientset/listers/loadbalance/v1alpha2"
 	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
-	"github.com/caicloud/loadbalancer-provider/providers/azure/client"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/tools/clientcmd"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/providers/azure/client"
+	aztesting "github.com/caicloud/loadbalancer-provider/providers/azure/client/testing"
 )
 
 const (
-	lbName          = "lb-lbtest-14f93ef434dc35225fa833674749ab98"
-	lbResourceGroup = "loadbalancer-test"
+	testGroup     = "test-group"
+	testNamespace = "kube-system"
+	testLBName    = "lb1"
+	testAzureName = "lb1-cluster1"
+	testPublicIP  = "52.0.0.1"
 )
 
-func getDefaultClient() (*client.Client, error) {
-	gopath := os.Getenv("GOPATH")
-	gopaths := strings.Split(gopath, ":")
-	if len(gopaths) == 0 {
-		return nil, fmt.Errorf("get env GOPATH err")
+type fakePatcher struct {
+	patches []string
+}
+
+func (p *fakePatcher) Patch(namespace, name string, data []byte) (*lbapi.LoadBalancer, error) {
+	p.patches = append(p.patches, string(data))
+	return &lbapi.LoadBalancer{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name}}, nil
+}
+
+// lastStatus returns the azure status in the last status patch
+func (p *fakePatcher) lastStatus(t *testing.T) *lbapi.AzureProviderStatus {
+	for i := len(p.patches) - 1; i >= 0; i-- {
+		lb := &lbapi.LoadBalancer{}
+		if err := json.Unmarshal([]byte(p.patches[i]), lb); err != nil {
+			t.Fatalf("invalid patch %s: %v", p.patches[i], err)
+		}
+		if lb.Status.ProvidersStatuses.Azure != nil {
+			return lb.Status.ProvidersStatuses.Azure
+		}
 	}
-	configFile := gopaths[0] + "/azure.json"
-	configBytes, err := ioutil.ReadFile(configFile)
-	if err != nil {
-		return nil, err
+	t.Fatal("no status is patched")
+	return nil
+}
+
+type testEnv struct {
+	fake     *aztesting.Fake
+	patcher  *fakePatcher
+	provider *AzureProvider
+	lbs      cache.Indexer
+	cms      cache.Indexer
+	nodes    cache.Indexer
+	// nics of nodes
+	nics map[string]string
+	// network security group shared by nodes
+	nsg string
+}
+
+// newTestEnv returns an azure with nodes node1, node2 and node3 and a
+// provider using it
+func newTestEnv(t *testing.T) *testEnv {
+	indexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+	env := &testEnv{
+		fake:    aztesting.NewFake(),
+		patcher: &fakePatcher{},
+		lbs:     cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers),
+		cms:     cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers),
+		nodes:   cache.NewIndexer(cache.MetaNamespaceKeyFunc, indexers),
+		nics:    make(map[string]string),
 	}
-	azConfig := &client.Config{}
-	err = json.Unmarshal(configBytes, azConfig)
-	if err != nil {
-		return nil, err
+
+	env.nsg = env.fake.AddSecurityGroup(testGroup, "nodes-nsg", network.SecurityRule{
+		Name: to.StringPtr("ssh"),
+		SecurityRulePropertiesFormat: &network.SecurityRulePropertiesFormat{
+			Protocol:                 network.SecurityRuleProtocolTCP,
+			SourcePortRange:          to.StringPtr("*"),
+			DestinationPortRange:     to.StringPtr("22"),
+			SourceAddressPrefix:      to.StringPtr("*"),
+			DestinationAddressPrefix: to.StringPtr("*"),
+			Access:                   network.SecurityRuleAccessAllow,
+			Priority:                 to.Int32Ptr(1000),
+			Direction:                network.SecurityRuleDirectionInbound,
+		},
+	})
+	env.fake.AddPublicIPAddress(testGroup, "lb1-ip", testPublicIP)
+	for i, name := range []string{"node1", "node2", "node3"} {
+		nic := env.fake.AddInterface(testGroup, name+"-nic", fmt.Sprintf("10.0.0.%d", i+4), env.nsg)
+		vm := env.fake.AddVirtualMachine(testGroup, name, nic)
+		env.nics[name] = nic
+		env.nodes.Add(&v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name,
+				Annotations: map[string]string{
+					annotationMachineCloudProvider: annotationCaicloudAzure,
+					annotationVirtualMachineID:     vm,
+				},
+			},
+		})
 	}
 
-	return client.NewClientWithConfig(azConfig)
+	env.provider = &AzureProvider{
+		patcher: env.patcher,
+		newClient: func(*core.StoreLister) (*client.Client, error) {
+			return env.fake.Client(), nil
+		},
+		loadBalancerNamespace: testNamespace,
+		loadBalancerName:      testLBName,
+	}
+	env.provider.SetListers(core.StoreLister{
+		LoadBalancer: lblisters.NewLoadBalancerLister(env.lbs),
+		ConfigMap:    v1listers.NewConfigMapLister(env.cms),
+		Node:         v1listers.NewNodeLister(env.nodes),
+	})
+	env.setPorts(nil, nil)
+	return env
 }
 
-func TestCreateAzureLoadBalancer_PublicAddress(t *testing.T) {
-	azClient, err := getDefaultClient()
-	if err != nil {
-		t.Fatalf("getDefaultClient failed : %v", err)
-	}
+func (env *testEnv) newLoadBalancer(nodes ...string) *lbapi.LoadBalancer {
 	lb := &lbapi.LoadBalancer{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: "lbtest",
+			Namespace:  testNamespace,
+			Name:       testLBName,
+			Finalizers: []string{azureFinalizer},
 		},
 		Spec: lbapi.LoadBalancerSpec{
+			Nodes: lbapi.NodesSpec{Names: nodes},
 			Providers: lbapi.ProvidersSpec{
 				Azure: &lbapi.AzureProvider{
-					ResourceGroupName: lbResourceGroup,
+					ResourceGroupName: testGroup,
 					Location:          "chinaeast",
-					SKU:               "Standard",
-					ClusterID:         "tail",
+					SKU:               lbapi.AzureStandardSKU,
+					ClusterID:         "cluster1",
 					IPAddressProperties: lbapi.AzureIPAddressProperties{
 						Public: &lbapi.AzurePublicIPAddressProperties{
-							PublicIPAddressID: to.StringPtr("/subscriptions/5d526643-5e89-4956-bbb8-9ad896af0b08/resourceGroups/loadbalancer-test/providers/Microsoft.Network/publicIPAddresses/public-ip"),
+							PublicIPAddressID: to.StringPtr(aztesting.ResourceID(testGroup, "publicIPAddresses", "lb1-ip")),
 						},
 					},
 				},
 			},
 		},
+		Status: lbapi.LoadBalancerStatus{
+			ProxyStatus: lbapi.ProxyStatus{
+				TCPConfigMap: "lb1-tcp",
+				UDPConfigMap: "lb1-udp",
+			},
+		},
 	}
+	env.lbs.Add(lb)
+	return lb
+}
 
-	// test create loadbalancer
-	_, err = createAzureLoadBalancer(azClient, lb)
+func (env *testEnv) setPorts(tcp, udp map[string]string) {
+	env.cms.Update(&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "lb1-tcp"}, Data: tcp})
+	env.cms.Update(&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: "lb1-udp"}, Data: udp})
+}
+
+func (env *testEnv) azureLB(t *testing.T) network.LoadBalancer {
+	azlb, err := env.fake.Client().LoadBalancer.Get(context.TODO(), testGroup, testAzureName, "")
 	if err != nil {
-		t.Fatalf("createAzureLoadBalancer failed %v", err)
+		t.Fatal(err)
+	}
+	return azlb
+}
+
+func ruleNames(azlb network.LoadBalancer) []string {
+	var names []string
+	for _, rule := range *azlb.LoadBalancingRules {
+		names = append(names, to.String(rule.Name))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// poolMembers returns the names of network interfaces in the backend pool
+func poolMembers(azlb network.LoadBalancer) []string {
+	var names []string
+	for _, ipc := range *(*azlb.BackendAddressPools)[0].BackendIPConfigurations {
+		_, name, _ := getGroupAndResourceNameFromID(to.String(ipc.ID), azureNetworkInterfaces)
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
 }
 
-func TestCreateAzureLoadBalancer_PrivateAddress(t *testing.T) {
-	azClient, err := getDefaultClient()
+// securityRules returns the rules in the security group as name:port and
+// their priorities, both are sorted because the priorities of generated rules
+// depend on the order of ports
+func (env *testEnv) securityRules(t *testing.T) ([]string, []int32) {
+	_, name, _ := getGroupAndResourceNameFromID(env.nsg, azureSecurityGroups)
+	sg, err := env.fake.Client().SecurityGroup.Get(context.TODO(), testGroup, name, "")
 	if err != nil {
-		t.Fatalf("getDefaultClient failed : %v", err)
+		t.Fatal(err)
 	}
-	lb := &lbapi.LoadBalancer{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: "lbtest",
+	var rules []string
+	var priorities []int32
+	for _, rule := range *sg.SecurityRules {
+		rules = append(rules, fmt.Sprintf("%s:%s", to.String(rule.Name), to.String(rule.DestinationPortRange)))
+		priorities = append(priorities, to.Int32(rule.Priority))
+	}
+	sort.Strings(rules)
+	sort.Slice(priorities, func(i, j int) bool { return priorities[i] < priorities[j] })
+	return rules, priorities
+}
+
+func azureWrites(calls []string) []string {
+	var writes []string
+	for _, call := range calls {
+		if !strings.HasSuffix(call, ".Get") {
+			writes = append(writes, call)
+		}
+	}
+	return writes
+}
+
+func TestOnUpdateCreate(t *testing.T) {
+	env := newTestEnv(t)
+	env.setPorts(map[string]string{"53": "default/dns:53", "8080": "default/web:80"}, map[string]string{"53": "default/dns:53"})
+	lb := env.newLoadBalancer("node1", "node2")
+
+	err := env.provider.OnUpdate(lb)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	azlb := env.azureLB(t)
+	assert.Equal(t, "Succeeded", to.String(azlb.ProvisioningState))
+	assert.Equal(t, "chinaeast", to.String(azlb.Location))
+	assert.Equal(t, network.LoadBalancerSkuName("Standard"), azlb.Sku.Name)
+	assert.Len(t, *azlb.FrontendIPConfigurations, 1)
+	assert.Len(t, *azlb.Probes, 2)
+	assert.Equal(t, []string{"tcp-443", "tcp-53", "tcp-80", "tcp-8080", "udp-53"}, ruleNames(azlb))
+	assert.Equal(t, []string{"node1-nic", "node2-nic"}, poolMembers(azlb))
+	rules, priorities := env.securityRules(t)
+	assert.Equal(t, []string{
+		"cps-lb-tcp-443:443",
+		"cps-lb-tcp-53:53",
+		"cps-lb-tcp-8080:8080",
+		"cps-lb-tcp-80:80",
+		"cps-lb-udp-53:53",
+		"ssh:22",
+	}, rules)
+	assert.Equal(t, []int32{1000, 1010, 1020, 1030, 1040, 1050}, priorities)
+
+	// the generated name is patched to spec
+	assert.Contains(t, env.patcher.patches, fmt.Sprintf(`{"spec":{"providers":{"azure":{"name":"%s"}}}}`, testAzureName))
+	status := env.patcher.lastStatus(t)
+	assert.Equal(t, lbapi.AzureRunningPhase, status.Phase)
+	assert.Equal(t, "Succeeded", status.ProvisioningState)
+	assert.Equal(t, testPublicIP, to.String(status.PublicIPAddress))
+
+	// nothing changes
+	env.fake.ResetCalls()
+	err = env.provider.OnUpdate(lb)
+	assert.Nil(t, err)
+	assert.Empty(t, env.fake.Calls())
+}
+
+func TestEnsureSyncIdempotent(t *testing.T) {
+	env := newTestEnv(t)
+	env.setPorts(map[string]string{"8080": "default/web:80"}, map[string]string{"53": "default/dns:53"})
+	lb := env.newLoadBalancer("node1", "node2")
+	if err := env.provider.OnUpdate(lb); err != nil {
+		t.Fatal(err)
+	}
+
+	// the status of azure is the same with spec, no write is needed
+	env.fake.ResetCalls()
+	lb.Spec.Providers.Azure.Name = testAzureName
+	_, ip, err := env.provider.ensureSync(lb, map[string]string{"8080": "default/web:80"}, map[string]string{"53": "default/dns:53"})
+	assert.Nil(t, err)
+	assert.Equal(t, testPublicIP, ip)
+	assert.Empty(t, azureWrites(env.fake.Calls()))
+}
+
+func TestSyncRules(t *testing.T) {
+	env := newTestEnv(t)
+	lb := env.newLoadBalancer("node1")
+	if err := env.provider.OnUpdate(lb); err != nil {
+		t.Fatal(err)
+	}
+	c := env.fake.Client()
+
+	steps := []struct {
+		name  string
+		tcp   map[string]string
+		udp   map[string]string
+		rules []string
+		write bool
+	}{
+		{
+			name:  "add tcp",
+			tcp:   map[string]string{"6060": "default/a:6060"},
+			rules: []string{"tcp-443", "tcp-6060", "tcp-80"},
+			write: true,
 		},
-		Spec: lbapi.LoadBalancerSpec{
-			Providers: lbapi.ProvidersSpec{
-				Azure: &lbapi.AzureProvider{
-					ResourceGroupName: "ca-demo",
-					Location:          "chinaeast",
-					SKU:               "Standard",
-					ClusterID:         "hello",
-					IPAddressProperties: lbapi.AzureIPAddressProperties{
-						// Public: &lbapi.PublicAzureIPAddressProperties{
-						// 	PublicIPAddressID: to.StringPtr("/subscriptions/5d526643-5e89-4956-bbb8-9ad896af0b08/resourceGroups/loadbalancer-test/providers/Microsoft.Network/publicIPAddresses/public-ip"),
-						// },
-						Private: &lbapi.AzurePrivateIPAddressProperties{
-							IPAllocationMethod: lbapi.AzureStaticIPAllocationMethod,
-							SubnetID:           "/subscriptions/5d526643-5e89-4956-bbb8-9ad896af0b08/resourceGroups/ca-demo/providers/Microsoft.Network/virtualNetworks/lb-test-zls/subnets/default",
-							VPCID:              "/subscriptions/5d526643-5e89-4956-bbb8-9ad896af0b08/resourceGroups/loadbalancer-test/providers/Microsoft.Network/virtualNetworks/loadbalancer-test-vnet",
-							PrivateIPAddress:   to.StringPtr("172.22.0.4"),
-						},
-					},
-				},
-			},
+		{
+			name:  "add tcp and udp",
+			tcp:   map[string]string{"6060": "default/a:6060", "6061": "default/b:6061"},
+			udp:   map[string]string{"6061": "default/b:6061"},
+			rules: []string{"tcp-443", "tcp-6060", "tcp-6061", "tcp-80", "udp-6061"},
+			write: true,
+		},
+		{
+			name:  "unchanged",
+			tcp:   map[string]string{"6060": "default/a:6060", "6061": "default/b:6061"},
+			udp:   map[string]string{"6061": "default/b:6061"},
+			rules: []string{"tcp-443", "tcp-6060", "tcp-6061", "tcp-80", "udp-6061"},
+		},
+		{
+			name:  "service changed",
+			tcp:   map[string]string{"6060": "default/c:6060", "6061": "default/b:6061"},
+			udp:   map[string]string{"6061": "default/b:6061"},
+			rules: []string{"tcp-443", "tcp-6060", "tcp-6061", "tcp-80", "udp-6061"},
+		},
+		{
+			name:  "remove",
+			tcp:   map[string]string{"6063": "default/d:6063"},
+			rules: []string{"tcp-443", "tcp-6063", "tcp-80"},
+			write: true,
+		},
+		{
+			name:  "invalid port is skipped",
+			tcp:   map[string]string{"6063": "default/d:6063", "http": "default/e:80"},
+			rules: []string{"tcp-443", "tcp-6063", "tcp-80"},
+			write: true,
+		},
+		{
+			name:  "remove all",
+			rules: []string{"tcp-443", "tcp-80"},
+			write: true,
 		},
 	}
 
-	_, err = createAzureLoadBalancer(azClient, lb)
-	if err != nil {
-		t.Fatalf("createAzureLoadBalancer failed %v", err)
+	for _, step := range steps {
+		azlb := env.azureLB(t)
+		env.fake.ResetCalls()
+		tcp, udp := copyMap(step.tcp), copyMap(step.udp)
+		err := syncRules(c, &azlb, tcp, udp, testGroup, nil)
+		if !assert.Nil(t, err, step.name) {
+			continue
+		}
+		assert.Equal(t, step.rules, ruleNames(env.azureLB(t)), step.name)
+		assert.Equal(t, step.write, len(env.fake.Calls()) > 0, step.name)
+		// the maps from configmaps are not modified
+		assert.Equal(t, copyMap(step.tcp), tcp, step.name)
+		assert.Equal(t, copyMap(step.udp), udp, step.name)
 	}
 }
 
-func TestAttachBackendPool(t *testing.T) {
+func TestSyncBackendPools(t *testing.T) {
+	env := newTestEnv(t)
+	lb := env.newLoadBalancer("node1")
+	if err := env.provider.OnUpdate(lb); err != nil {
+		t.Fatal(err)
+	}
+	c := env.fake.Client()
+	storeLister := &env.provider.storeLister
 
-	azClient, err := getDefaultClient()
-	if err != nil {
-		t.Fatalf("getDefaultClient failed : %v", err)
+	steps := []struct {
+		nodes   []string
+		members []string
+		detachs []string
+	}{
+		{nodes: []string{"node1", "node2"}, members: []string{"node1-nic", "node2-nic"}},
+		{nodes: []string{"node2", "node3"}, members: []string{"node2-nic", "node3-nic"}, detachs: []string{env.nics["node1"]}},
+		{nodes: []string{"node2", "node3"}, members: []string{"node2-nic", "node3-nic"}},
+		{nodes: nil, members: nil, detachs: []string{env.nics["node2"], env.nics["node3"]}},
+	}
+
+	for i, step := range steps {
+		azlb := env.azureLB(t)
+		detachs, attached, err := syncBackendPoolsWithNodes(c, storeLister, &azlb, step.nodes)
+		if !assert.Nil(t, err, "step %d", i) {
+			continue
+		}
+		sort.Strings(detachs)
+		assert.Equal(t, len(step.detachs), len(detachs), "step %d", i)
+		if len(step.detachs) > 0 {
+			assert.Equal(t, step.detachs, detachs, "step %d", i)
+		}
+		assert.Len(t, attached, len(step.nodes), "step %d", i)
+		assert.Equal(t, step.members, poolMembers(env.azureLB(t)), "step %d", i)
+	}
+
+	// unknown node
+	azlb := env.azureLB(t)
+	_, _, err := syncBackendPoolsWithNodes(c, storeLister, &azlb, []string{"node4"})
+	assert.NotNil(t, err)
+}
+
+func TestAttachAndDetachNetworkInterface(t *testing.T) {
+	env := newTestEnv(t)
+	lb := env.newLoadBalancer()
+	if err := env.provider.OnUpdate(lb); err != nil {
+		t.Fatal(err)
+	}
+	c := env.fake.Client()
+	poolID := to.String((*env.azureLB(t).BackendAddressPools)[0].ID)
+	nic := env.nics["node1"]
+
+	cases := []struct {
+		name    string
+		op      func(*client.Client, string, string) error
+		poolID  string
+		err     bool
+		members []string
+		writes  int
+	}{
+		{"attach", attachNetworkInterfacesAndLoadBalancer, poolID, false, []string{"node1-nic"}, 1},
+		{"attach again", attachNetworkInterfacesAndLoadBalancer, poolID, false, []string{"node1-nic"}, 0},
+		// the ids from azure may be in different cases
+		{"attach again in upper case", attachNetworkInterfacesAndLoadBalancer, strings.ToUpper(poolID), false, []string{"node1-nic"}, 0},
+		{"attach to missing pool", attachNetworkInterfacesAndLoadBalancer, poolID + "-missing", true, []string{"node1-nic"}, 1},
+		{"detach", detachNetworkInterfacesAndLoadBalancer, poolID, false, nil, 1},
+		{"detach again", detachNetworkInterfacesAndLoadBalancer, poolID, false, nil, 0},
 	}
-	azlb, err := azClient.LoadBalancer.Get(context.TODO(), lbResourceGroup, lbName, "")
+	for _, cs := range cases {
+		env.fake.ResetCalls()
+		err := cs.op(c, nic, cs.poolID)
+		assert.Equal(t, cs.err, err != nil, "%s: %v", cs.name, err)
+		assert.Equal(t, cs.members, poolMembers(env.azureLB(t)), cs.name)
+		assert.Len(t, env.fake.Calls(), cs.writes, cs.name)
+	}
+}
+
+func TestSyncSecurityGroupRules(t *testing.T) {
+	env := newTestEnv(t)
+	c := env.fake.Client()
+	nic1, nic2 := env.nics["node1"], env.nics["node2"]
+
+	// the stale rules generated before, the wrong one is corrected
+	_, sgName, _ := getGroupAndResourceNameFromID(env.nsg, azureSecurityGroups)
+	sg, err := c.SecurityGroup.Get(context.TODO(), testGroup, sgName, "")
 	if err != nil {
-		t.Fatalf("get LoadBalancer failed : %v", err)
+		t.Fatal(err)
 	}
-	// test attach backEnd
-	networkInterfaces := []string{
-		"/subscriptions/5d526643-5e89-4956-bbb8-9ad896af0b08/resourceGroups/loadbalancer-test/providers/Microsoft.Network/networkInterfaces/load-privatenet540",
+	stale := getDefaultSecurityGroupRule(securityGroupTCPPrefix, "7070", to.Int32Ptr(1020))
+	wrong := getDefaultSecurityGroupRule(securityGroupUDPPrefix, "53", to.Int32Ptr(1030))
+	wrong.Access = network.SecurityRuleAccessDeny
+	*sg.SecurityRules = append(*sg.SecurityRules, *stale, *wrong)
+	if _, err := c.SecurityGroup.CreateOrUpdate(context.TODO(), testGroup, sgName, sg); err != nil {
+		t.Fatal(err)
 	}
-	pool := (*azlb.BackendAddressPools)[0]
-	for _, networkInterface := range networkInterfaces {
-		t.Logf("start attach network %s to pool %s\n", networkInterface, to.String(pool.ID))
-		err = attachNetworkInterfacesAndLoadBalancer(azClient, networkInterface, to.String(pool.ID))
-		if err != nil {
-			t.Fatalf("attach network %s to pool %s failed %v\n", networkInterface, to.String(pool.ID), err)
+
+	err = syncSecurityGroupRules(c,
+		map[string]string{"80": "", "8080": ""},
+		map[string]string{"53": ""},
+		nil,
+		networkInterfaceIDSet{nic1: {}, nic2: {}})
+	assert.Nil(t, err)
+	// the priority of the deleted rule is reused
+	rules, priorities := env.securityRules(t)
+	assert.Equal(t, []string{
+		"cps-lb-tcp-8080:8080",
+		"cps-lb-tcp-80:80",
+		"cps-lb-udp-53:53",
+		"ssh:22",
+	}, rules)
+	assert.Equal(t, []int32{1000, 1010, 1020, 1030}, priorities)
+
+	sg, _ = c.SecurityGroup.Get(context.TODO(), testGroup, sgName, "")
+	for _, rule := range *sg.SecurityRules {
+		assert.Equal(t, network.SecurityRuleAccessAllow, rule.Access, to.String(rule.Name))
+	}
+
+	// the security group of detached interfaces is cleaned up if no
+	// interface in the pool uses it
+	err = syncSecurityGroupRules(c, nil, nil, []string{nic1, nic2}, nil)
+	assert.Nil(t, err)
+	rules, _ = env.securityRules(t)
+	assert.Equal(t, []string{"ssh:22"}, rules)
+}
+
+func TestCleanup(t *testing.T) {
+	recoverPollInterval, recoverPollTimeout = 10*time.Millisecond, 100*time.Millisecond
+	defer func() {
+		recoverPollInterval, recoverPollTimeout = 5*time.Second, 60*time.Second
+	}()
+
+	cases := []struct {
+		name    string
+		reserve bool
+		delete  bool
+	}{
+		{name: "delete azure lb", reserve: false, delete: true},
+		{name: "reserve azure lb", reserve: true, delete: true},
+		{name: "remove azure provider", reserve: false, delete: false},
+	}
+
+	for _, cs := range cases {
+		env := newTestEnv(t)
+		env.setPorts(map[string]string{"8080": "default/web:80"}, nil)
+		outboundIP := env.fake.AddPublicIPAddress(testGroup, "outbound-ip", "52.0.0.2")
+		secondIP := env.fake.AddPublicIPAddress(testGroup, "second-ip", "52.0.0.3")
+		lb := env.newLoadBalancer("node1", "node2")
+		lb.Annotations = map[string]string{ConfigAnnotation: fmt.Sprintf(
+			`{"outbound":{"publicIPAddressID":"%s"},"frontends":{"second":{"publicIPAddressID":"%s"}},"ports":{"8080":{"frontend":"second"}}}`, outboundIP, secondIP)}
+		if err := env.provider.OnUpdate(lb); err != nil {
+			t.Fatal(err)
 		}
-		t.Logf("attach network %s to pool %s success\n", networkInterface, to.String(pool.ID))
+		rules, _ := env.securityRules(t)
+		assert.Len(t, rules, 4, cs.name)
+		assert.Len(t, *env.azureLB(t).OutboundRules, 1, cs.name)
+		assert.Len(t, *env.azureLB(t).FrontendIPConfigurations, 3, cs.name)
+
+		lb = lb.DeepCopy()
+		lb.Spec.Providers.Azure.Name = testAzureName
+		lb.Spec.Providers.Azure.ReserveAzure = to.BoolPtr(cs.reserve)
+		if cs.delete {
+			now := metav1.Now()
+			lb.DeletionTimestamp = &now
+		} else {
+			lb.Spec.Providers.Azure = nil
+		}
+		err := env.provider.OnUpdate(lb)
+		if !assert.Nil(t, err, cs.name) {
+			continue
+		}
+
+		// the generated security rules are removed anyway
+		rules, _ = env.securityRules(t)
+		assert.Equal(t, []string{"ssh:22"}, rules, cs.name)
+
+		azlb, err := env.fake.Client().LoadBalancer.Get(context.TODO(), testGroup, testAzureName, "")
+		if cs.reserve {
+			assert.Nil(t, err, cs.name)
+			assert.Empty(t, *azlb.LoadBalancingRules, cs.name)
+			assert.Empty(t, *azlb.Probes, cs.name)
+			assert.Empty(t, *azlb.OutboundRules, cs.name)
+			if assert.Len(t, *azlb.FrontendIPConfigurations, 1, cs.name) {
+				assert.Equal(t, azureLoadBalancerFrontendName, to.String((*azlb.FrontendIPConfigurations)[0].Name), cs.name)
+			}
+			assert.Empty(t, poolMembers(azlb), cs.name)
+		} else {
+			assert.True(t, client.IsNotFound(err), cs.name)
+		}
+		// the public ips of users are no longer in use
+		assert.Nil(t, env.fake.Client().PublicIPAddress.Delete(context.TODO(), testGroup, "second-ip"), cs.name)
+		// the interfaces are detached
+		for _, name := range []string{"node1-nic", "node2-nic"} {
+			nic, err := env.fake.Client().NetworkInterface.Get(context.TODO(), testGroup, name, "")
+			assert.Nil(t, err)
+			pools := (*nic.IPConfigurations)[0].LoadBalancerBackendAddressPools
+			assert.True(t, pools == nil || len(*pools) == 0, cs.name)
+		}
+
+		// the finalizer is removed on deletion, otherwise the status is
+		// cleared
+		last := env.patcher.patches[len(env.patcher.patches)-1]
+		if cs.delete {
+			assert.Equal(t, `{"metadata":{"finalizers":[]}}`, last, cs.name)
+		} else {
+			assert.Equal(t, `{"status":{"ProvidersStatuses":{"azure":{}}}}`, last, cs.name)
+		}
+
+		// cleaned up only once
+		env.fake.ResetCalls()
+		assert.Nil(t, env.provider.OnUpdate(lb), cs.name)
+		assert.Empty(t, env.fake.Calls(), cs.name)
 	}
-	t.Logf("OK")
 }
 
-func TestDetachBackendPool(t *testing.T) {
+func TestErrorStatus(t *testing.T) {
+	cases := []struct {
+		name    string
+		inject  func(env *testEnv)
+		reason  string
+		message string
+	}{
+		{
+			name: "create azure lb failed",
+			inject: func(env *testEnv) {
+				env.fake.Errors["LoadBalancer.CreateOrUpdate"] = aztesting.NewError(400, "InvalidResourceReference", "Resource is not found.")
+			},
+			reason:  "InvalidResourceReference",
+			message: "Resource is not found.",
+		},
+		{
+			name: "invalid credential",
+			inject: func(env *testEnv) {
+				env.provider.newClient = func(*core.StoreLister) (*client.Client, error) {
+					return nil, client.NewServiceError("InvalidAuth", "invalid client secret")
+				}
+			},
+			reason:  "InvalidAuth",
+			message: "invalid client secret",
+		},
+		{
+			name: "update interface failed",
+			inject: func(env *testEnv) {
+				env.fake.Errors["NetworkInterface.CreateOrUpdate"] = aztesting.NewError(429, "RetryableError", "Too many requests.")
+			},
+			reason:  "RetryableError",
+			message: "Too many requests.",
+		},
+		{
+			name: "missing public ip",
+			inject: func(env *testEnv) {
+				env.fake.Errors["PublicIPAddress.Get"] = aztesting.NewError(404, "ResourceNotFound", "The public ip is not found.")
+			},
+			reason:  "ResourceNotFound",
+			message: "The public ip is not found.",
+		},
+		{
+			name: "unknown error",
+			inject: func(env *testEnv) {
+				env.fake.Errors["SecurityGroup.Get"] = fmt.Errorf("connection reset")
+			},
+			reason:  "Unknown",
+			message: "connection reset",
+		},
+	}
 
-	azClient, err := getDefaultClient()
-	if err != nil {
-		t.Fatalf("getDefaultClient failed : %v", err)
+	for _, cs := range cases {
+		env := newTestEnv(t)
+		lb := env.newLoadBalancer("node1")
+		cs.inject(env)
+
+		err := env.provider.OnUpdate(lb)
+		assert.NotNil(t, err, cs.name)
+		status := env.patcher.lastStatus(t)
+		assert.Equal(t, lbapi.AzureErrorPhase, status.Phase, cs.name)
+		assert.Equal(t, cs.reason, status.Reason, cs.name)
+		assert.Equal(t, cs.message, status.Message, cs.name)
+
+		// recovered in the next update
+		env.fake.Errors = map[string]error{}
+		env.provider.newClient = func(*core.StoreLister) (*client.Client, error) {
+			return env.fake.Client(), nil
+		}
+		lb.Spec.Providers.Azure.Name = testAzureName
+		assert.Nil(t, env.provider.OnUpdate(lb), cs.name)
+		assert.Equal(t, lbapi.AzureRunningPhase, env.patcher.lastStatus(t).Phase, cs.name)
 	}
-	azlb, err := azClient.LoadBalancer.Get(context.TODO(), lbResourceGroup, lbName, "")
-	if err != nil {
-		t.Fatalf("get LoadBalancer failed : %v", err)
+}
+
+func TestResumeFailedSync(t *testing.T) {
+	env := newTestEnv(t)
+	env.setPorts(map[string]string{"8080": "default/web:80"}, nil)
+	lb := env.newLoadBalancer("node1")
+	if err := env.provider.OnUpdate(lb); err != nil {
+		t.Fatal(err)
+	}
+	lb = lb.DeepCopy()
+	lb.Spec.Providers.Azure.Name = testAzureName
+
+	// node2 fails but node3 is still attached
+	lb.Spec.Nodes.Names = []string{"node1", "node2", "node3"}
+	env.lbs.Update(lb)
+	env.fake.Errors["NetworkInterface.CreateOrUpdate test-group/node2-nic"] = aztesting.NewError(429, "RetryableError", "Too many requests.")
+	env.fake.ResetCalls()
+	err := env.provider.OnUpdate(lb)
+	assert.NotNil(t, err)
+	assert.Equal(t, "RetryableError", env.patcher.lastStatus(t).Reason)
+	assert.Equal(t, []string{"node1-nic", "node3-nic"}, poolMembers(env.azureLB(t)))
+
+	// the virtual machines are not listed again and only node2 is updated
+	env.fake.Errors = map[string]error{
+		"VirtualMachine.Get": aztesting.NewError(500, "InternalServerError", "should not list virtual machines"),
 	}
-	// test detach backEnd
-	networkInterfaces := []string{
-		"/subscriptions/5d526643-5e89-4956-bbb8-9ad896af0b08/resourceGroups/loadbalancer-test/providers/Microsoft.Network/networkInterfaces/load-privatenet540",
+	env.fake.ResetCalls()
+	err = env.provider.OnUpdate(lb)
+	if !assert.Nil(t, err) {
+		return
 	}
-	pool := (*azlb.BackendAddressPools)[0]
-	for _, networkInterface := range networkInterfaces {
-		t.Logf("start detach network %s to pool %s\n", networkInterface, to.String(pool.ID))
-		err = detachNetworkInterfacesAndLoadBalancer(azClient, networkInterface, to.String(pool.ID))
-		if err != nil {
-			t.Fatalf("detach network %s to pool %s failed %v\n", networkInterface, to.String(pool.ID), err)
+	assert.Equal(t, []string{"node1-nic", "node2-nic", "node3-nic"}, poolMembers(env.azureLB(t)))
+	var nics []string
+	for _, call := range env.fake.Calls() {
+		assert.False(t, strings.HasPrefix(call, "LoadBalancer."), call)
+		if strings.HasPrefix(call, "NetworkInterface.") {
+			nics = append(nics, call)
 		}
-		t.Logf("detach network %s to pool %s success\n", networkInterface, to.String(pool.ID))
 	}
-	t.Logf("OK")
+	assert.Equal(t, []string{"NetworkInterface.CreateOrUpdate test-group/node2-nic"}, nics)
+	assert.Nil(t, env.provider.progress)
+	rules, _ := env.securityRules(t)
+	assert.Len(t, rules, 4)
 }
 
-func TestSyncLoadBalancerRules(t *testing.T) {
-	azClient, err := getDefaultClient()
-	if err != nil {
-		t.Fatalf("getDefaultClient failed : %v", err)
+func TestRestartChangedSync(t *testing.T) {
+	env := newTestEnv(t)
+	env.setPorts(map[string]string{"8080": "default/web:80"}, nil)
+	lb := env.newLoadBalancer("node1")
+	if err := env.provider.OnUpdate(lb); err != nil {
+		t.Fatal(err)
 	}
-	azlb, err := azClient.LoadBalancer.Get(context.TODO(), lbResourceGroup, lbName, "")
-	if err != nil {
-		t.Fatalf("get LoadBalancer failed : %v", err)
+	lb = lb.DeepCopy()
+	lb.Spec.Providers.Azure.Name = testAzureName
+
+	lb.Spec.Nodes.Names = []string{"node1", "node2"}
+	env.lbs.Update(lb)
+	env.fake.Errors["NetworkInterface.CreateOrUpdate"] = aztesting.NewError(429, "RetryableError", "Too many requests.")
+	assert.NotNil(t, env.provider.OnUpdate(lb))
+
+	// the ports change, the sync starts over and the rules are updated
+	env.fake.Errors = map[string]error{}
+	env.setPorts(map[string]string{"8080": "default/web:80", "9090": "default/web:90"}, nil)
+	env.fake.ResetCalls()
+	assert.Nil(t, env.provider.OnUpdate(lb))
+	assert.Contains(t, env.fake.Calls(), "LoadBalancer.CreateOrUpdate test-group/"+testAzureName)
+	assert.Equal(t, []string{"tcp-443", "tcp-80", "tcp-8080", "tcp-9090"}, ruleNames(env.azureLB(t)))
+	assert.Equal(t, []string{"node1-nic", "node2-nic"}, poolMembers(env.azureLB(t)))
+}
+
+func TestErrorMessageEscaped(t *testing.T) {
+	env := newTestEnv(t)
+	lb := env.newLoadBalancer("node1")
+	env.fake.Errors["LoadBalancer.CreateOrUpdate"] = aztesting.NewError(400, "InvalidParameter", `The value "lb1" is invalid.`)
+
+	assert.NotNil(t, env.provider.OnUpdate(lb))
+	status := env.patcher.lastStatus(t)
+	assert.Equal(t, `The value "lb1" is invalid.`, status.Message)
+}
+
+// ruleProbes returns the probe name of rules
+func ruleProbes(azlb network.LoadBalancer) map[string]string {
+	probes := make(map[string]string)
+	for _, rule := range *azlb.LoadBalancingRules {
+		id := to.String(rule.Probe.ID)
+		probes[to.String(rule.Name)] = id[strings.LastIndex(id, "/")+1:]
 	}
+	return probes
+}
 
+func probeNames(azlb network.LoadBalancer) []string {
+	var names []string
 	for _, probe := range *azlb.Probes {
-		t.Logf("port %d\n", *probe.Port)
+		names = append(names, to.String(probe.Name))
 	}
-	m1 := map[string]string{
-		"6060": "default/test1:6060",
+	return names
+}
+
+func TestParseConfig(t *testing.T) {
+	cases := []struct {
+		name    string
+		config  string
+		sku     lbapi.AzureSKUKind
+		private bool
+		dynamic bool
+		err     string
+	}{
+		{name: "empty"},
+		{name: "probe", config: `{"probe":{"protocol":"http","path":"/healthz","intervalInSeconds":10,"numberOfProbes":2}}`},
+		{name: "ports", config: `{"ports":{"8080":{"probe":{"port":8081}},"udp/53":{"probe":{"port":53}}}}`},
+		{name: "https with standard sku", config: `{"probe":{"protocol":"https"}}`, sku: lbapi.AzureStandardSKU},
+		{name: "https with basic sku", config: `{"probe":{"protocol":"https"}}`, sku: lbapi.AzureBasicSKU, err: "require the Standard SKU"},
+		{name: "invalid json", config: `{"probe":`, err: "invalid annotation"},
+		{name: "unknown protocol", config: `{"probe":{"protocol":"icmp"}}`, err: "unknown protocol"},
+		{name: "invalid port", config: `{"probe":{"port":70000}}`, err: "out of range"},
+		{name: "invalid path", config: `{"probe":{"protocol":"http","path":"healthz"}}`, err: "must start with /"},
+		{name: "short interval", config: `{"probe":{"intervalInSeconds":1}}`, err: "at least 5"},
+		{name: "invalid key", config: `{"ports":{"sctp/80":{}}}`, err: "invalid protocol"},
+		{name: "invalid key port", config: `{"ports":{"tcp/http":{}}}`, err: "invalid port"},
+		{name: "udp probe without port", config: `{"ports":{"udp/53":{"probe":{"protocol":"http"}}}}`, err: "required by udp ports"},
+		{name: "rule", config: `{"rule":{"loadDistribution":"sourceip","idleTimeoutInMinutes":30},"ports":{"80":{"rule":{"enableFloatingIP":true}}}}`},
+		{name: "unknown load distribution", config: `{"rule":{"loadDistribution":"RoundRobin"}}`, err: "unknown load distribution"},
+		{name: "long idle timeout", config: `{"ports":{"tcp/8080":{"rule":{"idleTimeoutInMinutes":31}}}}`, err: "between 4 and 30"},
+		{name: "tcp reset", config: `{"rule":{"enableTcpReset":true}}`, sku: lbapi.AzureStandardSKU},
+		{name: "tcp reset with basic sku", config: `{"ports":{"80":{"rule":{"enableTcpReset":true}}}}`, sku: lbapi.AzureBasicSKU, err: "requires the Standard SKU"},
+		{name: "tcp reset disabled", config: `{"rule":{"enableTcpReset":false}}`},
+		{name: "ha ports", config: `{"haPorts":true}`, sku: lbapi.AzureStandardSKU, private: true},
+		{name: "ha ports with basic sku", config: `{"haPorts":true}`, sku: lbapi.AzureBasicSKU, private: true, err: "require the Standard SKU"},
+		{name: "ha ports with public frontend", config: `{"haPorts":true}`, sku: lbapi.AzureStandardSKU, err: "require a private frontend"},
+		{name: "outbound", config: `{"outbound":{"allocatedOutboundPorts":1024}}`, sku: lbapi.AzureStandardSKU},
+		{name: "outbound with basic sku", config: `{"outbound":{}}`, sku: lbapi.AzureBasicSKU, err: "require the Standard SKU"},
+		{name: "outbound of private frontend", config: `{"outbound":{}}`, sku: lbapi.AzureStandardSKU, private: true, err: "not supported by a private loadbalancer"},
+		{name: "outbound public ip", config: `{"outbound":{"publicIPAddressID":"/subscriptions/s/resourceGroups/g/providers/Microsoft.Network/publicIPAddresses/ip"}}`, sku: lbapi.AzureStandardSKU},
+		{name: "outbound public ip of private frontend", config: `{"outbound":{"publicIPAddressID":"/subscriptions/s/resourceGroups/g/providers/Microsoft.Network/publicIPAddresses/ip"}}`, sku: lbapi.AzureStandardSKU, private: true, err: "not supported by a private loadbalancer"},
+		{name: "invalid outbound public ip", config: `{"outbound":{"publicIPAddressID":"ip"}}`, sku: lbapi.AzureStandardSKU, err: "invalid public ip id"},
+		{name: "invalid outbound ports", config: `{"outbound":{"allocatedOutboundPorts":1001}}`, sku: lbapi.AzureStandardSKU, err: "multiple of 8"},
+		{name: "frontends", config: `{"frontends":{"internal":{"subnetID":"subnet","privateIPAddress":"10.0.0.10"}},"ports":{"53":{"frontend":"internal"}}}`, private: true},
+		{name: "invalid frontend name", config: `{"frontends":{"Internal":{"subnetID":"subnet"}}}`, err: "lower case alphanumerics"},
+		{name: "frontend without ip", config: `{"frontends":{"internal":{}}}`, err: "one of publicIPAddressID and subnetID"},
+		{name: "frontend with both ips", config: `{"frontends":{"internal":{"subnetID":"subnet","publicIPAddressID":"ip"}}}`, err: "one of publicIPAddressID and subnetID"},
+		{name: "invalid frontend public ip", config: `{"frontends":{"public":{"publicIPAddressID":"ip"}}}`, err: "invalid public ip id"},
+		{name: "invalid frontend private ip", config: `{"frontends":{"internal":{"subnetID":"subnet","privateIPAddress":"10.0.0"}}}`, err: "invalid ip"},
+		{name: "private frontend of public loadbalancer", config: `{"frontends":{"internal":{"subnetID":"subnet"}}}`, sku: lbapi.AzureStandardSKU, err: "can not be mixed"},
+		{name: "public frontend of private loadbalancer", config: `{"frontends":{"public":{"publicIPAddressID":"/subscriptions/s/resourceGroups/g/providers/Microsoft.Network/publicIPAddresses/ip"}}}`, private: true, err: "can not be mixed"},
+		{name: "public frontends", config: `{"frontends":{"public":{"publicIPAddressID":"/subscriptions/s/resourceGroups/g/providers/Microsoft.Network/publicIPAddresses/ip"}}}`},
+		{name: "unknown frontend", config: `{"ports":{"53":{"frontend":"internal"}}}`, err: "unknown frontend"},
+		{name: "public ip", config: `{"publicIP":{"dnsLabel":"lb1-cluster1"}}`, sku: lbapi.AzureStandardSKU},
+		{name: "dynamic public ip", config: `{"publicIP":{}}`, sku: lbapi.AzureBasicSKU, dynamic: true},
+		{name: "dynamic public ip with standard sku", sku: lbapi.AzureStandardSKU, dynamic: true, err: "must be static"},
+		{name: "invalid dns label", config: `{"publicIP":{"dnsLabel":"LB1"}}`, err: "invalid dns label"},
+		{name: "public ip of private frontend", config: `{"publicIP":{}}`, private: true, err: "requires a public loadbalancer"},
 	}
-	err = syncRules(azClient, &azlb, m1, nil, lbResourceGroup)
-	if err != nil {
-		t.Errorf("syncRule failed : %v", err)
+	for _, c := range cases {
+		lb := &lbapi.LoadBalancer{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ConfigAnnotation: c.config}},
+			Spec: lbapi.LoadBalancerSpec{
+				Providers: lbapi.ProvidersSpec{Azure: &lbapi.AzureProvider{SKU: c.sku}},
+			},
+		}
+		if c.private {
+			lb.Spec.Providers.Azure.IPAddressProperties.Private = &lbapi.AzurePrivateIPAddressProperties{SubnetID: "subnet"}
+		} else {
+			lb.Spec.Providers.Azure.IPAddressProperties.Public = &lbapi.AzurePublicIPAddressProperties{
+				IPAllocationMethod: lbapi.AzureStaticIPAllocationMethod,
+			}
+			if c.dynamic {
+				lb.Spec.Providers.Azure.IPAddressProperties.Public.IPAllocationMethod = lbapi.AzureDynamicIPAllocationMethod
+			}
+		}
+		config, err := parseConfig(lb)
+		if c.err == "" {
+			assert.Nil(t, err, c.name)
+			assert.NotNil(t, config, c.name)
+			continue
+		}
+		if assert.NotNil(t, err, c.name) {
+			assert.Contains(t, err.Error(), c.err, c.name)
+			if se, ok := err.(*client.ServiceError); assert.True(t, ok, c.name) {
+				assert.Equal(t, "InvalidConfig", se.Code, c.name)
+			}
+		}
 	}
-	m2 := map[string]string{
-		"6061": "default/test2:6061",
-		"6060": "default/test1:6060",
+}
+
+func TestConfigProbe(t *testing.T) {
+	cases := []struct {
+		name     string
+		config   *Config
+		protocol network.TransportProtocol
+		port     int32
+		expected *network.Probe
+	}{
+		{
+			name:     "default",
+			protocol: network.TransportProtocolTCP,
+			port:     8080,
+		},
+		{
+			name:     "tcp probes own port",
+			config:   &Config{Probe: &ProbeConfig{}},
+			protocol: network.TransportProtocolTCP,
+			port:     8080,
+			expected: &network.Probe{ProbePropertiesFormat: &network.ProbePropertiesFormat{
+				Protocol: network.ProbeProtocolTCP, Port: to.Int32Ptr(8080), IntervalInSeconds: to.Int32Ptr(5), NumberOfProbes: to.Int32Ptr(3),
+			}},
+		},
+		{
+			name:     "udp uses default probe",
+			config:   &Config{Probe: &ProbeConfig{}},
+			protocol: network.TransportProtocolUDP,
+			port:     53,
+		},
+		{
+			name: "port overrides loadbalancer",
+			config: &Config{
+				Probe: &ProbeConfig{Protocol: "http", Path: "/healthz", IntervalInSeconds: 10},
+				Ports: map[string]PortConfig{"tcp/8080": {Probe: &ProbeConfig{Port: 10254, NumberOfProbes: 2}}},
+			},
+			protocol: network.TransportProtocolTCP,
+			port:     8080,
+			expected: &network.Probe{ProbePropertiesFormat: &network.ProbePropertiesFormat{
+				Protocol: network.ProbeProtocolHTTP, Port: to.Int32Ptr(10254), IntervalInSeconds: to.Int32Ptr(10), NumberOfProbes: to.Int32Ptr(2), RequestPath: to.StringPtr("/healthz"),
+			}},
+		},
+		{
+			name: "port of both protocols",
+			config: &Config{
+				Ports: map[string]PortConfig{"53": {Probe: &ProbeConfig{Protocol: "http", Port: 8053}}},
+			},
+			protocol: network.TransportProtocolUDP,
+			port:     53,
+			expected: &network.Probe{ProbePropertiesFormat: &network.ProbePropertiesFormat{
+				Protocol: network.ProbeProtocolHTTP, Port: to.Int32Ptr(8053), IntervalInSeconds: to.Int32Ptr(5), NumberOfProbes: to.Int32Ptr(3), RequestPath: to.StringPtr("/"),
+			}},
+		},
+		{
+			name: "tcp clears path",
+			config: &Config{
+				Probe: &ProbeConfig{Protocol: "http", Path: "/healthz"},
+				Ports: map[string]PortConfig{"8080": {Probe: &ProbeConfig{Protocol: "tcp"}}},
+			},
+			protocol: network.TransportProtocolTCP,
+			port:     8080,
+			expected: &network.Probe{ProbePropertiesFormat: &network.ProbePropertiesFormat{
+				Protocol: network.ProbeProtocolTCP, Port: to.Int32Ptr(8080), IntervalInSeconds: to.Int32Ptr(5), NumberOfProbes: to.Int32Ptr(3),
+			}},
+		},
 	}
-	err = syncRules(azClient, &azlb, m2, nil, lbResourceGroup)
-	if err != nil {
-		t.Errorf("syncRule failed : %v", err)
+	for _, c := range cases {
+		probe := c.config.probe(c.protocol, c.port)
+		if c.expected == nil {
+			assert.Nil(t, probe, c.name)
+			continue
+		}
+		if assert.NotNil(t, probe, c.name) {
+			assert.Equal(t, c.expected.ProbePropertiesFormat, probe.ProbePropertiesFormat, c.name)
+		}
 	}
+}
 
-	m3 := map[string]string{
-		"6060": "default/test1:6060",
-		"6063": "default/test3:6063",
+func TestSyncConfigurableProbes(t *testing.T) {
+	env := newTestEnv(t)
+	env.setPorts(map[string]string{"8080": "default/web:80", "9090": "default/api:90"}, map[string]string{"53": "default/dns:53"})
+	lb := env.newLoadBalancer("node1")
+	if err := env.provider.OnUpdate(lb); err != nil {
+		t.Fatal(err)
 	}
-	err = syncRules(azClient, &azlb, m3, nil, lbResourceGroup)
-	if err != nil {
-		t.Errorf("syncRule failed : %v", err)
+	azlb := env.azureLB(t)
+	assert.Equal(t, []string{"80", "443"}, probeNames(azlb))
+	assert.Equal(t, map[string]string{
+		"tcp-80": "80", "tcp-443": "443", "tcp-8080": "80", "tcp-9090": "80", "udp-53": "80",
+	}, ruleProbes(azlb))
+
+	httpProbe := to.String(newProbe(&ProbeConfig{Protocol: "http", Port: 8080, Path: "/healthz"}).Name)
+	tcpProbe := to.String(newProbe(&ProbeConfig{Port: 9090}).Name)
+	steps := []struct {
+		name   string
+		config string
+		probes []string
+		rules  map[string]string
+	}{
+		{
+			name:   "loadbalancer probe",
+			config: `{"probe":{"protocol":"http","path":"/healthz"}}`,
+			probes: []string{"80", "443", "http-8080-", "http-9090-"},
+		},
+		{
+			name:   "port probe",
+			config: `{"ports":{"tcp/8080":{"probe":{"protocol":"http","path":"/healthz"}},"9090":{"probe":{}}}}`,
+			probes: []string{"80", "443", httpProbe, tcpProbe},
+			rules: map[string]string{
+				"tcp-80": "80", "tcp-443": "443", "tcp-8080": httpProbe, "tcp-9090": tcpProbe, "udp-53": "80",
+			},
+		},
+		{
+			name:   "probe other port",
+			config: `{"ports":{"tcp/8080":{"probe":{"protocol":"http","port":10254}}}}`,
+			probes: []string{"80", "443", "http-10254-"},
+		},
+		{
+			name:   "remove probe",
+			config: `{"ports":{"tcp/8080":{"probe":{"protocol":"http","path":"/healthz"}}}}`,
+			probes: []string{"80", "443", httpProbe},
+			rules: map[string]string{
+				"tcp-80": "80", "tcp-443": "443", "tcp-8080": httpProbe, "tcp-9090": "80", "udp-53": "80",
+			},
+		},
+		{
+			name:   "default",
+			probes: []string{"80", "443"},
+			rules: map[string]string{
+				"tcp-80": "80", "tcp-443": "443", "tcp-8080": "80", "tcp-9090": "80", "udp-53": "80",
+			},
+		},
 	}
+	for _, step := range steps {
+		lb.Annotations = map[string]string{ConfigAnnotation: step.config}
+		err := env.provider.OnUpdate(lb)
+		if !assert.Nil(t, err, step.name) {
+			continue
+		}
+		azlb := env.azureLB(t)
+		names := probeNames(azlb)
+		if assert.Len(t, names, len(step.probes), step.name) {
+			for i := range names {
+				assert.True(t, strings.HasPrefix(names[i], step.probes[i]), "%s: probe %s", step.name, names[i])
+			}
+		}
+		if step.rules != nil {
+			assert.Equal(t, step.rules, ruleProbes(azlb), step.name)
+		}
+		// only the exported ports have rules
+		assert.Equal(t, []string{"tcp-443", "tcp-80", "tcp-8080", "tcp-9090", "udp-53"}, ruleNames(azlb), step.name)
+		assert.Equal(t, lbapi.AzureRunningPhase, env.patcher.lastStatus(t).Phase, step.name)
+	}
+
+	// invalid config is reported in status
+	lb.Annotations = map[string]string{ConfigAnnotation: `{"probe":{"protocol":"icmp"}}`}
+	err := env.provider.OnUpdate(lb)
+	assert.NotNil(t, err)
+	status := env.patcher.lastStatus(t)
+	assert.Equal(t, lbapi.AzureErrorPhase, status.Phase)
+	assert.Equal(t, "InvalidConfig", status.Reason)
 }
 
-func TestDeleteAzureLB(t *testing.T) {
-	azClient, err := getDefaultClient()
-	if err != nil {
-		t.Fatalf("getDefaultClient failed : %v", err)
+func TestConfigApplyRule(t *testing.T) {
+	config := &Config{
+		Rule: &RuleConfig{LoadDistribution: "SourceIP", IdleTimeoutInMinutes: 10, EnableTCPReset: to.BoolPtr(true)},
+		Ports: map[string]PortConfig{
+			"tcp/8080": {Rule: &RuleConfig{IdleTimeoutInMinutes: 20, EnableFloatingIP: to.BoolPtr(true)}},
+			"53":       {Rule: &RuleConfig{LoadDistribution: "default", DisableOutboundSnat: to.BoolPtr(true)}},
+			"443":      {Rule: &RuleConfig{IdleTimeoutInMinutes: 30, EnableTCPReset: to.BoolPtr(true)}},
+		},
 	}
-	err = azClient.LoadBalancer.Delete(context.TODO(), "ca-demo", "lbte")
-	if err != nil {
-		t.Fatalf("createAzureLoadBalancer failed %v", err)
+	cases := []struct {
+		name     string
+		config   *Config
+		protocol network.TransportProtocol
+		port     int32
+		exported bool
+		expected network.LoadBalancingRulePropertiesFormat
+	}{
+		{
+			name:     "default",
+			protocol: network.TransportProtocolTCP,
+			port:     8080,
+			exported: true,
+			expected: network.LoadBalancingRulePropertiesFormat{LoadDistribution: network.SourceIPProtocol, IdleTimeoutInMinutes: to.Int32Ptr(4), EnableFloatingIP: to.BoolPtr(false), EnableTCPReset: to.BoolPtr(false), DisableOutboundSnat: to.BoolPtr(false)},
+		},
+		{
+			name:     "loadbalancer",
+			config:   config,
+			protocol: network.TransportProtocolTCP,
+			port:     9090,
+			exported: true,
+			expected: network.LoadBalancingRulePropertiesFormat{LoadDistribution: network.SourceIP, IdleTimeoutInMinutes: to.Int32Ptr(10), EnableFloatingIP: to.BoolPtr(false), EnableTCPReset: to.BoolPtr(true), DisableOutboundSnat: to.BoolPtr(false)},
+		},
+		{
+			name:     "port overrides loadbalancer",
+			config:   config,
+			protocol: network.TransportProtocolTCP,
+			port:     8080,
+			exported: true,
+			expected: network.LoadBalancingRulePropertiesFormat{LoadDistribution: network.SourceIP, IdleTimeoutInMinutes: to.Int32Ptr(20), EnableFloatingIP: to.BoolPtr(true), EnableTCPReset: to.BoolPtr(true), DisableOutboundSnat: to.BoolPtr(false)},
+		},
+		{
+			name:     "port of both protocols",
+			config:   config,
+			protocol: network.TransportProtocolUDP,
+			port:     53,
+			exported: true,
+			expected: network.LoadBalancingRulePropertiesFormat{LoadDistribution: network.Default, IdleTimeoutInMinutes: to.Int32Ptr(10), EnableFloatingIP: to.BoolPtr(false), EnableTCPReset: to.BoolPtr(false), DisableOutboundSnat: to.BoolPtr(true)},
+		},
+		{
+			name:     "proxy port",
+			config:   config,
+			protocol: network.TransportProtocolTCP,
+			port:     443,
+			expected: network.LoadBalancingRulePropertiesFormat{LoadDistribution: network.SourceIPProtocol, IdleTimeoutInMinutes: to.Int32Ptr(30), EnableFloatingIP: to.BoolPtr(false), EnableTCPReset: to.BoolPtr(true), DisableOutboundSnat: to.BoolPtr(false)},
+		},
+	}
+	for _, c := range cases {
+		rule := network.LoadBalancingRule{
+			LoadBalancingRulePropertiesFormat: &network.LoadBalancingRulePropertiesFormat{
+				Protocol:     c.protocol,
+				FrontendPort: to.Int32Ptr(c.port),
+			},
+		}
+		c.config.applyRule(&rule, c.exported)
+		c.expected.Protocol = c.protocol
+		c.expected.FrontendPort = to.Int32Ptr(c.port)
+		assert.Equal(t, c.expected, *rule.LoadBalancingRulePropertiesFormat, c.name)
 	}
 }
 
-func Test_GetVmNetworkInterfaces(t *testing.T) {
-	azClient, err := getDefaultClient()
-	if err != nil {
-		t.Fatalf("getDefaultClient failed : %v", err)
+func TestSyncRuleOptions(t *testing.T) {
+	env := newTestEnv(t)
+	env.setPorts(map[string]string{"8080": "default/web:80"}, map[string]string{"53": "default/dns:53"})
+	lb := env.newLoadBalancer("node1")
+	if err := env.provider.OnUpdate(lb); err != nil {
+		t.Fatal(err)
 	}
-	nets, err := getNetworkInterfacesFromVM(azClient, "/subscriptions/5d526643-5e89-4956-bbb8-9ad896af0b08/resourceGroups/cps-resource-dev-test/providers/Microsoft.Compute/virtualMachines/compass-vm-pjb3ua-1-bqbpt1n7n4fo-zpbvc")
-	t.Logf("nets %v", nets)
-	if err != nil {
-		t.Fatalf("getNetworkInterfacesFromVM failed %v", err)
+
+	idleTimeouts := func(azlb network.LoadBalancer) map[string]int32 {
+		timeouts := make(map[string]int32)
+		for _, rule := range *azlb.LoadBalancingRules {
+			timeouts[to.String(rule.Name)] = to.Int32(rule.IdleTimeoutInMinutes)
+		}
+		return timeouts
+	}
+	steps := []struct {
+		name     string
+		config   string
+		timeouts map[string]int32
+	}{
+		{
+			name:     "loadbalancer",
+			config:   `{"rule":{"idleTimeoutInMinutes":10}}`,
+			timeouts: map[string]int32{"tcp-80": 4, "tcp-443": 4, "tcp-8080": 10, "udp-53": 10},
+		},
+		{
+			name:     "ports",
+			config:   `{"rule":{"idleTimeoutInMinutes":10},"ports":{"tcp/8080":{"rule":{"idleTimeoutInMinutes":20}},"80":{"rule":{"idleTimeoutInMinutes":30}}}}`,
+			timeouts: map[string]int32{"tcp-80": 30, "tcp-443": 4, "tcp-8080": 20, "udp-53": 10},
+		},
+		{
+			name:     "default",
+			timeouts: map[string]int32{"tcp-80": 4, "tcp-443": 4, "tcp-8080": 4, "udp-53": 4},
+		},
+	}
+	for _, step := range steps {
+		lb.Annotations = map[string]string{ConfigAnnotation: step.config}
+		env.fake.ResetCalls()
+		err := env.provider.OnUpdate(lb)
+		if !assert.Nil(t, err, step.name) {
+			continue
+		}
+		azlb := env.azureLB(t)
+		assert.Equal(t, step.timeouts, idleTimeouts(azlb), step.name)
+		// the rules are updated in place
+		assert.Len(t, *azlb.LoadBalancingRules, 4, step.name)
+		assert.NotEmpty(t, azureWrites(env.fake.Calls()), step.name)
 	}
 }
 
-func TestKubeClient(t *testing.T) {
-	kubeConfigPath := os.Getenv("HOME") + "/.kube/config"
-	config, err := clientcmd.BuildConfigFromFlags("", kubeConfigPath)
-	if err != nil {
-		t.Fatalf("BuildConfigFromFlags failed : %v ", err)
+func TestSyncHAPorts(t *testing.T) {
+	env := newTestEnv(t)
+	env.setPorts(map[string]string{"8080": "default/web:80"}, map[string]string{"53": "default/dns:53"})
+	lb := env.newLoadBalancer("node1")
+	lb.Spec.Providers.Azure.IPAddressProperties = lbapi.AzureIPAddressProperties{
+		Private: &lbapi.AzurePrivateIPAddressProperties{
+			IPAllocationMethod: "Dynamic",
+			SubnetID:           aztesting.ResourceID(testGroup, "virtualNetworks", "vnet") + "/subnets/default",
+		},
 	}
-	// create clientset
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		t.Fatalf("Create kubernetes client error:%v", err)
+
+	steps := []struct {
+		name   string
+		config string
+		rules  []string
+	}{
+		{
+			name:  "rules of ports",
+			rules: []string{"tcp-443", "tcp-80", "tcp-8080", "udp-53"},
+		},
+		{
+			name:   "ha ports",
+			config: `{"haPorts":true,"probe":{"protocol":"http"},"rule":{"idleTimeoutInMinutes":10}}`,
+			rules:  []string{"ha-ports"},
+		},
+		{
+			name:  "disable ha ports",
+			rules: []string{"tcp-443", "tcp-80", "tcp-8080", "udp-53"},
+		},
 	}
-	lb, err := clientset.LoadbalanceV1alpha2().LoadBalancers("kube-system").Get("sda", metav1.GetOptions{})
-	if err != nil {
-		t.Fatalf("err %v", err)
+	for _, step := range steps {
+		lb.Annotations = map[string]string{ConfigAnnotation: step.config}
+		err := env.provider.OnUpdate(lb)
+		if !assert.Nil(t, err, step.name) {
+			continue
+		}
+		azlb := env.azureLB(t)
+		assert.Equal(t, step.rules, ruleNames(azlb), step.name)
+		if step.config == "" {
+			continue
+		}
+		rule := (*azlb.LoadBalancingRules)[0]
+		assert.Equal(t, network.TransportProtocolAll, rule.Protocol, step.name)
+		assert.Equal(t, int32(0), to.Int32(rule.FrontendPort), step.name)
+		assert.Equal(t, int32(0), to.Int32(rule.BackendPort), step.name)
+		assert.Equal(t, int32(10), to.Int32(rule.IdleTimeoutInMinutes), step.name)
+		assert.Equal(t, map[string]string{"ha-ports": "80"}, ruleProbes(azlb), step.name)
+		// the probes of ports are useless
+		assert.Equal(t, []string{"80", "443"}, probeNames(azlb), step.name)
 	}
-	provider := &AzureProvider{
-		clientset: clientset,
+}
+
+func TestSyncOutboundRules(t *testing.T) {
+	env := newTestEnv(t)
+	env.setPorts(map[string]string{"8080": "default/web:80"}, nil)
+	outboundIP := env.fake.AddPublicIPAddress(testGroup, "outbound-ip", "52.0.0.2")
+	lb := env.newLoadBalancer("node1")
+	if err := env.provider.OnUpdate(lb); err != nil {
+		t.Fatal(err)
 	}
-	lb, err = provider.patchLoadBalancerAzureStatus(lb, lbapi.AzureRunningPhase, nil)
-	if err != nil {
-		t.Fatalf("patch failed %s\n", err)
+	azlbID := to.String(env.azureLB(t).ID)
+	lb.Spec.Providers.Azure.Name = testAzureName
+
+	steps := []struct {
+		name      string
+		config    string
+		frontends []string
+		// frontend of the outbound rule
+		frontend string
+		ports    int32
+		write    bool
+	}{
+		{
+			name:      "frontend of spec",
+			config:    `{"outbound":{}}`,
+			frontends: []string{azureLoadBalancerFrontendName},
+			frontend:  azureLoadBalancerFrontendName,
+			write:     true,
+		},
+		{
+			name:      "unchanged",
+			config:    `{"outbound":{}, "probe":null}`,
+			frontends: []string{azureLoadBalancerFrontendName},
+			frontend:  azureLoadBalancerFrontendName,
+		},
+		{
+			name:      "dedicated frontend",
+			config:    fmt.Sprintf(`{"outbound":{"publicIPAddressID":"%s","allocatedOutboundPorts":2048}}`, outboundIP),
+			frontends: []string{azureLoadBalancerFrontendName, azureLoadBalancerOutboundFrontendName},
+			frontend:  azureLoadBalancerOutboundFrontendName,
+			ports:     2048,
+			write:     true,
+		},
+		{
+			name:      "remove",
+			frontends: []string{azureLoadBalancerFrontendName},
+			write:     true,
+		},
+	}
+	for _, step := range steps {
+		lb.Annotations = map[string]string{ConfigAnnotation: step.config}
+		env.fake.ResetCalls()
+		err := env.provider.OnUpdate(lb)
+		if !assert.Nil(t, err, step.name) {
+			continue
+		}
+		azlb := env.azureLB(t)
+		var frontends []string
+		for _, front := range *azlb.FrontendIPConfigurations {
+			frontends = append(frontends, to.String(front.Name))
+		}
+		assert.Equal(t, step.frontends, frontends, step.name)
+		// the rules of the frontend of spec are kept
+		assert.Equal(t, []string{"tcp-443", "tcp-80", "tcp-8080"}, ruleNames(azlb), step.name)
+		assert.Equal(t, step.write, len(azureWrites(env.fake.Calls())) != 0, step.name)
+
+		if step.frontend == "" {
+			assert.Empty(t, *azlb.OutboundRules, step.name)
+			continue
+		}
+		if !assert.Len(t, *azlb.OutboundRules, 1, step.name) {
+			continue
+		}
+		rule := (*azlb.OutboundRules)[0]
+		assert.Equal(t, azureLoadBalancerOutboundRuleName, to.String(rule.Name), step.name)
+		assert.Equal(t, network.Protocol1All, rule.Protocol, step.name)
+		assert.Equal(t, []network.SubResource{{ID: to.StringPtr(azlbID + "/frontendIPConfigurations/" + step.frontend)}}, *rule.FrontendIPConfigurations, step.name)
+		assert.Equal(t, azlbID+"/backendAddressPools/"+azureLoadBalancerBackendName, to.String(rule.BackendAddressPool.ID), step.name)
+		assert.Equal(t, step.ports, to.Int32(rule.AllocatedOutboundPorts), step.name)
+	}
+}
+
+func TestSyncFrontends(t *testing.T) {
+	env := newTestEnv(t)
+	env.setPorts(map[string]string{"8080": "default/web:80", "9090": "default/api:90"}, map[string]string{"53": "default/dns:53"})
+	secondIP := env.fake.AddPublicIPAddress(testGroup, "second-ip", "52.0.0.3")
+	thirdIP := env.fake.AddPublicIPAddress(testGroup, "third-ip", "52.0.0.4")
+	lb := env.newLoadBalancer("node1")
+	if err := env.provider.OnUpdate(lb); err != nil {
+		t.Fatal(err)
+	}
+	lb.Spec.Providers.Azure.Name = testAzureName
+
+	// ruleFrontends returns the frontend name of rules
+	ruleFrontends := func(azlb network.LoadBalancer) map[string]string {
+		frontends := make(map[string]string)
+		for _, rule := range *azlb.LoadBalancingRules {
+			id := to.String(rule.FrontendIPConfiguration.ID)
+			frontends[to.String(rule.Name)] = id[strings.LastIndex(id, "/")+1:]
+		}
+		return frontends
+	}
+	frontends := fmt.Sprintf(`"frontends":{"second":{"publicIPAddressID":"%s"},"third":{"publicIPAddressID":"%s"}}`, secondIP, thirdIP)
+	steps := []struct {
+		name      string
+		config    string
+		frontends []string
+		rules     map[string]string
+	}{
+		{
+			name:      "frontend of spec",
+			frontends: []string{"LoadBalancerFrontend"},
+			rules: map[string]string{
+				"tcp-80":   "LoadBalancerFrontend",
+				"tcp-443":  "LoadBalancerFrontend",
+				"tcp-8080": "LoadBalancerFrontend",
+				"tcp-9090": "LoadBalancerFrontend",
+				"udp-53":   "LoadBalancerFrontend",
+			},
+		},
+		{
+			name:      "ports of frontends",
+			config:    fmt.Sprintf(`{%s,"ports":{"9090":{"frontend":"second"},"udp/53":{"frontend":"third"}}}`, frontends),
+			frontends: []string{"LoadBalancerFrontend", "LoadBalancerFrontend-second", "LoadBalancerFrontend-third"},
+			rules: map[string]string{
+				"tcp-80":          "LoadBalancerFrontend",
+				"tcp-443":         "LoadBalancerFrontend",
+				"tcp-8080":        "LoadBalancerFrontend",
+				"second-tcp-9090": "LoadBalancerFrontend-second",
+				"third-udp-53":    "LoadBalancerFrontend-third",
+			},
+		},
+		{
+			name:      "move port",
+			config:    fmt.Sprintf(`{%s,"ports":{"9090":{"frontend":"third"},"udp/53":{"frontend":"third"}}}`, frontends),
+			frontends: []string{"LoadBalancerFrontend", "LoadBalancerFrontend-second", "LoadBalancerFrontend-third"},
+			rules: map[string]string{
+				"tcp-80":            "LoadBalancerFrontend",
+				"tcp-443":           "LoadBalancerFrontend",
+				"tcp-8080":          "LoadBalancerFrontend",
+				"third-tcp-9090":    "LoadBalancerFrontend-third",
+				"third-udp-53":      "LoadBalancerFrontend-third",
+			},
+		},
+		{
+			name:      "remove frontend",
+			config:    fmt.Sprintf(`{"frontends":{"third":{"publicIPAddressID":"%s"}},"ports":{"udp/53":{"frontend":"third"}}}`, thirdIP),
+			frontends: []string{"LoadBalancerFrontend", "LoadBalancerFrontend-third"},
+			rules: map[string]string{
+				"tcp-80":          "LoadBalancerFrontend",
+				"tcp-443":         "LoadBalancerFrontend",
+				"tcp-8080":        "LoadBalancerFrontend",
+				"tcp-9090":        "LoadBalancerFrontend",
+				"third-udp-53":    "LoadBalancerFrontend-third",
+			},
+		},
+	}
+	for _, step := range steps {
+		lb.Annotations = map[string]string{ConfigAnnotation: step.config}
+		err := env.provider.OnUpdate(lb)
+		if !assert.Nil(t, err, step.name) {
+			continue
+		}
+		azlb := env.azureLB(t)
+		var names []string
+		for _, front := range *azlb.FrontendIPConfigurations {
+			names = append(names, to.String(front.Name))
+		}
+		assert.Equal(t, step.frontends, names, step.name)
+		assert.Equal(t, step.rules, ruleFrontends(azlb), step.name)
+
+		// synced
+		env.fake.ResetCalls()
+		_, _, err = env.provider.ensureSync(lb, env.provider.tcpRuleMap, env.provider.udpRuleMap)
+		assert.Nil(t, err, step.name)
+		assert.Empty(t, azureWrites(env.fake.Calls()), step.name)
+	}
+}
+
+// newManagedLoadBalancer returns a loadbalancer whose public ip is created
+// by the provider
+func (env *testEnv) newManagedLoadBalancer(config string, nodes ...string) *lbapi.LoadBalancer {
+	lb := env.newLoadBalancer(nodes...)
+	lb.Spec.Providers.Azure.IPAddressProperties.Public = &lbapi.AzurePublicIPAddressProperties{
+		IPAllocationMethod: lbapi.AzureStaticIPAllocationMethod,
+	}
+	if config != "" {
+		lb.Annotations = map[string]string{ConfigAnnotation: config}
+	}
+	env.lbs.Update(lb)
+	return lb
+}
+
+func TestSyncManagedPublicIPAddress(t *testing.T) {
+	env := newTestEnv(t)
+	env.setPorts(map[string]string{"8080": "default/web:80"}, nil)
+	lb := env.newManagedLoadBalancer(`{"publicIP":{"dnsLabel":"lb1"}}`, "node1")
+	if err := env.provider.OnUpdate(lb); !assert.Nil(t, err) {
+		return
+	}
+	lb.Spec.Providers.Azure.Name = testAzureName
+
+	ipName := testAzureName + "-ip"
+	ip, err := env.fake.Client().PublicIPAddress.Get(context.TODO(), testGroup, ipName, "")
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, network.PublicIPAddressSkuNameStandard, ip.Sku.Name)
+	assert.Equal(t, network.Static, ip.PublicIPAllocationMethod)
+	assert.Equal(t, "lb1", to.String(ip.DNSSettings.DomainNameLabel))
+	assert.Equal(t, "cluster1", to.String(ip.Tags[publicIPAddressClusterTag]))
+	assert.Equal(t, testNamespace+"/"+testLBName, to.String(ip.Tags[publicIPAddressLoadBalancerTag]))
+
+	// the created public ip is used by the frontend and reported in status
+	azlb := env.azureLB(t)
+	assert.Equal(t, to.String(ip.ID), to.String((*azlb.FrontendIPConfigurations)[0].PublicIPAddress.ID))
+	assert.Equal(t, to.String(ip.IPAddress), to.String(env.patcher.lastStatus(t).PublicIPAddress))
+	assert.NotEqual(t, "", to.String(ip.IPAddress))
+
+	// nothing changes
+	env.fake.ResetCalls()
+	assert.Nil(t, env.provider.OnUpdate(lb))
+	assert.Empty(t, azureWrites(env.fake.Calls()))
+
+	// only the public ip is updated
+	lb.Annotations[ConfigAnnotation] = `{"publicIP":{"dnsLabel":"lb1-new"}}`
+	env.fake.ResetCalls()
+	assert.Nil(t, env.provider.OnUpdate(lb))
+	assert.Equal(t, []string{"PublicIPAddress.CreateOrUpdate " + testGroup + "/" + ipName}, azureWrites(env.fake.Calls()))
+	updated, _ := env.fake.Client().PublicIPAddress.Get(context.TODO(), testGroup, ipName, "")
+	assert.Equal(t, "lb1-new", to.String(updated.DNSSettings.DomainNameLabel))
+	assert.Equal(t, to.String(ip.IPAddress), to.String(updated.IPAddress))
+}
+
+func TestSyncManagedPublicIPAddressConflict(t *testing.T) {
+	env := newTestEnv(t)
+	env.fake.AddPublicIPAddress(testGroup, testAzureName+"-ip", "52.0.0.9")
+	lb := env.newManagedLoadBalancer("", "node1")
+
+	err := env.provider.OnUpdate(lb)
+	assert.NotNil(t, err)
+	status := env.patcher.lastStatus(t)
+	assert.Equal(t, lbapi.AzureErrorPhase, status.Phase)
+	assert.Equal(t, "PublicIPAddressConflict", status.Reason)
+
+	// the public ip of others is not changed
+	assert.Empty(t, azureWrites(env.fake.Calls()))
+}
+
+func TestCleanupManagedPublicIPAddress(t *testing.T) {
+	recoverPollInterval, recoverPollTimeout = 10*time.Millisecond, 100*time.Millisecond
+	defer func() {
+		recoverPollInterval, recoverPollTimeout = 5*time.Second, 60*time.Second
+	}()
+
+	cases := []struct {
+		name    string
+		reserve bool
+		// the sync fails after the public ip is created
+		failed bool
+	}{
+		{name: "delete public ip", reserve: false},
+		{name: "reserve public ip", reserve: true},
+		{name: "delete public ip after failed sync", reserve: false, failed: true},
+	}
+	for _, cs := range cases {
+		env := newTestEnv(t)
+		lb := env.newManagedLoadBalancer("", "node1")
+		if cs.failed {
+			env.fake.Errors["NetworkInterface.CreateOrUpdate"] = aztesting.NewError(400, "InvalidParameter", "The interface is invalid.")
+		}
+		if err := env.provider.OnUpdate(lb); (err != nil) != cs.failed {
+			t.Fatal(err)
+		}
+		delete(env.fake.Errors, "NetworkInterface.CreateOrUpdate")
+		_, err := env.fake.Client().PublicIPAddress.Get(context.TODO(), testGroup, testAzureName+"-ip", "")
+		assert.Nil(t, err, cs.name)
+
+		lb = lb.DeepCopy()
+		lb.Spec.Providers.Azure.Name = testAzureName
+		lb.Spec.Providers.Azure.ReserveAzure = to.BoolPtr(cs.reserve)
+		now := metav1.Now()
+		lb.DeletionTimestamp = &now
+		if err := env.provider.OnUpdate(lb); !assert.Nil(t, err, cs.name) {
+			continue
+		}
+
+		_, err = env.fake.Client().PublicIPAddress.Get(context.TODO(), testGroup, testAzureName+"-ip", "")
+		if cs.reserve {
+			assert.Nil(t, err, cs.name)
+		} else {
+			assert.True(t, client.IsNotFound(err), cs.name)
+		}
 	}
 }
@@ -0,0 +1,203 @@
+package client
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// authentication methods selected by the authMethod field of the credential
+// secret
+const (
+	// AuthMethodClientSecret authenticates as a service principal with
+	// clientID and clientSecret
+	AuthMethodClientSecret = "clientSecret"
+	// AuthMethodClientCertificate authenticates as a service principal with
+	// clientID and clientCertificate, the certificate is in PEM with the
+	// private key or PKCS#12 protected by clientCertificatePassword
+	AuthMethodClientCertificate = "clientCertificate"
+	// AuthMethodManagedIdentity authenticates with the managed identity of
+	// the node from IMDS or msiEndpoint, clientID selects a user assigned
+	// identity
+	AuthMethodManagedIdentity = "managedIdentity"
+	// AuthMethodWorkloadIdentity authenticates as clientID with the
+	// federated token in federatedTokenFile
+	AuthMethodWorkloadIdentity = "workloadIdentity"
+)
+
+// environment variables injected by the workload identity webhook
+const (
+	envClientID           = "AZURE_CLIENT_ID"
+	envTenantID           = "AZURE_TENANT_ID"
+	envFederatedTokenFile = "AZURE_FEDERATED_TOKEN_FILE"
+)
+
+const clientAssertionTypeJWT = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// authMethod returns the authentication method of config, it is inferred
+// from the credentials given if authMethod is not set
+func (c *Config) authMethod() string {
+	switch {
+	case c.AuthMethod != "":
+		return c.AuthMethod
+	case len(c.ClientCertificate) != 0:
+		return AuthMethodClientCertificate
+	case c.FederatedTokenFile != "":
+		return AuthMethodWorkloadIdentity
+	case c.ClientSecret == "" && c.MSIEndpoint != "":
+		return AuthMethodManagedIdentity
+	}
+	return AuthMethodClientSecret
+}
+
+func newAuthorizer(env azure.Environment, config *Config) (autorest.Authorizer, error) {
+	resource := tokenResource(env)
+
+	method := config.authMethod()
+	if method == AuthMethodManagedIdentity {
+		spt, err := newManagedIdentityToken(config, resource)
+		if err != nil {
+			return nil, err
+		}
+		return autorest.NewBearerAuthorizer(spt), nil
+	}
+
+	clientID, tenantID := config.ClientID, config.TenantID
+	if method == AuthMethodWorkloadIdentity {
+		clientID = valueOrEnv(clientID, envClientID)
+		tenantID = valueOrEnv(tenantID, envTenantID)
+	}
+	oauthConfig, err := adal.NewOAuthConfig(env.ActiveDirectoryEndpoint, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	var spt *adal.ServicePrincipalToken
+	switch method {
+	case AuthMethodClientSecret:
+		spt, err = adal.NewServicePrincipalToken(*oauthConfig, clientID, config.ClientSecret, resource)
+	case AuthMethodClientCertificate:
+		certificate, privateKey, perr := parseCertificate(config.ClientCertificate, config.ClientCertificatePassword)
+		if perr != nil {
+			return nil, perr
+		}
+		spt, err = adal.NewServicePrincipalTokenFromCertificate(*oauthConfig, clientID, certificate, privateKey, resource)
+	case AuthMethodWorkloadIdentity:
+		tokenFile := valueOrEnv(config.FederatedTokenFile, envFederatedTokenFile)
+		if tokenFile == "" {
+			return nil, fmt.Errorf("azure: federated token file is required by %s", method)
+		}
+		spt, err = adal.NewServicePrincipalTokenWithSecret(*oauthConfig, clientID, resource, &federatedTokenSecret{path: tokenFile})
+	default:
+		return nil, fmt.Errorf("azure: unknown auth method %q", method)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return autorest.NewBearerAuthorizer(spt), nil
+}
+
+func newManagedIdentityToken(config *Config, resource string) (*adal.ServicePrincipalToken, error) {
+	endpoint := config.MSIEndpoint
+	if endpoint == "" {
+		endpoint, _ = adal.GetMSIVMEndpoint()
+	}
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("azure: invalid msi endpoint %q: %v", endpoint, err)
+	}
+	if config.ClientID != "" {
+		return adal.NewServicePrincipalTokenFromMSIWithUserAssignedID(endpoint, resource, config.ClientID)
+	}
+	return adal.NewServicePrincipalTokenFromMSI(endpoint, resource)
+}
+
+func valueOrEnv(value, key string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(key)
+}
+
+// parseCertificate parses the certificate and its rsa private key in PEM or
+// PKCS#12
+func parseCertificate(data []byte, password string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	if !strings.Contains(string(data), "-----BEGIN") {
+		key, certificate, err := pkcs12.Decode(data, password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("azure: invalid client certificate: %v", err)
+		}
+		privateKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("azure: private key of client certificate is not rsa")
+		}
+		return certificate, privateKey, nil
+	}
+
+	var certificate *x509.Certificate
+	var privateKey *rsa.PrivateKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			if certificate != nil {
+				continue
+			}
+			c, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("azure: invalid client certificate: %v", err)
+			}
+			certificate = c
+		case "RSA PRIVATE KEY":
+			key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("azure: invalid private key of client certificate: %v", err)
+			}
+			privateKey = key
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("azure: invalid private key of client certificate: %v", err)
+			}
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				return nil, nil, fmt.Errorf("azure: private key of client certificate is not rsa")
+			}
+			privateKey = rsaKey
+		}
+	}
+	if certificate == nil || privateKey == nil {
+		return nil, nil, fmt.Errorf("azure: client certificate requires both the certificate and the private key")
+	}
+	return certificate, privateKey, nil
+}
+
+// federatedTokenSecret authenticates with the federated token in a file, the
+// file is read on every refresh since it is rotated by kubelet
+type federatedTokenSecret struct {
+	path string
+}
+
+// SetAuthenticationValues implements adal.ServicePrincipalSecret
+func (s *federatedTokenSecret) SetAuthenticationValues(spt *adal.ServicePrincipalToken, v *url.Values) error {
+	token, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("azure: read federated token: %v", err)
+	}
+	v.Set("client_assertion", strings.TrimSpace(string(token)))
+	v.Set("client_assertion_type", clientAssertionTypeJWT)
+	return nil
+}
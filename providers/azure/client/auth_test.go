@@ -0,0 +1,274 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+)
+
+// tokenServer is a stand-in of azure active directory and IMDS, it issues
+// the token named after the credential it receives
+type tokenServer struct {
+	*httptest.Server
+	requests []*http.Request
+}
+
+func newTokenServer() *tokenServer {
+	s := &tokenServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		s.requests = append(s.requests, r)
+
+		var token string
+		switch {
+		case r.URL.Path == "/msi/token":
+			if r.Header.Get("Metadata") != "true" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			token = "msi:" + r.URL.Query().Get("client_id")
+		case r.PostForm.Get("client_secret") != "":
+			token = "secret:" + r.PostForm.Get("client_secret")
+		case r.PostForm.Get("client_assertion_type") == clientAssertionTypeJWT:
+			token = "assertion:" + r.PostForm.Get("client_id")
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": token,
+			"expires_in":   "3600",
+			"expires_on":   "1893456000",
+			"not_before":   "1500000000",
+			"resource":     r.FormValue("resource"),
+			"token_type":   "Bearer",
+		})
+	}))
+	return s
+}
+
+func (s *tokenServer) environment() azure.Environment {
+	return azure.Environment{
+		Name:                    "AzureCustomCloud",
+		ResourceManagerEndpoint: s.URL + "/arm/",
+		ActiveDirectoryEndpoint: s.URL + "/",
+	}
+}
+
+func authorize(authorizer autorest.Authorizer) (string, error) {
+	req, err := autorest.Prepare(&http.Request{Header: http.Header{}}, authorizer.WithAuthorization())
+	if err != nil {
+		return "", err
+	}
+	return req.Header.Get("Authorization"), nil
+}
+
+func newTestCertificate(t *testing.T) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "loadbalancer-provider"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return append(data, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})...)
+}
+
+func TestNewAuthorizer(t *testing.T) {
+	server := newTokenServer()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "azure-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("federated-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certificate := newTestCertificate(t)
+
+	cases := []struct {
+		name      string
+		data      map[string]string
+		method    string
+		token     string
+		assertion string
+		err       bool
+	}{
+		{
+			name:   "client secret",
+			data:   map[string]string{"clientID": "id", "clientSecret": "s3cret", "tenantID": "tenant"},
+			method: AuthMethodClientSecret,
+			token:  "secret:s3cret",
+		},
+		{
+			name:   "client certificate",
+			data:   map[string]string{"clientID": "id", "tenantID": "tenant", "clientCertificate": string(certificate)},
+			method: AuthMethodClientCertificate,
+			token:  "assertion:id",
+		},
+		{
+			name:   "invalid client certificate",
+			data:   map[string]string{"authMethod": AuthMethodClientCertificate, "clientID": "id", "tenantID": "tenant", "clientCertificate": "-----BEGIN CERTIFICATE-----\n"},
+			method: AuthMethodClientCertificate,
+			err:    true,
+		},
+		{
+			name:   "system assigned managed identity",
+			data:   map[string]string{"msiEndpoint": server.URL + "/msi/token"},
+			method: AuthMethodManagedIdentity,
+			token:  "msi:",
+		},
+		{
+			name:   "user assigned managed identity",
+			data:   map[string]string{"authMethod": AuthMethodManagedIdentity, "clientID": "identity", "msiEndpoint": server.URL + "/msi/token"},
+			method: AuthMethodManagedIdentity,
+			token:  "msi:identity",
+		},
+		{
+			name:      "workload identity",
+			data:      map[string]string{"clientID": "id", "tenantID": "tenant", "federatedTokenFile": tokenFile},
+			method:    AuthMethodWorkloadIdentity,
+			token:     "assertion:id",
+			assertion: "federated-token",
+		},
+		{
+			name:   "workload identity without token file",
+			data:   map[string]string{"authMethod": AuthMethodWorkloadIdentity, "clientID": "id", "tenantID": "tenant"},
+			method: AuthMethodWorkloadIdentity,
+			err:    true,
+		},
+		{
+			name:   "unknown method",
+			data:   map[string]string{"authMethod": "password"},
+			method: "password",
+			err:    true,
+		},
+	}
+
+	for _, cs := range cases {
+		data := make(map[string][]byte)
+		for k, v := range cs.data {
+			data[k] = []byte(v)
+		}
+		config := NewConfig(data)
+		assert.Equal(t, cs.method, config.authMethod(), cs.name)
+
+		server.requests = nil
+		authorizer, err := newAuthorizer(server.environment(), config)
+		if cs.err {
+			assert.NotNil(t, err, cs.name)
+			continue
+		}
+		if !assert.Nil(t, err, cs.name) {
+			continue
+		}
+		header, err := authorize(authorizer)
+		if !assert.Nil(t, err, cs.name) {
+			continue
+		}
+		assert.Equal(t, "Bearer "+cs.token, header, cs.name)
+		if assert.Len(t, server.requests, 1, cs.name) && cs.assertion != "" {
+			assert.Equal(t, cs.assertion, server.requests[0].PostForm.Get("client_assertion"), cs.name)
+		}
+	}
+}
+
+func TestWorkloadIdentityFromEnv(t *testing.T) {
+	server := newTokenServer()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "azure-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	ioutil.WriteFile(tokenFile, []byte("token-1"), 0600)
+
+	for k, v := range map[string]string{envClientID: "env-id", envTenantID: "env-tenant", envFederatedTokenFile: tokenFile} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	authorizer, err := newAuthorizer(server.environment(), &Config{AuthMethod: AuthMethodWorkloadIdentity})
+	if !assert.Nil(t, err) {
+		return
+	}
+	header, err := authorize(authorizer)
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer assertion:env-id", header)
+	if assert.Len(t, server.requests, 1) {
+		assert.True(t, strings.HasPrefix(server.requests[0].URL.Path, "/env-tenant/"))
+		assert.Equal(t, "token-1", server.requests[0].PostForm.Get("client_assertion"))
+	}
+}
+
+func TestGetAPISecret(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	secrets := []*corev1.Secret{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "other"}, Type: corev1.SecretTypeOpaque, Data: map[string][]byte{"clientID": []byte("other")}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "azure"}, Type: SecretTypeAzure, Data: map[string][]byte{"clientID": []byte("azure")}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "lb"}, Type: corev1.SecretTypeOpaque, Data: map[string][]byte{"clientID": []byte("lb")}},
+	}
+	for _, secret := range secrets {
+		indexer.Add(secret)
+	}
+	storeLister := &core.StoreLister{Secret: v1listers.NewSecretLister(indexer)}
+	defer SetCredentialSecret("", "")
+
+	cases := []struct {
+		namespace string
+		name      string
+		clientID  string
+		err       bool
+	}{
+		{"", "", "azure", false},
+		{"default", "lb", "lb", false},
+		{"", "other", "other", false},
+		{"default", "missing", "", true},
+	}
+	for _, cs := range cases {
+		SetCredentialSecret(cs.namespace, cs.name)
+		data, err := getAPISecret(SecretTypeAzure, storeLister)
+		if cs.err {
+			assert.NotNil(t, err, cs.name)
+			continue
+		}
+		if assert.Nil(t, err, cs.name) {
+			assert.Equal(t, cs.clientID, string(data["clientID"]), cs.name)
+		}
+	}
+}
@@ -1,35 +1,16 @@
 package client
 
 import (
+	"sync"
+
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-06-01/compute"
-	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-01-01/network"
-	"github.com/Azure/go-autorest/autorest"
-	"github.com/Azure/go-autorest/autorest/azure"
-	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-07-01/network"
+	log "github.com/zoumo/logdog"
+	"k8s.io/apimachinery/pkg/types"
 
 	core "github.com/caicloud/loadbalancer-provider/core/provider"
 )
 
-// environment is the cloud environment operated in China
-var environment = azure.ChinaCloud
-
-var baseURL = environment.ResourceManagerEndpoint
-
-func newClientAuthorizer(clientID, clientSecret, tenantID string) (autorest.Authorizer, error) {
-	clientConfig := auth.ClientCredentialsConfig{
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
-		TenantID:     tenantID,
-		AADEndpoint:  environment.ActiveDirectoryEndpoint,
-		Resource:     environment.ResourceManagerEndpoint,
-	}
-	authorizer, err := clientConfig.Authorizer()
-	if err != nil {
-		return nil, err
-	}
-	return authorizer, nil
-}
-
 //NewConfig new config
 func NewConfig(data map[string][]byte) *Config {
 	return &Config{
@@ -37,32 +18,52 @@ func NewConfig(data map[string][]byte) *Config {
 		ClientID:       string(data["clientID"]),
 		ClientSecret:   string(data["clientSecret"]),
 		TenantID:       string(data["tenantID"]),
+		Cloud:          string(data["cloud"]),
+		Environment:    string(data["environment"]),
+
+		AuthMethod:                string(data["authMethod"]),
+		ClientCertificate:         data["clientCertificate"],
+		ClientCertificatePassword: string(data["clientCertificatePassword"]),
+		MSIEndpoint:               string(data["msiEndpoint"]),
+		FederatedTokenFile:        string(data["federatedTokenFile"]),
 	}
 }
 
 // NewClientWithConfig returns a Azure Client by config
 func NewClientWithConfig(config *Config) (*Client, error) {
-	authorizer, err := newClientAuthorizer(config.ClientID, config.ClientSecret, config.TenantID)
+	env, err := LoadEnvironment(config.Cloud, []byte(config.Environment))
+	if err != nil {
+		return nil, NewServiceError("InvalidEnvironment", err.Error())
+	}
+	baseURL := env.ResourceManagerEndpoint
+
+	authorizer, err := newAuthorizer(env, config)
 	if err != nil {
 		return nil, NewServiceError("InvalidAuth", err.Error())
 	}
 
 	lbClient := network.NewLoadBalancersClientWithBaseURI(baseURL, config.SubscriptionID)
 	lbClient.Authorizer = authorizer
+	withRetry(&lbClient.Client, DefaultRetryPolicy, DefaultMetrics)
 
 	vmClient := compute.NewVirtualMachinesClientWithBaseURI(baseURL, config.SubscriptionID)
 	vmClient.Authorizer = authorizer
+	withRetry(&vmClient.Client, DefaultRetryPolicy, DefaultMetrics)
 
 	networkInterfaceClient := network.NewInterfacesClientWithBaseURI(baseURL, config.SubscriptionID)
 	networkInterfaceClient.Authorizer = authorizer
+	withRetry(&networkInterfaceClient.Client, DefaultRetryPolicy, DefaultMetrics)
 
 	securityGroupClient := network.NewSecurityGroupsClientWithBaseURI(baseURL, config.SubscriptionID)
 	securityGroupClient.Authorizer = authorizer
+	withRetry(&securityGroupClient.Client, DefaultRetryPolicy, DefaultMetrics)
 
 	publicIPAddressClient := network.NewPublicIPAddressesClientWithBaseURI(baseURL, config.SubscriptionID)
 	publicIPAddressClient.Authorizer = authorizer
+	withRetry(&publicIPAddressClient.Client, DefaultRetryPolicy, DefaultMetrics)
 
 	return &Client{
+		Environment: env,
 		LoadBalancer: &loadBalancerClientWrapper{
 			LoadBalancersClient: lbClient,
 		},
@@ -76,7 +77,9 @@ func NewClientWithConfig(config *Config) (*Client, error) {
 		SecurityGroup: &securityGroupClientWrapper{
 			SecurityGroupsClient: securityGroupClient,
 		},
-		PublicIPAddress: publicIPAddressClient,
+		PublicIPAddress: &publicIPAddressClientWrapper{
+			PublicIPAddressesClient: publicIPAddressClient,
+		},
 	}, nil
 }
 
@@ -88,3 +91,54 @@ func NewClient(storeLister *core.StoreLister) (*Client, error) {
 	}
 	return NewClientWithConfig(NewConfig(secret))
 }
+
+// Cache holds the client built from the credential secret, the client and
+// its tokens are reused until the secret changes
+type Cache struct {
+	mu         sync.Mutex
+	newClient  func(*Config) (*Client, error)
+	client     *Client
+	secretUID  types.UID
+	secretRV   string
+	secretName string
+}
+
+// NewCache returns a Cache building clients by NewClientWithConfig
+func NewCache() *Cache {
+	return &Cache{newClient: NewClientWithConfig}
+}
+
+// Get returns the cached client, it is rebuilt if the credential secret is
+// replaced or updated
+func (c *Cache) Get(storeLister *core.StoreLister) (*Client, error) {
+	secret, err := getCredentialSecret(SecretTypeAzure, storeLister)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := secret.Namespace + "/" + secret.Name
+	if c.client != nil && c.secretUID == secret.UID && c.secretRV == secret.ResourceVersion && c.secretName == name {
+		return c.client, nil
+	}
+
+	client, err := c.newClient(NewConfig(secret.Data))
+	if err != nil {
+		return nil, err
+	}
+	if c.client != nil {
+		log.Info("Azure credential secret changed, client is rebuilt", log.Fields{"secret": name, "resourceVersion": secret.ResourceVersion})
+	}
+	c.client = client
+	c.secretUID, c.secretRV, c.secretName = secret.UID, secret.ResourceVersion, name
+	return client, nil
+}
+
+// Invalidate drops the cached client, the next Get rebuilds it
+func (c *Cache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.client = nil
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	v1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+)
+
+func TestCache(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	storeLister := &core.StoreLister{Secret: v1listers.NewSecretLister(indexer)}
+	secret := func(uid, rv, secret string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "azure", UID: types.UID("uid-" + uid), ResourceVersion: rv},
+			Type:       SecretTypeAzure,
+			Data:       map[string][]byte{"clientSecret": []byte(secret)},
+		}
+	}
+
+	var built []string
+	c := NewCache()
+	c.newClient = func(config *Config) (*Client, error) {
+		if config.ClientSecret == "invalid" {
+			return nil, NewServiceError("InvalidAuth", "invalid secret")
+		}
+		built = append(built, config.ClientSecret)
+		return &Client{Config: config}, nil
+	}
+
+	steps := []struct {
+		name   string
+		secret *corev1.Secret
+		want   string
+		built  int
+		err    bool
+	}{
+		{name: "missing secret", err: true},
+		{name: "build", secret: secret("1", "1", "a"), want: "a", built: 1},
+		{name: "reuse", secret: secret("1", "1", "a"), want: "a", built: 1},
+		{name: "rotated", secret: secret("1", "2", "b"), want: "b", built: 2},
+		{name: "recreated", secret: secret("2", "2", "b"), want: "b", built: 3},
+		{name: "invalid is not cached", secret: secret("2", "3", "invalid"), err: true, built: 3},
+		{name: "fixed", secret: secret("2", "4", "c"), want: "c", built: 4},
+	}
+
+	var last *Client
+	for _, step := range steps {
+		if step.secret != nil {
+			indexer.Update(step.secret)
+		}
+		client, err := c.Get(storeLister)
+		if step.err {
+			assert.NotNil(t, err, step.name)
+			continue
+		}
+		if !assert.Nil(t, err, step.name) {
+			continue
+		}
+		assert.Equal(t, step.want, client.Config.ClientSecret, step.name)
+		assert.Len(t, built, step.built, step.name)
+		if step.name == "reuse" {
+			assert.True(t, last == client, step.name)
+		}
+		last = client
+	}
+
+	c.Invalidate()
+	client, err := c.Get(storeLister)
+	assert.Nil(t, err)
+	assert.False(t, last == client)
+	assert.Equal(t, fmt.Sprint([]string{"a", "b", "b", "c", "c"}), fmt.Sprint(built))
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// names of the clouds accepted in the credential secret and the flag
+const (
+	CloudPublic       = "public"
+	CloudChina        = "china"
+	CloudUSGovernment = "usgovernment"
+	CloudGerman       = "german"
+	// CloudCustom uses the endpoints in the custom environment json,
+	// e.g. Azure Stack or a local stand-in
+	CloudCustom = "custom"
+)
+
+var clouds = map[string]azure.Environment{
+	CloudPublic:       azure.PublicCloud,
+	CloudChina:        azure.ChinaCloud,
+	CloudUSGovernment: azure.USGovernmentCloud,
+	CloudGerman:       azure.GermanCloud,
+}
+
+// defaultEnvironment is used if the credential secret does not specify a cloud
+var defaultEnvironment = azure.ChinaCloud
+
+// SetDefaultEnvironment sets the environment used if the credential secret
+// does not specify a cloud
+func SetDefaultEnvironment(env azure.Environment) {
+	defaultEnvironment = env
+}
+
+// EnvironmentFromName returns the environment of a known cloud, both the short
+// name such as public and the name used by autorest such as AzurePublicCloud
+// are accepted
+func EnvironmentFromName(name string) (azure.Environment, error) {
+	key := strings.ToLower(strings.TrimSpace(name))
+	key = strings.TrimSuffix(strings.TrimPrefix(key, "azure"), "cloud")
+	if env, ok := clouds[key]; ok {
+		return env, nil
+	}
+	return azure.Environment{}, fmt.Errorf("azure: unknown cloud %q", name)
+}
+
+// ParseEnvironment parses a custom environment in the json format of autorest,
+// the resource manager and active directory endpoints are required
+func ParseEnvironment(data []byte) (azure.Environment, error) {
+	env := azure.Environment{}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return env, fmt.Errorf("azure: invalid custom environment: %v", err)
+	}
+	if err := validateEndpoint("resourceManagerEndpoint", env.ResourceManagerEndpoint); err != nil {
+		return env, err
+	}
+	if err := validateEndpoint("activeDirectoryEndpoint", env.ActiveDirectoryEndpoint); err != nil {
+		return env, err
+	}
+	if env.Name == "" {
+		env.Name = "AzureCustomCloud"
+	}
+	return env, nil
+}
+
+func validateEndpoint(field, endpoint string) error {
+	if endpoint == "" {
+		return fmt.Errorf("azure: %s of custom environment is required", field)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("azure: invalid %s %q of custom environment", field, endpoint)
+	}
+	return nil
+}
+
+// LoadEnvironment returns the environment of the cloud, a custom environment is
+// used if the cloud is custom or empty with the custom json given, the default
+// environment is used if both are empty
+func LoadEnvironment(cloud string, custom []byte) (azure.Environment, error) {
+	custom = []byte(strings.TrimSpace(string(custom)))
+	switch {
+	case strings.EqualFold(cloud, CloudCustom) || strings.EqualFold(cloud, "AzureStackCloud"):
+		if len(custom) == 0 {
+			return azure.Environment{}, fmt.Errorf("azure: custom environment is required by cloud %s", cloud)
+		}
+		return ParseEnvironment(custom)
+	case cloud != "":
+		return EnvironmentFromName(cloud)
+	case len(custom) != 0:
+		return ParseEnvironment(custom)
+	}
+	return defaultEnvironment, nil
+}
+
+// tokenResource returns the resource to request tokens for
+func tokenResource(env azure.Environment) string {
+	if env.TokenAudience != "" {
+		return env.TokenAudience
+	}
+	return env.ResourceManagerEndpoint
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadEnvironment(t *testing.T) {
+	stack := `{
+		"name": "AzureStackCloud",
+		"resourceManagerEndpoint": "https://management.local.azurestack.external/",
+		"activeDirectoryEndpoint": "https://login.microsoftonline.com/",
+		"tokenAudience": "https://management.adfs.azurestack.local/4de154de"
+	}`
+	local := `{"resourceManagerEndpoint": "http://127.0.0.1:8080/", "activeDirectoryEndpoint": "http://127.0.0.1:8081/"}`
+
+	cases := []struct {
+		name     string
+		cloud    string
+		custom   string
+		err      bool
+		env      string
+		endpoint string
+		resource string
+	}{
+		{"default", "", "", false, "AzureChinaCloud", azure.ChinaCloud.ResourceManagerEndpoint, azure.ChinaCloud.TokenAudience},
+		{"public", "public", "", false, "AzurePublicCloud", "https://management.azure.com/", "https://management.azure.com/"},
+		{"china", "China", "", false, "AzureChinaCloud", azure.ChinaCloud.ResourceManagerEndpoint, azure.ChinaCloud.TokenAudience},
+		{"usgovernment", "usgovernment", "", false, "AzureUSGovernmentCloud", azure.USGovernmentCloud.ResourceManagerEndpoint, azure.USGovernmentCloud.TokenAudience},
+		{"autorest name", "AzureGermanCloud", "", false, "AzureGermanCloud", azure.GermanCloud.ResourceManagerEndpoint, azure.GermanCloud.TokenAudience},
+		{"unknown", "mars", "", true, "", "", ""},
+		{"custom", "custom", stack, false, "AzureStackCloud", "https://management.local.azurestack.external/", "https://management.adfs.azurestack.local/4de154de"},
+		{"azure stack", "AzureStackCloud", stack, false, "AzureStackCloud", "https://management.local.azurestack.external/", "https://management.adfs.azurestack.local/4de154de"},
+		{"custom without cloud", "", local, false, "AzureCustomCloud", "http://127.0.0.1:8080/", "http://127.0.0.1:8080/"},
+		{"named cloud ignores custom", "public", local, false, "AzurePublicCloud", "https://management.azure.com/", "https://management.azure.com/"},
+		{"custom without json", "custom", "", true, "", "", ""},
+		{"invalid json", "custom", "{", true, "", "", ""},
+		{"missing endpoint", "custom", `{"resourceManagerEndpoint": "http://127.0.0.1:8080/"}`, true, "", "", ""},
+		{"invalid endpoint", "custom", `{"resourceManagerEndpoint": "127.0.0.1", "activeDirectoryEndpoint": "http://127.0.0.1/"}`, true, "", "", ""},
+	}
+
+	for _, cs := range cases {
+		env, err := LoadEnvironment(cs.cloud, []byte(cs.custom))
+		if cs.err {
+			assert.NotNil(t, err, cs.name)
+			continue
+		}
+		if !assert.Nil(t, err, cs.name) {
+			continue
+		}
+		assert.Equal(t, cs.env, env.Name, cs.name)
+		assert.Equal(t, cs.endpoint, env.ResourceManagerEndpoint, cs.name)
+		assert.Equal(t, cs.resource, tokenResource(env), cs.name)
+	}
+}
+
+func TestNewClientWithEnvironment(t *testing.T) {
+	config := NewConfig(map[string][]byte{
+		"subscriptionID": []byte("sub"),
+		"clientID":       []byte("id"),
+		"clientSecret":   []byte("secret"),
+		"tenantID":       []byte("tenant"),
+		"cloud":          []byte("public"),
+	})
+	c, err := NewClientWithConfig(config)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, azure.PublicCloud.Name, c.Environment.Name)
+	assert.Equal(t, azure.PublicCloud.ResourceManagerEndpoint, c.LoadBalancer.(*loadBalancerClientWrapper).BaseURI)
+
+	config.Cloud = "mars"
+	_, err = NewClientWithConfig(config)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "InvalidEnvironment", err.(*ServiceError).Code)
+	}
+}
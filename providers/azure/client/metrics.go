@@ -0,0 +1,102 @@
+package client
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// OperationMetrics are the counters of requests of an operation
+type OperationMetrics struct {
+	Requests   int
+	Errors     int
+	Throttled  int
+	Retries    int
+	Latency    time.Duration
+	MaxLatency time.Duration
+}
+
+// AverageLatency returns the average latency of the requests
+func (m OperationMetrics) AverageLatency() time.Duration {
+	if m.Requests == 0 {
+		return 0
+	}
+	return m.Latency / time.Duration(m.Requests)
+}
+
+// Metrics records the requests to azure resource manager per operation
+type Metrics struct {
+	mu         sync.Mutex
+	operations map[string]*OperationMetrics
+}
+
+// NewMetrics returns an empty Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{operations: make(map[string]*OperationMetrics)}
+}
+
+// DefaultMetrics records requests of clients created by NewClientWithConfig,
+// it survives the rebuilding of clients
+var DefaultMetrics = NewMetrics()
+
+func (m *Metrics) operation(op string) *OperationMetrics {
+	o, ok := m.operations[op]
+	if !ok {
+		o = &OperationMetrics{}
+		m.operations[op] = o
+	}
+	return o
+}
+
+func (m *Metrics) observe(op string, latency time.Duration, resp *http.Response, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := m.operation(op)
+	o.Requests++
+	o.Latency += latency
+	if latency > o.MaxLatency {
+		o.MaxLatency = latency
+	}
+	if err != nil || resp.StatusCode >= http.StatusBadRequest {
+		o.Errors++
+	}
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		o.Throttled++
+	}
+}
+
+func (m *Metrics) retry(op string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.operation(op).Retries++
+}
+
+// Snapshot returns a copy of the metrics of all operations
+func (m *Metrics) Snapshot() map[string]OperationMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snapshot := make(map[string]OperationMetrics, len(m.operations))
+	for op, o := range m.operations {
+		snapshot[op] = *o
+	}
+	return snapshot
+}
+
+// Operations returns the sorted names of operations recorded
+func (m *Metrics) Operations() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ops := make([]string, 0, len(m.operations))
+	for op := range m.operations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	return ops
+}
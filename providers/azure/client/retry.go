@@ -0,0 +1,273 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	log "github.com/zoumo/logdog"
+)
+
+// RetryPolicy controls the retries and timeouts of requests to azure
+// resource manager
+type RetryPolicy struct {
+	// MaxAttempts is the max number of attempts of a request including the
+	// first one, only GET and PUT are retried
+	MaxAttempts int
+	// MinBackoff and MaxBackoff bound the jittered exponential backoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxRetryAfter caps the delay required by the Retry-After header
+	MaxRetryAfter time.Duration
+	// Timeout is the timeout of each attempt
+	Timeout time.Duration
+	// Budget is the max time spent on a request including the retries
+	Budget time.Duration
+	// PollingTimeout is the max time to wait for a long running operation
+	PollingTimeout time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of clients created by
+// NewClientWithConfig
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	MinBackoff:     time.Second,
+	MaxBackoff:     30 * time.Second,
+	MaxRetryAfter:  2 * time.Minute,
+	Timeout:        30 * time.Second,
+	Budget:         5 * time.Minute,
+	PollingTimeout: 10 * time.Minute,
+}
+
+// statuses of throttled or transient failed requests
+var retryableStatusCodes = map[int]bool{
+	http.StatusRequestTimeout:      true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// withRetry configures the autorest client to send requests by the policy.
+// The retries of autorest are disabled, the final throttled or failed
+// response is returned as an error so that autorest does not retry it again.
+func withRetry(c *autorest.Client, policy RetryPolicy, metrics *Metrics) {
+	c.Sender = &retrySender{
+		next:    c.Sender,
+		policy:  policy,
+		metrics: metrics,
+	}
+	c.RetryAttempts = 1
+	c.PollingDuration = policy.PollingTimeout
+}
+
+type retrySender struct {
+	next    autorest.Sender
+	policy  RetryPolicy
+	metrics *Metrics
+}
+
+// Do implements autorest.Sender
+func (s *retrySender) Do(r *http.Request) (*http.Response, error) {
+	op := operationName(r)
+	idempotent := r.Method == http.MethodGet || r.Method == http.MethodPut
+	deadline := time.Now().Add(s.policy.Budget)
+
+	rr := autorest.NewRetriableRequest(r)
+	for attempt := 1; ; attempt++ {
+		if err := rr.Prepare(); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		resp, err := s.do(rr.Request())
+		s.metrics.observe(op, time.Since(start), resp, err)
+
+		if err == nil && !retryableStatusCodes[resp.StatusCode] {
+			return resp, nil
+		}
+		if r.Context().Err() != nil {
+			return nil, newRetryError(op, resp, err)
+		}
+
+		delay := s.policy.delay(attempt, resp)
+		if !idempotent || attempt >= s.policy.MaxAttempts || time.Now().Add(delay).After(deadline) {
+			return nil, newRetryError(op, resp, err)
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		s.metrics.retry(op)
+		log.Warn("Retry azure request", log.Fields{"op": op, "attempt": attempt, "delay": delay, "status": statusCode(resp), "err": err})
+
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return nil, newRetryError(op, nil, r.Context().Err())
+		}
+	}
+}
+
+// do sends the request with the timeout of an attempt, the timeout is
+// released after the body is closed
+func (s *retrySender) do(r *http.Request) (*http.Response, error) {
+	if s.policy.Timeout <= 0 {
+		return s.next.Do(r)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.policy.Timeout)
+	resp, err := s.next.Do(r.WithContext(ctx))
+	if err != nil || resp == nil || resp.Body == nil {
+		cancel()
+		return resp, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// delay returns the delay before the next attempt, Retry-After is honoured
+// if present, otherwise it is the jittered exponential backoff
+func (p RetryPolicy) delay(attempt int, resp *http.Response) time.Duration {
+	if d, ok := retryAfter(resp); ok {
+		if d > p.MaxRetryAfter {
+			d = p.MaxRetryAfter
+		}
+		return d
+	}
+	backoff := p.MinBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+	// equal jitter keeps at least half of the backoff
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// retryAfter parses the Retry-After header in seconds or http date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// retryError is the final failure of a request given up by retrySender, it
+// is a net.Error which is not temporary so that autorest does not retry it
+type retryError struct {
+	autorest.DetailedError
+	timeout bool
+}
+
+// Timeout implements net.Error
+func (e *retryError) Timeout() bool { return e.timeout }
+
+// Temporary implements net.Error
+func (e *retryError) Temporary() bool { return false }
+
+func newRetryError(op string, resp *http.Response, err error) error {
+	if resp == nil {
+		code, timeout := "RequestFailed", isTimeout(err)
+		if timeout {
+			code = "RequestTimeout"
+		}
+		return &retryError{
+			DetailedError: autorest.DetailedError{
+				Original:    &azure.RequestError{ServiceError: &azure.ServiceError{Code: code, Message: err.Error()}},
+				PackageType: "client",
+				Method:      op,
+				StatusCode:  0,
+				Message:     "request failed after retries",
+			},
+			timeout: timeout,
+		}
+	}
+
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	re := &azure.RequestError{}
+	if json.Unmarshal(body, re) != nil || re.ServiceError == nil || re.ServiceError.Code == "" {
+		re.ServiceError = &azure.ServiceError{
+			Code:    strings.Replace(http.StatusText(resp.StatusCode), " ", "", -1),
+			Message: strings.TrimSpace(string(body)),
+		}
+	}
+	re.StatusCode = resp.StatusCode
+	return &retryError{
+		DetailedError: autorest.DetailedError{
+			Original:    re,
+			PackageType: "client",
+			Method:      op,
+			StatusCode:  resp.StatusCode,
+			Message:     "request failed after retries",
+			Response:    resp,
+		},
+	}
+}
+
+func isTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	t, ok := err.(interface{ Timeout() bool })
+	return ok && t.Timeout()
+}
+
+func statusCode(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
+}
+
+// operationName returns the method and the type of the resource requested,
+// e.g. GET loadBalancers
+func operationName(r *http.Request) string {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	resource := "unknown"
+	for i, segment := range segments {
+		if !strings.EqualFold(segment, "providers") || i+2 >= len(segments) {
+			continue
+		}
+		// the types are at odd positions after the namespace of provider
+		for j := i + 2; j < len(segments); j += 2 {
+			resource = segments[j]
+		}
+	}
+	return r.Method + " " + resource
+}
@@ -0,0 +1,190 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-07-01/network"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOperationName(t *testing.T) {
+	cases := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"GET", "/subscriptions/s/resourceGroups/g/providers/Microsoft.Network/loadBalancers/lb", "GET loadBalancers"},
+		{"PUT", "/subscriptions/s/resourceGroups/g/providers/Microsoft.Network/networkInterfaces/nic", "PUT networkInterfaces"},
+		{"GET", "/subscriptions/s/resourceGroups/g/providers/Microsoft.Compute/virtualMachines/vm", "GET virtualMachines"},
+		{"GET", "/subscriptions/s/providers/Microsoft.Network/locations/chinaeast/operations/1", "GET operations"},
+		{"GET", "/subscriptions/s/providers/Microsoft.Network/loadBalancers", "GET loadBalancers"},
+		{"GET", "/subscriptions/s", "GET unknown"},
+	}
+	for _, cs := range cases {
+		r := &http.Request{Method: cs.method, URL: &url.URL{Path: cs.path}}
+		assert.Equal(t, cs.want, operationName(r), cs.path)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := RetryPolicy{MinBackoff: time.Second, MaxBackoff: 8 * time.Second, MaxRetryAfter: time.Minute}
+	header := func(value string) *http.Response {
+		return &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{value}}}
+	}
+
+	cases := []struct {
+		name     string
+		attempt  int
+		resp     *http.Response
+		min, max time.Duration
+	}{
+		{"first backoff", 1, nil, 500 * time.Millisecond, time.Second},
+		{"third backoff", 3, nil, 2 * time.Second, 4 * time.Second},
+		{"capped backoff", 10, nil, 4 * time.Second, 8 * time.Second},
+		{"retry after seconds", 1, header("20"), 20 * time.Second, 20 * time.Second},
+		{"retry after capped", 1, header("3600"), time.Minute, time.Minute},
+		{"retry after date", 1, header(time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)), 28 * time.Second, 30 * time.Second},
+		{"retry after past date", 1, header(time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)), 0, 0},
+		{"invalid retry after", 1, header("soon"), 500 * time.Millisecond, time.Second},
+	}
+	for _, cs := range cases {
+		for i := 0; i < 20; i++ {
+			d := policy.delay(cs.attempt, cs.resp)
+			assert.True(t, d >= cs.min && d <= cs.max, "%s: %v not in [%v, %v]", cs.name, d, cs.min, cs.max)
+		}
+	}
+}
+
+// armServer replies the responses in order, the last one is repeated
+type armServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string
+}
+
+type armResponse struct {
+	status     int
+	retryAfter string
+	body       string
+	delay      time.Duration
+}
+
+func newARMServer(responses ...armResponse) *armServer {
+	s := &armServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.Method)
+		resp := responses[len(responses)-1]
+		if len(s.requests) <= len(responses) {
+			resp = responses[len(s.requests)-1]
+		}
+		s.mu.Unlock()
+
+		if resp.delay > 0 {
+			select {
+			case <-time.After(resp.delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if resp.retryAfter != "" {
+			w.Header().Set("Retry-After", resp.retryAfter)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.status)
+		fmt.Fprint(w, resp.body)
+	}))
+	return s
+}
+
+func (s *armServer) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func TestRetrySender(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:    3,
+		MinBackoff:     time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		MaxRetryAfter:  10 * time.Millisecond,
+		Timeout:        100 * time.Millisecond,
+		Budget:         time.Second,
+		PollingTimeout: time.Second,
+	}
+	ok := armResponse{status: http.StatusOK, body: `{"name":"lb"}`}
+	throttled := armResponse{status: http.StatusTooManyRequests, retryAfter: "1", body: `{"error":{"code":"TooManyRequests","message":"throttled"}}`}
+	unavailable := armResponse{status: http.StatusServiceUnavailable, body: `{"error":{"code":"ServerBusy","message":"busy"}}`}
+
+	cases := []struct {
+		name      string
+		responses []armResponse
+		delete    bool
+		requests  int
+		code      string
+		retries   int
+		throttled int
+	}{
+		{name: "success", responses: []armResponse{ok}, requests: 1},
+		{name: "throttled", responses: []armResponse{throttled, throttled, ok}, requests: 3, retries: 2, throttled: 2},
+		{name: "transient", responses: []armResponse{unavailable, ok}, requests: 2, retries: 1},
+		{name: "give up", responses: []armResponse{unavailable}, requests: 3, code: "ServerBusy", retries: 2},
+		{name: "error without body", responses: []armResponse{{status: http.StatusBadGateway}}, requests: 3, code: "BadGateway", retries: 2},
+		{name: "not retryable", responses: []armResponse{{status: http.StatusNotFound, body: `{"error":{"code":"ResourceNotFound","message":"missing"}}`}}, requests: 1, code: "ResourceNotFound"},
+		{name: "timeout", responses: []armResponse{{status: http.StatusOK, delay: time.Second}, ok}, requests: 2, retries: 1},
+		{name: "always timeout", responses: []armResponse{{status: http.StatusOK, delay: time.Second}}, requests: 3, code: "RequestTimeout", retries: 2},
+		{name: "delete is not retried", responses: []armResponse{unavailable}, delete: true, requests: 1, code: "ServerBusy"},
+	}
+
+	for _, cs := range cases {
+		server := newARMServer(cs.responses...)
+		metrics := NewMetrics()
+		lbClient := network.NewLoadBalancersClientWithBaseURI(server.URL, "sub")
+		withRetry(&lbClient.Client, policy, metrics)
+
+		var err error
+		op := "GET loadBalancers"
+		if cs.delete {
+			op = "DELETE loadBalancers"
+			_, err = lbClient.Delete(context.TODO(), "group", "lb")
+		} else {
+			var azlb network.LoadBalancer
+			azlb, err = lbClient.Get(context.TODO(), "group", "lb", "")
+			if err == nil {
+				assert.Equal(t, "lb", *azlb.Name, cs.name)
+			}
+		}
+		server.Close()
+
+		assert.Equal(t, cs.requests, server.count(), cs.name)
+		if cs.code == "" {
+			assert.Nil(t, err, cs.name)
+		} else if assert.NotNil(t, err, cs.name) {
+			se := ParseServiceError(err)
+			if assert.NotNil(t, se, "%s: %v", cs.name, err) {
+				assert.Equal(t, cs.code, se.Code, cs.name)
+			}
+		}
+
+		m := metrics.Snapshot()[op]
+		assert.Equal(t, cs.requests, m.Requests, cs.name)
+		assert.Equal(t, cs.retries, m.Retries, cs.name)
+		assert.Equal(t, cs.throttled, m.Throttled, cs.name)
+		assert.Equal(t, cs.requests-1+boolToInt(cs.code != ""), m.Errors, cs.name)
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,832 @@
+package testing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-06-01/compute"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-07-01/network"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/to"
+
+	"github.com/caicloud/loadbalancer-provider/providers/azure/client"
+)
+
+const (
+	// SubscriptionID is the subscription of all the fake resources
+	SubscriptionID = "00000000-0000-0000-0000-000000000000"
+
+	provisioningSucceeded = "Succeeded"
+
+	resourceLoadBalancers     = "loadBalancers"
+	resourceInterfaces        = "networkInterfaces"
+	resourceSecurityGroups    = "networkSecurityGroups"
+	resourcePublicIPAddresses = "publicIPAddresses"
+	resourceVirtualMachines   = "virtualMachines"
+
+	minSecurityRulePriority = 100
+	maxSecurityRulePriority = 4096
+)
+
+// ResourceID returns the id of the resource in the fake subscription,
+// resourceType is the last segment of the provider type, e.g. loadBalancers
+func ResourceID(group, resourceType, name string) string {
+	provider := "Microsoft.Network"
+	if resourceType == resourceVirtualMachines {
+		provider = "Microsoft.Compute"
+	}
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/%s/%s/%s", SubscriptionID, group, provider, resourceType, name)
+}
+
+// NewError returns an error in the form of azure sdk
+func NewError(statusCode int, code, message string) error {
+	return autorest.DetailedError{
+		Original: &azure.RequestError{
+			ServiceError: &azure.ServiceError{Code: code, Message: message},
+		},
+		PackageType: "network.fake",
+		StatusCode:  statusCode,
+		Message:     message,
+	}
+}
+
+func notFound(resourceType, group, name string) error {
+	return NewError(404, "ResourceNotFound",
+		fmt.Sprintf("The Resource '%s/%s' under resource group '%s' was not found.", resourceType, name, group))
+}
+
+func invalidReference(id string) error {
+	return NewError(400, "InvalidResourceReference", fmt.Sprintf("Resource %s referenced by resource is not found.", id))
+}
+
+// Fake is an in-memory azure which implements the clients of client.Client.
+//
+// Like azure, the resources returned have IDs, etags and the provisioning
+// state, the sub resources of load balancer get IDs, the collections are
+// never nil, the backend pools refer to the ip configurations of network
+// interfaces attached, and the references to missing resources are
+// rejected.
+type Fake struct {
+	// Errors are returned by the operations instead of executing them,
+	// the key is "<Client>.<Method>", e.g. "LoadBalancer.CreateOrUpdate",
+	// or "<Client>.<Method> <group>/<name>" for a single resource
+	Errors map[string]error
+
+	mu                 sync.Mutex
+	calls              []string
+	etag               int
+	allocatedAddresses int
+	loadBalancers      map[string]network.LoadBalancer
+	interfaces         map[string]network.Interface
+	securityGroups     map[string]network.SecurityGroup
+	publicIPAddresses  map[string]network.PublicIPAddress
+	virtualMachines    map[string]compute.VirtualMachine
+}
+
+// NewFake returns an empty Fake
+func NewFake() *Fake {
+	return &Fake{
+		Errors:            make(map[string]error),
+		loadBalancers:     make(map[string]network.LoadBalancer),
+		interfaces:        make(map[string]network.Interface),
+		securityGroups:    make(map[string]network.SecurityGroup),
+		publicIPAddresses: make(map[string]network.PublicIPAddress),
+		virtualMachines:   make(map[string]compute.VirtualMachine),
+	}
+}
+
+// Client returns a client.Client operating the fake
+func (f *Fake) Client() *client.Client {
+	return &client.Client{
+		Config:           &client.Config{SubscriptionID: SubscriptionID},
+		LoadBalancer:     &loadBalancers{f},
+		VM:               &virtualMachines{f},
+		NetworkInterface: &interfaces{f},
+		SecurityGroup:    &securityGroups{f},
+		PublicIPAddress:  &publicIPAddresses{f},
+	}
+}
+
+// Calls returns the write operations in order, in the form of
+// "<Client>.<Method> <group>/<name>"
+func (f *Fake) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// ResetCalls clears the recorded calls
+func (f *Fake) ResetCalls() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
+
+// AddSecurityGroup adds a network security group and returns its id
+func (f *Fake) AddSecurityGroup(group, name string, rules ...network.SecurityRule) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sg := network.SecurityGroup{
+		Name: to.StringPtr(name),
+		SecurityGroupPropertiesFormat: &network.SecurityGroupPropertiesFormat{
+			SecurityRules: &rules,
+		},
+	}
+	sg, _ = f.putSecurityGroup(group, name, sg)
+	return to.String(sg.ID)
+}
+
+// AddInterface adds a network interface with one ip configuration named
+// ipconfig1, the interface is in the security group if securityGroupID
+// is not empty
+func (f *Fake) AddInterface(group, name, privateIP, securityGroupID string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	nic := network.Interface{
+		Name: to.StringPtr(name),
+		InterfacePropertiesFormat: &network.InterfacePropertiesFormat{
+			IPConfigurations: &[]network.InterfaceIPConfiguration{
+				{
+					Name: to.StringPtr("ipconfig1"),
+					InterfaceIPConfigurationPropertiesFormat: &network.InterfaceIPConfigurationPropertiesFormat{
+						PrivateIPAddress: to.StringPtr(privateIP),
+						Primary:          to.BoolPtr(true),
+					},
+				},
+			},
+		},
+	}
+	if securityGroupID != "" {
+		nic.NetworkSecurityGroup = &network.SecurityGroup{ID: to.StringPtr(securityGroupID)}
+	}
+	nic, _ = f.putInterface(group, name, nic)
+	return to.String(nic.ID)
+}
+
+// AddVirtualMachine adds a virtual machine using the network interfaces
+// and returns its id
+func (f *Fake) AddVirtualMachine(group, name string, interfaceIDs ...string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	refs := make([]compute.NetworkInterfaceReference, 0, len(interfaceIDs))
+	for _, id := range interfaceIDs {
+		refs = append(refs, compute.NetworkInterfaceReference{ID: to.StringPtr(id)})
+	}
+	vm := compute.VirtualMachine{
+		Name: to.StringPtr(name),
+		VirtualMachineProperties: &compute.VirtualMachineProperties{
+			NetworkProfile: &compute.NetworkProfile{NetworkInterfaces: &refs},
+		},
+	}
+	vm = f.putVirtualMachine(group, name, vm)
+	return to.String(vm.ID)
+}
+
+// AddPublicIPAddress adds a static public ip address and returns its id
+func (f *Fake) AddPublicIPAddress(group, name, address string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := ResourceID(group, resourcePublicIPAddresses, name)
+	f.publicIPAddresses[key(id)] = network.PublicIPAddress{
+		ID:   to.StringPtr(id),
+		Name: to.StringPtr(name),
+		Etag: f.nextEtag(),
+		PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{
+			PublicIPAllocationMethod: network.Static,
+			IPAddress:                to.StringPtr(address),
+			ProvisioningState:        to.StringPtr(provisioningSucceeded),
+		},
+	}
+	return id
+}
+
+// putPublicIPAddress saves the public ip address, an address is allocated
+// to a static one if it has none. f.mu must be held.
+func (f *Fake) putPublicIPAddress(group, name string, in network.PublicIPAddress) network.PublicIPAddress {
+	var ip network.PublicIPAddress
+	deepCopy(in, &ip)
+	id := ResourceID(group, resourcePublicIPAddresses, name)
+	ip.ID = to.StringPtr(id)
+	ip.Name = to.StringPtr(name)
+	ip.Etag = f.nextEtag()
+	if ip.PublicIPAddressPropertiesFormat == nil {
+		ip.PublicIPAddressPropertiesFormat = &network.PublicIPAddressPropertiesFormat{}
+	}
+	props := ip.PublicIPAddressPropertiesFormat
+	props.ProvisioningState = to.StringPtr(provisioningSucceeded)
+	if old, ok := f.publicIPAddresses[key(id)]; ok && old.IPAddress != nil {
+		props.IPAddress = old.IPAddress
+	}
+	if props.PublicIPAllocationMethod == network.Static && props.IPAddress == nil {
+		f.allocatedAddresses++
+		props.IPAddress = to.StringPtr(fmt.Sprintf("52.1.%d.%d", f.allocatedAddresses/256, f.allocatedAddresses%256))
+	}
+	f.publicIPAddresses[key(id)] = ip
+
+	var ret network.PublicIPAddress
+	deepCopy(ip, &ret)
+	return ret
+}
+
+// call records the write operation and returns the injected error.
+// f.mu must be held.
+func (f *Fake) call(op, group, name string, write bool) error {
+	if write {
+		f.calls = append(f.calls, fmt.Sprintf("%s %s/%s", op, group, name))
+	}
+	if err, ok := f.Errors[fmt.Sprintf("%s %s/%s", op, group, name)]; ok {
+		return err
+	}
+	return f.Errors[op]
+}
+
+func (f *Fake) nextEtag() *string {
+	f.etag++
+	return to.StringPtr(fmt.Sprintf("W/\"%d\"", f.etag))
+}
+
+func key(id string) string {
+	return strings.ToLower(id)
+}
+
+// deepCopy copies in to out by json like the resources are sent to and
+// received from azure
+func deepCopy(in, out interface{}) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		panic(err)
+	}
+}
+
+// loadBalancerView returns the load balancer with the back references of
+// backend pools. f.mu must be held.
+func (f *Fake) loadBalancerView(stored network.LoadBalancer) network.LoadBalancer {
+	var lb network.LoadBalancer
+	deepCopy(stored, &lb)
+
+	nicKeys := make([]string, 0, len(f.interfaces))
+	for k := range f.interfaces {
+		nicKeys = append(nicKeys, k)
+	}
+	sort.Strings(nicKeys)
+
+	for i := range *lb.BackendAddressPools {
+		pool := &(*lb.BackendAddressPools)[i]
+		refs := []network.InterfaceIPConfiguration{}
+		for _, k := range nicKeys {
+			for _, ipc := range *f.interfaces[k].IPConfigurations {
+				if ipc.LoadBalancerBackendAddressPools == nil {
+					continue
+				}
+				for _, p := range *ipc.LoadBalancerBackendAddressPools {
+					if key(to.String(p.ID)) == key(to.String(pool.ID)) {
+						refs = append(refs, network.InterfaceIPConfiguration{ID: ipc.ID})
+					}
+				}
+			}
+		}
+		pool.BackendIPConfigurations = &refs
+	}
+	return lb
+}
+
+// putLoadBalancer normalizes and validates the load balancer before
+// saving it. f.mu must be held.
+func (f *Fake) putLoadBalancer(group, name string, in network.LoadBalancer) (network.LoadBalancer, error) {
+	var lb network.LoadBalancer
+	deepCopy(in, &lb)
+
+	id := ResourceID(group, resourceLoadBalancers, name)
+	lb.ID = to.StringPtr(id)
+	lb.Name = to.StringPtr(name)
+	lb.Type = to.StringPtr("Microsoft.Network/loadBalancers")
+	lb.Etag = f.nextEtag()
+	if lb.LoadBalancerPropertiesFormat == nil {
+		lb.LoadBalancerPropertiesFormat = &network.LoadBalancerPropertiesFormat{}
+	}
+	props := lb.LoadBalancerPropertiesFormat
+	props.ProvisioningState = to.StringPtr(provisioningSucceeded)
+	if props.FrontendIPConfigurations == nil {
+		props.FrontendIPConfigurations = &[]network.FrontendIPConfiguration{}
+	}
+	if props.BackendAddressPools == nil {
+		props.BackendAddressPools = &[]network.BackendAddressPool{}
+	}
+	if props.Probes == nil {
+		props.Probes = &[]network.Probe{}
+	}
+	if props.LoadBalancingRules == nil {
+		props.LoadBalancingRules = &[]network.LoadBalancingRule{}
+	}
+	if props.InboundNatRules == nil {
+		props.InboundNatRules = &[]network.InboundNatRule{}
+	}
+	if props.InboundNatPools == nil {
+		props.InboundNatPools = &[]network.InboundNatPool{}
+	}
+	if props.OutboundRules == nil {
+		props.OutboundRules = &[]network.OutboundRule{}
+	}
+
+	// the sub resources are identified by names
+	known := make(map[string]bool)
+	subID := func(kind string, subName *string) (*string, error) {
+		if to.String(subName) == "" {
+			return nil, NewError(400, "InvalidRequestFormat", fmt.Sprintf("%s of load balancer %s has no name", kind, name))
+		}
+		subID := fmt.Sprintf("%s/%s/%s", id, kind, to.String(subName))
+		if known[key(subID)] {
+			return nil, NewError(400, "InvalidRequestFormat", fmt.Sprintf("duplicate name %s in %s", to.String(subName), kind))
+		}
+		known[key(subID)] = true
+		return to.StringPtr(subID), nil
+	}
+
+	var err error
+	for i := range *props.FrontendIPConfigurations {
+		fe := &(*props.FrontendIPConfigurations)[i]
+		if fe.ID, err = subID("frontendIPConfigurations", fe.Name); err != nil {
+			return network.LoadBalancer{}, err
+		}
+		if fe.FrontendIPConfigurationPropertiesFormat == nil {
+			fe.FrontendIPConfigurationPropertiesFormat = &network.FrontendIPConfigurationPropertiesFormat{}
+		}
+		fe.FrontendIPConfigurationPropertiesFormat.ProvisioningState = to.StringPtr(provisioningSucceeded)
+		if ip := fe.PublicIPAddress; ip != nil {
+			if _, ok := f.publicIPAddresses[key(to.String(ip.ID))]; !ok {
+				return network.LoadBalancer{}, invalidReference(to.String(ip.ID))
+			}
+		}
+	}
+	for i := range *props.BackendAddressPools {
+		pool := &(*props.BackendAddressPools)[i]
+		if pool.ID, err = subID("backendAddressPools", pool.Name); err != nil {
+			return network.LoadBalancer{}, err
+		}
+		// the back references are read only
+		pool.BackendAddressPoolPropertiesFormat = &network.BackendAddressPoolPropertiesFormat{
+			ProvisioningState: to.StringPtr(provisioningSucceeded),
+		}
+	}
+	for i := range *props.Probes {
+		probe := &(*props.Probes)[i]
+		if probe.ID, err = subID("probes", probe.Name); err != nil {
+			return network.LoadBalancer{}, err
+		}
+		if probe.ProbePropertiesFormat == nil {
+			probe.ProbePropertiesFormat = &network.ProbePropertiesFormat{}
+		}
+		probe.ProbePropertiesFormat.ProvisioningState = to.StringPtr(provisioningSucceeded)
+	}
+	for i := range *props.LoadBalancingRules {
+		rule := &(*props.LoadBalancingRules)[i]
+		if rule.ID, err = subID("loadBalancingRules", rule.Name); err != nil {
+			return network.LoadBalancer{}, err
+		}
+		if rule.LoadBalancingRulePropertiesFormat == nil {
+			rule.LoadBalancingRulePropertiesFormat = &network.LoadBalancingRulePropertiesFormat{}
+		}
+		rule.LoadBalancingRulePropertiesFormat.ProvisioningState = to.StringPtr(provisioningSucceeded)
+	}
+	for i := range *props.OutboundRules {
+		rule := &(*props.OutboundRules)[i]
+		if rule.ID, err = subID("outboundRules", rule.Name); err != nil {
+			return network.LoadBalancer{}, err
+		}
+		if rule.OutboundRulePropertiesFormat == nil || rule.Protocol == "" {
+			return network.LoadBalancer{}, NewError(400, "InvalidRequestFormat", fmt.Sprintf("outbound rule %s has no protocol", to.String(rule.Name)))
+		}
+		rule.OutboundRulePropertiesFormat.ProvisioningState = to.StringPtr(provisioningSucceeded)
+	}
+	// the references are checked after all the sub resources get IDs
+	var refs []*network.SubResource
+	for _, rule := range *props.LoadBalancingRules {
+		refs = append(refs, rule.FrontendIPConfiguration, rule.BackendAddressPool, rule.Probe)
+	}
+	for _, rule := range *props.OutboundRules {
+		refs = append(refs, rule.BackendAddressPool)
+		if rule.FrontendIPConfigurations != nil {
+			for i := range *rule.FrontendIPConfigurations {
+				refs = append(refs, &(*rule.FrontendIPConfigurations)[i])
+			}
+		}
+	}
+	for _, ref := range refs {
+		if ref == nil {
+			continue
+		}
+		if !known[key(to.String(ref.ID))] {
+			return network.LoadBalancer{}, invalidReference(to.String(ref.ID))
+		}
+	}
+
+	f.loadBalancers[key(id)] = lb
+	return f.loadBalancerView(lb), nil
+}
+
+// putInterface validates and saves the network interface. f.mu must be held.
+func (f *Fake) putInterface(group, name string, in network.Interface) (network.Interface, error) {
+	var nic network.Interface
+	deepCopy(in, &nic)
+
+	id := ResourceID(group, resourceInterfaces, name)
+	nic.ID = to.StringPtr(id)
+	nic.Name = to.StringPtr(name)
+	nic.Etag = f.nextEtag()
+	if nic.InterfacePropertiesFormat == nil {
+		nic.InterfacePropertiesFormat = &network.InterfacePropertiesFormat{}
+	}
+	nic.InterfacePropertiesFormat.ProvisioningState = to.StringPtr(provisioningSucceeded)
+	if nic.IPConfigurations == nil {
+		nic.IPConfigurations = &[]network.InterfaceIPConfiguration{}
+	}
+	if sg := nic.NetworkSecurityGroup; sg != nil {
+		if _, ok := f.securityGroups[key(to.String(sg.ID))]; !ok {
+			return network.Interface{}, invalidReference(to.String(sg.ID))
+		}
+	}
+	for i := range *nic.IPConfigurations {
+		ipc := &(*nic.IPConfigurations)[i]
+		ipc.ID = to.StringPtr(fmt.Sprintf("%s/ipConfigurations/%s", id, to.String(ipc.Name)))
+		if ipc.InterfaceIPConfigurationPropertiesFormat == nil {
+			ipc.InterfaceIPConfigurationPropertiesFormat = &network.InterfaceIPConfigurationPropertiesFormat{}
+		}
+		ipc.InterfaceIPConfigurationPropertiesFormat.ProvisioningState = to.StringPtr(provisioningSucceeded)
+		if ipc.LoadBalancerBackendAddressPools == nil {
+			continue
+		}
+		for _, pool := range *ipc.LoadBalancerBackendAddressPools {
+			if !f.poolExists(to.String(pool.ID)) {
+				return network.Interface{}, invalidReference(to.String(pool.ID))
+			}
+		}
+	}
+
+	f.interfaces[key(id)] = nic
+	var ret network.Interface
+	deepCopy(nic, &ret)
+	return ret, nil
+}
+
+// poolExists returns true if the backend pool exists. f.mu must be held.
+func (f *Fake) poolExists(poolID string) bool {
+	i := strings.Index(key(poolID), "/backendaddresspools/")
+	if i < 0 {
+		return false
+	}
+	lb, ok := f.loadBalancers[key(poolID[:i])]
+	if !ok {
+		return false
+	}
+	for _, pool := range *lb.BackendAddressPools {
+		if key(to.String(pool.ID)) == key(poolID) {
+			return true
+		}
+	}
+	return false
+}
+
+// putSecurityGroup validates and saves the security group. f.mu must be held.
+func (f *Fake) putSecurityGroup(group, name string, in network.SecurityGroup) (network.SecurityGroup, error) {
+	var sg network.SecurityGroup
+	deepCopy(in, &sg)
+
+	id := ResourceID(group, resourceSecurityGroups, name)
+	sg.ID = to.StringPtr(id)
+	sg.Name = to.StringPtr(name)
+	sg.Etag = f.nextEtag()
+	if sg.SecurityGroupPropertiesFormat == nil {
+		sg.SecurityGroupPropertiesFormat = &network.SecurityGroupPropertiesFormat{}
+	}
+	sg.SecurityGroupPropertiesFormat.ProvisioningState = to.StringPtr(provisioningSucceeded)
+	if sg.SecurityRules == nil {
+		sg.SecurityRules = &[]network.SecurityRule{}
+	}
+
+	names := make(map[string]bool)
+	priorities := make(map[string]bool)
+	for i := range *sg.SecurityRules {
+		rule := &(*sg.SecurityRules)[i]
+		ruleName := to.String(rule.Name)
+		if names[ruleName] {
+			return network.SecurityGroup{}, NewError(400, "InvalidRequestFormat", fmt.Sprintf("duplicate security rule name %s", ruleName))
+		}
+		names[ruleName] = true
+		if rule.SecurityRulePropertiesFormat == nil {
+			return network.SecurityGroup{}, NewError(400, "InvalidRequestFormat", fmt.Sprintf("security rule %s has no properties", ruleName))
+		}
+		priority := to.Int32(rule.Priority)
+		if priority < minSecurityRulePriority || priority > maxSecurityRulePriority {
+			return network.SecurityGroup{}, NewError(400, "SecurityRuleInvalidPriority",
+				fmt.Sprintf("security rule %s has invalid priority %d", ruleName, priority))
+		}
+		p := fmt.Sprintf("%s/%d", rule.Direction, priority)
+		if priorities[p] {
+			return network.SecurityGroup{}, NewError(400, "SecurityRuleConflict",
+				fmt.Sprintf("security rule %s conflicts with another rule, they have the same priority %d", ruleName, priority))
+		}
+		priorities[p] = true
+		rule.ID = to.StringPtr(fmt.Sprintf("%s/securityRules/%s", id, ruleName))
+		rule.Etag = sg.Etag
+		rule.SecurityRulePropertiesFormat.ProvisioningState = to.StringPtr(provisioningSucceeded)
+	}
+
+	f.securityGroups[key(id)] = sg
+	var ret network.SecurityGroup
+	deepCopy(sg, &ret)
+	return ret, nil
+}
+
+// putVirtualMachine saves the virtual machine. f.mu must be held.
+func (f *Fake) putVirtualMachine(group, name string, in compute.VirtualMachine) compute.VirtualMachine {
+	var vm compute.VirtualMachine
+	deepCopy(in, &vm)
+
+	id := ResourceID(group, resourceVirtualMachines, name)
+	vm.ID = to.StringPtr(id)
+	vm.Name = to.StringPtr(name)
+	if vm.VirtualMachineProperties == nil {
+		vm.VirtualMachineProperties = &compute.VirtualMachineProperties{}
+	}
+	vm.VirtualMachineProperties.ProvisioningState = to.StringPtr(provisioningSucceeded)
+	if vm.NetworkProfile == nil {
+		vm.NetworkProfile = &compute.NetworkProfile{NetworkInterfaces: &[]compute.NetworkInterfaceReference{}}
+	}
+	f.virtualMachines[key(id)] = vm
+
+	var ret compute.VirtualMachine
+	deepCopy(vm, &ret)
+	return ret
+}
+
+type loadBalancers struct {
+	f *Fake
+}
+
+func (c *loadBalancers) Get(ctx context.Context, group, name, expand string) (network.LoadBalancer, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("LoadBalancer.Get", group, name, false); err != nil {
+		return network.LoadBalancer{}, err
+	}
+	lb, ok := c.f.loadBalancers[key(ResourceID(group, resourceLoadBalancers, name))]
+	if !ok {
+		return network.LoadBalancer{}, notFound("Microsoft.Network/loadBalancers", group, name)
+	}
+	return c.f.loadBalancerView(lb), nil
+}
+
+func (c *loadBalancers) CreateOrUpdate(ctx context.Context, group, name string, lb network.LoadBalancer) (network.LoadBalancer, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("LoadBalancer.CreateOrUpdate", group, name, true); err != nil {
+		return network.LoadBalancer{}, err
+	}
+	return c.f.putLoadBalancer(group, name, lb)
+}
+
+func (c *loadBalancers) Delete(ctx context.Context, group, name string) error {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("LoadBalancer.Delete", group, name, true); err != nil {
+		return err
+	}
+	id := ResourceID(group, resourceLoadBalancers, name)
+	delete(c.f.loadBalancers, key(id))
+
+	// the network interfaces are detached from the deleted backend pools
+	prefix := key(id + "/backendAddressPools/")
+	for k, nic := range c.f.interfaces {
+		for i := range *nic.IPConfigurations {
+			ipc := &(*nic.IPConfigurations)[i]
+			if ipc.LoadBalancerBackendAddressPools == nil {
+				continue
+			}
+			pools := []network.BackendAddressPool{}
+			for _, pool := range *ipc.LoadBalancerBackendAddressPools {
+				if !strings.HasPrefix(key(to.String(pool.ID)), prefix) {
+					pools = append(pools, pool)
+				}
+			}
+			ipc.LoadBalancerBackendAddressPools = &pools
+		}
+		c.f.interfaces[k] = nic
+	}
+	return nil
+}
+
+func (c *loadBalancers) ListAll(ctx context.Context) ([]network.LoadBalancer, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("LoadBalancer.ListAll", "", "", false); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(c.f.loadBalancers))
+	for k := range c.f.loadBalancers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := make([]network.LoadBalancer, 0, len(keys))
+	for _, k := range keys {
+		ret = append(ret, c.f.loadBalancerView(c.f.loadBalancers[k]))
+	}
+	return ret, nil
+}
+
+type interfaces struct {
+	f *Fake
+}
+
+func (c *interfaces) Get(ctx context.Context, group, name, expand string) (network.Interface, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("NetworkInterface.Get", group, name, false); err != nil {
+		return network.Interface{}, err
+	}
+	nic, ok := c.f.interfaces[key(ResourceID(group, resourceInterfaces, name))]
+	if !ok {
+		return network.Interface{}, notFound("Microsoft.Network/networkInterfaces", group, name)
+	}
+	var ret network.Interface
+	deepCopy(nic, &ret)
+	return ret, nil
+}
+
+func (c *interfaces) ListAll(ctx context.Context) ([]network.Interface, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("NetworkInterface.ListAll", "", "", false); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(c.f.interfaces))
+	for k := range c.f.interfaces {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := make([]network.Interface, 0, len(keys))
+	for _, k := range keys {
+		var nic network.Interface
+		deepCopy(c.f.interfaces[k], &nic)
+		ret = append(ret, nic)
+	}
+	return ret, nil
+}
+
+func (c *interfaces) CreateOrUpdate(ctx context.Context, group, name string, nic network.Interface) (network.Interface, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("NetworkInterface.CreateOrUpdate", group, name, true); err != nil {
+		return network.Interface{}, err
+	}
+	return c.f.putInterface(group, name, nic)
+}
+
+func (c *interfaces) Delete(ctx context.Context, group, name string) error {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("NetworkInterface.Delete", group, name, true); err != nil {
+		return err
+	}
+	delete(c.f.interfaces, key(ResourceID(group, resourceInterfaces, name)))
+	return nil
+}
+
+type securityGroups struct {
+	f *Fake
+}
+
+func (c *securityGroups) Get(ctx context.Context, group, name, expand string) (network.SecurityGroup, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("SecurityGroup.Get", group, name, false); err != nil {
+		return network.SecurityGroup{}, err
+	}
+	sg, ok := c.f.securityGroups[key(ResourceID(group, resourceSecurityGroups, name))]
+	if !ok {
+		return network.SecurityGroup{}, notFound("Microsoft.Network/networkSecurityGroups", group, name)
+	}
+	var ret network.SecurityGroup
+	deepCopy(sg, &ret)
+	return ret, nil
+}
+
+func (c *securityGroups) CreateOrUpdate(ctx context.Context, group, name string, sg network.SecurityGroup) (network.SecurityGroup, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("SecurityGroup.CreateOrUpdate", group, name, true); err != nil {
+		return network.SecurityGroup{}, err
+	}
+	return c.f.putSecurityGroup(group, name, sg)
+}
+
+type publicIPAddresses struct {
+	f *Fake
+}
+
+func (c *publicIPAddresses) Get(ctx context.Context, group, name, expand string) (network.PublicIPAddress, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("PublicIPAddress.Get", group, name, false); err != nil {
+		return network.PublicIPAddress{}, err
+	}
+	ip, ok := c.f.publicIPAddresses[key(ResourceID(group, resourcePublicIPAddresses, name))]
+	if !ok {
+		return network.PublicIPAddress{}, notFound("Microsoft.Network/publicIPAddresses", group, name)
+	}
+	var ret network.PublicIPAddress
+	deepCopy(ip, &ret)
+	return ret, nil
+}
+
+func (c *publicIPAddresses) CreateOrUpdate(ctx context.Context, group, name string, ip network.PublicIPAddress) (network.PublicIPAddress, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("PublicIPAddress.CreateOrUpdate", group, name, true); err != nil {
+		return network.PublicIPAddress{}, err
+	}
+	return c.f.putPublicIPAddress(group, name, ip), nil
+}
+
+func (c *publicIPAddresses) Delete(ctx context.Context, group, name string) error {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("PublicIPAddress.Delete", group, name, true); err != nil {
+		return err
+	}
+	id := ResourceID(group, resourcePublicIPAddresses, name)
+	for _, lb := range c.f.loadBalancers {
+		for _, fe := range *lb.FrontendIPConfigurations {
+			if fe.PublicIPAddress != nil && key(to.String(fe.PublicIPAddress.ID)) == key(id) {
+				return NewError(400, "PublicIPAddressInUse", fmt.Sprintf("public ip %s is used by load balancer %s", name, to.String(lb.Name)))
+			}
+		}
+	}
+	delete(c.f.publicIPAddresses, key(id))
+	return nil
+}
+
+type virtualMachines struct {
+	f *Fake
+}
+
+func (c *virtualMachines) Get(ctx context.Context, group, name string, expand compute.InstanceViewTypes) (compute.VirtualMachine, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("VM.Get", group, name, false); err != nil {
+		return compute.VirtualMachine{}, err
+	}
+	vm, ok := c.f.virtualMachines[key(ResourceID(group, resourceVirtualMachines, name))]
+	if !ok {
+		return compute.VirtualMachine{}, notFound("Microsoft.Compute/virtualMachines", group, name)
+	}
+	var ret compute.VirtualMachine
+	deepCopy(vm, &ret)
+	return ret, nil
+}
+
+func (c *virtualMachines) ListAll(ctx context.Context) ([]compute.VirtualMachine, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("VM.ListAll", "", "", false); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(c.f.virtualMachines))
+	for k := range c.f.virtualMachines {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := make([]compute.VirtualMachine, 0, len(keys))
+	for _, k := range keys {
+		var vm compute.VirtualMachine
+		deepCopy(c.f.virtualMachines[k], &vm)
+		ret = append(ret, vm)
+	}
+	return ret, nil
+}
+
+func (c *virtualMachines) CreateOrUpdate(ctx context.Context, group, name string, vm compute.VirtualMachine) (compute.VirtualMachine, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("VM.CreateOrUpdate", group, name, true); err != nil {
+		return compute.VirtualMachine{}, err
+	}
+	return c.f.putVirtualMachine(group, name, vm), nil
+}
+
+func (c *virtualMachines) Delete(ctx context.Context, group, name string) error {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if err := c.f.call("VM.Delete", group, name, true); err != nil {
+		return err
+	}
+	delete(c.f.virtualMachines, key(ResourceID(group, resourceVirtualMachines, name)))
+	return nil
+}
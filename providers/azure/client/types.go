@@ -4,7 +4,8 @@ import (
 	"context"
 
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2018-06-01/compute"
-	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-01-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-07-01/network"
+	"github.com/Azure/go-autorest/autorest/azure"
 )
 
 // Config defines the config data required by Azure
@@ -13,11 +14,28 @@ type Config struct {
 	ClientID       string `json:"clientID"`
 	ClientSecret   string `json:"clientSecret"`
 	TenantID       string `json:"tenantID"`
+	// Cloud is the name of the cloud, e.g. public, china, usgovernment,
+	// german or custom
+	Cloud string `json:"cloud,omitempty"`
+	// Environment is the custom environment json, e.g. for Azure Stack
+	Environment string `json:"environment,omitempty"`
+
+	// AuthMethod is one of clientSecret, clientCertificate, managedIdentity
+	// and workloadIdentity, it is inferred from the credentials if empty
+	AuthMethod                string `json:"authMethod,omitempty"`
+	ClientCertificate         []byte `json:"clientCertificate,omitempty"`
+	ClientCertificatePassword string `json:"clientCertificatePassword,omitempty"`
+	// MSIEndpoint overrides the IMDS endpoint of managed identity
+	MSIEndpoint string `json:"msiEndpoint,omitempty"`
+	// FederatedTokenFile is the token file of workload identity, defaults to
+	// $AZURE_FEDERATED_TOKEN_FILE
+	FederatedTokenFile string `json:"federatedTokenFile,omitempty"`
 }
 
 // Client defines the Azure clients we need
 type Client struct {
 	Config           *Config
+	Environment      azure.Environment
 	LoadBalancer     loadBalancerClient
 	VM               virtualMachineClient
 	NetworkInterface networkInterfaceClient
@@ -27,6 +45,36 @@ type Client struct {
 
 type publicIPAddressClient interface {
 	Get(ctx context.Context, resourceGroupName, publicAddressName, expand string) (network.PublicIPAddress, error)
+	CreateOrUpdate(ctx context.Context, resourceGroupName, publicAddressName string, parameters network.PublicIPAddress) (network.PublicIPAddress, error)
+	Delete(ctx context.Context, resourceGroupName, publicAddressName string) error
+}
+
+type publicIPAddressClientWrapper struct {
+	network.PublicIPAddressesClient
+}
+
+func (c *publicIPAddressClientWrapper) CreateOrUpdate(ctx context.Context, resourceGroupName, publicAddressName string, parameters network.PublicIPAddress) (network.PublicIPAddress, error) {
+	createFuture, err := c.PublicIPAddressesClient.CreateOrUpdate(ctx, resourceGroupName, publicAddressName, parameters)
+	if err != nil {
+		return network.PublicIPAddress{}, err
+	}
+
+	err = createFuture.WaitForCompletion(ctx, c.PublicIPAddressesClient.Client)
+	if err != nil {
+		return network.PublicIPAddress{}, err
+	}
+	return createFuture.Result(c.PublicIPAddressesClient)
+}
+
+func (c *publicIPAddressClientWrapper) Delete(ctx context.Context, resourceGroupName, publicAddressName string) error {
+	deleteFuture, err := c.PublicIPAddressesClient.Delete(ctx, resourceGroupName, publicAddressName)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return deleteFuture.WaitForCompletion(ctx, c.PublicIPAddressesClient.Client)
 }
 
 type securityGroupClient interface {
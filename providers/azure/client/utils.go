@@ -27,7 +27,36 @@ const (
 	SecretTypeAzure corev1.SecretType = "azure"
 )
 
+// credentialSecretNamespace and credentialSecretName reference the secret of
+// credentials, the first secret of azure type in kube-system is used if empty
+var credentialSecretNamespace, credentialSecretName string
+
+// SetCredentialSecret references the secret of credentials by namespace and
+// name instead of looking for the secret of azure type in kube-system
+func SetCredentialSecret(namespace, name string) {
+	if namespace == "" {
+		namespace = v1.NamespaceSystem
+	}
+	credentialSecretNamespace, credentialSecretName = namespace, name
+}
+
 func getAPISecret(provider corev1.SecretType, storeLister *core.StoreLister) (map[string][]byte, error) {
+	secret, err := getCredentialSecret(provider, storeLister)
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data, nil
+}
+
+func getCredentialSecret(provider corev1.SecretType, storeLister *core.StoreLister) (*corev1.Secret, error) {
+	if credentialSecretName != "" {
+		secret, err := storeLister.Secret.Secrets(credentialSecretNamespace).Get(credentialSecretName)
+		if err != nil {
+			return nil, fmt.Errorf("azure: get secret %s/%s failed: %v", credentialSecretNamespace, credentialSecretName, err)
+		}
+		return secret, nil
+	}
+
 	secrets, err := storeLister.Secret.Secrets(v1.NamespaceSystem).List(labels.Everything())
 	if err != nil {
 		return nil, err
@@ -37,7 +66,7 @@ func getAPISecret(provider corev1.SecretType, storeLister *core.StoreLister) (ma
 	}
 	for _, secret := range secrets {
 		if secret.Type == provider {
-			return secret.Data, nil
+			return secret, nil
 		}
 	}
 	return nil, fmt.Errorf("azure: get %s type secret failed", provider)
@@ -70,6 +99,10 @@ func ParseServiceError(err error) *ServiceError {
 	if !ok {
 		return nil
 	}
+	// autorest wraps the error of a request given up by retrySender
+	if re, ok := detailedError.Original.(*retryError); ok {
+		return ParseServiceError(re.DetailedError)
+	}
 	if detailedError.StatusCode == nil || detailedError.Original == nil {
 		return nil
 	}
@@ -0,0 +1,671 @@
+package azure
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-07-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+
+	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+	"github.com/caicloud/loadbalancer-provider/providers/azure/client"
+)
+
+const (
+	// ConfigAnnotation is the annotation of the loadbalancer holding the json
+	// of Config, the azure options which are not in the azure provider spec
+	ConfigAnnotation = "loadbalance.caicloud.io/azure-config"
+
+	// probeProtocolHTTPS is only accepted by the Standard SKU
+	probeProtocolHTTPS network.ProbeProtocol = "Https"
+
+	defaultProbeIntervalInSeconds int32 = 5
+	defaultProbeNumberOfProbes    int32 = 3
+	defaultProbeRequestPath             = "/"
+	minProbeIntervalInSeconds     int32 = 5
+
+	defaultRuleLoadDistribution           = network.SourceIPProtocol
+	defaultRuleIdleTimeoutInMinutes int32 = 4
+	minRuleIdleTimeoutInMinutes     int32 = 4
+	maxRuleIdleTimeoutInMinutes     int32 = 30
+
+	maxAllocatedOutboundPorts int32 = 64000
+)
+
+// the names of frontends are part of the names of rules
+var frontendNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,38}[a-z0-9])?$`)
+
+// dnsLabelRegexp is the domain name label accepted by azure
+var dnsLabelRegexp = regexp.MustCompile(`^[a-z][-a-z0-9]{1,61}[a-z0-9]$`)
+
+// Config is the azure config of a loadbalancer
+type Config struct {
+	// Probe is the health probe of the ports exported by the tcp and udp
+	// configmaps, the default probe tcp 80 is used if it is not set
+	Probe *ProbeConfig `json:"probe,omitempty"`
+	// Rule is the rule options of the ports exported by the tcp and udp configmaps
+	Rule *RuleConfig `json:"rule,omitempty"`
+	// Ports overrides the config of the exported ports, the key is
+	// <protocol>/<port> such as tcp/8080, or <port> for both protocols.
+	// The probes of the ports 80 and 443 of the proxy can't be changed
+	Ports map[string]PortConfig `json:"ports,omitempty"`
+	// HAPorts replaces the rules of the proxy and the exported ports with a
+	// rule of all protocols and ports, it requires the Standard SKU and a
+	// private frontend
+	HAPorts bool `json:"haPorts,omitempty"`
+	// Outbound is the outbound rule of the backends, which have no default
+	// snat behind a Standard loadbalancer
+	Outbound *OutboundConfig `json:"outbound,omitempty"`
+	// Frontends are the frontends besides the frontend of spec, the key is
+	// the name referred by the ports
+	Frontends map[string]FrontendConfig `json:"frontends,omitempty"`
+	// PublicIP is the public ip created for a public loadbalancer without
+	// publicIPAddressID, the public ip is created even if it is not set
+	PublicIP *PublicIPConfig `json:"publicIP,omitempty"`
+
+	// publicIPAddressID is the id of the created public ip, it is set on sync
+	publicIPAddressID string
+}
+
+// PublicIPConfig is the config of the public ip created for the loadbalancer
+type PublicIPConfig struct {
+	// DNSLabel is the domain name label of the public ip, no dns record
+	// is created if it is empty
+	DNSLabel string `json:"dnsLabel,omitempty"`
+}
+
+// FrontendConfig is the config of a public or private frontend, it must be
+// of the same kind as the frontend of spec
+type FrontendConfig struct {
+	// PublicIPAddressID is the public ip of a public frontend
+	PublicIPAddressID string `json:"publicIPAddressID,omitempty"`
+	// SubnetID is the subnet of a private frontend
+	SubnetID string `json:"subnetID,omitempty"`
+	// PrivateIPAddress is the static ip of a private frontend, the ip is
+	// allocated dynamically if it is empty
+	PrivateIPAddress string `json:"privateIPAddress,omitempty"`
+}
+
+// PortConfig is the azure config of an exported port
+type PortConfig struct {
+	// Probe overrides the fields set in the probe of the loadbalancer
+	Probe *ProbeConfig `json:"probe,omitempty"`
+	// Rule overrides the fields set in the rule of the loadbalancer
+	Rule *RuleConfig `json:"rule,omitempty"`
+	// Frontend is the name of the frontend in Frontends exporting the
+	// port, the frontend of spec is used if it is empty
+	Frontend string `json:"frontend,omitempty"`
+}
+
+// ProbeConfig is the config of a health probe
+type ProbeConfig struct {
+	// Protocol is one of tcp, http and https, defaults to tcp
+	Protocol string `json:"protocol,omitempty"`
+	// Port is the probed port, defaults to the exported port. The udp ports
+	// use the default probe if it is not set
+	Port int32 `json:"port,omitempty"`
+	// Path is the request path of the http and https probes, defaults to /
+	Path string `json:"path,omitempty"`
+	// IntervalInSeconds is the interval between two probes, defaults to 5
+	IntervalInSeconds int32 `json:"intervalInSeconds,omitempty"`
+	// NumberOfProbes is the number of failed probes before the backend
+	// is taken out of rotation, defaults to 3
+	NumberOfProbes int32 `json:"numberOfProbes,omitempty"`
+}
+
+// RuleConfig is the options of a load balancing rule
+type RuleConfig struct {
+	// LoadDistribution is one of Default, SourceIP and SourceIPProtocol,
+	// defaults to SourceIPProtocol
+	LoadDistribution string `json:"loadDistribution,omitempty"`
+	// IdleTimeoutInMinutes is the idle timeout of tcp connections between
+	// 4 and 30, defaults to 4
+	IdleTimeoutInMinutes int32 `json:"idleTimeoutInMinutes,omitempty"`
+	// EnableFloatingIP enables direct server return, defaults to false
+	EnableFloatingIP *bool `json:"enableFloatingIP,omitempty"`
+	// EnableTCPReset sends tcp reset on idle timeout, it requires the Standard
+	// SKU and only applies to tcp rules, defaults to false
+	EnableTCPReset *bool `json:"enableTcpReset,omitempty"`
+	// DisableOutboundSnat disables the outbound snat of the backends with
+	// the frontend ip, defaults to false
+	DisableOutboundSnat *bool `json:"disableOutboundSnat,omitempty"`
+}
+
+// OutboundConfig is the config of the outbound rule, it is only valid for a
+// public loadbalancer
+type OutboundConfig struct {
+	// PublicIPAddressID is the public ip of a frontend dedicated to
+	// outbound, the public frontend of the loadbalancer is used if it is empty
+	PublicIPAddressID string `json:"publicIPAddressID,omitempty"`
+	// AllocatedOutboundPorts is the number of snat ports of each backend,
+	// it is allocated by azure if it is not set
+	AllocatedOutboundPorts int32 `json:"allocatedOutboundPorts,omitempty"`
+}
+
+// configAnnotation returns the raw config of the loadbalancer
+func configAnnotation(lb *lbapi.LoadBalancer) string {
+	if lb == nil {
+		return ""
+	}
+	return lb.Annotations[ConfigAnnotation]
+}
+
+// parseConfig parses and validates the config annotation of the loadbalancer,
+// an empty config is returned if the annotation is not set
+func parseConfig(lb *lbapi.LoadBalancer) (*Config, error) {
+	config := &Config{}
+	raw := strings.TrimSpace(configAnnotation(lb))
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), config); err != nil {
+			return nil, invalidConfigError("invalid annotation %s: %v", ConfigAnnotation, err)
+		}
+	}
+	// the spec is validated even if there is no annotation
+	if err := config.validate(lb); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func invalidConfigError(format string, a ...interface{}) error {
+	return client.NewServiceError("InvalidConfig", fmt.Sprintf(format, a...))
+}
+
+func (c *Config) validate(lb *lbapi.LoadBalancer) error {
+	var sku lbapi.AzureSKUKind
+	var properties lbapi.AzureIPAddressProperties
+	if lb.Spec.Providers.Azure != nil {
+		sku = lb.Spec.Providers.Azure.SKU
+		properties = lb.Spec.Providers.Azure.IPAddressProperties
+	}
+	if c.HAPorts {
+		if sku != lbapi.AzureStandardSKU {
+			return invalidConfigError("haPorts: ha ports require the Standard SKU")
+		}
+		if properties.Private == nil || properties.Public != nil {
+			return invalidConfigError("haPorts: ha ports require a private frontend")
+		}
+	}
+	if err := c.PublicIP.validate(sku, properties); err != nil {
+		return err
+	}
+	if err := c.Outbound.validate(sku, properties); err != nil {
+		return err
+	}
+	for name, frontend := range c.Frontends {
+		if err := frontend.validate(name); err != nil {
+			return err
+		}
+		// azure rejects a loadbalancer mixing public and private frontends
+		if (frontend.PublicIPAddressID != "") != (properties.Public != nil) {
+			return invalidConfigError("frontends[%s]: public and private frontends can not be mixed", name)
+		}
+	}
+	if err := c.Probe.validate("probe", sku); err != nil {
+		return err
+	}
+	if err := c.Rule.validate("rule", sku); err != nil {
+		return err
+	}
+	for key, port := range c.Ports {
+		protocol, _, err := parsePortKey(key)
+		if err != nil {
+			return err
+		}
+		if err := port.Rule.validate(fmt.Sprintf("ports[%s].rule", key), sku); err != nil {
+			return err
+		}
+		if _, ok := c.Frontends[port.Frontend]; port.Frontend != "" && !ok {
+			return invalidConfigError("ports[%s].frontend: unknown frontend %s", key, port.Frontend)
+		}
+		field := fmt.Sprintf("ports[%s].probe", key)
+		if err := port.Probe.validate(field, sku); err != nil {
+			return err
+		}
+		if port.Probe != nil && protocol == network.TransportProtocolUDP && c.Probe.merge(port.Probe).Port == 0 {
+			return invalidConfigError("%s.port is required by udp ports", field)
+		}
+	}
+	return nil
+}
+
+// parsePortKey parses the key of Ports, the protocol is empty if the
+// key is a port only
+func parsePortKey(key string) (network.TransportProtocol, int32, error) {
+	var protocol network.TransportProtocol
+	port := key
+	if i := strings.Index(key, "/"); i != -1 {
+		switch strings.ToLower(key[:i]) {
+		case "tcp":
+			protocol = network.TransportProtocolTCP
+		case "udp":
+			protocol = network.TransportProtocolUDP
+		default:
+			return "", 0, invalidConfigError("invalid protocol of ports[%s]", key)
+		}
+		port = key[i+1:]
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", 0, invalidConfigError("invalid port of ports[%s]", key)
+	}
+	return protocol, int32(n), nil
+}
+
+func (p *ProbeConfig) validate(field string, sku lbapi.AzureSKUKind) error {
+	if p == nil {
+		return nil
+	}
+	protocol, err := parseProbeProtocol(p.Protocol)
+	if err != nil {
+		return invalidConfigError("%s.protocol: %v", field, err)
+	}
+	if protocol == probeProtocolHTTPS && sku != lbapi.AzureStandardSKU {
+		return invalidConfigError("%s.protocol: https probes require the Standard SKU", field)
+	}
+	if p.Port < 0 || p.Port > 65535 {
+		return invalidConfigError("%s.port: %d is out of range", field, p.Port)
+	}
+	if p.Path != "" && !strings.HasPrefix(p.Path, "/") {
+		return invalidConfigError("%s.path: %q must start with /", field, p.Path)
+	}
+	if p.IntervalInSeconds != 0 && p.IntervalInSeconds < minProbeIntervalInSeconds {
+		return invalidConfigError("%s.intervalInSeconds: must be at least %d", field, minProbeIntervalInSeconds)
+	}
+	if p.NumberOfProbes < 0 {
+		return invalidConfigError("%s.numberOfProbes: must be positive", field)
+	}
+	return nil
+}
+
+func parseProbeProtocol(protocol string) (network.ProbeProtocol, error) {
+	switch strings.ToLower(protocol) {
+	case "", "tcp":
+		return network.ProbeProtocolTCP, nil
+	case "http":
+		return network.ProbeProtocolHTTP, nil
+	case "https":
+		return probeProtocolHTTPS, nil
+	}
+	return "", fmt.Errorf("unknown protocol %q", protocol)
+}
+
+func (f FrontendConfig) validate(name string) error {
+	if !frontendNameRegexp.MatchString(name) {
+		return invalidConfigError("frontends[%s]: the name must be lower case alphanumerics or '-' up to 40 characters", name)
+	}
+	if (f.PublicIPAddressID == "") == (f.SubnetID == "") {
+		return invalidConfigError("frontends[%s]: one of publicIPAddressID and subnetID is required", name)
+	}
+	if f.PublicIPAddressID != "" {
+		if _, _, err := getGroupAndResourceNameFromID(f.PublicIPAddressID, azurePublicIPAddresses); err != nil {
+			return invalidConfigError("frontends[%s].publicIPAddressID: invalid public ip id %s", name, f.PublicIPAddressID)
+		}
+		if f.PrivateIPAddress != "" {
+			return invalidConfigError("frontends[%s].privateIPAddress: a public frontend has no private ip", name)
+		}
+	}
+	if f.PrivateIPAddress != "" && net.ParseIP(f.PrivateIPAddress) == nil {
+		return invalidConfigError("frontends[%s].privateIPAddress: invalid ip %s", name, f.PrivateIPAddress)
+	}
+	return nil
+}
+
+func (p *PublicIPConfig) validate(sku lbapi.AzureSKUKind, properties lbapi.AzureIPAddressProperties) error {
+	if !managedPublicIPAddress(properties) {
+		if p != nil {
+			return invalidConfigError("publicIP: requires a public loadbalancer without publicIPAddressID")
+		}
+		return nil
+	}
+	if sku == lbapi.AzureStandardSKU && properties.Public.IPAllocationMethod != lbapi.AzureStaticIPAllocationMethod {
+		return invalidConfigError("publicIP: the public ip of the Standard SKU must be static")
+	}
+	if p != nil && p.DNSLabel != "" && !dnsLabelRegexp.MatchString(p.DNSLabel) {
+		return invalidConfigError("publicIP.dnsLabel: invalid dns label %s", p.DNSLabel)
+	}
+	return nil
+}
+
+func (o *OutboundConfig) validate(sku lbapi.AzureSKUKind, properties lbapi.AzureIPAddressProperties) error {
+	if o == nil {
+		return nil
+	}
+	if sku != lbapi.AzureStandardSKU {
+		return invalidConfigError("outbound: outbound rules require the Standard SKU")
+	}
+	// a public frontend on a private loadbalancer mixes public and private
+	// frontends, the backends of a private loadbalancer go out by other ways
+	if properties.Public == nil {
+		return invalidConfigError("outbound: not supported by a private loadbalancer")
+	}
+	if o.PublicIPAddressID != "" {
+		if _, _, err := getGroupAndResourceNameFromID(o.PublicIPAddressID, azurePublicIPAddresses); err != nil {
+			return invalidConfigError("outbound.publicIPAddressID: invalid public ip id %s", o.PublicIPAddressID)
+		}
+	}
+	if o.AllocatedOutboundPorts < 0 || o.AllocatedOutboundPorts > maxAllocatedOutboundPorts || o.AllocatedOutboundPorts%8 != 0 {
+		return invalidConfigError("outbound.allocatedOutboundPorts: must be a multiple of 8 up to %d", maxAllocatedOutboundPorts)
+	}
+	return nil
+}
+
+func (r *RuleConfig) validate(field string, sku lbapi.AzureSKUKind) error {
+	if r == nil {
+		return nil
+	}
+	if _, err := parseLoadDistribution(r.LoadDistribution); err != nil {
+		return invalidConfigError("%s.loadDistribution: %v", field, err)
+	}
+	if r.IdleTimeoutInMinutes != 0 && (r.IdleTimeoutInMinutes < minRuleIdleTimeoutInMinutes || r.IdleTimeoutInMinutes > maxRuleIdleTimeoutInMinutes) {
+		return invalidConfigError("%s.idleTimeoutInMinutes: must be between %d and %d", field, minRuleIdleTimeoutInMinutes, maxRuleIdleTimeoutInMinutes)
+	}
+	if to.Bool(r.EnableTCPReset) && sku != lbapi.AzureStandardSKU {
+		return invalidConfigError("%s.enableTcpReset: tcp reset requires the Standard SKU", field)
+	}
+	return nil
+}
+
+func parseLoadDistribution(distribution string) (network.LoadDistribution, error) {
+	if distribution == "" {
+		return defaultRuleLoadDistribution, nil
+	}
+	for _, d := range network.PossibleLoadDistributionValues() {
+		if strings.EqualFold(distribution, string(d)) {
+			return d, nil
+		}
+	}
+	return "", fmt.Errorf("unknown load distribution %q", distribution)
+}
+
+// merge returns a copy of r with the fields set in override
+func (r *RuleConfig) merge(override *RuleConfig) RuleConfig {
+	var merged RuleConfig
+	if r != nil {
+		merged = *r
+	}
+	if override == nil {
+		return merged
+	}
+	if override.LoadDistribution != "" {
+		merged.LoadDistribution = override.LoadDistribution
+	}
+	if override.IdleTimeoutInMinutes != 0 {
+		merged.IdleTimeoutInMinutes = override.IdleTimeoutInMinutes
+	}
+	if override.EnableFloatingIP != nil {
+		merged.EnableFloatingIP = override.EnableFloatingIP
+	}
+	if override.EnableTCPReset != nil {
+		merged.EnableTCPReset = override.EnableTCPReset
+	}
+	if override.DisableOutboundSnat != nil {
+		merged.DisableOutboundSnat = override.DisableOutboundSnat
+	}
+	return merged
+}
+
+// merge returns a copy of p with the fields set in override
+func (p *ProbeConfig) merge(override *ProbeConfig) *ProbeConfig {
+	if p == nil && override == nil {
+		return nil
+	}
+	merged := ProbeConfig{}
+	if p != nil {
+		merged = *p
+	}
+	if override == nil {
+		return &merged
+	}
+	if override.Protocol != "" {
+		merged.Protocol = override.Protocol
+		// the path of a http probe is useless to a tcp probe
+		if merged.Path != "" && strings.ToLower(override.Protocol) == "tcp" {
+			merged.Path = ""
+		}
+	}
+	if override.Port != 0 {
+		merged.Port = override.Port
+	}
+	if override.Path != "" {
+		merged.Path = override.Path
+	}
+	if override.IntervalInSeconds != 0 {
+		merged.IntervalInSeconds = override.IntervalInSeconds
+	}
+	if override.NumberOfProbes != 0 {
+		merged.NumberOfProbes = override.NumberOfProbes
+	}
+	return &merged
+}
+
+// haPorts returns true if the ha ports rule is used
+func (c *Config) haPorts() bool {
+	return c != nil && c.HAPorts
+}
+
+// dnsLabel returns the dns label of the created public ip
+func (c *Config) dnsLabel() string {
+	if c == nil || c.PublicIP == nil {
+		return ""
+	}
+	return c.PublicIP.DNSLabel
+}
+
+// ipAddressProperties returns the properties with the id of the created
+// public ip, the spec is not changed so that it is still compared with the cache
+func (c *Config) ipAddressProperties(properties lbapi.AzureIPAddressProperties) lbapi.AzureIPAddressProperties {
+	if c == nil || c.publicIPAddressID == "" || !managedPublicIPAddress(properties) {
+		return properties
+	}
+	public := *properties.Public
+	public.PublicIPAddressID = to.StringPtr(c.publicIPAddressID)
+	properties.Public = &public
+	return properties
+}
+
+// outbound returns the outbound config, nil means no outbound rule
+func (c *Config) outbound() *OutboundConfig {
+	if c == nil {
+		return nil
+	}
+	return c.Outbound
+}
+
+// frontendName returns the name of the azure frontend of a frontend in
+// Frontends, the empty name is the frontend of spec
+func frontendName(name string) string {
+	if name == "" {
+		return azureLoadBalancerFrontendName
+	}
+	return fmt.Sprintf("%s-%s", azureLoadBalancerFrontendName, name)
+}
+
+// frontendIPConfigs returns the frontends in Frontends sorted by name
+func (c *Config) frontendIPConfigs() []network.FrontendIPConfiguration {
+	if c == nil || len(c.Frontends) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(c.Frontends))
+	for name := range c.Frontends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fronts := make([]network.FrontendIPConfiguration, 0, len(names))
+	for _, name := range names {
+		config := c.Frontends[name]
+		format := &network.FrontendIPConfigurationPropertiesFormat{}
+		if config.PublicIPAddressID != "" {
+			format.PublicIPAddress = &network.PublicIPAddress{
+				ID: to.StringPtr(config.PublicIPAddressID),
+			}
+		} else {
+			format.PrivateIPAllocationMethod = network.Dynamic
+			if config.PrivateIPAddress != "" {
+				format.PrivateIPAllocationMethod = network.Static
+				format.PrivateIPAddress = to.StringPtr(config.PrivateIPAddress)
+			}
+			format.Subnet = &network.Subnet{
+				ID: to.StringPtr(config.SubnetID),
+			}
+		}
+		fronts = append(fronts, network.FrontendIPConfiguration{
+			Name: to.StringPtr(frontendName(name)),
+			FrontendIPConfigurationPropertiesFormat: format,
+		})
+	}
+	return fronts
+}
+
+// hasPublicFrontend returns true if any frontend in Frontends is public
+func (c *Config) hasPublicFrontend() bool {
+	if c == nil {
+		return false
+	}
+	for _, frontend := range c.Frontends {
+		if frontend.PublicIPAddressID != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// port returns the config of the exported port, the config of
+// <protocol>/<port> takes precedence over <port>
+func (c *Config) port(protocol network.TransportProtocol, port int32) PortConfig {
+	if c == nil {
+		return PortConfig{}
+	}
+	if config, ok := c.Ports[fmt.Sprintf("%s/%d", strings.ToLower(string(protocol)), port)]; ok {
+		return config
+	}
+	return c.Ports[strconv.Itoa(int(port))]
+}
+
+// probe returns the probe of the exported port, nil means the default probe
+func (c *Config) probe(protocol network.TransportProtocol, port int32) *network.Probe {
+	if c == nil {
+		return nil
+	}
+	config := c.Probe.merge(c.port(protocol, port).Probe)
+	if config == nil {
+		return nil
+	}
+	if config.Port == 0 {
+		if protocol == network.TransportProtocolUDP {
+			return nil
+		}
+		config.Port = port
+	}
+	return newProbe(config)
+}
+
+// applyRule sets the options of the rule of the exported port, the rules
+// of the proxy only use the options of Ports
+func (c *Config) applyRule(rule *network.LoadBalancingRule, exported bool) {
+	var config RuleConfig
+	if c != nil {
+		base := c.Rule
+		if !exported {
+			base = nil
+		}
+		config = base.merge(c.port(rule.Protocol, to.Int32(rule.FrontendPort)).Rule)
+	}
+	distribution, _ := parseLoadDistribution(config.LoadDistribution)
+	idle := config.IdleTimeoutInMinutes
+	if idle == 0 {
+		idle = defaultRuleIdleTimeoutInMinutes
+	}
+	rule.LoadDistribution = distribution
+	rule.IdleTimeoutInMinutes = to.Int32Ptr(idle)
+	rule.EnableFloatingIP = to.BoolPtr(to.Bool(config.EnableFloatingIP))
+	rule.EnableTCPReset = to.BoolPtr(to.Bool(config.EnableTCPReset) && rule.Protocol == network.TransportProtocolTCP)
+	rule.DisableOutboundSnat = to.BoolPtr(to.Bool(config.DisableOutboundSnat))
+}
+
+// newProbe returns the probe of a valid config with the defaults filled in,
+// the name is unique to the settings so that probes are shared by ports
+func newProbe(config *ProbeConfig) *network.Probe {
+	protocol, _ := parseProbeProtocol(config.Protocol)
+	interval := config.IntervalInSeconds
+	if interval == 0 {
+		interval = defaultProbeIntervalInSeconds
+	}
+	number := config.NumberOfProbes
+	if number == 0 {
+		number = defaultProbeNumberOfProbes
+	}
+	var path *string
+	if protocol != network.ProbeProtocolTCP {
+		path = to.StringPtr(defaultProbeRequestPath)
+		if config.Path != "" {
+			path = to.StringPtr(config.Path)
+		}
+	}
+
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s:%d:%s:%d:%d", protocol, config.Port, to.String(path), interval, number)
+	name := fmt.Sprintf("%s-%d-%08x", strings.ToLower(string(protocol)), config.Port, h.Sum32())
+
+	return &network.Probe{
+		Name: to.StringPtr(name),
+		ProbePropertiesFormat: &network.ProbePropertiesFormat{
+			Protocol:          protocol,
+			Port:              to.Int32Ptr(config.Port),
+			IntervalInSeconds: to.Int32Ptr(interval),
+			NumberOfProbes:    to.Int32Ptr(number),
+			RequestPath:       path,
+		},
+	}
+}
+
+// desiredProbes returns the default probes and the probes of the exported
+// ports, the probes of the ports are sorted by name. The ha ports rule only
+// uses the default probe
+func desiredProbes(c *Config, tcpMap, udpMap map[string]string) []network.Probe {
+	probes := defaultClusterAzureLBProbes()
+	if c.haPorts() {
+		return probes
+	}
+	seen := make(map[string]bool)
+	var extra []network.Probe
+	collect := func(m map[string]string, protocol network.TransportProtocol) {
+		for key := range m {
+			port, err := strconv.Atoi(key)
+			if err != nil {
+				continue
+			}
+			probe := c.probe(protocol, int32(port))
+			if probe == nil || seen[to.String(probe.Name)] {
+				continue
+			}
+			seen[to.String(probe.Name)] = true
+			extra = append(extra, *probe)
+		}
+	}
+	collect(tcpMap, network.TransportProtocolTCP)
+	collect(udpMap, network.TransportProtocolUDP)
+	sort.Slice(extra, func(i, j int) bool {
+		return to.String(extra[i].Name) < to.String(extra[j].Name)
+	})
+	return append(probes, extra...)
+}
+
+// findProbe returns the probe of azlb by name
+func findProbe(azlb *network.LoadBalancer, name string) *network.Probe {
+	if azlb.Probes == nil {
+		return nil
+	}
+	for i := range *azlb.Probes {
+		if to.String((*azlb.Probes)[i].Name) == name {
+			return &(*azlb.Probes)[i]
+		}
+	}
+	return nil
+}
@@ -6,7 +6,7 @@ import (
 	"reflect"
 	"strings"
 
-	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-01-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-07-01/network"
 	"github.com/Azure/go-autorest/autorest/to"
 	log "github.com/zoumo/logdog"
 
@@ -16,23 +16,22 @@ import (
 )
 
 // it will delete default info when recover default azlb
-// make sure config the correct default info
-func ensureSyncDefaultAzureLBConfig(c *client.Client, azlb *network.LoadBalancer, lb *lbapi.LoadBalancer) (*network.LoadBalancer, error) {
+// make sure config the correct default info and probes
+func ensureSyncDefaultAzureLBConfig(c *client.Client, azlb *network.LoadBalancer, lb *lbapi.LoadBalancer, config *Config, probes []network.Probe) (*network.LoadBalancer, error) {
 	var err error
-	azlb, change := ensureSyncDefaultConfigExceptRules(azlb, lb)
+	azlb, change := ensureSyncDefaultConfigExceptRules(azlb, lb, config, probes)
 	if change {
-		// if probe frontend or backend changed, must clean rules because of rules will invoke
-		// the resources reference above all, but the resources can be deleted
-		if *azlb.LoadBalancingRules != nil && len(*azlb.LoadBalancingRules) != 0 {
-			*azlb.LoadBalancingRules = (*azlb.LoadBalancingRules)[:0]
-		}
 		*azlb, err = c.LoadBalancer.CreateOrUpdate(context.TODO(), lb.Spec.Providers.Azure.ResourceGroupName, to.String(azlb.Name), *azlb)
 		if err != nil {
 			log.Errorf("update lb failed error : %v", err)
 			return nil, err
 		}
 	}
-	azlb, err = ensureSyncDefaultRules(c, azlb, lb)
+	azlb, err = ensureSyncDefaultRules(c, azlb, lb, config)
+	if err != nil {
+		return nil, err
+	}
+	azlb, err = ensureSyncOutboundRules(c, azlb, lb, config)
 	if err != nil {
 		return nil, err
 	}
@@ -53,6 +52,7 @@ func getProbesBrief(probes *[]network.Probe) *[]network.Probe {
 				Port:              probe.Port,
 				IntervalInSeconds: probe.IntervalInSeconds,
 				NumberOfProbes:    probe.NumberOfProbes,
+				RequestPath:       probe.RequestPath,
 			},
 		})
 	}
@@ -94,10 +94,16 @@ func getAzureLoadBalancerFrontendIPConfigBrief(ipConfigs *[]network.FrontendIPCo
 	for _, config := range *ipConfigs {
 		format := config.FrontendIPConfigurationPropertiesFormat
 		if format != nil {
+			// the address allocated dynamically is not in config
+			privateIPAddress := format.PrivateIPAddress
+			if format.PrivateIPAllocationMethod == network.Dynamic {
+				privateIPAddress = nil
+			}
 			brief = append(brief, network.FrontendIPConfiguration{
+				Name: config.Name,
 				FrontendIPConfigurationPropertiesFormat: &network.FrontendIPConfigurationPropertiesFormat{
 					PrivateIPAllocationMethod: format.PrivateIPAllocationMethod,
-					PrivateIPAddress:          format.PrivateIPAddress,
+					PrivateIPAddress:          privateIPAddress,
 					Subnet:                    format.Subnet,
 					PublicIPAddress:           format.PublicIPAddress,
 				},
@@ -108,10 +114,11 @@ func getAzureLoadBalancerFrontendIPConfigBrief(ipConfigs *[]network.FrontendIPCo
 }
 
 // check probe backend and frontend in same config except chore for example Etag、ProvisioningState
-func ensureSyncDefaultConfigExceptRules(azlb *network.LoadBalancer, lb *lbapi.LoadBalancer) (*network.LoadBalancer, bool) {
-	var change bool
+// rules invoke the resources above, so the rules referring to the changed
+// resources are removed, they are added back when syncing rules
+func ensureSyncDefaultConfigExceptRules(azlb *network.LoadBalancer, lb *lbapi.LoadBalancer, config *Config, probes []network.Probe) (*network.LoadBalancer, bool) {
+	var change, resetRules, resetOutbound bool
 	// 1.ensure probe
-	probes := defaultClusterAzureLBProbes()
 	probesBrief := getProbesBrief(azlb.Probes)
 	if !reflect.DeepEqual(probesBrief, &probes) {
 		azlb.Probes = &probes
@@ -125,23 +132,170 @@ func ensureSyncDefaultConfigExceptRules(azlb *network.LoadBalancer, lb *lbapi.Lo
 				Name: to.StringPtr(azureLoadBalancerBackendName),
 			},
 		}
-		change = true
+		change, resetRules, resetOutbound = true, true, true
 	}
 
-	// 3.check frontend
-	frontsConfig := getAzureLoadBalancerFrontendIPConfigByConfig(lb.Spec.Providers.Azure.IPAddressProperties)
+	// 3.check frontend, the frontends of config and the outbound frontend
+	// follow the frontend of spec
+	frontsConfig := getAzureLoadBalancerFrontendIPConfigByConfig(config.ipAddressProperties(lb.Spec.Providers.Azure.IPAddressProperties))
+	*frontsConfig = append(*frontsConfig, config.frontendIPConfigs()...)
+	if outbound := getOutboundFrontendIPConfig(config); outbound != nil {
+		*frontsConfig = append(*frontsConfig, *outbound)
+	}
 	frontsBrief := getAzureLoadBalancerFrontendIPConfigBrief(azlb.FrontendIPConfigurations)
 	if !reflect.DeepEqual(frontsConfig, frontsBrief) {
+		// the rules of the other frontends are kept if the frontend of spec is unchanged
+		if frontsBrief == nil || !reflect.DeepEqual((*frontsConfig)[0], (*frontsBrief)[0]) {
+			resetRules = true
+		}
 		azlb.FrontendIPConfigurations = frontsConfig
-		change = true
+		change, resetOutbound = true, true
+	}
+	if resetRules && azlb.LoadBalancingRules != nil {
+		*azlb.LoadBalancingRules = (*azlb.LoadBalancingRules)[:0]
+	}
+	if change {
+		removeRulesWithoutReference(azlb)
+	}
+	if resetOutbound && azlb.OutboundRules != nil {
+		*azlb.OutboundRules = (*azlb.OutboundRules)[:0]
 	}
 	return azlb, change
 }
 
+// getOutboundFrontendIPConfig returns the frontend dedicated to outbound
+func getOutboundFrontendIPConfig(config *Config) *network.FrontendIPConfiguration {
+	outbound := config.outbound()
+	if outbound == nil || outbound.PublicIPAddressID == "" {
+		return nil
+	}
+	return &network.FrontendIPConfiguration{
+		Name: to.StringPtr(azureLoadBalancerOutboundFrontendName),
+		FrontendIPConfigurationPropertiesFormat: &network.FrontendIPConfigurationPropertiesFormat{
+			PublicIPAddress: &network.PublicIPAddress{
+				ID: to.StringPtr(outbound.PublicIPAddressID),
+			},
+		},
+	}
+}
+
+// findFrontendIPConfig returns the frontend of azlb by name
+func findFrontendIPConfig(azlb *network.LoadBalancer, name string) *network.FrontendIPConfiguration {
+	if azlb.FrontendIPConfigurations == nil {
+		return nil
+	}
+	for i := range *azlb.FrontendIPConfigurations {
+		if to.String((*azlb.FrontendIPConfigurations)[i].Name) == name {
+			return &(*azlb.FrontendIPConfigurations)[i]
+		}
+	}
+	return nil
+}
+
+// ensureSyncOutboundRules syncs the outbound rule with config
+func ensureSyncOutboundRules(c *client.Client, azlb *network.LoadBalancer, lb *lbapi.LoadBalancer, config *Config) (*network.LoadBalancer, error) {
+	var rules []network.OutboundRule
+	if outbound := config.outbound(); outbound != nil {
+		frontendName := azureLoadBalancerFrontendName
+		if outbound.PublicIPAddressID != "" {
+			frontendName = azureLoadBalancerOutboundFrontendName
+		}
+		frontend := findFrontendIPConfig(azlb, frontendName)
+		if frontend == nil {
+			return nil, fmt.Errorf("azure lb frontend %s not found", frontendName)
+		}
+		rule := network.OutboundRule{
+			Name: to.StringPtr(azureLoadBalancerOutboundRuleName),
+			OutboundRulePropertiesFormat: &network.OutboundRulePropertiesFormat{
+				Protocol: network.Protocol1All,
+				FrontendIPConfigurations: &[]network.SubResource{
+					{ID: frontend.ID},
+				},
+				BackendAddressPool: &network.SubResource{
+					ID: (*azlb.BackendAddressPools)[0].ID,
+				},
+			},
+		}
+		if outbound.AllocatedOutboundPorts != 0 {
+			rule.AllocatedOutboundPorts = to.Int32Ptr(outbound.AllocatedOutboundPorts)
+		}
+		rules = append(rules, rule)
+	}
+	if equalOutboundRules(azlb.OutboundRules, rules) {
+		return azlb, nil
+	}
+	azlb.OutboundRules = &rules
+	var err error
+	*azlb, err = c.LoadBalancer.CreateOrUpdate(context.TODO(), lb.Spec.Providers.Azure.ResourceGroupName, to.String(azlb.Name), *azlb)
+	if err != nil {
+		log.Errorf("update outbound rules failed: %v", err)
+		return nil, err
+	}
+	return azlb, nil
+}
+
+// check outbound rules in same config except chore, the allocated ports
+// are ignored if they are allocated by azure
+func equalOutboundRules(current *[]network.OutboundRule, expected []network.OutboundRule) bool {
+	if current == nil || len(*current) == 0 {
+		return len(expected) == 0
+	}
+	if len(*current) != len(expected) {
+		return false
+	}
+	for i, x := range *current {
+		if x.OutboundRulePropertiesFormat == nil {
+			return false
+		}
+		ports := expected[i].AllocatedOutboundPorts
+		if ports == nil {
+			ports = x.AllocatedOutboundPorts
+		}
+		brief := network.OutboundRule{
+			Name: x.Name,
+			OutboundRulePropertiesFormat: &network.OutboundRulePropertiesFormat{
+				Protocol:                 x.Protocol,
+				AllocatedOutboundPorts:   ports,
+				FrontendIPConfigurations: x.FrontendIPConfigurations,
+				BackendAddressPool:       x.BackendAddressPool,
+			},
+		}
+		if !reflect.DeepEqual(brief, expected[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// removeRulesWithoutReference removes the rules referring to the probes or
+// frontends not in azlb
+func removeRulesWithoutReference(azlb *network.LoadBalancer) {
+	if azlb.LoadBalancingRules == nil {
+		return
+	}
+	refName := func(ref *network.SubResource) string {
+		id := to.String(ref.ID)
+		return id[strings.LastIndex(id, "/")+1:]
+	}
+	rules := make([]network.LoadBalancingRule, 0, len(*azlb.LoadBalancingRules))
+	for _, rule := range *azlb.LoadBalancingRules {
+		if rule.LoadBalancingRulePropertiesFormat != nil {
+			if rule.Probe != nil && findProbe(azlb, refName(rule.Probe)) == nil {
+				continue
+			}
+			if rule.FrontendIPConfiguration != nil && findFrontendIPConfig(azlb, refName(rule.FrontendIPConfiguration)) == nil {
+				continue
+			}
+		}
+		rules = append(rules, rule)
+	}
+	azlb.LoadBalancingRules = &rules
+}
+
 // create a default azure load balancer
-func createAzureLoadBalancer(c *client.Client, lb *lbapi.LoadBalancer) (*network.LoadBalancer, error) {
+func createAzureLoadBalancer(c *client.Client, lb *lbapi.LoadBalancer, config *Config) (*network.LoadBalancer, error) {
 	// init
-	azlb := initClusterAzureLoadBalancerObject(lb, lb.Spec.Providers.Azure.ClusterID)
+	azlb := initClusterAzureLoadBalancerObject(lb, lb.Spec.Providers.Azure.ClusterID, config)
 	log.Infof("create azure loadbalancer %s", to.String(azlb.Name))
 	azlb, err := c.LoadBalancer.CreateOrUpdate(context.TODO(), lb.Spec.Providers.Azure.ResourceGroupName, to.String(azlb.Name), azlb)
 	if err != nil {
@@ -153,13 +307,33 @@ func createAzureLoadBalancer(c *client.Client, lb *lbapi.LoadBalancer) (*network
 }
 
 // ensure sync default rules
-func ensureSyncDefaultRules(c *client.Client, azlb *network.LoadBalancer, lb *lbapi.LoadBalancer) (*network.LoadBalancer, error) {
-	frontendIPConfigurationID := to.String((*azlb.FrontendIPConfigurations)[0].ID)
+func ensureSyncDefaultRules(c *client.Client, azlb *network.LoadBalancer, lb *lbapi.LoadBalancer, config *Config) (*network.LoadBalancer, error) {
+	frontend := findFrontendIPConfig(azlb, azureLoadBalancerFrontendName)
+	if frontend == nil {
+		return nil, fmt.Errorf("azure lb frontend %s not found", azureLoadBalancerFrontendName)
+	}
+	frontendIPConfigurationID := to.String(frontend.ID)
 	backendAddressPoolID := to.String((*azlb.BackendAddressPools)[0].ID)
-	lbRules := azureLBProbes2Rules(frontendIPConfigurationID, backendAddressPoolID, *azlb.Probes)
+	// the probes of exported ports are used by the rules of the ports
+	var probes []network.Probe
+	for _, probe := range defaultClusterAzureLBProbes() {
+		if found := findProbe(azlb, to.String(probe.Name)); found != nil {
+			probes = append(probes, *found)
+		}
+	}
+	var lbRules []network.LoadBalancingRule
+	if config.haPorts() && len(probes) != 0 {
+		lbRules = []network.LoadBalancingRule{haPortsRule(frontendIPConfigurationID, backendAddressPoolID, &probes[0], config)}
+	} else {
+		lbRules = azureLBProbes2Rules(frontendIPConfigurationID, backendAddressPoolID, probes, config)
+	}
 	var change bool
 	if azlb.LoadBalancingRules != nil && len(*azlb.LoadBalancingRules) != 0 {
-		change = patchAzureLoadBalancerDefaultRules(azlb, lbRules)
+		// the ha ports rule replaces all the other rules
+		change = removeRules(azlb, func(rule *network.LoadBalancingRule) bool {
+			return isHAPortsRule(rule) != config.haPorts()
+		})
+		change = patchAzureLoadBalancerDefaultRules(azlb, lbRules) || change
 	} else {
 		azlb.LoadBalancingRules = &lbRules
 		change = true
@@ -176,17 +350,38 @@ func ensureSyncDefaultRules(c *client.Client, azlb *network.LoadBalancer, lb *lb
 	return azlb, nil
 }
 
+// removeRules removes the matched rules, returns true if any is removed
+func removeRules(azlb *network.LoadBalancer, match func(*network.LoadBalancingRule) bool) bool {
+	rules := make([]network.LoadBalancingRule, 0, len(*azlb.LoadBalancingRules))
+	for i := range *azlb.LoadBalancingRules {
+		if !match(&(*azlb.LoadBalancingRules)[i]) {
+			rules = append(rules, (*azlb.LoadBalancingRules)[i])
+		}
+	}
+	if len(rules) == len(*azlb.LoadBalancingRules) {
+		return false
+	}
+	azlb.LoadBalancingRules = &rules
+	return true
+}
+
 // patchAzureLoadBalancerDefaultRules
 // patch default rules if the rule not exist in azure rules
+// the rule with the same name is replaced if its options are changed
 func patchAzureLoadBalancerDefaultRules(azlb *network.LoadBalancer, defaultRules []network.LoadBalancingRule) bool {
 	var change bool
 	for _, defaultRule := range defaultRules {
 		exist := false
-		for _, rule := range *azlb.LoadBalancingRules {
+		for i, rule := range *azlb.LoadBalancingRules {
 			if equalRule(rule, defaultRule) {
 				exist = true
 				break
 			}
+			if to.String(rule.Name) == to.String(defaultRule.Name) {
+				(*azlb.LoadBalancingRules)[i] = defaultRule
+				exist, change = true, true
+				break
+			}
 		}
 		if !exist {
 			*azlb.LoadBalancingRules = append(*azlb.LoadBalancingRules, defaultRule)
@@ -197,6 +392,7 @@ func patchAzureLoadBalancerDefaultRules(azlb *network.LoadBalancer, defaultRules
 }
 
 // check rule in same config except chore for example Etag、ProvisioningState
+// the options of rules are compared so that the changed options are synced
 func equalRule(x, brief network.LoadBalancingRule) bool {
 	Xbrief := network.LoadBalancingRule{
 		Name: x.Name,
@@ -216,6 +412,7 @@ func equalRule(x, brief network.LoadBalancingRule) bool {
 			BackendPort:          x.BackendPort,
 			IdleTimeoutInMinutes: x.IdleTimeoutInMinutes,
 			EnableFloatingIP:     x.EnableFloatingIP,
+			EnableTCPReset:       x.EnableTCPReset,
 			DisableOutboundSnat:  x.DisableOutboundSnat,
 		},
 	}
@@ -238,30 +435,35 @@ func getAzureLoadbalancer(c *client.Client, groupName, lbName string) (*network.
 }
 
 // ensureSyncRulesAndBackendPools return true if lb has diff with azureLB
-// sync rules and BackendPools
-func ensureSyncRulesAndBackendPools(c *client.Client, storeLister *core.StoreLister, azlb *network.LoadBalancer, lb *lbapi.LoadBalancer, tcpMap, udpMap map[string]string) error {
+// sync rules and BackendPools, the steps finished in progress are skipped
+func ensureSyncRulesAndBackendPools(c *client.Client, storeLister *core.StoreLister, azlb *network.LoadBalancer, lb *lbapi.LoadBalancer, tcpMap, udpMap map[string]string, config *Config, progress *syncProgress) error {
 
 	groupName := getGroupName(lb)
-	err := syncRules(c, azlb, tcpMap, udpMap, groupName)
-	if err != nil {
-		return err
+	if !progress.finished(stepRules) {
+		err := syncRules(c, azlb, tcpMap, udpMap, groupName, config)
+		if err != nil {
+			return err
+		}
+		progress.finish(stepRules)
+		log.Info("sync rules successfully...")
 	}
-	log.Info("sync rules successfully...")
-	detachNetworks, azlbBackendNetworksMap, err := syncBackendPools(c, storeLister, azlb, lb)
+	detachNetworks, azlbBackendNetworksMap, err := syncBackendPoolsWithProgress(c, storeLister, azlb, lb.Spec.Nodes.Names, progress)
 	if err != nil {
 		return err
 	}
+	progress.finish(stepBackendPools)
 	log.Infof("sync backendPools successfully...")
 	// if use public address , need sync security rules to the security group
-	if usePublicAddress(lb) {
+	if (usePublicAddress(lb) || config.hasPublicFrontend()) && !progress.finished(stepSecurityGroups) {
 		// add default security group rules
-		if tcpMap == nil {
-			tcpMap = make(map[string]string)
-		}
+		tcpMap = copyMap(tcpMap)
 		tcpMap["80"] = ""
 		tcpMap["443"] = ""
 		err = syncSecurityGroupRules(c, tcpMap, udpMap, detachNetworks, azlbBackendNetworksMap)
 		log.Infof("sync security group rules result %v", err)
+		if err == nil {
+			progress.finish(stepSecurityGroups)
+		}
 	}
 	return err
 }
@@ -579,10 +781,11 @@ func setProvisioningState(lb *lbapi.LoadBalancer, provisioningState string) {
 	lb.Status.ProvidersStatuses.Azure.ProvisioningState = provisioningState
 }
 
-func syncRules(c *client.Client, azlb *network.LoadBalancer, tcpMap, udpMap map[string]string, groupName string) (err error) {
+func syncRules(c *client.Client, azlb *network.LoadBalancer, tcpMap, udpMap map[string]string, groupName string, config *Config) (err error) {
 
 	log.Infof("sync rules azlb group %s name %s , \ntcp rules :%v \nudp rules: %v", groupName, to.String(azlb.Name), tcpMap, udpMap)
-	change := makeUpRules(azlb, tcpMap, udpMap)
+	// the maps are shared with the configmap cache, don't modify them
+	change := makeUpRules(azlb, copyMap(tcpMap), copyMap(udpMap), config)
 	if change {
 		*azlb, err = c.LoadBalancer.CreateOrUpdate(context.TODO(), groupName, to.String(azlb.Name), *azlb)
 		if err != nil {
@@ -593,35 +796,59 @@ func syncRules(c *client.Client, azlb *network.LoadBalancer, tcpMap, udpMap map[
 	return nil
 }
 
-// sync backend pools
-func syncBackendPools(c *client.Client, storeLister *core.StoreLister, azlb *network.LoadBalancer, lb *lbapi.LoadBalancer) ([]string, networkInterfaceIDSet, error) {
-	nodes := lb.Spec.Nodes.Names
-	return syncBackendPoolsWithNodes(c, storeLister, azlb, nodes)
-}
-
 // sync backend pools with spec nodes
 func syncBackendPoolsWithNodes(c *client.Client, storeLister *core.StoreLister, azlb *network.LoadBalancer, nodes []string) ([]string, networkInterfaceIDSet, error) {
+	return syncBackendPoolsWithProgress(c, storeLister, azlb, nodes, nil)
+}
+
+// syncBackendPoolsWithProgress syncs backend pools with spec nodes, the
+// network interfaces resolved and updated in progress are not done again.
+// All the network interfaces are tried even if some of them fail.
+func syncBackendPoolsWithProgress(c *client.Client, storeLister *core.StoreLister, azlb *network.LoadBalancer, nodes []string, progress *syncProgress) ([]string, networkInterfaceIDSet, error) {
 	log.Infof("sync backend pools azlb name %s", to.String(azlb.Name))
-	// nodes := lb.Spec.Nodes.Names
-	detachs, attachs, azlbBackendNetworksMap, err := diffBackendPoolNetworkInterfaecs(c, azlb, nodes, storeLister)
-	if err != nil {
-		return nil, nil, err
+	if progress.finished(stepBackendPools) {
+		return progress.detachs, progress.networks, nil
 	}
 	if azlb.BackendAddressPools == nil || len(*azlb.BackendAddressPools) == 0 {
 		return nil, nil, fmt.Errorf("backend pools is empty")
 	}
-	poolID := to.String((*(azlb.BackendAddressPools))[0].ID)
-	for _, detach := range detachs {
-		err := detachNetworkInterfacesAndLoadBalancer(c, detach, poolID)
+
+	var detachs, attachs []string
+	var azlbBackendNetworksMap networkInterfaceIDSet
+	if progress != nil && progress.resolved {
+		detachs, attachs, azlbBackendNetworksMap = progress.detachs, progress.attachs, progress.networks
+		log.Info("resume syncing backend pools", log.Fields{"detachs": len(detachs), "attachs": len(attachs), "updated": len(progress.updated)})
+	} else {
+		var err error
+		detachs, attachs, azlbBackendNetworksMap, err = diffBackendPoolNetworkInterfaecs(c, azlb, nodes, storeLister)
 		if err != nil {
 			return nil, nil, err
 		}
+		progress.resolve(detachs, attachs, azlbBackendNetworksMap)
 	}
-	for _, attach := range attachs {
-		err := attachNetworkInterfacesAndLoadBalancer(c, attach, poolID)
-		if err != nil {
-			return nil, nil, err
+
+	poolID := to.String((*(azlb.BackendAddressPools))[0].ID)
+	var firstErr error
+	update := func(nic string, fn func(*client.Client, string, string) error) {
+		if progress.isUpdated(nic) {
+			return
 		}
+		if err := fn(c, nic, poolID); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return
+		}
+		progress.markUpdated(nic)
+	}
+	for _, detach := range detachs {
+		update(detach, detachNetworkInterfacesAndLoadBalancer)
+	}
+	for _, attach := range attachs {
+		update(attach, attachNetworkInterfacesAndLoadBalancer)
+	}
+	if firstErr != nil {
+		return nil, nil, firstErr
 	}
 	return detachs, azlbBackendNetworksMap, nil
 }
@@ -637,7 +864,7 @@ func detachNetworkInterfacesAndLoadBalancer(c *client.Client, detachID string, p
 		return err
 	}
 	if nic.IPConfigurations == nil {
-		log.Warnf("networkInterface[%s/%s] ipc is zero, skip it", name)
+		log.Warnf("networkInterface[%s/%s] ipc is zero, skip it", groupName, name)
 		return nil
 	}
 
@@ -684,7 +911,7 @@ func attachNetworkInterfacesAndLoadBalancer(c *client.Client, attachID string, p
 		return err
 	}
 	if nic.IPConfigurations == nil {
-		log.Warnf("networkInterface[%s/%s] ipc is zero, skip it", name)
+		log.Warnf("networkInterface[%s/%s] ipc is zero, skip it", groupName, name)
 		return fmt.Errorf("ipc is zero")
 	}
 
@@ -725,7 +952,7 @@ func attachNetworkInterfacesAndLoadBalancer(c *client.Client, attachID string, p
 }
 
 // init azure loadbalancer with no probe rules and backends
-func initClusterAzureLoadBalancerObject(lb *lbapi.LoadBalancer, clusterID string) network.LoadBalancer {
+func initClusterAzureLoadBalancerObject(lb *lbapi.LoadBalancer, clusterID string, config *Config) network.LoadBalancer {
 	lbName := lb.Spec.Providers.Azure.Name
 	if len(lbName) == 0 {
 		lbName = getAzureLBName(lb.Name, clusterID)
@@ -738,7 +965,7 @@ func initClusterAzureLoadBalancerObject(lb *lbapi.LoadBalancer, clusterID string
 		},
 		LoadBalancerPropertiesFormat: &network.LoadBalancerPropertiesFormat{},
 	}
-	frontendIPConfigurations := getAzureLoadBalancerFrontendIPConfigByConfig(lb.Spec.Providers.Azure.IPAddressProperties)
+	frontendIPConfigurations := getAzureLoadBalancerFrontendIPConfigByConfig(config.ipAddressProperties(lb.Spec.Providers.Azure.IPAddressProperties))
 	azlb.FrontendIPConfigurations = frontendIPConfigurations
 	return azlb
 }
@@ -769,6 +996,21 @@ func recoverDefaultAzureLoadBalancer(c *client.Client, groupName, lbName string)
 		*azlb.Probes = (*azlb.Probes)[:0]
 	}
 
+	// 3.clean outbound rules and the frontends except the one of spec,
+	// which refer to the public ips and subnets of users
+	if azlb.OutboundRules != nil && len(*azlb.OutboundRules) != 0 {
+		*azlb.OutboundRules = (*azlb.OutboundRules)[:0]
+	}
+	if findFrontendIPConfig(&azlb, azureLoadBalancerFrontendName) != nil {
+		fronts := make([]network.FrontendIPConfiguration, 0, 1)
+		for _, front := range *azlb.FrontendIPConfigurations {
+			if to.String(front.Name) == azureLoadBalancerFrontendName {
+				fronts = append(fronts, front)
+			}
+		}
+		azlb.FrontendIPConfigurations = &fronts
+	}
+
 	pools := azlb.BackendAddressPools
 
 	// update azlb
@@ -781,11 +1023,11 @@ func recoverDefaultAzureLoadBalancer(c *client.Client, groupName, lbName string)
 	if pools == nil || len(*pools) == 0 {
 		return nil
 	}
-	// 3.clean backend pools netInterfaces
+	// 4.clean backend pools netInterfaces
 	pool := (*pools)[0]
 	poolID := to.String(pool.ID)
 
-	// 4.detach all netInterfaces with backend pool ID
+	// 5.detach all netInterfaces with backend pool ID
 	if pool.BackendIPConfigurations == nil || len(*pool.BackendIPConfigurations) == 0 {
 		return nil
 	}
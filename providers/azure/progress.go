@@ -0,0 +1,85 @@
+package azure
+
+import (
+	"encoding/json"
+
+	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+)
+
+// steps of ensureSync, a failed sync resumes from the failed step if the
+// loadbalancer is unchanged
+const (
+	stepLoadBalancer   = "loadBalancer"
+	stepRules          = "rules"
+	stepBackendPools   = "backendPools"
+	stepSecurityGroups = "securityGroups"
+)
+
+// syncProgress records the progress of a sync
+type syncProgress struct {
+	key  string
+	done map[string]bool
+
+	// network interfaces resolved from nodes, they are kept so that the
+	// virtual machines are not listed again on resume
+	resolved bool
+	detachs  []string
+	attachs  []string
+	networks networkInterfaceIDSet
+	// network interfaces updated
+	updated map[string]bool
+}
+
+// syncProgressKey returns the key of the spec, config and ports synced
+func syncProgressKey(lb *lbapi.LoadBalancer, tcp, udp map[string]string) string {
+	azure := *lb.Spec.Providers.Azure
+	// the name is generated on creation
+	if azure.Name == "" {
+		azure.Name = getAzureLBName(lb.Name, azure.ClusterID)
+	}
+	data, _ := json.Marshal(struct {
+		Azure  lbapi.AzureProvider
+		Config string
+		Nodes  []string
+		TCP    map[string]string
+		UDP    map[string]string
+	}{azure, configAnnotation(lb), lb.Spec.Nodes.Names, tcp, udp})
+	return string(data)
+}
+
+func newSyncProgress(key string) *syncProgress {
+	return &syncProgress{
+		key:     key,
+		done:    make(map[string]bool),
+		updated: make(map[string]bool),
+	}
+}
+
+// finished returns true if the step is done in the previous attempt
+func (p *syncProgress) finished(step string) bool {
+	return p != nil && p.done[step]
+}
+
+func (p *syncProgress) finish(step string) {
+	if p != nil {
+		p.done[step] = true
+	}
+}
+
+// resolve records the network interfaces to update
+func (p *syncProgress) resolve(detachs, attachs []string, networks networkInterfaceIDSet) {
+	if p != nil {
+		p.resolved = true
+		p.detachs, p.attachs, p.networks = detachs, attachs, networks
+	}
+}
+
+func (p *syncProgress) isUpdated(nic string) bool {
+	return p != nil && p.updated[nic]
+}
+
+func (p *syncProgress) markUpdated(nic string) {
+	if p != nil {
+		p.updated[nic] = true
+	}
+}
@@ -0,0 +1,152 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-07-01/network"
+	"github.com/Azure/go-autorest/autorest/to"
+	log "github.com/zoumo/logdog"
+
+	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+	"github.com/caicloud/loadbalancer-provider/providers/azure/client"
+)
+
+const (
+	// tags of the public ips created by the provider, a public ip is only
+	// updated and deleted if it is owned by the loadbalancer
+	publicIPAddressClusterTag      = "caicloud-cluster"
+	publicIPAddressLoadBalancerTag = "caicloud-loadbalancer"
+
+	publicIPAddressNameFormat = "%s-ip"
+)
+
+// managedPublicIPAddress returns true if the public ip of the loadbalancer
+// is created by the provider, which means no publicIPAddressID is given
+func managedPublicIPAddress(properties lbapi.AzureIPAddressProperties) bool {
+	return properties.Public != nil && to.String(properties.Public.PublicIPAddressID) == ""
+}
+
+// getPublicIPAddressName returns the name of the public ip created for the azure lb
+func getPublicIPAddressName(lbName string) string {
+	return fmt.Sprintf(publicIPAddressNameFormat, lbName)
+}
+
+// getPublicIPAddressOwner returns the value of the loadbalancer tag
+func getPublicIPAddressOwner(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// ownedPublicIPAddress returns true if the public ip is created for the
+// loadbalancer, the cluster is not checked if it is unknown
+func ownedPublicIPAddress(ip *network.PublicIPAddress, clusterID, owner string) bool {
+	if ip.Tags == nil || to.String(ip.Tags[publicIPAddressLoadBalancerTag]) != owner {
+		return false
+	}
+	return clusterID == "" || to.String(ip.Tags[publicIPAddressClusterTag]) == clusterID
+}
+
+// newPublicIPAddress returns the public ip of the loadbalancer, the SKU
+// follows the SKU of the loadbalancer
+func newPublicIPAddress(lb *lbapi.LoadBalancer, config *Config) network.PublicIPAddress {
+	azureSpec := lb.Spec.Providers.Azure
+	ip := network.PublicIPAddress{
+		Location: to.StringPtr(azureSpec.Location),
+		Sku: &network.PublicIPAddressSku{
+			Name: network.PublicIPAddressSkuName(azureSpec.SKU),
+		},
+		Tags: map[string]*string{
+			publicIPAddressClusterTag:      to.StringPtr(azureSpec.ClusterID),
+			publicIPAddressLoadBalancerTag: to.StringPtr(getPublicIPAddressOwner(lb.Namespace, lb.Name)),
+		},
+		PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{
+			PublicIPAllocationMethod: network.IPAllocationMethod(azureSpec.IPAddressProperties.Public.IPAllocationMethod),
+		},
+	}
+	if label := config.dnsLabel(); label != "" {
+		ip.DNSSettings = &network.PublicIPAddressDNSSettings{
+			DomainNameLabel: to.StringPtr(label),
+		}
+	}
+	return ip
+}
+
+// equalPublicIPAddress compares the fields of the public ip set by newPublicIPAddress
+func equalPublicIPAddress(ip, desired *network.PublicIPAddress) bool {
+	if ip.Sku == nil || ip.Sku.Name != desired.Sku.Name || ip.PublicIPAddressPropertiesFormat == nil {
+		return false
+	}
+	if ip.PublicIPAllocationMethod != desired.PublicIPAllocationMethod {
+		return false
+	}
+	return getDNSLabel(ip) == getDNSLabel(desired)
+}
+
+func getDNSLabel(ip *network.PublicIPAddress) string {
+	if ip.DNSSettings == nil {
+		return ""
+	}
+	return to.String(ip.DNSSettings.DomainNameLabel)
+}
+
+// ensureManagedPublicIPAddress creates or updates the public ip of a public
+// loadbalancer without publicIPAddressID, the id is saved in the config
+func ensureManagedPublicIPAddress(c *client.Client, lb *lbapi.LoadBalancer, config *Config) error {
+	azureSpec := lb.Spec.Providers.Azure
+	if !managedPublicIPAddress(azureSpec.IPAddressProperties) {
+		return nil
+	}
+	lbName := azureSpec.Name
+	if len(lbName) == 0 {
+		lbName = getAzureLBName(lb.Name, azureSpec.ClusterID)
+	}
+	name := getPublicIPAddressName(lbName)
+	owner := getPublicIPAddressOwner(lb.Namespace, lb.Name)
+	desired := newPublicIPAddress(lb, config)
+
+	ip, err := c.PublicIPAddress.Get(context.TODO(), azureSpec.ResourceGroupName, name, "")
+	if err != nil && !client.IsNotFound(err) {
+		log.Errorf("get public ip %s failed %v", name, err)
+		return err
+	}
+	if err == nil {
+		if !ownedPublicIPAddress(&ip, azureSpec.ClusterID, owner) {
+			return client.NewServiceError("PublicIPAddressConflict", fmt.Sprintf("public ip %s is not created for loadbalancer %s", name, owner))
+		}
+		if equalPublicIPAddress(&ip, &desired) {
+			config.publicIPAddressID = to.String(ip.ID)
+			return nil
+		}
+	}
+
+	log.Infof("create or update public ip group %s name %s", azureSpec.ResourceGroupName, name)
+	ip, err = c.PublicIPAddress.CreateOrUpdate(context.TODO(), azureSpec.ResourceGroupName, name, desired)
+	if err != nil {
+		log.Errorf("create or update public ip %s failed %v", name, err)
+		return err
+	}
+	config.publicIPAddressID = to.String(ip.ID)
+	return nil
+}
+
+// deleteManagedPublicIPAddress deletes the public ip created for the azure lb,
+// it is kept if it is not owned by the loadbalancer
+func deleteManagedPublicIPAddress(c *client.Client, azure *lbapi.AzureProvider, owner string) error {
+	if !managedPublicIPAddress(azure.IPAddressProperties) {
+		return nil
+	}
+	name := getPublicIPAddressName(azure.Name)
+	ip, err := c.PublicIPAddress.Get(context.TODO(), azure.ResourceGroupName, name, "")
+	if client.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !ownedPublicIPAddress(&ip, azure.ClusterID, owner) {
+		log.Warnf("public ip %s is not created for loadbalancer %s, skip", name, owner)
+		return nil
+	}
+	log.Infof("delete public ip group %s name %s", azure.ResourceGroupName, name)
+	return c.PublicIPAddress.Delete(context.TODO(), azure.ResourceGroupName, name)
+}
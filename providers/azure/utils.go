@@ -6,7 +6,7 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-01-01/network"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2018-07-01/network"
 	"github.com/Azure/go-autorest/autorest/to"
 	log "github.com/zoumo/logdog"
 	"k8s.io/api/core/v1"
@@ -22,8 +22,11 @@ const (
 
 	azureNameFormat = "%s-%s"
 
-	azureLoadBalancerFrontendName = "LoadBalancerFrontend"
-	azureLoadBalancerBackendName  = "LoadBalancerBackend"
+	azureLoadBalancerFrontendName         = "LoadBalancerFrontend"
+	azureLoadBalancerBackendName          = "LoadBalancerBackend"
+	azureLoadBalancerOutboundFrontendName = "LoadBalancerOutboundFrontend"
+	azureLoadBalancerOutboundRuleName     = "LoadBalancerOutbound"
+	azureLoadBalancerHAPortsRuleName      = "ha-ports"
 
 	azureResourceGroups    = "resourceGroups"
 	azureNetworkInterfaces = "networkInterfaces"
@@ -129,7 +132,7 @@ func getNetworkInterfacesFromVM(c *client.Client, machine *machineInfo) ([]strin
 	}
 
 	if vm.NetworkProfile.NetworkInterfaces == nil || len(*vm.NetworkProfile.NetworkInterfaces) == 0 {
-		return nil, fmt.Errorf("vm %s has no networkInterfaces", vm.Name)
+		return nil, fmt.Errorf("vm %s has no networkInterfaces", to.String(vm.Name))
 	}
 	networkInterfaces := make([]string, 0, len(*vm.NetworkProfile.NetworkInterfaces))
 	for _, networkInterface := range *vm.NetworkProfile.NetworkInterfaces {
@@ -162,12 +165,12 @@ func defaultClusterAzureLBProbes() []network.Probe {
 	return re
 }
 
-func azureLBProbes2Rules(frontendIPConfigurationID, backendAddressPoolID string, probes []network.Probe) []network.LoadBalancingRule {
+func azureLBProbes2Rules(frontendIPConfigurationID, backendAddressPoolID string, probes []network.Probe, config *Config) []network.LoadBalancingRule {
 	re := make([]network.LoadBalancingRule, 0, len(probes))
 	for i := range probes {
 		probe := &probes[i]
 		ruleName := getRuleName(to.Int32(probe.Port), network.TransportProtocolTCP)
-		re = append(re, network.LoadBalancingRule{
+		rule := network.LoadBalancingRule{
 			Name: to.StringPtr(ruleName),
 			LoadBalancingRulePropertiesFormat: &network.LoadBalancingRulePropertiesFormat{
 				FrontendIPConfiguration: &network.SubResource{
@@ -179,21 +182,46 @@ func azureLBProbes2Rules(frontendIPConfigurationID, backendAddressPoolID string,
 				Probe: &network.SubResource{
 					ID: probe.ID,
 				},
-				Protocol: network.TransportProtocolTCP,
-				// The load distribution policy for this rule
-				// make sure the traffic distributed to one backend in a conversation
-				LoadDistribution:     network.SourceIPProtocol,
-				FrontendPort:         probe.Port,
-				BackendPort:          probe.Port,
-				IdleTimeoutInMinutes: to.Int32Ptr(4),
-				EnableFloatingIP:     to.BoolPtr(false),
-				DisableOutboundSnat:  to.BoolPtr(false),
+				Protocol:     network.TransportProtocolTCP,
+				FrontendPort: probe.Port,
+				BackendPort:  probe.Port,
 			},
-		})
+		}
+		// The load distribution policy defaults to SourceIPProtocol
+		// make sure the traffic distributed to one backend in a conversation
+		config.applyRule(&rule, false)
+		re = append(re, rule)
 	}
 	return re
 }
 
+// haPortsRule returns the rule of all protocols and ports
+func haPortsRule(frontendIPConfigurationID, backendAddressPoolID string, probe *network.Probe, config *Config) network.LoadBalancingRule {
+	rule := network.LoadBalancingRule{
+		Name: to.StringPtr(azureLoadBalancerHAPortsRuleName),
+		LoadBalancingRulePropertiesFormat: &network.LoadBalancingRulePropertiesFormat{
+			FrontendIPConfiguration: &network.SubResource{
+				ID: to.StringPtr(frontendIPConfigurationID),
+			},
+			BackendAddressPool: &network.SubResource{
+				ID: to.StringPtr(backendAddressPoolID),
+			},
+			Probe: &network.SubResource{
+				ID: probe.ID,
+			},
+			Protocol:     network.TransportProtocolAll,
+			FrontendPort: to.Int32Ptr(0),
+			BackendPort:  to.Int32Ptr(0),
+		},
+	}
+	config.applyRule(&rule, true)
+	return rule
+}
+
+func isHAPortsRule(rule *network.LoadBalancingRule) bool {
+	return rule.Protocol == network.TransportProtocolAll && to.Int32(rule.FrontendPort) == 0
+}
+
 func getGroupName(lb *lbapi.LoadBalancer) string {
 	azure := lb.Spec.Providers.Azure
 	if azure == nil {
@@ -210,7 +238,8 @@ func isDefaultRules(rule *network.LoadBalancingRule) bool {
 	if port != 80 && port != 443 {
 		return false
 	}
-	return true
+	// the ports may be exported by the other frontends
+	return to.String(rule.Name) == getRuleName(port, rule.Protocol)
 }
 
 func getRuleName(port int32, protocol network.TransportProtocol) string {
@@ -218,8 +247,22 @@ func getRuleName(port int32, protocol network.TransportProtocol) string {
 	return strings.ToLower(name)
 }
 
+// getFrontendRuleName returns the name of rule of the frontend in config,
+// the rules of the frontend of spec have no prefix
+func getFrontendRuleName(frontend string, port int32, protocol network.TransportProtocol) string {
+	name := getRuleName(port, protocol)
+	if frontend == "" {
+		return name
+	}
+	return fmt.Sprintf("%s-%s", frontend, name)
+}
+
 //return true if azlb has diff with tcp and udp map
-func makeUpRules(azlb *network.LoadBalancer, tcpMap, udpMap map[string]string) bool {
+func makeUpRules(azlb *network.LoadBalancer, tcpMap, udpMap map[string]string, config *Config) bool {
+	// the ha ports rule is synced with the default rules
+	if config.haPorts() {
+		return false
+	}
 
 	var oldRules []network.LoadBalancingRule
 	if azlb.LoadBalancingRules == nil || len(*azlb.LoadBalancingRules) == 0 {
@@ -229,13 +272,13 @@ func makeUpRules(azlb *network.LoadBalancer, tcpMap, udpMap map[string]string) b
 	}
 
 	// remain the Constant rule
-	newRules, diff := remainConstantRules(oldRules, tcpMap, udpMap)
+	newRules, diff := remainConstantRules(azlb, oldRules, tcpMap, udpMap, config)
 	if len(tcpMap) != 0 || len(udpMap) != 0 {
 		diff = true
 	}
 	// add new tcp rule
 	for port, service := range tcpMap {
-		newRule, err := newRuleWithConfig(azlb, port, service, network.TransportProtocolTCP)
+		newRule, err := newRuleWithConfig(azlb, port, service, network.TransportProtocolTCP, config)
 		if err != nil {
 			log.Warnf("invalid port %v error : %v", port, err)
 			continue
@@ -244,7 +287,7 @@ func makeUpRules(azlb *network.LoadBalancer, tcpMap, udpMap map[string]string) b
 	}
 	// add new udp rule
 	for port, service := range udpMap {
-		newRule, err := newRuleWithConfig(azlb, port, service, network.TransportProtocolUDP)
+		newRule, err := newRuleWithConfig(azlb, port, service, network.TransportProtocolUDP, config)
 		if err != nil {
 			log.Warnf("invalid port %v error : %v", port, err)
 			continue
@@ -259,7 +302,8 @@ func makeUpRules(azlb *network.LoadBalancer, tcpMap, udpMap map[string]string) b
 }
 
 // remain constant rules, will delete the constant rule from tcpMap and udpMap
-func remainConstantRules(oldRules []network.LoadBalancingRule, tcpMap, udpMap map[string]string) ([]network.LoadBalancingRule, bool) {
+// a rule is constant if it is the same as the rule made up with config
+func remainConstantRules(azlb *network.LoadBalancer, oldRules []network.LoadBalancingRule, tcpMap, udpMap map[string]string, config *Config) ([]network.LoadBalancingRule, bool) {
 	newRules := make([]network.LoadBalancingRule, 0, len(oldRules))
 	var diff bool
 	for _, rule := range oldRules {
@@ -280,12 +324,10 @@ func remainConstantRules(oldRules []network.LoadBalancingRule, tcpMap, udpMap ma
 			newRules = append(newRules, rule)
 			continue
 		}
-		_, ok := m[portKey]
-		if ok {
-			ruleName := getRuleName(port, rule.Protocol)
-			if to.String(rule.Name) == ruleName {
-				delete(tcpMap, portKey)
-				// fmt.Printf("ruleName %s rule.Name %s\n", ruleName, to.String(rule.Name))
+		if service, ok := m[portKey]; ok {
+			expected, err := newRuleWithConfig(azlb, portKey, service, rule.Protocol, config)
+			if err == nil && equalRule(rule, *expected) {
+				delete(m, portKey)
 				newRules = append(newRules, rule)
 				continue
 			}
@@ -295,8 +337,8 @@ func remainConstantRules(oldRules []network.LoadBalancingRule, tcpMap, udpMap ma
 	return newRules, diff
 }
 
-//new rule
-func newRuleWithConfig(azlb *network.LoadBalancer, port, service string, protocol network.TransportProtocol) (*network.LoadBalancingRule, error) {
+//new rule, the port uses the probe and frontend in config or the defaults
+func newRuleWithConfig(azlb *network.LoadBalancer, port, service string, protocol network.TransportProtocol, config *Config) (*network.LoadBalancingRule, error) {
 	// check
 	if azlb.Probes == nil || len(*azlb.Probes) == 0 {
 		return nil, fmt.Errorf("azure lb probes is nil")
@@ -307,16 +349,28 @@ func newRuleWithConfig(azlb *network.LoadBalancer, port, service string, protoco
 	if azlb.BackendAddressPools == nil || len(*azlb.BackendAddressPools) == 0 {
 		return nil, fmt.Errorf("azure lb backendAddressPools is nil")
 	}
-	// get param
-	probeID := (*azlb.Probes)[0].ID
-	frontendIPConfigurationID := to.String((*azlb.FrontendIPConfigurations)[0].ID)
-	backendAddressPoolID := to.String((*azlb.BackendAddressPools)[0].ID)
-
 	lbPort, err := strconv.Atoi(port)
 	if err != nil {
 		return nil, err
 	}
-	ruleName := getRuleName(int32(lbPort), protocol)
+
+	// get param
+	probeID := (*azlb.Probes)[0].ID
+	if probe := config.probe(protocol, int32(lbPort)); probe != nil {
+		found := findProbe(azlb, to.String(probe.Name))
+		if found == nil {
+			return nil, fmt.Errorf("azure lb probe %s not found", to.String(probe.Name))
+		}
+		probeID = found.ID
+	}
+	frontendConfig := config.port(protocol, int32(lbPort)).Frontend
+	frontend := findFrontendIPConfig(azlb, frontendName(frontendConfig))
+	if frontend == nil {
+		return nil, fmt.Errorf("azure lb frontend %s not found", frontendName(frontendConfig))
+	}
+	frontendIPConfigurationID := to.String(frontend.ID)
+	backendAddressPoolID := to.String((*azlb.BackendAddressPools)[0].ID)
+	ruleName := getFrontendRuleName(frontendConfig, int32(lbPort), protocol)
 
 	rule := &network.LoadBalancingRule{
 		Name: to.StringPtr(ruleName),
@@ -330,17 +384,14 @@ func newRuleWithConfig(azlb *network.LoadBalancer, port, service string, protoco
 			Probe: &network.SubResource{
 				ID: probeID,
 			},
-			Protocol: protocol,
-			// The load distribution policy for this rule,
-			// make sure the traffic distributed to one backend in a conversation
-			LoadDistribution:     network.SourceIPProtocol,
-			FrontendPort:         to.Int32Ptr(int32(lbPort)),
-			BackendPort:          to.Int32Ptr(int32(lbPort)),
-			IdleTimeoutInMinutes: to.Int32Ptr(4),
-			EnableFloatingIP:     to.BoolPtr(false),
-			DisableOutboundSnat:  to.BoolPtr(false),
+			Protocol:     protocol,
+			FrontendPort: to.Int32Ptr(int32(lbPort)),
+			BackendPort:  to.Int32Ptr(int32(lbPort)),
 		},
 	}
+	// The load distribution policy defaults to SourceIPProtocol,
+	// make sure the traffic distributed to one backend in a conversation
+	config.applyRule(rule, true)
 	return rule, nil
 }
 
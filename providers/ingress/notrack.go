@@ -0,0 +1,52 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"strconv"
+	"strings"
+
+	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+)
+
+const (
+	// NotrackConfigKey is the key in the proxy config of loadbalancer
+	// which enables NOTRACK for the exported ports, e.g. sidecar.notrack: "true"
+	NotrackConfigKey = "sidecar.notrack"
+
+	// multiportMax is the max number of ports in an iptables multiport match
+	multiportMax = 15
+)
+
+// notrackEnabled returns true if NOTRACK is enabled in the proxy config
+func notrackEnabled(lb *lbapi.LoadBalancer) bool {
+	enabled, err := strconv.ParseBool(strings.TrimSpace(lb.Spec.Proxy.Config[NotrackConfigKey]))
+	return err == nil && enabled
+}
+
+// chunkPorts splits the ports into chunks with at most size ports
+func chunkPorts(ports []string, size int) [][]string {
+	chunks := make([][]string, 0, (len(ports)+size-1)/size)
+	for len(ports) > size {
+		chunks = append(chunks, ports[:size])
+		ports = ports[size:]
+	}
+	if len(ports) > 0 {
+		chunks = append(chunks, ports)
+	}
+	return chunks
+}
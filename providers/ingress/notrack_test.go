@@ -0,0 +1,62 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"strconv"
+	"testing"
+
+	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkPorts(t *testing.T) {
+	ports := make([]string, 0)
+	for i := 1; i <= 31; i++ {
+		ports = append(ports, strconv.Itoa(i))
+	}
+	tests := []struct {
+		ports []string
+		sizes []int
+	}{
+		{nil, []int{}},
+		{ports[:1], []int{1}},
+		{ports[:15], []int{15}},
+		{ports[:16], []int{15, 1}},
+		{ports, []int{15, 15, 1}},
+	}
+	for _, tt := range tests {
+		chunks := chunkPorts(tt.ports, multiportMax)
+		sizes := make([]int, 0)
+		all := make([]string, 0)
+		for _, chunk := range chunks {
+			sizes = append(sizes, len(chunk))
+			all = append(all, chunk...)
+		}
+		assert.Equal(t, tt.sizes, sizes)
+		assert.Equal(t, len(tt.ports), len(all))
+	}
+}
+
+func TestNotrackEnabled(t *testing.T) {
+	lb := &lbapi.LoadBalancer{}
+	assert.False(t, notrackEnabled(lb))
+	lb.Spec.Proxy.Config = map[string]string{NotrackConfigKey: "true"}
+	assert.True(t, notrackEnabled(lb))
+	lb.Spec.Proxy.Config = map[string]string{NotrackConfigKey: "yes"}
+	assert.False(t, notrackEnabled(lb))
+}
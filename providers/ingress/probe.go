@@ -0,0 +1,286 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/caicloud/clientset/kubernetes"
+	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	log "github.com/zoumo/logdog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// PortsStatusAnnotation holds the readiness of the exported ports
+	// reported by the sidecars, the value is a json object keyed by node name
+	PortsStatusAnnotation = core.StatusAnnotationPrefix + "sidecar-ports"
+
+	portProbeInterval = 5 * time.Second
+	portProbeTimeout  = 1 * time.Second
+)
+
+// PortStatus is the readiness of an exported port
+type PortStatus struct {
+	Protocol string `json:"protocol"`
+	Port     string `json:"port"`
+	Ready    bool   `json:"ready"`
+	Message  string `json:"message,omitempty"`
+}
+
+// NodePortsStatus is the readiness of the exported ports on a node
+type NodePortsStatus struct {
+	Ready bool         `json:"ready"`
+	Ports []PortStatus `json:"ports"`
+}
+
+// portProber probes the exported ports of proxy on the node periodically.
+// The tcp ports are ready if they can be connected. The udp ports are
+// best effort, they are not ready only if the node replies port unreachable.
+type portProber struct {
+	host     string
+	probe    func(protocol, addr string) (bool, string)
+	onChange func(NodePortsStatus)
+
+	mu sync.Mutex
+	// updated is false until the ports are set by update, nothing is
+	// probed and no status is reported before it
+	updated  bool
+	tcpPorts []string
+	udpPorts []string
+	status   *NodePortsStatus
+
+	kickCh chan struct{}
+	stopCh chan struct{}
+}
+
+func newPortProber(host string, onChange func(NodePortsStatus)) *portProber {
+	return &portProber{
+		host:     host,
+		probe:    probePort,
+		onChange: onChange,
+		kickCh:   make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+	}
+}
+
+func (p *portProber) start() {
+	go wait.Until(p.probeAll, portProbeInterval, p.stopCh)
+	go func() {
+		for {
+			select {
+			case <-p.kickCh:
+				p.probeAll()
+			case <-p.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (p *portProber) stop() {
+	close(p.stopCh)
+}
+
+// update changes the ports to probe and probes them immediately
+func (p *portProber) update(tcpPorts, udpPorts []string) {
+	p.mu.Lock()
+	p.updated = true
+	p.tcpPorts = tcpPorts
+	p.udpPorts = udpPorts
+	p.mu.Unlock()
+
+	select {
+	case p.kickCh <- struct{}{}:
+	default:
+	}
+}
+
+func (p *portProber) probeAll() {
+	p.mu.Lock()
+	if !p.updated {
+		p.mu.Unlock()
+		return
+	}
+	var targets []PortStatus
+	for _, port := range p.tcpPorts {
+		targets = append(targets, PortStatus{Protocol: "tcp", Port: port})
+	}
+	for _, port := range p.udpPorts {
+		targets = append(targets, PortStatus{Protocol: "udp", Port: port})
+	}
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i := range targets {
+		wg.Add(1)
+		go func(t *PortStatus) {
+			defer wg.Done()
+			t.Ready, t.Message = p.probe(t.Protocol, net.JoinHostPort(p.host, t.Port))
+		}(&targets[i])
+	}
+	wg.Wait()
+
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Protocol != targets[j].Protocol {
+			return targets[i].Protocol < targets[j].Protocol
+		}
+		a, _ := strconv.Atoi(targets[i].Port)
+		b, _ := strconv.Atoi(targets[j].Port)
+		return a < b
+	})
+	status := NodePortsStatus{Ready: true, Ports: targets}
+	for _, t := range targets {
+		if !t.Ready {
+			status.Ready = false
+			log.Debug("port is not ready", log.Fields{"protocol": t.Protocol, "port": t.Port, "msg": t.Message})
+		}
+	}
+
+	p.mu.Lock()
+	changed := p.status == nil || !reflect.DeepEqual(*p.status, status)
+	p.status = &status
+	p.mu.Unlock()
+
+	if changed && p.onChange != nil {
+		p.onChange(status)
+	}
+}
+
+// getStatus returns the last status, false if no probe has finished
+func (p *portProber) getStatus() (NodePortsStatus, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.status == nil {
+		return NodePortsStatus{}, false
+	}
+	return *p.status, true
+}
+
+// ServeHTTP writes the status in json, the code is 503 if any port is not ready
+func (p *portProber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status, ok := p.getStatus()
+	code := http.StatusOK
+	if !ok || !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
+
+func probePort(protocol, addr string) (bool, string) {
+	conn, err := net.DialTimeout(protocol, addr, portProbeTimeout)
+	if err != nil {
+		return false, err.Error()
+	}
+	defer conn.Close()
+	if protocol == "tcp" {
+		return true, ""
+	}
+
+	// send an empty datagram, the kernel replies icmp port unreachable
+	// if nothing listens on the port, which fails the read
+	conn.SetDeadline(time.Now().Add(portProbeTimeout))
+	if _, err := conn.Write([]byte{}); err != nil {
+		return false, err.Error()
+	}
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		return true, ""
+	}
+	if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+		return true, "no response"
+	}
+	if isConnRefused(err) {
+		return false, "port unreachable"
+	}
+	return false, err.Error()
+}
+
+func isConnRefused(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+		return sysErr.Err == syscall.ECONNREFUSED
+	}
+	return opErr.Err == syscall.ECONNREFUSED
+}
+
+// portsStatusReporter writes the status of node to the annotation of
+// loadbalancer
+type portsStatusReporter struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	node      string
+}
+
+// report sets the status of node, the node is removed if status is nil
+func (r *portsStatusReporter) report(status *NodePortsStatus) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		lbs := r.client.LoadbalanceV1alpha2().LoadBalancers(r.namespace)
+		lb, err := lbs.Get(r.name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		statuses := make(map[string]NodePortsStatus)
+		if v, ok := lb.Annotations[PortsStatusAnnotation]; ok {
+			if err := json.Unmarshal([]byte(v), &statuses); err != nil {
+				log.Warn("discard invalid ports status", log.Fields{"err": err})
+				statuses = make(map[string]NodePortsStatus)
+			}
+		}
+		old, exists := statuses[r.node]
+		switch {
+		case status == nil && !exists:
+			return nil
+		case status == nil:
+			delete(statuses, r.node)
+		case exists && reflect.DeepEqual(old, *status):
+			return nil
+		default:
+			statuses[r.node] = *status
+		}
+
+		data, err := json.Marshal(statuses)
+		if err != nil {
+			return err
+		}
+		lb = lb.DeepCopy()
+		if lb.Annotations == nil {
+			lb.Annotations = make(map[string]string)
+		}
+		lb.Annotations[PortsStatusAnnotation] = string(data)
+		_, err = lbs.Update(lb)
+		return err
+	})
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProbePort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ready, _ := probePort("tcp", addr)
+	assert.True(t, ready)
+	ln.Close()
+	ready, _ = probePort("tcp", addr)
+	assert.False(t, ready)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = pc.LocalAddr().String()
+	ready, msg := probePort("udp", addr)
+	assert.True(t, ready)
+	assert.Equal(t, "no response", msg)
+	pc.Close()
+	ready, _ = probePort("udp", addr)
+	assert.False(t, ready)
+}
+
+func TestPortProber(t *testing.T) {
+	var changes []NodePortsStatus
+	p := newPortProber("127.0.0.1", func(status NodePortsStatus) {
+		changes = append(changes, status)
+	})
+	down := map[string]bool{"tcp/8080": true}
+	p.probe = func(protocol, addr string) (bool, string) {
+		_, port, _ := net.SplitHostPort(addr)
+		if down[protocol+"/"+port] {
+			return false, "connection refused"
+		}
+		return true, ""
+	}
+
+	// nothing is probed before the ports are updated
+	p.probeAll()
+	assert.Empty(t, changes)
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	p.update([]string{"8080", "80"}, []string{"53"})
+	p.probeAll()
+	p.probeAll()
+	if assert.Len(t, changes, 1) {
+		assert.False(t, changes[0].Ready)
+		assert.Equal(t, []PortStatus{
+			{Protocol: "tcp", Port: "80", Ready: true},
+			{Protocol: "tcp", Port: "8080", Ready: false, Message: "connection refused"},
+			{Protocol: "udp", Port: "53", Ready: true},
+		}, changes[0].Ports)
+	}
+
+	delete(down, "tcp/8080")
+	p.probeAll()
+	assert.Len(t, changes, 2)
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"ready":true`)
+	assert.Contains(t, rec.Body.String(), strconv.Quote("8080"))
+}
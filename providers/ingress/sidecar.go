@@ -18,14 +18,20 @@ package ingress
 
 import (
 	"net"
+	"net/http"
+	"reflect"
 	"strings"
 
+	"github.com/caicloud/clientset/kubernetes"
 	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/journal"
 	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
 	"github.com/caicloud/loadbalancer-provider/core/pkg/sysctl"
 	core "github.com/caicloud/loadbalancer-provider/core/provider"
 	"github.com/caicloud/loadbalancer-provider/pkg/version"
 	log "github.com/zoumo/logdog"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 
 	utildbus "k8s.io/kubernetes/pkg/util/dbus"
 	k8sexec "k8s.io/kubernetes/pkg/util/exec"
@@ -71,74 +77,132 @@ var (
 	}
 )
 var _ core.Provider = &IngressSidecar{}
+var _ core.EventRecorderSetter = &IngressSidecar{}
 
 // IngressSidecar ...
 type IngressSidecar struct {
-	nodeInfo      *corenet.Interface
-	storeLister   core.StoreLister
-	ipt           iptables.Interface
-	sysctlDefault map[string]string
-	tcpPorts      []string
-	udpPorts      []string
+	nodeInfo    *corenet.Interface
+	storeLister core.StoreLister
+	recorder    core.EventRecorder
+	portChecker *core.HostPortChecker
+	ipt         iptables.Interface
+	journal     *journal.Journal
+	// notrack is true if the chain is ensured, tcpPorts and udpPorts are
+	// the sorted ports of the NOTRACK rules in it
+	notrack  bool
+	tcpPorts []string
+	udpPorts []string
+	// sysctlConfigMap is the name of configmap which holds the sysctl
+	// profile, it is optional
+	sysctlConfigMap string
+	// sysctls is the desired sysctl profile before the first sync and
+	// the applied one after it
+	sysctls map[string]string
+	// prober probes the exported ports, and the status is reported to the
+	// loadbalancer by reporter if it is not nil
+	prober   *portProber
+	reporter *portsStatusReporter
 }
 
-// NewIngressSidecar creates a new ingress sidecar
-func NewIngressSidecar(nodeIP net.IP, lb *lbapi.LoadBalancer) (*IngressSidecar, error) {
+// NewIngressSidecar creates a new ingress sidecar, the readiness of the
+// exported ports is reported to the loadbalancer by client if it is not nil
+func NewIngressSidecar(nodeIP net.IP, lb *lbapi.LoadBalancer, stateDir, sysctlConfigMap string, client kubernetes.Interface, nodeName string) (*IngressSidecar, error) {
 	nodeInfo, err := corenet.InterfaceByIP(nodeIP.String())
 	if err != nil {
 		log.Error("get node info err", log.Fields{"err": err})
 		return nil, err
 	}
+	j, err := journal.Open(stateDir)
+	if err != nil {
+		log.Error("open journal error", log.Fields{"dir": stateDir, "err": err})
+		return nil, err
+	}
 	execer := k8sexec.New()
 	dbus := utildbus.New()
 	iptInterface := iptables.New(execer, dbus, iptables.ProtocolIpv4)
 
+	// the configmap is not available until the listers are set, start
+	// with the profile in proxy config
+	profile, errs := sysctlProfile(lb, nil)
+	for _, err := range errs {
+		log.Warn("ignore sysctl", log.Fields{"err": err})
+	}
+
 	sidecar := &IngressSidecar{
-		nodeInfo:      nodeInfo,
-		sysctlDefault: make(map[string]string),
-		ipt:           iptInterface,
+		nodeInfo:        nodeInfo,
+		ipt:             iptInterface,
+		journal:         j,
+		sysctlConfigMap: sysctlConfigMap,
+		sysctls:         profile,
+		portChecker:     core.NewHostPortChecker(core.ProxyProcesses...),
 	}
+	if client != nil {
+		sidecar.reporter = &portsStatusReporter{
+			client:    client,
+			namespace: lb.Namespace,
+			name:      lb.Name,
+			node:      nodeName,
+		}
+	}
+	sidecar.prober = newPortProber(nodeIP.String(), sidecar.onPortsStatusChange)
 
 	return sidecar, nil
 }
 
 // OnUpdate ...
 func (p *IngressSidecar) OnUpdate(lb *lbapi.LoadBalancer) error {
-	// FIX: issue #3
-	// if err := lbapi.ValidateLoadBalancer(lb); err != nil {
-	// 	log.Error("invalid loadbalancer", log.Fields{"err": err})
-	// 	return nil
-	// }
-
-	// // filtered
-	// if lb.Spec.Type != lbapi.LoadBalancerTypeExternal || lb.Spec.Providers.Ipvsdr == nil {
-	// 	return nil
-	// }
-
-	// tcpcm, err := p.storeLister.ConfigMap.ConfigMaps(lb.Namespace).Get(lb.Status.ProxyStatus.TCPConfigMap)
-	// if err != nil {
-	// 	log.Error("can not find tcp configmap for loadbalancer")
-	// 	return err
-	// }
-	// udpcm, err := p.storeLister.ConfigMap.ConfigMaps(lb.Namespace).Get(lb.Status.ProxyStatus.UDPConfigMap)
-	// if err != nil {
-	// 	log.Error("can not find udp configmap for loadbalancer")
-	// 	return err
-	// }
-
-	// tcpPorts, udpPorts := core.GetExportedPorts(tcpcm, udpcm)
-
-	// if reflect.DeepEqual(p.tcpPorts, tcpPorts) && reflect.DeepEqual(p.udpPorts, udpPorts) {
-	// 	// no change
-	// 	return nil
-	// }
-
-	// log.Info("Updating config")
-
-	// p.tcpPorts = tcpPorts
-	// p.udpPorts = udpPorts
-
-	// p.ensureIptablesNotrack(tcpPorts, udpPorts)
+	if err := p.updateSysctl(lb); err != nil {
+		// the ports are still synced, the sysctls are retried on next update
+		log.Error("update sysctl error", log.Fields{"err": err})
+	}
+
+	if err := lbapi.ValidateLoadBalancer(lb); err != nil {
+		log.Error("invalid loadbalancer", log.Fields{"err": err})
+		return nil
+	}
+
+	tcpcm, err := p.storeLister.ConfigMap.ConfigMaps(lb.Namespace).Get(lb.Status.ProxyStatus.TCPConfigMap)
+	if err != nil {
+		log.Error("can not find tcp configmap for loadbalancer")
+		return err
+	}
+	udpcm, err := p.storeLister.ConfigMap.ConfigMaps(lb.Namespace).Get(lb.Status.ProxyStatus.UDPConfigMap)
+	if err != nil {
+		log.Error("can not find udp configmap for loadbalancer")
+		return err
+	}
+
+	tcpPorts, udpPorts := core.CheckExportedPorts(p.recorder, p.portChecker, lb, tcpcm, udpcm)
+	p.prober.update(tcpPorts, udpPorts)
+
+	if !notrackEnabled(lb) {
+		if p.notrack {
+			log.Info("NOTRACK is disabled, delete iptables chain")
+			p.deleteChain()
+			p.notrack = false
+			p.tcpPorts, p.udpPorts = nil, nil
+		}
+		return nil
+	}
+
+	if p.notrack && reflect.DeepEqual(p.tcpPorts, tcpPorts) && reflect.DeepEqual(p.udpPorts, udpPorts) {
+		// no change
+		return nil
+	}
+
+	log.Info("Updating NOTRACK rules", log.Fields{"tcp": tcpPorts, "udp": udpPorts})
+
+	if !p.notrack {
+		p.ensureChain()
+		p.notrack = true
+	}
+	if err := p.ensureIptablesNotrack(tcpPorts, udpPorts); err != nil {
+		// retry on next update
+		p.tcpPorts, p.udpPorts = nil, nil
+		return err
+	}
+	p.tcpPorts = tcpPorts
+	p.udpPorts = udpPorts
 
 	return nil
 }
@@ -147,12 +211,22 @@ func (p *IngressSidecar) OnUpdate(lb *lbapi.LoadBalancer) error {
 func (p *IngressSidecar) Start() {
 	log.Info("Startting ingress sidecar provider")
 
+	// restore the true original values and remove the leftovers before
+	// applying new state
+	if err := p.journal.Undo(journal.NewHostUndoer()); err != nil {
+		log.Error("undo journal error", log.Fields{"err": err})
+	}
+
 	p.changeSysctl()
-	// p.ensureChain()
+	// the reserved ports are served by proxy anyway, they are probed until
+	// the exported ports are known
+	p.prober.update(core.ReservedTCPPorts, core.ReservedUDPPorts)
+	p.prober.start()
 	return
 }
 
-// WaitForStart ...
+// WaitForStart does not wait for the ports of proxy, the syncing must not be
+// blocked by a slow proxy, the readiness is reported by the prober
 func (p *IngressSidecar) WaitForStart() bool {
 	return true
 }
@@ -161,14 +235,50 @@ func (p *IngressSidecar) WaitForStart() bool {
 func (p *IngressSidecar) Stop() error {
 	log.Info("Shutting down ingress sidecar provider")
 
+	p.prober.stop()
+	if p.reporter != nil {
+		// the ports on this node are no longer served
+		if err := p.reporter.report(nil); err != nil {
+			log.Error("remove ports status error", log.Fields{"err": err})
+		}
+	}
+
 	err := p.resetSysctl()
 	if err != nil {
 		log.Error("reset sysctl error", log.Fields{"err": err})
 	}
 
-	// p.deleteChain()
+	if p.notrack {
+		p.deleteChain()
+	}
 
-	return nil
+	// revert the mutations which are not reverted explicitly
+	err = p.journal.Undo(journal.NewHostUndoer())
+	if err != nil {
+		log.Error("undo journal error", log.Fields{"err": err})
+	}
+	return err
+}
+
+// Handler returns the http handler which serves the readiness of sidecar,
+// /healthz is always ok and /ports returns the readiness of the exported ports
+func (p *IngressSidecar) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.Handle("/ports", p.prober)
+	return mux
+}
+
+func (p *IngressSidecar) onPortsStatusChange(status NodePortsStatus) {
+	log.Info("ports status changed", log.Fields{"ready": status.Ready})
+	if p.reporter == nil {
+		return
+	}
+	if err := p.reporter.report(&status); err != nil {
+		log.Error("report ports status error", log.Fields{"err": err})
+	}
 }
 
 // Info ...
@@ -182,16 +292,20 @@ func (p *IngressSidecar) Info() core.Info {
 	}
 }
 
+// SetEventRecorder implements core.EventRecorderSetter
+func (p *IngressSidecar) SetEventRecorder(recorder core.EventRecorder) {
+	p.recorder = recorder
+}
+
 // SetListers sets the configured store listers in the generic ingress controller
 func (p *IngressSidecar) SetListers(lister core.StoreLister) {
 	p.storeLister = lister
 }
 
-// changeSysctl changes the required network setting in /proc to get
-// keepalived working in the local system.
+// changeSysctl changes the network setting in /proc according to the
+// initial sysctl profile
 func (p *IngressSidecar) changeSysctl() error {
-	var err error
-	p.sysctlDefault, err = sysctl.BulkModify(sysctlAdjustments)
+	err := p.journal.ModifySysctl(sysctl.Settings(p.sysctls))
 	if err != nil {
 		log.Error("error change sysctl", log.Fields{"err": err})
 		return err
@@ -199,14 +313,62 @@ func (p *IngressSidecar) changeSysctl() error {
 	return nil
 }
 
+// updateSysctl applies the sysctl profile of loadbalancer, the sysctls
+// removed from the profile are restored to the original values
+func (p *IngressSidecar) updateSysctl(lb *lbapi.LoadBalancer) error {
+	var cm *v1.ConfigMap
+	if p.sysctlConfigMap != "" {
+		var err error
+		cm, err = p.storeLister.ConfigMap.ConfigMaps(lb.Namespace).Get(p.sysctlConfigMap)
+		if errors.IsNotFound(err) {
+			cm = nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	profile, errs := sysctlProfile(lb, cm)
+	for _, err := range errs {
+		log.Warn("ignore sysctl", log.Fields{"err": err})
+	}
+
+	removed := make(map[string]string)
+	for k, v := range p.sysctls {
+		if _, ok := profile[k]; !ok {
+			removed[k] = v
+		}
+	}
+	if len(removed) > 0 {
+		log.Info("restore sysctl removed from profile", log.Fields{"sysctls": removed})
+		if err := p.journal.ResetSysctl(sysctl.Settings(removed)); err != nil {
+			return err
+		}
+		for k := range removed {
+			delete(p.sysctls, k)
+		}
+	}
+
+	// the changes are applied transactionally, nothing is changed if
+	// any of them fails
+	if err := p.journal.ModifySysctl(sysctl.Settings(profile)); err != nil {
+		return err
+	}
+	p.sysctls = profile
+	return nil
+}
+
 // resetSysctl resets the network setting
 func (p *IngressSidecar) resetSysctl() error {
-	log.Info("reset sysctl to original value", log.Fields{"defaults": p.sysctlDefault})
-	_, err := sysctl.BulkModify(p.sysctlDefault)
-	return err
+	log.Info("reset sysctl to original value", log.Fields{"defaults": p.journal.State().Sysctls})
+	return p.journal.ResetSysctl(sysctl.Settings(p.sysctls))
 }
 
 func (p *IngressSidecar) ensureChain() {
+	err := p.journal.RecordChain(p.chain())
+	if err != nil {
+		log.Error("record iptables chain in journal error", log.Fields{"err": err})
+	}
+
 	// create chain
 	ae, err := p.ipt.EnsureChain(tableRaw, iptables.Chain(iptablesChain))
 	if err != nil {
@@ -231,38 +393,47 @@ func (p *IngressSidecar) deleteChain() {
 	// delete jump rule
 	p.ipt.DeleteRule(tableRaw, iptables.ChainPrerouting, "-j", iptablesChain)
 	// delete chain
-	p.ipt.DeleteChain(tableRaw, iptablesChain)
+	err := p.ipt.DeleteChain(tableRaw, iptablesChain)
+	if err != nil {
+		log.Error("delete iptables chain error", log.Fields{"chain": iptablesChain, "err": err})
+		return
+	}
+	p.journal.ForgetChain(p.chain())
 }
 
-func (p *IngressSidecar) setIptablesNotrack(protocol string, ports []string) (bool, error) {
-	args := make([]string, 0)
-	args = append(args, "-i", p.nodeInfo.Name, "-p", protocol)
+func (p *IngressSidecar) chain() journal.Chain {
+	return journal.Chain{Table: tableRaw, Chain: iptablesChain, JumpFrom: string(iptables.ChainPrerouting)}
+}
 
-	if len(ports) > 0 {
-		args = append(args, "-m", "multiport", "--dports", strings.Join(ports, ","))
+func (p *IngressSidecar) setIptablesNotrack(protocol string, ports []string) error {
+	// iptables: too many ports specified
+	// multiport accepts 15 ports at most
+	for _, chunk := range chunkPorts(ports, multiportMax) {
+		args := make([]string, 0)
+		args = append(args, "-i", p.nodeInfo.Name, "-p", protocol)
+		args = append(args, "-m", "multiport", "--dports", strings.Join(chunk, ","))
+		args = append(args, "-j", "NOTRACK")
+
+		if _, err := p.ipt.EnsureRule(iptables.Append, tableRaw, iptablesChain, args...); err != nil {
+			return err
+		}
 	}
-	args = append(args, "-j", "NOTRACK")
-
-	return p.ipt.EnsureRule(iptables.Prepend, tableRaw, iptablesChain, args...)
+	return nil
 }
 
-func (p *IngressSidecar) ensureIptablesNotrack(tcpPorts, udpPorts []string) {
+func (p *IngressSidecar) ensureIptablesNotrack(tcpPorts, udpPorts []string) error {
 	log.Info("ensure iptables rules")
 
 	// flush all rules
 	p.flushChain()
 
-	if len(tcpPorts) > 0 {
-		_, err := p.setIptablesNotrack("tcp", tcpPorts)
-		if err != nil {
-			log.Error("error ensure iptables tcp rule for", log.Fields{"tcpPorts": tcpPorts})
-		}
+	if err := p.setIptablesNotrack("tcp", tcpPorts); err != nil {
+		log.Error("error ensure iptables tcp rule for", log.Fields{"tcpPorts": tcpPorts, "err": err})
+		return err
 	}
-	if len(udpPorts) > 0 {
-		_, err := p.setIptablesNotrack("udp", udpPorts)
-		if err != nil {
-			log.Error("error ensure iptables udp rule for", log.Fields{"udpPorts": udpPorts})
-		}
+	if err := p.setIptablesNotrack("udp", udpPorts); err != nil {
+		log.Error("error ensure iptables udp rule for", log.Fields{"udpPorts": udpPorts, "err": err})
+		return err
 	}
-
+	return nil
 }
@@ -0,0 +1,103 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// SysctlConfigPrefix is the prefix of the sysctl entries in the proxy
+	// config of loadbalancer, e.g. sidecar.sysctl.net.core.somaxconn: "4096"
+	SysctlConfigPrefix = "sidecar.sysctl."
+)
+
+var (
+	// allowedSysctls are the sysctls which can be tuned by user, they are
+	// namespaced by the network namespace. Global sysctls such as
+	// net.core.netdev_max_backlog are not allowed
+	allowedSysctls = map[string]bool{
+		"net.core.somaxconn":                 true,
+		"net.ipv4.ip_local_port_range":       true,
+		"net.ipv4.ip_local_reserved_ports":   true,
+		"net.ipv4.tcp_keepalive_time":        true,
+		"net.ipv4.tcp_keepalive_intvl":       true,
+		"net.ipv4.tcp_keepalive_probes":      true,
+		"net.ipv4.tcp_max_tw_buckets":        true,
+		"net.ipv4.tcp_tw_reuse":              true,
+		"net.ipv4.tcp_fin_timeout":           true,
+		"net.ipv4.tcp_max_syn_backlog":       true,
+		"net.ipv4.tcp_syncookies":            true,
+		"net.ipv4.tcp_slow_start_after_idle": true,
+		"net.ipv4.tcp_rmem":                  true,
+		"net.ipv4.tcp_wmem":                  true,
+	}
+)
+
+// sysctlProfile returns the sysctls which should be applied, the defaults
+// are overridden by the proxy config of loadbalancer, and then by the
+// configmap. An empty value removes the sysctl from the profile. The keys
+// which are not allowed are ignored and returned as errors.
+func sysctlProfile(lb *lbapi.LoadBalancer, cm *v1.ConfigMap) (map[string]string, []error) {
+	profile := make(map[string]string, len(sysctlAdjustments))
+	for k, v := range sysctlAdjustments {
+		profile[k] = v
+	}
+
+	var errs []error
+	override := func(source, key, value string) {
+		key = strings.TrimSpace(key)
+		if !allowedSysctls[key] {
+			errs = append(errs, fmt.Errorf("sysctl %v in %v is not allowed", key, source))
+			return
+		}
+		value = strings.TrimSpace(value)
+		if value == "" {
+			delete(profile, key)
+			return
+		}
+		profile[key] = value
+	}
+
+	if lb != nil {
+		for _, k := range sortedConfigKeys(lb.Spec.Proxy.Config) {
+			if strings.HasPrefix(k, SysctlConfigPrefix) {
+				override("proxy config", strings.TrimPrefix(k, SysctlConfigPrefix), lb.Spec.Proxy.Config[k])
+			}
+		}
+	}
+	if cm != nil {
+		for _, k := range sortedConfigKeys(cm.Data) {
+			override("configmap "+cm.Name, k, cm.Data[k])
+		}
+	}
+	return profile, errs
+}
+
+func sortedConfigKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
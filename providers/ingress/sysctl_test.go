@@ -0,0 +1,63 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"testing"
+
+	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+)
+
+func TestSysctlProfile(t *testing.T) {
+	lb := &lbapi.LoadBalancer{}
+	lb.Spec.Proxy.Config = map[string]string{
+		"sidecar.sysctl.net.core.somaxconn":          "4096",
+		"sidecar.sysctl.net.ipv4.tcp_fin_timeout":    "",
+		"sidecar.sysctl.net.ipv4.tcp_syncookies":     "1",
+		"sidecar.sysctl.kernel.panic":                "1",
+		"sidecar.sysctl.net.core.netdev_max_backlog": "1000",
+		"worker-processes":                           "4",
+		"sidecar.sysctl.net.ipv4.tcp_max_tw_buckets": "8000",
+	}
+	cm := &v1.ConfigMap{
+		Data: map[string]string{
+			"net.ipv4.tcp_max_tw_buckets": "10000",
+			"vm.swappiness":               "0",
+		},
+	}
+	cm.Name = "sysctl"
+
+	profile, errs := sysctlProfile(lb, cm)
+	assert.Len(t, errs, 3)
+	assert.Equal(t, "4096", profile["net.core.somaxconn"])
+	assert.Equal(t, "1", profile["net.ipv4.tcp_syncookies"])
+	assert.Equal(t, "10000", profile["net.ipv4.tcp_max_tw_buckets"])
+	assert.Equal(t, sysctlAdjustments["net.ipv4.tcp_keepalive_time"], profile["net.ipv4.tcp_keepalive_time"])
+	assert.NotContains(t, profile, "net.ipv4.tcp_fin_timeout")
+	assert.NotContains(t, profile, "kernel.panic")
+	assert.NotContains(t, profile, "vm.swappiness")
+	// the global sysctl can not be tuned
+	assert.Equal(t, sysctlAdjustments["net.core.netdev_max_backlog"], profile["net.core.netdev_max_backlog"])
+	// the defaults must not be modified
+	assert.Equal(t, "2048", sysctlAdjustments["net.core.somaxconn"])
+
+	profile, errs = sysctlProfile(&lbapi.LoadBalancer{}, nil)
+	assert.Empty(t, errs)
+	assert.Equal(t, sysctlAdjustments, profile)
+}
@@ -0,0 +1,43 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvsdr
+
+import (
+	"github.com/caicloud/loadbalancer-provider/core/pkg/bgp"
+)
+
+const (
+	// AnnounceModeVRRP announces the VIP by keepalived VRRP, all the
+	// nodes must be in the same L2 network
+	AnnounceModeVRRP = "vrrp"
+	// AnnounceModeBGP announces the VIP /32 from every healthy node to
+	// the BGP peers, the upstream routers spread the traffic by ECMP
+	AnnounceModeBGP = "bgp"
+	// AnnounceModeL2 binds the VIP to the node elected by a Lease and
+	// announces it by gratuitous ARP, keepalived is not used
+	AnnounceModeL2 = "l2"
+)
+
+// AnnounceConfig contains the settings about how to announce the VIP
+type AnnounceConfig struct {
+	// Mode is vrrp, bgp or l2
+	Mode string
+	// BGP is used in bgp mode
+	BGP bgp.Config
+	// L2 is used in l2 mode
+	L2 L2Config
+}
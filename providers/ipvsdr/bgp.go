@@ -0,0 +1,103 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvsdr
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/caicloud/loadbalancer-provider/core/pkg/bgp"
+	log "github.com/zoumo/logdog"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	healthCheckPort     = "80"
+	healthCheckInterval = 2 * time.Second
+	healthCheckTimeout  = 1 * time.Second
+	// the VIP is withdrawn after healthCheckFall continuous failures
+	healthCheckFall = 3
+)
+
+// bgpAnnouncer announces the VIP while the local proxy is healthy and
+// withdraws it when the proxy fails
+type bgpAnnouncer struct {
+	speaker  *bgp.Speaker
+	prefix   *net.IPNet
+	probe    string
+	failures int
+	stopCh   chan struct{}
+}
+
+func newBGPAnnouncer(nodeIP net.IP, vip string, cfg bgp.Config) (*bgpAnnouncer, error) {
+	ip := net.ParseIP(vip)
+	if ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("bgp mode only supports ipv4 vip, got %q", vip)
+	}
+	if cfg.RouterID == nil {
+		cfg.RouterID = nodeIP
+	}
+	if cfg.NextHop == nil {
+		cfg.NextHop = nodeIP
+	}
+	speaker, err := bgp.NewSpeaker(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &bgpAnnouncer{
+		speaker: speaker,
+		prefix:  &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)},
+		probe:   net.JoinHostPort(nodeIP.String(), healthCheckPort),
+		stopCh:  make(chan struct{}),
+	}, nil
+}
+
+func (a *bgpAnnouncer) start() {
+	a.speaker.Start()
+	go wait.Until(a.check, healthCheckInterval, a.stopCh)
+}
+
+// stop withdraws the VIP and closes all the sessions
+func (a *bgpAnnouncer) stop() {
+	close(a.stopCh)
+	a.speaker.Withdraw(a.prefix)
+	a.speaker.Stop()
+}
+
+func (a *bgpAnnouncer) check() {
+	conn, err := net.DialTimeout("tcp", a.probe, healthCheckTimeout)
+	if err == nil {
+		conn.Close()
+		if a.failures >= healthCheckFall {
+			log.Info("proxy becomes healthy, announce vip", log.Fields{"vip": a.prefix})
+		}
+		a.failures = 0
+		if err := a.speaker.Announce(a.prefix); err != nil {
+			log.Error("announce vip error", log.Fields{"vip": a.prefix, "err": err})
+		}
+		return
+	}
+
+	a.failures++
+	if a.failures == healthCheckFall {
+		log.Warn("proxy is unhealthy, withdraw vip", log.Fields{"vip": a.prefix, "err": err})
+	}
+	if a.failures >= healthCheckFall {
+		a.speaker.Withdraw(a.prefix)
+	}
+}
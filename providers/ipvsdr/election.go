@@ -0,0 +1,205 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvsdr
+
+import (
+	"time"
+
+	log "github.com/zoumo/logdog"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	coordinationclient "k8s.io/client-go/kubernetes/typed/coordination/v1beta1"
+)
+
+const (
+	defaultLeaseDuration = 15 * time.Second
+	leaseRetryPeriod     = 2 * time.Second
+)
+
+// leaseElector elects a leader among the nodes of loadbalancer by a
+// Lease. Besides the lease expiration, a candidate takes over the lease
+// when the holder is no longer a node of loadbalancer or the holder's
+// node is not ready, so the failover is driven by the node health.
+type leaseElector struct {
+	client    coordinationclient.LeasesGetter
+	namespace string
+	name      string
+	identity  string
+	duration  time.Duration
+
+	isCandidate func(node string) bool
+	isNodeReady func(node string) bool
+
+	onStartedLeading func()
+	onStoppedLeading func()
+
+	leading   bool
+	lastRenew time.Time
+	stopCh    chan struct{}
+	doneCh    chan struct{}
+}
+
+func (e *leaseElector) start() {
+	e.stopCh = make(chan struct{})
+	e.doneCh = make(chan struct{})
+	go func() {
+		defer close(e.doneCh)
+		wait.Until(e.tryAcquireOrRenew, leaseRetryPeriod, e.stopCh)
+	}()
+}
+
+// stop releases the lease if it is held, so that another candidate can
+// take over immediately
+func (e *leaseElector) stop() {
+	close(e.stopCh)
+	<-e.doneCh
+
+	if !e.leading {
+		return
+	}
+	lease, err := e.client.Leases(e.namespace).Get(e.name, metav1.GetOptions{})
+	if err == nil && holderOf(lease) == e.identity {
+		empty := ""
+		lease.Spec.HolderIdentity = &empty
+		if _, err := e.client.Leases(e.namespace).Update(lease); err != nil {
+			log.Error("release lease error", log.Fields{"lease": e.name, "err": err})
+		}
+	}
+	e.setLeading(false)
+}
+
+func (e *leaseElector) tryAcquireOrRenew() {
+	now := time.Now()
+	leases := e.client.Leases(e.namespace)
+
+	lease, err := leases.Get(e.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		if !e.eligible() {
+			return
+		}
+		lease = &coordinationv1beta1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: e.namespace,
+				Name:      e.name,
+			},
+		}
+		e.fillLease(lease, now, true)
+		_, err = leases.Create(lease)
+		e.handleResult(now, err)
+		return
+	}
+	if err != nil {
+		log.Error("get lease error", log.Fields{"lease": e.name, "err": err})
+		e.handleResult(now, err)
+		return
+	}
+
+	holder := holderOf(lease)
+	switch {
+	case holder == e.identity:
+		e.fillLease(lease, now, false)
+	case e.eligible() && canTakeOver(lease, now, e.isCandidate, e.isNodeReady):
+		log.Info("take over the lease", log.Fields{"lease": e.name, "holder": holder})
+		e.fillLease(lease, now, true)
+	default:
+		e.setLeading(false)
+		return
+	}
+
+	_, err = leases.Update(lease)
+	e.handleResult(now, err)
+}
+
+func (e *leaseElector) handleResult(now time.Time, err error) {
+	if err == nil {
+		e.lastRenew = now
+		e.setLeading(true)
+		return
+	}
+	if errors.IsConflict(err) {
+		// someone else updated the lease first
+		e.setLeading(false)
+		return
+	}
+	log.Error("update lease error", log.Fields{"lease": e.name, "err": err})
+	// keep leading until the lease may have expired on other candidates
+	if e.leading && now.Sub(e.lastRenew) > e.duration {
+		e.setLeading(false)
+	}
+}
+
+func (e *leaseElector) fillLease(lease *coordinationv1beta1.Lease, now time.Time, acquire bool) {
+	identity := e.identity
+	duration := int32(e.duration / time.Second)
+	renewTime := metav1.NewMicroTime(now)
+	lease.Spec.HolderIdentity = &identity
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &renewTime
+	if acquire {
+		transitions := int32(0)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+		lease.Spec.AcquireTime = &renewTime
+		lease.Spec.LeaseTransitions = &transitions
+	}
+}
+
+// eligible returns true if this node can acquire the lease
+func (e *leaseElector) eligible() bool {
+	return e.isCandidate(e.identity) && e.isNodeReady(e.identity)
+}
+
+func (e *leaseElector) setLeading(leading bool) {
+	if e.leading == leading {
+		return
+	}
+	e.leading = leading
+	if leading {
+		log.Info("became the leader", log.Fields{"lease": e.name, "identity": e.identity})
+		e.onStartedLeading()
+	} else {
+		log.Info("stopped leading", log.Fields{"lease": e.name, "identity": e.identity})
+		e.onStoppedLeading()
+	}
+}
+
+func holderOf(lease *coordinationv1beta1.Lease) string {
+	if lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+// canTakeOver returns true if the lease is not held, expired, or held by
+// a node which is not a candidate or not ready
+func canTakeOver(lease *coordinationv1beta1.Lease, now time.Time, isCandidate, isNodeReady func(string) bool) bool {
+	holder := holderOf(lease)
+	if holder == "" {
+		return true
+	}
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	expire := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	if now.After(expire) {
+		return true
+	}
+	return !isCandidate(holder) || !isNodeReady(holder)
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvsdr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestLease(holder string, renew time.Time) *coordinationv1beta1.Lease {
+	duration := int32(15)
+	renewTime := metav1.NewMicroTime(renew)
+	return &coordinationv1beta1.Lease{
+		Spec: coordinationv1beta1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			RenewTime:            &renewTime,
+		},
+	}
+}
+
+func TestCanTakeOver(t *testing.T) {
+	now := time.Now()
+	candidates := map[string]bool{"node1": true, "node2": true}
+	ready := map[string]bool{"node1": true}
+	isCandidate := func(node string) bool { return candidates[node] }
+	isNodeReady := func(node string) bool { return ready[node] }
+
+	tests := []struct {
+		name  string
+		lease *coordinationv1beta1.Lease
+		want  bool
+	}{
+		{"held by ready node", newTestLease("node1", now), false},
+		{"expired", newTestLease("node1", now.Add(-20*time.Second)), true},
+		{"not held", newTestLease("", now), true},
+		{"holder not ready", newTestLease("node2", now), true},
+		{"holder not candidate", newTestLease("node3", now), true},
+		{"no renew time", &coordinationv1beta1.Lease{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, canTakeOver(tt.lease, now, isCandidate, isNodeReady))
+		})
+	}
+}
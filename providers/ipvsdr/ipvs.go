@@ -0,0 +1,239 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvsdr
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/zoumo/logdog"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8sexec "k8s.io/kubernetes/pkg/util/exec"
+)
+
+const (
+	realServerCheckInterval = 5 * time.Second
+	realServerCheckTimeout  = 3 * time.Second
+	persistenceTimeout      = "360"
+)
+
+// ipvsDataplane manages the fwmark virtual server by ipvsadm instead of
+// keepalived, the real servers are health checked by connecting to port
+// 80 like the TCP_CHECK of keepalived. The virtual server only exists
+// while the dataplane is active.
+type ipvsDataplane struct {
+	mark int
+
+	mu      sync.Mutex
+	active  bool
+	vs      *virtualServer
+	healthy map[string]bool
+
+	applied ipvsService
+	// dirty means the virtual server may differ from applied after an
+	// ipvsadm error, it is deleted and created again on next sync
+	dirty bool
+
+	ipvsadm func(args ...string) ([]byte, error)
+
+	stopCh chan struct{}
+}
+
+func newIPVSDataplane(mark int) *ipvsDataplane {
+	return &ipvsDataplane{
+		mark:    mark,
+		healthy: make(map[string]bool),
+		ipvsadm: runIPVSAdm,
+		stopCh:  make(chan struct{}),
+	}
+}
+
+func runIPVSAdm(args ...string) ([]byte, error) {
+	return k8sexec.New().Command("ipvsadm", args...).CombinedOutput()
+}
+
+func (d *ipvsDataplane) start() {
+	go wait.Until(d.check, realServerCheckInterval, d.stopCh)
+}
+
+// stop stops the health checking and deletes the virtual server
+func (d *ipvsDataplane) stop() {
+	close(d.stopCh)
+	if err := d.setActive(false); err != nil {
+		log.Error("delete ipvs virtual server error", log.Fields{"err": err})
+	}
+}
+
+// update changes the desired virtual server
+func (d *ipvsDataplane) update(vs virtualServer) {
+	d.mu.Lock()
+	d.vs = &vs
+	d.mu.Unlock()
+	d.check()
+}
+
+// setActive creates or deletes the virtual server, it is retried by the
+// health checking on error
+func (d *ipvsDataplane) setActive(active bool) error {
+	d.mu.Lock()
+	d.active = active
+	d.mu.Unlock()
+	return d.sync()
+}
+
+func (d *ipvsDataplane) check() {
+	d.mu.Lock()
+	var servers []string
+	if d.vs != nil {
+		servers = d.vs.RealServer
+	}
+	d.mu.Unlock()
+
+	healthy := make(map[string]bool, len(servers))
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(server, "80"), realServerCheckTimeout)
+			if err != nil {
+				log.Debug("real server is unhealthy", log.Fields{"rs": server, "err": err})
+				return
+			}
+			conn.Close()
+			lock.Lock()
+			healthy[server] = true
+			lock.Unlock()
+		}(server)
+	}
+	wg.Wait()
+
+	d.mu.Lock()
+	d.healthy = healthy
+	d.mu.Unlock()
+	if err := d.sync(); err != nil {
+		log.Error("sync ipvs virtual server error, retry on next check", log.Fields{"err": err})
+	}
+}
+
+// sync changes the virtual server from the applied state to the desired
+// one, the virtual server is created again after an error
+func (d *ipvsDataplane) sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	desired := ipvsService{realServers: make(map[string]bool)}
+	if d.active && d.vs != nil {
+		desired.scheduler = d.vs.Scheduler
+		desired.lbKind = d.vs.LbKind
+		for _, server := range d.vs.RealServer {
+			if d.healthy[server] {
+				desired.realServers[server] = true
+			}
+		}
+	}
+
+	if d.dirty {
+		out, err := d.ipvsadm("-D", "-f", strconv.Itoa(d.mark))
+		if err != nil && !strings.Contains(string(out), "No such service") {
+			return fmt.Errorf("ipvsadm -D error: %v, %s", err, out)
+		}
+		d.applied = ipvsService{}
+		d.dirty = false
+	}
+
+	for _, args := range ipvsCommands(d.mark, d.applied, desired) {
+		out, err := d.ipvsadm(args...)
+		if err != nil {
+			d.dirty = true
+			return fmt.Errorf("ipvsadm %s error: %v, %s", strings.Join(args, " "), err, out)
+		}
+	}
+
+	d.applied = desired
+	return nil
+}
+
+// ipvsService is the state of the fwmark virtual server, an empty
+// scheduler means the virtual server does not exist
+type ipvsService struct {
+	scheduler   string
+	lbKind      string
+	realServers map[string]bool
+}
+
+// ipvsCommands returns the ipvsadm arguments which change the fwmark
+// virtual server from the current state to the desired one
+func ipvsCommands(mark int, cur, desired ipvsService) [][]string {
+	fwmark := strconv.Itoa(mark)
+	cmds := make([][]string, 0)
+
+	if desired.scheduler == "" {
+		if cur.scheduler != "" {
+			cmds = append(cmds, []string{"-D", "-f", fwmark})
+		}
+		return cmds
+	}
+
+	curServers := cur.realServers
+	switch {
+	case cur.scheduler == "":
+		cmds = append(cmds, []string{"-A", "-f", fwmark, "-s", desired.scheduler, "-p", persistenceTimeout})
+		curServers = nil
+	case cur.scheduler != desired.scheduler:
+		cmds = append(cmds, []string{"-E", "-f", fwmark, "-s", desired.scheduler, "-p", persistenceTimeout})
+	}
+
+	forward := forwardFlag(desired.lbKind)
+	for _, server := range sortedKeys(desired.realServers) {
+		switch {
+		case !curServers[server]:
+			cmds = append(cmds, []string{"-a", "-f", fwmark, "-r", server + ":0", forward, "-w", "1"})
+		case cur.lbKind != desired.lbKind:
+			cmds = append(cmds, []string{"-e", "-f", fwmark, "-r", server + ":0", forward, "-w", "1"})
+		}
+	}
+	for _, server := range sortedKeys(curServers) {
+		if !desired.realServers[server] {
+			cmds = append(cmds, []string{"-d", "-f", fwmark, "-r", server + ":0"})
+		}
+	}
+	return cmds
+}
+
+// forwardFlag returns the ipvsadm packet forwarding flag of lb kind
+func forwardFlag(lbKind string) string {
+	if lbKind == lbKindTUN {
+		return "-i"
+	}
+	return "-g"
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
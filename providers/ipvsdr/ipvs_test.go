@@ -0,0 +1,132 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvsdr
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPVSCommands(t *testing.T) {
+	servers := func(ips ...string) map[string]bool {
+		m := make(map[string]bool)
+		for _, ip := range ips {
+			m[ip] = true
+		}
+		return m
+	}
+	tests := []struct {
+		name    string
+		cur     ipvsService
+		desired ipvsService
+		want    [][]string
+	}{
+		{
+			"create",
+			ipvsService{},
+			ipvsService{"rr", lbKindDR, servers("10.0.0.1")},
+			[][]string{
+				{"-A", "-f", "1", "-s", "rr", "-p", "360"},
+				{"-a", "-f", "1", "-r", "10.0.0.1:0", "-g", "-w", "1"},
+			},
+		},
+		{
+			"unchanged",
+			ipvsService{"rr", lbKindDR, servers("10.0.0.1")},
+			ipvsService{"rr", lbKindDR, servers("10.0.0.1")},
+			[][]string{},
+		},
+		{
+			"change scheduler and servers",
+			ipvsService{"rr", lbKindDR, servers("10.0.0.1", "10.0.0.3", "10.0.0.2")},
+			ipvsService{"wrr", lbKindDR, servers("10.0.0.1", "10.0.0.4")},
+			[][]string{
+				{"-E", "-f", "1", "-s", "wrr", "-p", "360"},
+				{"-a", "-f", "1", "-r", "10.0.0.4:0", "-g", "-w", "1"},
+				{"-d", "-f", "1", "-r", "10.0.0.2:0"},
+				{"-d", "-f", "1", "-r", "10.0.0.3:0"},
+			},
+		},
+		{
+			"change lb kind",
+			ipvsService{"rr", lbKindDR, servers("10.0.0.1")},
+			ipvsService{"rr", lbKindTUN, servers("10.0.0.1", "10.1.0.1")},
+			[][]string{
+				{"-e", "-f", "1", "-r", "10.0.0.1:0", "-i", "-w", "1"},
+				{"-a", "-f", "1", "-r", "10.1.0.1:0", "-i", "-w", "1"},
+			},
+		},
+		{
+			"delete",
+			ipvsService{"rr", lbKindDR, servers("10.0.0.1")},
+			ipvsService{},
+			[][]string{{"-D", "-f", "1"}},
+		},
+		{
+			"nothing to delete",
+			ipvsService{},
+			ipvsService{},
+			[][]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ipvsCommands(acceptMark, tt.cur, tt.desired)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestIPVSDataplaneSyncError(t *testing.T) {
+	var calls [][]string
+	failed := map[string]bool{"-a": true}
+	d := newIPVSDataplane(acceptMark)
+	d.ipvsadm = func(args ...string) ([]byte, error) {
+		calls = append(calls, args)
+		if failed[args[0]] {
+			delete(failed, args[0])
+			return []byte("Memory allocation problem"), errors.New("exit status 1")
+		}
+		if args[0] == "-D" {
+			return []byte("No such service"), errors.New("exit status 1")
+		}
+		return nil, nil
+	}
+	d.vs = &virtualServer{Scheduler: "rr", LbKind: lbKindDR, RealServer: []string{"10.0.0.1"}}
+	d.healthy = map[string]bool{"10.0.0.1": true}
+
+	assert.NotNil(t, d.setActive(true))
+	assert.Equal(t, [][]string{
+		{"-A", "-f", "1", "-s", "rr", "-p", "360"},
+		{"-a", "-f", "1", "-r", "10.0.0.1:0", "-g", "-w", "1"},
+	}, calls)
+
+	// the virtual server is created again
+	calls = nil
+	assert.Nil(t, d.sync())
+	assert.Equal(t, [][]string{
+		{"-D", "-f", "1"},
+		{"-A", "-f", "1", "-s", "rr", "-p", "360"},
+		{"-a", "-f", "1", "-r", "10.0.0.1:0", "-g", "-w", "1"},
+	}, calls)
+
+	calls = nil
+	assert.Nil(t, d.sync())
+	assert.Empty(t, calls)
+}
@@ -2,30 +2,103 @@ package ipvsdr
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/zoumo/golib/netutil"
-	"github.com/zoumo/golib/shell"
 	log "github.com/zoumo/logdog"
 	"k8s.io/apimachinery/pkg/util/wait"
+	k8sexec "k8s.io/kubernetes/pkg/util/exec"
+)
+
+const (
+	ipvsConnFile = "/proc/net/ip_vs_conn"
+	// ipvsRulesFile is the file name in state dir which holds the
+	// saved ipvs rules while the cache is draining
+	ipvsRulesFile = "ipvs.rules"
+)
+
+// ip_vs_conn fields
+const (
+	fConnProto int = iota
+	fConnFromIP
+	fConnFromPort
+	fConnToIP
+	fConnToPort
+	fConnDestIP
+	fConnDestPort
+	fConnState
+	fConnExpires
 )
 
 type ipvsCacheCleaner struct {
-	vip    string
-	saved  string
-	stopCh chan struct{}
+	vip       string
+	mark      int
+	stateFile string
+	saved     string
+
+	mu       sync.Mutex
+	notifyCh chan struct{}
+	stopCh   chan struct{}
+}
+
+func newIPVSCacheCleaner(vip string, mark int, stateDir string) *ipvsCacheCleaner {
+	return &ipvsCacheCleaner{
+		vip:       vip,
+		mark:      mark,
+		stateFile: filepath.Join(stateDir, ipvsRulesFile),
+		notifyCh:  make(chan struct{}, 1),
+		stopCh:    make(chan struct{}),
+	}
 }
 
 func (ipvs *ipvsCacheCleaner) start() {
+	// rules saved by the previous process have not been restored,
+	// load them so that we can restore them correctly
+	if err := ipvs.loadState(); err != nil {
+		log.Error("Error load saved ipvs rules", log.Fields{"file": ipvs.stateFile, "err": err})
+	}
+
 	go wait.Until(ipvs.worker, 10*time.Second, ipvs.stopCh)
+	go func() {
+		for {
+			select {
+			case <-ipvs.notifyCh:
+				ipvs.worker()
+			case <-ipvs.stopCh:
+				return
+			}
+		}
+	}()
 }
 
 func (ipvs *ipvsCacheCleaner) stop() {
 	close(ipvs.stopCh)
 }
 
+// notify asks the cleaner to check the cache immediately,
+// it is called when the vrrp state changes
+func (ipvs *ipvsCacheCleaner) notify() {
+	select {
+	case ipvs.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
 func (ipvs *ipvsCacheCleaner) worker() {
+	ipvs.mu.Lock()
+	defer ipvs.mu.Unlock()
+
 	vipExists := checkVIPExists(ipvs.vip)
 	if vipExists {
 		// skip check ipvs persistent connection cache
@@ -36,10 +109,15 @@ func (ipvs *ipvsCacheCleaner) worker() {
 		return
 	}
 
-	cacheExists := checkCacheExists()
-	if cacheExists {
+	entries, err := countIPVSConnEntries(ipvs.vip)
+	if err != nil {
+		log.Error("Error count ipvs connection entries", log.Fields{"vip": ipvs.vip, "err": err})
+		return
+	}
+	if entries > 0 {
 		// vip doesn't exist but cache exists
 		// we should clean the rules and wait for cache expiring
+		log.Debug("ipvs connection entries of vip found", log.Fields{"vip": ipvs.vip, "entries": entries})
 		ipvs.ipvsSaveAndClean()
 	} else {
 		// backup but no cache
@@ -47,30 +125,38 @@ func (ipvs *ipvsCacheCleaner) worker() {
 	}
 }
 
+// ipvsSaveAndClean saves the rules of our virtual service and deletes the service,
+// the connection entries pointing to it will be expired by kernel (expire_nodest_conn)
+// or time out, other virtual services on the node are not touched.
 func (ipvs *ipvsCacheCleaner) ipvsSaveAndClean() error {
-
 	if ipvs.saved != "" {
 		return nil
 	}
 
-	ipvsadm := shell.Command("ipvsadm").CombinedOutputClosure()
-	output, err := ipvsadm("-Sn")
+	output, err := k8sexec.New().Command("ipvsadm", "-Sn").CombinedOutput()
 	if err != nil {
 		log.Errorf("Error save ipvs rules: %v", string(output))
 		return err
 	}
-	if len(output) == 0 {
+	rules := filterIPVSRules(string(output), ipvs.mark)
+	if len(rules) == 0 {
 		// empty rules
 		return nil
 	}
-	// clean the whole table
-	msg, err := ipvsadm("-C")
+
+	// persist rules before deleting them, so a restart can restore them
+	if err := ipvs.saveState(rules); err != nil {
+		log.Error("Error persist ipvs rules", log.Fields{"file": ipvs.stateFile, "err": err})
+		return err
+	}
+
+	msg, err := k8sexec.New().Command("ipvsadm", "-D", "-f", strconv.Itoa(ipvs.mark)).CombinedOutput()
 	if err != nil {
-		log.Errorf("Error clean ipvs rules: %v", string(msg))
+		log.Errorf("Error delete ipvs virtual service: %v", string(msg))
 		return err
 	}
 
-	ipvs.saved = string(output)
+	ipvs.saved = rules
 	log.Info("Waiting for ipvs persistent connection hash table being empty")
 	log.Infof("Saved ipvs rules %q", ipvs.saved)
 	return nil
@@ -81,22 +167,78 @@ func (ipvs *ipvsCacheCleaner) ipvsRestore() error {
 		return nil
 	}
 
-	msg, err := shell.Command("echo", shell.QueryEscape(ipvs.saved)).Pipe("ipvsadm", "-R").CombinedOutput()
+	// keepalived may have recreated the virtual service after restarting,
+	// delete it firstly to avoid conflicts
+	msg, err := k8sexec.New().Command("ipvsadm", "-D", "-f", strconv.Itoa(ipvs.mark)).CombinedOutput()
+	if err != nil && !strings.Contains(string(msg), "No such service") {
+		log.Errorf("Error delete ipvs virtual service: %v", string(msg))
+		return err
+	}
+
+	cmd := k8sexec.New().Command("ipvsadm", "-R")
+	cmd.SetStdin(strings.NewReader(ipvs.saved))
+	msg, err = cmd.CombinedOutput()
 	if err != nil {
 		log.Errorf("Error restore ipvs rules: %v", string(msg))
 		return err
 	}
 
 	ipvs.saved = ""
+	if err := os.Remove(ipvs.stateFile); err != nil && !os.IsNotExist(err) {
+		log.Error("Error remove saved ipvs rules", log.Fields{"file": ipvs.stateFile, "err": err})
+	}
 	log.Info("Restore ipvs rules")
 	return nil
+}
+
+func (ipvs *ipvsCacheCleaner) loadState() error {
+	data, err := ioutil.ReadFile(ipvs.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ipvs.saved = string(data)
+	if ipvs.saved != "" {
+		log.Infof("Loaded saved ipvs rules %q", ipvs.saved)
+	}
+	return nil
+}
 
+// saveState writes rules to the state file atomically
+func (ipvs *ipvsCacheCleaner) saveState(rules string) error {
+	if err := os.MkdirAll(filepath.Dir(ipvs.stateFile), 0755); err != nil {
+		return err
+	}
+	tmp := ipvs.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(rules), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ipvs.stateFile)
+}
+
+// filterIPVSRules returns the rules of fwmark virtual service from the
+// output of ipvsadm -Sn
+func filterIPVSRules(rules string, mark int) string {
+	var buf bytes.Buffer
+	for _, line := range strings.Split(rules, "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "-f" && fields[i+1] == strconv.Itoa(mark) {
+				buf.WriteString(line)
+				buf.WriteString("\n")
+				break
+			}
+		}
+	}
+	return buf.String()
 }
 
 func checkVIPExists(ip string) bool {
 	slice, err := netutil.InterfacesByIP(ip)
 	if err != nil {
-		log.Errorf("Error get net interfaces by ip", ip)
+		log.Errorf("Error get net interfaces by ip %v", ip)
 		return false
 	}
 	for _, iface := range slice {
@@ -109,22 +251,54 @@ func checkVIPExists(ip string) bool {
 	return false
 }
 
-func checkCacheExists() bool {
-	// get the first 2 lines of /proc/net/ip_vs_conn
-	ipvsconn, err := os.Open("/proc/net/ip_vs_conn")
+// countIPVSConnEntries returns the number of entries in ipvs connection
+// table whose virtual address is vip, including persistence templates
+func countIPVSConnEntries(vip string) (int, error) {
+	ipvsconn, err := os.Open(ipvsConnFile)
+	if os.IsNotExist(err) {
+		// ip_vs is not loaded
+		return 0, nil
+	}
 	if err != nil {
-		return false
+		return 0, err
 	}
 	defer ipvsconn.Close()
 
-	scanner := bufio.NewScanner(ipvsconn)
-	number := 0
+	return countConnEntries(ipvsconn, net.ParseIP(vip))
+}
+
+func countConnEntries(r io.Reader, vip net.IP) (int, error) {
+	if vip == nil {
+		return 0, fmt.Errorf("invalid vip")
+	}
+	scanner := bufio.NewScanner(r)
+	// skip first line, it is header not entries
+	scanner.Scan()
+
+	count := 0
 	for scanner.Scan() {
-		// the first line is header not entries
-		number++
-		if number >= 2 {
-			return true
+		fields := strings.Fields(scanner.Text())
+		if len(fields) <= fConnToIP {
+			continue
+		}
+		ip := parseIPVSConnAddr(fields[fConnToIP])
+		if ip != nil && ip.Equal(vip) {
+			count++
 		}
 	}
-	return false
+	return count, scanner.Err()
+}
+
+// parseIPVSConnAddr parses the address in /proc/net/ip_vs_conn,
+// ipv4 address is printed in hex, e.g. C0A80001, and ipv6 address
+// is printed in the full form, e.g. fe80:0000:0000:0000:0000:0000:0000:0001
+func parseIPVSConnAddr(s string) net.IP {
+	if strings.Contains(s, ":") {
+		return net.ParseIP(s)
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != net.IPv4len {
+		return nil
+	}
+	return net.IPv4(b[0], b[1], b[2], b[3])
 }
@@ -0,0 +1,81 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvsdr
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const ipvsConnSample = `Pro FromIP   FPrt ToIP     TPrt DestIP   DPrt State       Expires PEName PEData
+TCP C0A80A01 D5E2 C0A863C8 0050 C0A80101 0050 ESTABLISHED     899
+IP  C0A80A01 0000 C0A863C8 0000 C0A80101 0000 NONE            359
+TCP C0A80A02 D5E3 C0A863C9 0050 C0A80102 0050 ESTABLISHED     899
+TCP fe80:0000:0000:0000:0000:0000:0000:0001 D5E4 fe80:0000:0000:0000:0000:0000:0000:00c8 0050 fe80:0000:0000:0000:0000:0000:0000:0002 0050 ESTABLISHED 899
+`
+
+func TestCountConnEntries(t *testing.T) {
+	tests := []struct {
+		name string
+		vip  string
+		want int
+	}{
+		{"entries and template", "192.168.99.200", 2},
+		{"another vip", "192.168.99.201", 1},
+		{"no entries", "192.168.99.202", 0},
+		{"ipv6", "fe80::c8", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := countConnEntries(strings.NewReader(ipvsConnSample), net.ParseIP(tt.vip))
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := countConnEntries(strings.NewReader(ipvsConnSample), nil)
+	assert.NotNil(t, err)
+}
+
+func TestFilterIPVSRules(t *testing.T) {
+	rules := `-A -t 10.0.0.1:80 -s rr
+-a -t 10.0.0.1:80 -r 10.0.0.2:80 -m -w 1
+-A -f 1 -s rr -p 360
+-a -f 1 -r 192.168.1.1:0 -g -w 1
+-a -f 1 -r 192.168.1.2:0 -g -w 1
+-A -f 10 -s rr
+`
+	want := `-A -f 1 -s rr -p 360
+-a -f 1 -r 192.168.1.1:0 -g -w 1
+-a -f 1 -r 192.168.1.2:0 -g -w 1
+`
+	assert.Equal(t, want, filterIPVSRules(rules, acceptMark))
+	assert.Equal(t, "", filterIPVSRules("", acceptMark))
+}
+
+func TestParseVRRPNotify(t *testing.T) {
+	instance, state, ok := parseVRRPNotify(`INSTANCE "vips" MASTER 100`)
+	assert.True(t, ok)
+	assert.Equal(t, "vips", instance)
+	assert.Equal(t, "MASTER", state)
+
+	_, _, ok = parseVRRPNotify(`GROUP "g1" BACKUP 100`)
+	assert.False(t, ok)
+}
@@ -20,16 +20,20 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
 	nodeutil "github.com/caicloud/clientset/util/node"
 	"github.com/caicloud/loadbalancer-provider/core/pkg/arp"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/journal"
 	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
 	"github.com/caicloud/loadbalancer-provider/core/pkg/sysctl"
 	core "github.com/caicloud/loadbalancer-provider/core/provider"
+	"github.com/caicloud/loadbalancer-provider/pkg/execd"
 	"github.com/caicloud/loadbalancer-provider/pkg/version"
 	log "github.com/zoumo/logdog"
+	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/util/flowcontrol"
 	utildbus "k8s.io/kubernetes/pkg/util/dbus"
@@ -39,9 +43,14 @@ import (
 
 const (
 	tableMangle = "mangle"
+	// the resolved neighbors are refreshed periodically to notice
+	// the changes of their hardware addresses
+	neighborRefreshPeriod = 30 * time.Second
 )
 
 var _ core.Provider = &IpvsdrProvider{}
+var _ core.Resyncer = &IpvsdrProvider{}
+var _ core.EventRecorderSetter = &IpvsdrProvider{}
 
 var (
 	// sysctl changes required by keepalived
@@ -58,6 +67,19 @@ var (
 		"net.ipv4.conf.lo.arp_ignore": "1",
 		// Always use the best local address for ARP requests sent on interface.
 		"net.ipv4.conf.lo.arp_announce": "2",
+		// drop the connection entries whose destination is unavailable, so that the
+		// cache drains quickly after the virtual service is removed on backup nodes
+		"net.ipv4.vs.expire_nodest_conn": "1",
+		// expire the persistence templates whose destination is quiescent
+		"net.ipv4.vs.expire_quiescent_template": "1",
+	}
+
+	// the ipvs sysctls exist only after ip_vs is loaded, they are
+	// skipped with a warning instead of failing the others
+	optionalSysctls = []string{
+		"net.ipv4.vs.conntrack",
+		"net.ipv4.vs.expire_nodest_conn",
+		"net.ipv4.vs.expire_quiescent_template",
 	}
 )
 
@@ -68,23 +90,46 @@ type IpvsdrProvider struct {
 	reloadRateLimiter flowcontrol.RateLimiter
 	keepalived        *keepalived
 	ipvsCacheChecker  *ipvsCacheCleaner
+	vrrpWatcher       *vrrpWatcher
+	bgpAnnouncer      *bgpAnnouncer
+	l2Announcer       *l2Announcer
+	tunnel            *tunnel
+	resolver          *arp.Resolver
+	resync            func()
+	recorder          core.EventRecorder
+	portChecker       *core.HostPortChecker
+	stopCh            chan struct{}
+	announceMode      string
 	storeLister       core.StoreLister
-	sysctlDefault     map[string]string
+	journal           *journal.Journal
 	ipt               iptables.Interface
 	cfgMD5            string
 	vip               string
 	nodeIPLabels      []string
 	nodeIPAnnotations []string
+
+	// lb is the last updated loadbalancer, keepalived crashes are
+	// recorded as its events
+	lbMu sync.Mutex
+	lb   *lbapi.LoadBalancer
 }
 
 // NewIpvsdrProvider creates a new ipvs-dr LoadBalancer Provider.
-func NewIpvsdrProvider(nodeIP net.IP, lb *lbapi.LoadBalancer, unicast bool, labels, annotations []string) (*IpvsdrProvider, error) {
+func NewIpvsdrProvider(nodeIP net.IP, lb *lbapi.LoadBalancer, unicast bool, labels, annotations []string, stateDir string, announce AnnounceConfig) (*IpvsdrProvider, error) {
 	nodeInfo, err := corenet.InterfaceByIP(nodeIP.String())
 	if err != nil {
 		log.Error("get node info err", log.Fields{"err": err})
 		return nil, err
 	}
 
+	// the journal records the host mutations, the ones left by the
+	// previous run are reverted on start
+	j, err := journal.Open(stateDir)
+	if err != nil {
+		log.Error("open journal error", log.Fields{"dir": stateDir, "err": err})
+		return nil, err
+	}
+
 	execer := k8sexec.New()
 	dbus := utildbus.New()
 	iptInterface := iptables.New(execer, dbus, iptables.ProtocolIpv4)
@@ -94,10 +139,60 @@ func NewIpvsdrProvider(nodeIP net.IP, lb *lbapi.LoadBalancer, unicast bool, labe
 		nodeInfo:          nodeInfo,
 		reloadRateLimiter: flowcontrol.NewTokenBucketRateLimiter(10.0, 10),
 		vip:               lb.Spec.Providers.Ipvsdr.VIP,
-		sysctlDefault:     make(map[string]string, 0),
+		journal:           j,
 		ipt:               iptInterface,
 		nodeIPLabels:      labels,
 		nodeIPAnnotations: annotations,
+		announceMode:      announce.Mode,
+		tunnel:            &tunnel{vip: lb.Spec.Providers.Ipvsdr.VIP, journal: j},
+		stopCh:            make(chan struct{}),
+		portChecker:       core.NewHostPortChecker(core.ProxyProcesses...),
+	}
+
+	// the mark rules and real servers depend on the neighbors' MAC,
+	// resync the loadbalancer when any of them changes
+	ipvs.resolver = arp.NewResolver(arp.ResolverOptions{
+		OnChange: func(iface, ip string, old, cur net.HardwareAddr) {
+			log.Info("neighbor hardware address changed", log.Fields{"ip": ip, "old": old, "new": cur})
+			if ipvs.resync != nil {
+				ipvs.resync()
+			}
+		},
+	})
+
+	switch announce.Mode {
+	case AnnounceModeVRRP:
+		ipvs.ipvsCacheChecker = newIPVSCacheCleaner(lb.Spec.Providers.Ipvsdr.VIP, acceptMark, stateDir)
+
+		// check the ipvs cache immediately when vrrp state changes
+		ipvs.vrrpWatcher = &vrrpWatcher{
+			path: keepalivedNotifyFifo,
+			onChange: func(instance, state string) {
+				ipvs.ipvsCacheChecker.notify()
+			},
+		}
+	case AnnounceModeBGP:
+		// every node is active in bgp mode and the VIP is always bound to lo,
+		// so the ipvs cache cleaner and vrrp watcher are not needed
+		ipvs.bgpAnnouncer, err = newBGPAnnouncer(nodeIP, ipvs.vip, announce.BGP)
+		if err != nil {
+			return nil, err
+		}
+	case AnnounceModeL2:
+		if announce.L2.LeaseNamespace == "" {
+			announce.L2.LeaseNamespace = lb.Namespace
+		}
+		if announce.L2.LeaseName == "" {
+			announce.L2.LeaseName = "ipvsdr-" + lb.Name
+		}
+		ipvs.l2Announcer, err = newL2Announcer(nodeInfo.Name, ipvs.vip, announce.L2, j, ipvs.isNodeReady)
+		if err != nil {
+			return nil, err
+		}
+		// keepalived is not used in l2 mode
+		return ipvs, nil
+	default:
+		return nil, fmt.Errorf("unknown announce mode %q", announce.Mode)
 	}
 
 	// neighbors := getNodeNeighbors(nodeInfo, clusterNodes)
@@ -105,12 +200,11 @@ func NewIpvsdrProvider(nodeIP net.IP, lb *lbapi.LoadBalancer, unicast bool, labe
 		nodeIP:     nodeIP,
 		nodeInfo:   nodeInfo,
 		useUnicast: unicast,
+		vrrp:       announce.Mode == AnnounceModeVRRP,
 		ipt:        iptInterface,
-	}
-
-	ipvs.ipvsCacheChecker = &ipvsCacheCleaner{
-		vip:    lb.Spec.Providers.Ipvsdr.VIP,
-		stopCh: make(chan struct{}),
+		journal:    j,
+		onRestart:  ipvs.onKeepalivedRestart,
+		onCrash:    ipvs.onKeepalivedCrash,
 	}
 
 	err = ipvs.keepalived.loadTemplate()
@@ -137,6 +231,10 @@ func (p *IpvsdrProvider) OnUpdate(lb *lbapi.LoadBalancer) error {
 
 	log.Info("IPVS: OnUpdating")
 
+	p.lbMu.Lock()
+	p.lb = lb
+	p.lbMu.Unlock()
+
 	tcpcm, err := p.storeLister.ConfigMap.ConfigMaps(lb.Namespace).Get(lb.Status.ProxyStatus.TCPConfigMap)
 	if err != nil {
 		log.Error("can not find tcp configmap for loadbalancer")
@@ -149,7 +247,7 @@ func (p *IpvsdrProvider) OnUpdate(lb *lbapi.LoadBalancer) error {
 		return err
 	}
 
-	tcpPorts, udpPorts := core.GetExportedPorts(tcpcm, udpcm)
+	tcpPorts, udpPorts := core.CheckExportedPorts(p.recorder, p.portChecker, lb, tcpcm, udpcm)
 
 	// get selected nodes' ip
 	if len(lb.Spec.Nodes.Names) == 0 {
@@ -163,12 +261,40 @@ func (p *IpvsdrProvider) OnUpdate(lb *lbapi.LoadBalancer) error {
 		return nil
 	}
 
-	// All the resolvedNodes MUST be in the same L2 network
-	// After resolving, we will figure out which nodes can not be reached
+	method, err := getForwardMethod(lb)
+	if err != nil {
+		log.Error("invalid forward method", log.Fields{"err": err})
+		return nil
+	}
+	if method == ForwardMethodTUN {
+		err = p.tunnel.ensure()
+	} else {
+		err = p.tunnel.teardown()
+	}
+	if err != nil {
+		log.Error("error configure ipip tunnel", log.Fields{"method": method, "err": err})
+		return err
+	}
+
 	unresolvedNeighbors := getNeighbors(p.nodeIP.String(), resolvedNodes)
-	resolvedNeighbors := p.resolveNeighbors(unresolvedNeighbors)
-	if len(unresolvedNeighbors) > 0 && len(resolvedNeighbors) == 0 {
-		log.Warn("Cannot get any valid neighbors MAC")
+	var resolvedNeighbors, markedNeighbors []ipmac
+	if method == ForwardMethodTUN {
+		// the real servers are reached through the ipip tunnel, they can be
+		// in different subnets and the MAC based marks are not needed, the
+		// decapsulated packets come from tunl0 and are never marked
+		for _, n := range unresolvedNeighbors {
+			resolvedNeighbors = append(resolvedNeighbors, ipmac{IP: n})
+		}
+	} else {
+		// In vrrp mode, all the resolvedNodes MUST be in the same L2 network.
+		// In bgp mode, the nodes may be in different L2 networks, the nodes
+		// which can not be reached are not used as real servers.
+		// After resolving, we will figure out which nodes can not be reached
+		resolvedNeighbors = p.resolveNeighbors(unresolvedNeighbors)
+		if len(unresolvedNeighbors) > 0 && len(resolvedNeighbors) == 0 {
+			log.Warn("Cannot get any valid neighbors MAC")
+		}
+		markedNeighbors = resolvedNeighbors
 	}
 
 	// rebuild resolvedNodes
@@ -180,9 +306,16 @@ func (p *IpvsdrProvider) OnUpdate(lb *lbapi.LoadBalancer) error {
 	svc := virtualServer{
 		VIP:        lb.Spec.Providers.Ipvsdr.VIP,
 		Scheduler:  string(lb.Spec.Providers.Ipvsdr.Scheduler),
+		LbKind:     lbKind(method),
 		RealServer: resolvedNodes,
 	}
 
+	if p.announceMode == AnnounceModeL2 {
+		p.l2Announcer.update(svc, lb.Spec.Nodes.Names)
+		p.ensureIptablesMark(markedNeighbors, tcpPorts, udpPorts)
+		return nil
+	}
+
 	err = p.keepalived.UpdateConfig(
 		[]virtualServer{svc},
 		resolvedNeighbors,
@@ -194,7 +327,7 @@ func (p *IpvsdrProvider) OnUpdate(lb *lbapi.LoadBalancer) error {
 		return err
 	}
 
-	p.ensureIptablesMark(resolvedNeighbors, tcpPorts, udpPorts)
+	p.ensureIptablesMark(markedNeighbors, tcpPorts, udpPorts)
 
 	// check md5
 	md5, err := checksum(keepalivedCfg)
@@ -217,9 +350,36 @@ func (p *IpvsdrProvider) OnUpdate(lb *lbapi.LoadBalancer) error {
 func (p *IpvsdrProvider) Start() {
 	log.Info("Startting ipvs dr provider")
 
-	p.changeSysctl()
+	// restore the true original values and remove the leftovers before
+	// applying new state, such as the old VIP when the VIP of loadbalancer
+	// changed. Only the addresses recorded in journal are removed, the
+	// addresses of other loadbalancers on the node are kept
+	if err := p.journal.Undo(journal.NewHostUndoer()); err != nil {
+		log.Error("undo journal error", log.Fields{"err": err})
+	}
+	// the fwmark virtual service is created by keepalived or the dataplane
+	if err := p.journal.RecordService(acceptMark); err != nil {
+		log.Error("record ipvs service in journal error", log.Fields{"err": err})
+	}
+
+	if err := p.changeSysctl(); err != nil {
+		log.Error("change sysctl error", log.Fields{"err": err})
+	}
 	p.setLoopbackVIP()
 	p.ensureChain()
+	go p.resolver.Run(neighborRefreshPeriod, p.stopCh)
+	switch p.announceMode {
+	case AnnounceModeBGP:
+		p.keepalived.Start()
+		p.bgpAnnouncer.start()
+		return
+	case AnnounceModeL2:
+		p.l2Announcer.start()
+		return
+	}
+	if err := p.vrrpWatcher.start(); err != nil {
+		log.Error("watch vrrp state error", log.Fields{"err": err})
+	}
 	p.keepalived.Start()
 	p.ipvsCacheChecker.start()
 	return
@@ -227,11 +387,22 @@ func (p *IpvsdrProvider) Start() {
 
 // WaitForStart waits for ipvsdr fully run
 func (p *IpvsdrProvider) WaitForStart() bool {
-	err := wait.Poll(time.Second, 60*time.Second, func() (bool, error) {
+	if p.announceMode == AnnounceModeL2 {
+		return true
+	}
+
+	done := p.keepalived.done()
+	err := wait.Poll(100*time.Millisecond, 60*time.Second, func() (bool, error) {
+		select {
+		case <-done:
+			return false, fmt.Errorf("keepalived exited with code %d", p.keepalived.cmd.ExitCode())
+		default:
+		}
 		return p.keepalived.isRunning(), nil
 	})
 
 	if err != nil {
+		log.Error("wait for keepalived error", log.Fields{"err": err})
 		return false
 	}
 	return true
@@ -241,6 +412,17 @@ func (p *IpvsdrProvider) WaitForStart() bool {
 func (p *IpvsdrProvider) Stop() error {
 	log.Info("Shutting down ipvs dr provider")
 
+	close(p.stopCh)
+
+	switch p.announceMode {
+	case AnnounceModeBGP:
+		// withdraw the VIP before tearing down the dataplane
+		p.bgpAnnouncer.stop()
+	case AnnounceModeL2:
+		// release the lease so that another node takes over at once
+		p.l2Announcer.stop()
+	}
+
 	err := p.resetSysctl()
 	if err != nil {
 		log.Error("reset sysctl error", log.Fields{"err": err})
@@ -253,10 +435,24 @@ func (p *IpvsdrProvider) Stop() error {
 
 	p.deleteChain()
 
+	err = p.tunnel.teardown()
+	if err != nil {
+		log.Error("teardown ipip tunnel error", log.Fields{"err": err})
+	}
+
+	switch p.announceMode {
+	case AnnounceModeBGP:
+		p.keepalived.Stop()
+		return p.undoLeftovers()
+	case AnnounceModeL2:
+		return p.undoLeftovers()
+	}
+
 	p.ipvsCacheChecker.stop()
 	p.keepalived.Stop()
+	p.vrrpWatcher.stop()
 
-	return nil
+	return p.undoLeftovers()
 }
 
 // Info ...
@@ -270,6 +466,43 @@ func (p *IpvsdrProvider) Info() core.Info {
 	}
 }
 
+// onKeepalivedRestart re-applies the host state which keepalived may have
+// cleaned up when exiting and resyncs the loadbalancer
+func (p *IpvsdrProvider) onKeepalivedRestart() {
+	if err := p.setLoopbackVIP(); err != nil {
+		log.Error("set loopback vip error", log.Fields{"err": err})
+	}
+	p.ensureChain()
+	if p.resync != nil {
+		p.resync()
+	}
+}
+
+// onKeepalivedCrash records an event with the last logs of keepalived
+func (p *IpvsdrProvider) onKeepalivedCrash(status execd.ExitStatus, logs []execd.LogLine) {
+	p.lbMu.Lock()
+	lb := p.lb
+	p.lbMu.Unlock()
+	if lb == nil || p.recorder == nil {
+		return
+	}
+	msg := fmt.Sprintf("keepalived on node %s exited: %v", p.nodeInfo.Name, status.Err)
+	if len(logs) > 0 {
+		msg += ", last logs:\n" + execd.FormatLogs(logs)
+	}
+	p.recorder.Event(lb, v1.EventTypeWarning, "KeepalivedExited", msg)
+}
+
+// SetResyncFunc implements core.Resyncer
+func (p *IpvsdrProvider) SetResyncFunc(resync func()) {
+	p.resync = resync
+}
+
+// SetEventRecorder implements core.EventRecorderSetter
+func (p *IpvsdrProvider) SetEventRecorder(recorder core.EventRecorder) {
+	p.recorder = recorder
+}
+
 // SetListers sets the configured store listers in the generic ingress controller
 func (p *IpvsdrProvider) SetListers(lister core.StoreLister) {
 	p.storeLister = lister
@@ -297,7 +530,37 @@ func (p *IpvsdrProvider) getNodesIP(names []string) []string {
 	return ips
 }
 
+// isNodeReady returns true if the node is in the store and its Ready
+// condition is true
+func (p *IpvsdrProvider) isNodeReady(name string) bool {
+	node, err := p.storeLister.Node.Get(name)
+	if err != nil {
+		return false
+	}
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == v1.NodeReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// undoLeftovers reverts the mutations which are not reverted explicitly,
+// such as the ipvs virtual service and keepalived's iptables chain
+func (p *IpvsdrProvider) undoLeftovers() error {
+	err := p.journal.Undo(journal.NewHostUndoer())
+	if err != nil {
+		log.Error("undo journal error", log.Fields{"err": err})
+	}
+	return err
+}
+
 func (p *IpvsdrProvider) ensureChain() {
+	err := p.journal.RecordChain(p.chain())
+	if err != nil {
+		log.Error("record iptables chain in journal error", log.Fields{"err": err})
+	}
+
 	// create chain
 	ae, err := p.ipt.EnsureChain(tableMangle, iptables.Chain(iptablesChain))
 	if err != nil {
@@ -322,22 +585,28 @@ func (p *IpvsdrProvider) deleteChain() {
 	// delete jump rule
 	p.ipt.DeleteRule(tableMangle, iptables.ChainPrerouting, "-j", iptablesChain)
 	// delete chain
-	p.ipt.DeleteChain(tableMangle, iptablesChain)
+	err := p.ipt.DeleteChain(tableMangle, iptablesChain)
+	if err != nil {
+		log.Error("delete iptables chain error", log.Fields{"chain": iptablesChain, "err": err})
+		return
+	}
+	p.journal.ForgetChain(p.chain())
+}
+
+func (p *IpvsdrProvider) chain() journal.Chain {
+	return journal.Chain{Table: tableMangle, Chain: iptablesChain, JumpFrom: string(iptables.ChainPrerouting)}
 }
 
 // changeSysctl changes the required network setting in /proc to get
 // keepalived working in the local system.
 func (p *IpvsdrProvider) changeSysctl() error {
-	var err error
-	p.sysctlDefault, err = sysctl.BulkModify(sysctlAdjustments)
-	return err
+	return p.journal.ModifySysctl(sysctl.Settings(sysctlAdjustments, optionalSysctls...))
 }
 
 // resetSysctl resets the network setting
 func (p *IpvsdrProvider) resetSysctl() error {
-	log.Info("reset sysctl to original value", log.Fields{"defaults": p.sysctlDefault})
-	_, err := sysctl.BulkModify(p.sysctlDefault)
-	return err
+	log.Info("reset sysctl to original value", log.Fields{"defaults": p.journal.State().Sysctls})
+	return p.journal.ResetSysctl(sysctl.Settings(sysctlAdjustments))
 }
 
 // setLoopbackVIP sets vip to dev lo
@@ -352,9 +621,17 @@ func (p *IpvsdrProvider) setLoopbackVIP() error {
 		return err
 	}
 
-	out, err := k8sexec.New().Command("ip", "addr", "add", p.vip+"/32", "dev", lo.Name).CombinedOutput()
+	vip, err := corenet.HostNet(p.vip)
+	if err != nil {
+		return err
+	}
+	err = p.journal.RecordAddress(lo.Name, vip)
+	if err != nil {
+		return err
+	}
+	err = corenet.EnsureAddress(lo.Name, vip)
 	if err != nil {
-		return fmt.Errorf("set VIP %s to dev lo error: %v\n%s", p.vip, err, out)
+		return fmt.Errorf("set VIP %s to dev lo error: %v", p.vip, err)
 	}
 	return nil
 }
@@ -372,23 +649,29 @@ func (p *IpvsdrProvider) removeLoopbackVIP() error {
 		return err
 	}
 
-	out, err := k8sexec.New().Command("ip", "addr", "del", p.vip+"/32", "dev", lo.Name).CombinedOutput()
+	vip, err := corenet.HostNet(p.vip)
+	if err != nil {
+		return err
+	}
+	err = corenet.RemoveAddress(lo.Name, vip)
 	if err != nil {
-		return fmt.Errorf("removing configured VIP from dev lo error: %v\n%s", err, out)
+		return fmt.Errorf("removing configured VIP from dev lo error: %v", err)
 	}
-	return nil
+	return p.journal.ForgetAddress(lo.Name, vip)
 }
 
 func (p *IpvsdrProvider) resolveNeighbors(neighbors []string) []ipmac {
 	resolvedNeighbors := make([]ipmac, 0)
 
+	resolved, errs := p.resolver.ResolveAll(p.nodeInfo.Name, neighbors)
+	for ip, err := range errs {
+		log.Errorf("failed to resolve hardware address for %v: %v", ip, err)
+	}
+	// keep the order of neighbors
 	for _, neighbor := range neighbors {
-		hwAddr, err := arp.Resolve(p.nodeInfo.Name, neighbor)
-		if err != nil {
-			log.Errorf("failed to resolve hardware address for %v", neighbor)
-			continue
+		if hwAddr, ok := resolved[neighbor]; ok {
+			resolvedNeighbors = append(resolvedNeighbors, ipmac{IP: neighbor, MAC: hwAddr})
 		}
-		resolvedNeighbors = append(resolvedNeighbors, ipmac{IP: neighbor, MAC: hwAddr})
 	}
 
 	log.Debugf("resolved neighbors macs: %v", resolvedNeighbors)
@@ -20,15 +20,16 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"sync/atomic"
 	"syscall"
 	"text/template"
 	"time"
 
+	"github.com/caicloud/loadbalancer-provider/core/pkg/journal"
 	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
 	"github.com/caicloud/loadbalancer-provider/pkg/execd"
 	log "github.com/zoumo/logdog"
 
-	k8sexec "k8s.io/kubernetes/pkg/util/exec"
 	"k8s.io/kubernetes/pkg/util/iptables"
 )
 
@@ -37,6 +38,11 @@ const (
 	keepalivedCfg  = "/etc/keepalived/keepalived.conf"
 	keepalivedTmpl = "/root/keepalived.tmpl"
 
+	// the recent lines of keepalived logs are kept, the last lines of the
+	// crashed process are reported in event
+	keepalivedLogLines      = 200
+	keepalivedCrashLogLines = 10
+
 	acceptMark = 1
 	dropMark   = 0
 	mask       = "0x00000001"
@@ -50,17 +56,29 @@ type ipmac struct {
 type virtualServer struct {
 	VIP        string
 	Scheduler  string
+	LbKind     string
 	RealServer []string
 }
 
 type keepalived struct {
 	useUnicast bool
-	nodeIP     net.IP
-	nodeInfo   *corenet.Interface
-	ipt        iptables.Interface
-	cmd        *execd.D
-	tmpl       *template.Template
-	vips       []string
+	// vrrp is false when the VIP is announced by other means,
+	// keepalived only manages the ipvs virtual servers then
+	vrrp     bool
+	nodeIP   net.IP
+	nodeInfo *corenet.Interface
+	ipt      iptables.Interface
+	journal  *journal.Journal
+	cmd      *execd.D
+	tmpl     *template.Template
+	vips     []string
+	// onRestart is called after keepalived is restarted by the daemon
+	onRestart func()
+	// onCrash is called with the last lines of keepalived logs after
+	// keepalived exits unexpectedly
+	onCrash func(status execd.ExitStatus, logs []execd.LogLine)
+	// stopping is set by Stop, the exits after it are not crashes
+	stopping int32
 }
 
 // WriteCfg creates a new keepalived configuration file.
@@ -74,7 +92,20 @@ func (k *keepalived) UpdateConfig(vss []virtualServer, neighbors []ipmac, priori
 
 	log.Infof("Updating keealived config")
 	// save vips for release when shutting down
-	k.vips = getVIPs(vss)
+	vips := getVIPs(vss)
+	if k.vrrp {
+		k.vips = vips
+		// keepalived binds the vips, record them before keepalived reloads
+		for _, vip := range vips {
+			addr, err := corenet.HostNet(vip)
+			if err != nil {
+				return err
+			}
+			if err := k.journal.RecordAddress(k.nodeInfo.Name, addr); err != nil {
+				log.Error("record vip in journal error", log.Fields{"vip": vip, "err": err})
+			}
+		}
+	}
 
 	conf := make(map[string]interface{})
 	conf["iptablesChain"] = iptablesChain
@@ -82,12 +113,14 @@ func (k *keepalived) UpdateConfig(vss []virtualServer, neighbors []ipmac, priori
 	conf["myIP"] = k.nodeIP.String()
 	conf["netmask"] = 32 // useless
 	conf["vss"] = vss
-	conf["vips"] = k.vips
+	conf["vips"] = vips
 	conf["neighbors"] = neighbors
 	conf["priority"] = priority
 	conf["useUnicast"] = k.useUnicast
 	conf["vrid"] = vrid
 	conf["acceptMark"] = acceptMark
+	conf["notifyFifo"] = keepalivedNotifyFifo
+	conf["vrrp"] = k.vrrp
 
 	return k.tmpl.Execute(w, conf)
 }
@@ -106,6 +139,10 @@ func getVIPs(svcs []virtualServer) []string {
 // Start starts a keepalived process in foreground.
 // In case of any error it will terminate the execution with a fatal error
 func (k *keepalived) Start() {
+	err := k.journal.RecordChain(journal.Chain{Table: string(iptables.TableFilter), Chain: iptablesChain})
+	if err != nil {
+		log.Error("record iptables chain in journal error", log.Fields{"err": err})
+	}
 	ae, err := k.ipt.EnsureChain(iptables.TableFilter, iptables.Chain(iptablesChain))
 	if err != nil {
 		log.Fatalf("unexpected error: %v", err)
@@ -114,11 +151,20 @@ func (k *keepalived) Start() {
 		log.Infof("chain %v already existed", iptablesChain)
 	}
 
-	go k.run()
+	k.run()
 }
 
 func (k *keepalived) isRunning() bool {
-	return k.cmd.IsRunning()
+	return k.cmd != nil && k.cmd.IsRunning()
+}
+
+// done returns a channel which is closed when the keepalived daemon gives
+// up or is stopped
+func (k *keepalived) done() <-chan struct{} {
+	if k.cmd == nil {
+		return nil
+	}
+	return k.cmd.Done()
 }
 
 func (k *keepalived) run() {
@@ -133,16 +179,51 @@ func (k *keepalived) run() {
 	// 	Setpgid: true,
 	// 	Pgid:    0,
 	// }
-	k.cmd.Stdout = os.Stdout
-	k.cmd.Stderr = os.Stderr
+	k.cmd.CaptureLogs(keepalivedLogLines)
 
 	k.cmd.SetGracePeriod(1 * time.Second)
 
+	started := false
+	k.cmd.OnStart = func(pid int) {
+		if !started {
+			started = true
+			return
+		}
+		log.Warn("keepalived restarted", log.Fields{"pid": pid, "restarts": k.cmd.Restarts() + 1})
+		if k.onRestart != nil {
+			k.onRestart()
+		}
+	}
+	k.cmd.OnExit = k.onExit
+
 	if err := k.cmd.RunForever(); err != nil {
 		panic(fmt.Sprintf("can not run keepalived, %v", err))
 	}
 }
 
+// onExit reports the crash of keepalived, the exit caused by Stop is
+// expected even if keepalived is killed after the grace period
+func (k *keepalived) onExit(status execd.ExitStatus) {
+	if atomic.LoadInt32(&k.stopping) != 0 {
+		log.Info("keepalived exited on stop", log.Fields{"pid": status.Pid, "err": status.Err})
+		return
+	}
+	log.Warn("keepalived exited", log.Fields{"pid": status.Pid, "err": status.Err, "runtime": status.Runtime})
+	if status.Err == nil || k.onCrash == nil {
+		return
+	}
+	var logs []execd.LogLine
+	for _, l := range k.cmd.RecentLogs(0) {
+		if l.Pid == status.Pid {
+			logs = append(logs, l)
+		}
+	}
+	if len(logs) > keepalivedCrashLogLines {
+		logs = logs[len(logs)-keepalivedCrashLogLines:]
+	}
+	k.onCrash(status, logs)
+}
+
 // Reload sends SIGHUP to keepalived to reload the configuration.
 func (k *keepalived) Reload() error {
 	log.Info("reloading keepalived")
@@ -160,6 +241,7 @@ func (k *keepalived) Reload() error {
 
 // Stop stop keepalived process
 func (k *keepalived) Stop() {
+	atomic.StoreInt32(&k.stopping, 1)
 	for _, vip := range k.vips {
 		k.removeVIP(vip)
 	}
@@ -179,12 +261,16 @@ func (k *keepalived) Stop() {
 }
 
 func (k *keepalived) removeVIP(vip string) error {
-	log.Info("removing configured VIP %v from dev %v", vip, k.nodeInfo.Name)
-	out, err := k8sexec.New().Command("ip", "addr", "del", vip+"/32", "dev", k.nodeInfo.Name).CombinedOutput()
+	log.Infof("removing configured VIP %v from dev %v", vip, k.nodeInfo.Name)
+	addr, err := corenet.HostNet(vip)
 	if err != nil {
-		return fmt.Errorf("error reloading keepalived: %v\n%s", err, out)
+		return err
 	}
-	return nil
+	err = corenet.RemoveAddress(k.nodeInfo.Name, addr)
+	if err != nil {
+		return fmt.Errorf("error removing VIP %v: %v", vip, err)
+	}
+	return k.journal.ForgetAddress(k.nodeInfo.Name, addr)
 }
 
 func (k *keepalived) loadTemplate() error {
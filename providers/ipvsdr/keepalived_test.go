@@ -17,11 +17,14 @@ limitations under the License.
 package ipvsdr
 
 import (
+	"errors"
 	"html/template"
 	"io/ioutil"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/caicloud/loadbalancer-provider/pkg/execd"
 )
 
 func TestTemplate(t *testing.T) {
@@ -36,6 +39,7 @@ func TestTemplate(t *testing.T) {
 		{
 			VIP:       "192.168.99.200",
 			Scheduler: "rr",
+			LbKind:    lbKindDR,
 			RealServer: []string{
 				"192.168.1.1",
 				"192.168.1.2",
@@ -48,5 +52,30 @@ func TestTemplate(t *testing.T) {
 	conf["useUnicast"] = true
 	conf["vrid"] = 100
 	conf["acceptMark"] = acceptMark
+	conf["notifyFifo"] = keepalivedNotifyFifo
+	conf["vrrp"] = true
+	assert.Nil(t, tmpl.Execute(ioutil.Discard, conf))
+
+	conf["vrrp"] = false
 	assert.Nil(t, tmpl.Execute(ioutil.Discard, conf))
 }
+
+func TestKeepalivedOnExit(t *testing.T) {
+	crashes := 0
+	k := &keepalived{
+		cmd: execd.Daemon("keepalived"),
+		onCrash: func(status execd.ExitStatus, logs []execd.LogLine) {
+			crashes++
+		},
+	}
+
+	k.onExit(execd.ExitStatus{Pid: 1})
+	assert.Equal(t, 0, crashes)
+	k.onExit(execd.ExitStatus{Pid: 2, Err: errors.New("exit status 1")})
+	assert.Equal(t, 1, crashes)
+
+	// killed by Stop after the grace period
+	k.stopping = 1
+	k.onExit(execd.ExitStatus{Pid: 3, Err: errors.New("signal: killed")})
+	assert.Equal(t, 1, crashes)
+}
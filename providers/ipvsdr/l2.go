@@ -0,0 +1,201 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvsdr
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/caicloud/clientset/kubernetes"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/arp"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/journal"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	log "github.com/zoumo/logdog"
+)
+
+const (
+	gratuitousARPInterval = 10 * time.Second
+)
+
+// L2Config contains the settings of l2 announce mode
+type L2Config struct {
+	// Client is used to maintain the Lease
+	Client kubernetes.Interface
+	// LeaseNamespace and LeaseName identify the Lease, the namespace
+	// and name of the loadbalancer are used by default
+	LeaseNamespace string
+	LeaseName      string
+	// NodeName is the name of the node where the provider is running
+	NodeName string
+	// LeaseDuration is 15s by default
+	LeaseDuration time.Duration
+}
+
+// l2Announcer binds the VIP to the interface of the elected leader and
+// announces it by gratuitous ARP, the leader also runs the ipvs virtual
+// server.
+type l2Announcer struct {
+	iface     string
+	vip       net.IP
+	elector   *leaseElector
+	dataplane *ipvsDataplane
+	journal   *journal.Journal
+
+	mu      sync.Mutex
+	nodes   map[string]bool
+	leading bool
+	stopCh  chan struct{}
+}
+
+func newL2Announcer(iface, vip string, cfg L2Config, j *journal.Journal, isNodeReady func(string) bool) (*l2Announcer, error) {
+	ip := net.ParseIP(vip)
+	if ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("l2 mode only supports ipv4 vip, got %q", vip)
+	}
+	if cfg.Client == nil {
+		return nil, fmt.Errorf("l2 mode requires kubernetes client")
+	}
+	if cfg.NodeName == "" {
+		return nil, fmt.Errorf("l2 mode requires node name")
+	}
+	if cfg.LeaseDuration == 0 {
+		cfg.LeaseDuration = defaultLeaseDuration
+	}
+
+	a := &l2Announcer{
+		iface:     iface,
+		vip:       ip.To4(),
+		dataplane: newIPVSDataplane(acceptMark),
+		journal:   j,
+		nodes:     make(map[string]bool),
+		stopCh:    make(chan struct{}),
+	}
+	a.elector = &leaseElector{
+		client:           cfg.Client.CoordinationV1beta1(),
+		namespace:        cfg.LeaseNamespace,
+		name:             cfg.LeaseName,
+		identity:         cfg.NodeName,
+		duration:         cfg.LeaseDuration,
+		isCandidate:      a.isCandidate,
+		isNodeReady:      isNodeReady,
+		onStartedLeading: a.onStartedLeading,
+		onStoppedLeading: a.onStoppedLeading,
+	}
+	return a, nil
+}
+
+func (a *l2Announcer) start() {
+	a.dataplane.start()
+	a.elector.start()
+	go a.announceLoop()
+}
+
+func (a *l2Announcer) stop() {
+	close(a.stopCh)
+	a.elector.stop()
+	a.dataplane.stop()
+}
+
+// update changes the candidates and the virtual server
+func (a *l2Announcer) update(vs virtualServer, nodes []string) {
+	a.mu.Lock()
+	a.nodes = make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		a.nodes[node] = true
+	}
+	a.mu.Unlock()
+
+	a.dataplane.update(vs)
+}
+
+func (a *l2Announcer) isCandidate(node string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.nodes[node]
+}
+
+func (a *l2Announcer) isLeading() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.leading
+}
+
+func (a *l2Announcer) onStartedLeading() {
+	a.mu.Lock()
+	a.leading = true
+	a.mu.Unlock()
+
+	err := a.journal.RecordAddress(a.iface, a.vipNet())
+	if err != nil {
+		log.Error("record vip in journal error", log.Fields{"vip": a.vip, "err": err})
+	}
+	err = corenet.EnsureAddress(a.iface, a.vipNet())
+	if err != nil {
+		log.Error("add vip error", log.Fields{"vip": a.vip, "iface": a.iface, "err": err})
+	}
+	if err := a.dataplane.setActive(true); err != nil {
+		log.Error("create ipvs virtual server error", log.Fields{"err": err})
+	}
+	a.announce()
+}
+
+func (a *l2Announcer) onStoppedLeading() {
+	a.mu.Lock()
+	a.leading = false
+	a.mu.Unlock()
+
+	if err := a.dataplane.setActive(false); err != nil {
+		log.Error("delete ipvs virtual server error", log.Fields{"err": err})
+	}
+	err := corenet.RemoveAddress(a.iface, a.vipNet())
+	if err != nil {
+		log.Error("remove vip error", log.Fields{"vip": a.vip, "iface": a.iface, "err": err})
+		return
+	}
+	if err := a.journal.ForgetAddress(a.iface, a.vipNet()); err != nil {
+		log.Error("forget vip in journal error", log.Fields{"vip": a.vip, "err": err})
+	}
+}
+
+// announceLoop sends gratuitous ARP periodically while leading, in case
+// the neighbors missed the ones sent on takeover
+func (a *l2Announcer) announceLoop() {
+	ticker := time.NewTicker(gratuitousARPInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stopCh:
+			return
+		case <-ticker.C:
+			if a.isLeading() {
+				a.announce()
+			}
+		}
+	}
+}
+
+func (a *l2Announcer) vipNet() *net.IPNet {
+	return &net.IPNet{IP: a.vip, Mask: net.CIDRMask(32, 32)}
+}
+
+func (a *l2Announcer) announce() {
+	if err := arp.Gratuitous(a.iface, a.vip); err != nil {
+		log.Error("send gratuitous arp error", log.Fields{"vip": a.vip, "iface": a.iface, "err": err})
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvsdr
+
+import (
+	"fmt"
+	"strings"
+
+	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/journal"
+	corenet "github.com/caicloud/loadbalancer-provider/core/pkg/net"
+	"github.com/caicloud/loadbalancer-provider/core/pkg/sysctl"
+	log "github.com/zoumo/logdog"
+	k8sexec "k8s.io/kubernetes/pkg/util/exec"
+)
+
+const (
+	// ForwardMethodAnnotation selects the ipvs packet forwarding method of
+	// the loadbalancer, the value is dr or tun, dr by default. It is an
+	// annotation until the spec in clientset has a field for it
+	ForwardMethodAnnotation = "loadbalance.caicloud.io/ipvsdr-forward-method"
+
+	// ForwardMethodDR is direct routing, all the nodes must be in the
+	// same L2 network
+	ForwardMethodDR = "dr"
+	// ForwardMethodTUN is ip tunneling, the packets are encapsulated in
+	// ipip to the real servers which may be in different subnets
+	ForwardMethodTUN = "tun"
+
+	lbKindDR  = "DR"
+	lbKindTUN = "TUN"
+
+	tunnelDevice = "tunl0"
+)
+
+var (
+	// sysctl changes required by ipip tunnel
+	tunnelSysctlAdjustments = map[string]string{
+		// the decapsulated packets come from tunl0, but the replies are routed
+		// via the node interface, so reverse path filtering must be disabled.
+		// the kernel uses the max value of conf/all and conf/{interface}, so
+		// conf/all is required although it applies to the whole node, the
+		// original value is restored by teardown
+		"net.ipv4.conf.all.rp_filter":   "0",
+		"net.ipv4.conf.tunl0.rp_filter": "0",
+		// do not reply arp for the VIP on tunl0
+		"net.ipv4.conf.tunl0.arp_ignore":   "1",
+		"net.ipv4.conf.tunl0.arp_announce": "2",
+	}
+)
+
+// getForwardMethod returns the forwarding method of the loadbalancer
+func getForwardMethod(lb *lbapi.LoadBalancer) (string, error) {
+	method := strings.ToLower(strings.TrimSpace(lb.Annotations[ForwardMethodAnnotation]))
+	switch method {
+	case "", ForwardMethodDR:
+		return ForwardMethodDR, nil
+	case ForwardMethodTUN:
+		return ForwardMethodTUN, nil
+	}
+	return "", fmt.Errorf("unknown forward method %q in annotation %v", method, ForwardMethodAnnotation)
+}
+
+// lbKind returns the keepalived lb_kind of the forwarding method
+func lbKind(method string) string {
+	if method == ForwardMethodTUN {
+		return lbKindTUN
+	}
+	return lbKindDR
+}
+
+// tunnel configures the ipip tunnel device to receive the encapsulated
+// packets as a real server
+type tunnel struct {
+	vip     string
+	enabled bool
+	journal *journal.Journal
+}
+
+// ensure loads the ipip module, binds the VIP to tunl0 and changes the
+// sysctls, it is idempotent
+func (t *tunnel) ensure() error {
+	if out, err := k8sexec.New().Command("modprobe", "ipip").CombinedOutput(); err != nil {
+		return fmt.Errorf("load ipip module error: %v\n%s", err, out)
+	}
+	if out, err := k8sexec.New().Command("ip", "link", "set", tunnelDevice, "up").CombinedOutput(); err != nil {
+		return fmt.Errorf("set %s up error: %v\n%s", tunnelDevice, err, out)
+	}
+	vip, err := corenet.HostNet(t.vip)
+	if err != nil {
+		return err
+	}
+	if err := t.journal.RecordAddress(tunnelDevice, vip); err != nil {
+		return err
+	}
+	if err := corenet.EnsureAddress(tunnelDevice, vip); err != nil {
+		return fmt.Errorf("set VIP %s to dev %s error: %v", t.vip, tunnelDevice, err)
+	}
+
+	if t.enabled {
+		return nil
+	}
+	log.Info("enable ipip tunnel", log.Fields{"vip": t.vip, "dev": tunnelDevice})
+	t.enabled = true
+	return t.journal.ModifySysctl(sysctl.Settings(tunnelSysctlAdjustments))
+}
+
+// teardown removes the VIP from tunl0 and resets the sysctls, the device
+// is kept since it may be shared with others, such as calico
+func (t *tunnel) teardown() error {
+	if !t.enabled {
+		return nil
+	}
+	log.Info("disable ipip tunnel", log.Fields{"vip": t.vip, "dev": tunnelDevice})
+	t.enabled = false
+
+	err := t.journal.ResetSysctl(sysctl.Settings(tunnelSysctlAdjustments))
+	if err != nil {
+		log.Error("reset tunnel sysctl error", log.Fields{"err": err})
+	}
+	vip, err := corenet.HostNet(t.vip)
+	if err != nil {
+		return err
+	}
+	if err := corenet.RemoveAddress(tunnelDevice, vip); err != nil {
+		return fmt.Errorf("removing VIP from dev %s error: %v", tunnelDevice, err)
+	}
+	return t.journal.ForgetAddress(tunnelDevice, vip)
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvsdr
+
+import (
+	"testing"
+
+	lbapi "github.com/caicloud/clientset/pkg/apis/loadbalance/v1alpha2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetForwardMethod(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		want        string
+		wantErr     bool
+	}{
+		{nil, ForwardMethodDR, false},
+		{map[string]string{ForwardMethodAnnotation: "dr"}, ForwardMethodDR, false},
+		{map[string]string{ForwardMethodAnnotation: " TUN "}, ForwardMethodTUN, false},
+		{map[string]string{ForwardMethodAnnotation: "nat"}, "", true},
+	}
+	for _, tt := range tests {
+		lb := &lbapi.LoadBalancer{}
+		lb.Annotations = tt.annotations
+		got, err := getForwardMethod(lb)
+		if tt.wantErr {
+			assert.NotNil(t, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, tt.want, got)
+		assert.Equal(t, map[string]string{ForwardMethodDR: lbKindDR, ForwardMethodTUN: lbKindTUN}[got], lbKind(got))
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2017 Caicloud authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ipvsdr
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"syscall"
+
+	log "github.com/zoumo/logdog"
+)
+
+const (
+	keepalivedNotifyFifo = "/var/run/keepalived.fifo"
+)
+
+// vrrpWatcher reads the vrrp state transitions which keepalived writes to
+// the notify fifo, the line looks like:
+//
+//	INSTANCE "vips" MASTER 100
+type vrrpWatcher struct {
+	path     string
+	onChange func(instance, state string)
+	fifo     *os.File
+}
+
+func (w *vrrpWatcher) start() error {
+	if err := ensureFifo(w.path); err != nil {
+		return err
+	}
+
+	// open with O_RDWR so that opening does not block until
+	// keepalived opens the writing end, and reading does not get
+	// EOF when keepalived restarts
+	fifo, err := os.OpenFile(w.path, os.O_RDWR, os.ModeNamedPipe)
+	if err != nil {
+		return err
+	}
+	w.fifo = fifo
+
+	go func() {
+		scanner := bufio.NewScanner(fifo)
+		for scanner.Scan() {
+			instance, state, ok := parseVRRPNotify(scanner.Text())
+			if !ok {
+				continue
+			}
+			log.Info("vrrp state changed", log.Fields{"instance": instance, "state": state})
+			w.onChange(instance, state)
+		}
+	}()
+
+	return nil
+}
+
+func (w *vrrpWatcher) stop() {
+	if w.fifo != nil {
+		w.fifo.Close()
+	}
+}
+
+func ensureFifo(path string) error {
+	info, err := os.Stat(path)
+	if err == nil {
+		if info.Mode()&os.ModeNamedPipe != 0 {
+			return nil
+		}
+		// a regular file left by something else
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return syscall.Mkfifo(path, 0600)
+}
+
+// parseVRRPNotify parses the notify line of keepalived, only the
+// vrrp instance lines are accepted
+func parseVRRPNotify(line string) (string, string, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || fields[0] != "INSTANCE" {
+		return "", "", false
+	}
+	return strings.Trim(fields[1], `"`), fields[2], true
+}